@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Alertmanagers are declared next to the rules and used as actions by name,
+// like webhooks:
+//
+//	alertmanagers:
+//	  am:
+//	    url: http://alertmanager:9093
+//	    labels: {severity: warning}
+//	    annotations:                      # text/template, see webhookPayload
+//	      summary: '{{.Summary}}'
+//	      runbook_url: https://wiki.example.org/eos-shaping
+//	    resend_interval: 1m               # default 1m
+//	    timeout: 10s                      # default 10s
+//
+// Alerts are posted to the v2 API when they fire or resolve, and firing
+// alerts are re-sent every resend_interval so Alertmanager doesn't resolve
+// them on its own. Their labels are alertname (the rule name), entity_type,
+// id, estimator and direction plus the configured ones; Alertmanager groups
+// and deduplicates on them.
+
+type alertmanager struct {
+	URL            string            `yaml:"url"`
+	Labels         map[string]string `yaml:"labels"`
+	Annotations    map[string]string `yaml:"annotations"`
+	ResendInterval time.Duration     `yaml:"resend_interval"`
+	Timeout        time.Duration     `yaml:"timeout"`
+
+	name        string
+	endpoint    string
+	annotations map[string]*template.Template
+	client      *http.Client
+	queue       chan []amAlert
+	stopResend  func()
+
+	mu     sync.Mutex
+	firing map[alertKey]amAlert
+}
+
+// amAlert is an alert in the format of the Alertmanager v2 API.
+type amAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt,omitzero"`
+}
+
+// init validates the Alertmanager settings and starts the sender.
+func (am *alertmanager) init(name string) error {
+	u, err := url.Parse(am.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http:// or https:// URL, got %q", am.URL)
+	}
+	am.endpoint = strings.TrimSuffix(am.URL, "/") + "/api/v2/alerts"
+
+	if am.Annotations == nil {
+		am.Annotations = map[string]string{"summary": "{{.Summary}}"}
+	}
+	am.annotations = make(map[string]*template.Template, len(am.Annotations))
+	for k, v := range am.Annotations {
+		t, err := template.New(k).Funcs(webhookFuncs).Parse(v)
+		if err != nil {
+			return fmt.Errorf("annotations.%s: %w", k, err)
+		}
+		am.annotations[k] = t
+	}
+	if am.ResendInterval < 0 || am.Timeout < 0 {
+		return fmt.Errorf("resend_interval and timeout must not be negative")
+	}
+	if am.ResendInterval == 0 {
+		am.ResendInterval = time.Minute
+	}
+	if am.Timeout == 0 {
+		am.Timeout = 10 * time.Second
+	}
+
+	am.name = name
+	am.client = &http.Client{Timeout: am.Timeout}
+	am.firing = make(map[alertKey]amAlert)
+	am.queue = make(chan []amAlert, webhookQueueSize)
+	go func() {
+		for alerts := range am.queue {
+			if err := am.post(alerts); err != nil {
+				log.Printf("Alertmanager %s: %v", am.name, err)
+			}
+		}
+	}()
+	am.stopResend = every(am.ResendInterval, am.resend)
+	return nil
+}
+
+// resend sends the firing alerts again, so the Alertmanager doesn't resolve
+// them on its own.
+func (am *alertmanager) resend() {
+	am.mu.Lock()
+	alerts := make([]amAlert, 0, len(am.firing))
+	for _, a := range am.firing {
+		alerts = append(alerts, a)
+	}
+	am.mu.Unlock()
+	if len(alerts) > 0 {
+		am.enqueue(alerts)
+	}
+}
+
+func (am *alertmanager) stop() {
+	am.stopResend()
+}
+
+// notify is the alert action of the Alertmanager.
+func (am *alertmanager) notify(ev alertEvent) {
+	a, err := am.alert(ev)
+	if err != nil {
+		log.Printf("Alertmanager %s: %v", am.name, err)
+		return
+	}
+
+	key := alertKey{ev.Rule.Name, ev.Entity}
+	am.mu.Lock()
+	if ev.Firing {
+		am.firing[key] = a
+	} else {
+		if prev, ok := am.firing[key]; ok {
+			a.StartsAt = prev.StartsAt
+		}
+		a.EndsAt = ev.Timestamp
+		delete(am.firing, key)
+	}
+	am.mu.Unlock()
+
+	am.enqueue([]amAlert{a})
+}
+
+func (am *alertmanager) enqueue(alerts []amAlert) {
+	select {
+	case am.queue <- alerts:
+	default:
+		log.Printf("Alertmanager %s: queue full, dropping %d alerts", am.name, len(alerts))
+	}
+}
+
+func (am *alertmanager) alert(ev alertEvent) (amAlert, error) {
+	labels := map[string]string{
+		"alertname":   ev.Rule.Name,
+		"entity_type": ev.Entity.Type,
+		"id":          ev.Entity.ID,
+		"estimator":   ev.Rule.Estimator,
+		"direction":   ev.Rule.Direction,
+	}
+	for k, v := range am.Labels {
+		labels[k] = v
+	}
+
+	payload := newWebhookPayload(ev)
+	annotations := make(map[string]string, len(am.annotations))
+	for k, t := range am.annotations {
+		var b strings.Builder
+		if err := t.Execute(&b, payload); err != nil {
+			return amAlert{}, fmt.Errorf("rendering annotation %s: %w", k, err)
+		}
+		annotations[k] = b.String()
+	}
+	return amAlert{Labels: labels, Annotations: annotations, StartsAt: ev.Timestamp}, nil
+}
+
+func (am *alertmanager) post(alerts []amAlert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	resp, err := am.client.Post(am.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("POST %s: %s: %s", redactURL(am.endpoint), resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
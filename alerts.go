@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// Alert rules are read from a YAML file passed with -alert-rules:
+//
+//	rules:
+//	  - name: heavy-writer
+//	    type: user           # app, user or group
+//	    id: "1234"           # omit to watch every entity of the type
+//	    estimator: SMA_5_SECONDS
+//	    direction: write     # read, write or total
+//	    above: 2GB/s         # or below:
+//	    for: 5               # consecutive reports (default 1)
+//	    actions: [log]       # log or notifiers declared in the file (see notifier.go)
+//
+// A rule fires separately for every matching entity once the condition held
+// for the given number of reports, and resolves on the first report where it
+// no longer holds. An entity that dropped out of the report is at 0: it
+// resolves an above rule and keeps a below rule firing. The entity of a rule
+// with an id is watched from the first report, whether it was ever in one or
+// not; for rules without an id, an entity absent for alertAbsentExpiry is
+// forgotten, resolving its alert, so departed entities don't pile up.
+
+// alertAbsentExpiry is how long an entity may be absent from the reports
+// before the below rules without an id forget it.
+const alertAbsentExpiry = time.Hour
+
+var (
+	alertFiring = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_alert_firing",
+			Help: "1 while the alert rule fires for the entity",
+		},
+		[]string{"rule", "entity_type", "id"},
+	)
+	alertPending = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_alert_pending_reports",
+			Help: "Consecutive reports the rule condition held for the entity, while not yet firing",
+		},
+		[]string{"rule", "entity_type", "id"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(alertFiring, alertPending)
+}
+
+type alertRule struct {
+	Name      string   `yaml:"name"`
+	Type      string   `yaml:"type"`
+	ID        string   `yaml:"id"`
+	Estimator string   `yaml:"estimator"`
+	Direction string   `yaml:"direction"`
+	Above     byteRate `yaml:"above"`
+	Below     byteRate `yaml:"below"`
+	For       int      `yaml:"for"`
+	Actions   []string `yaml:"actions"`
+	Channel   string   `yaml:"channel"` // Slack channel overriding the notifier's
+
+	notifiers []notifier
+}
+
+type alertRulesDoc struct {
+	Webhooks      map[string]*webhook       `yaml:"webhooks"`
+	Alertmanagers map[string]*alertmanager  `yaml:"alertmanagers"`
+	Slack         map[string]*slackNotifier `yaml:"slack"`
+	Email         map[string]*emailNotifier `yaml:"email"`
+	Exec          map[string]*execNotifier  `yaml:"exec"`
+	Rules         []*alertRule              `yaml:"rules"`
+}
+
+// alertEvent is sent to the actions of a rule when it fires or resolves.
+type alertEvent struct {
+	Rule      *alertRule
+	Entity    entityKey
+	Value     float64 // rate in bytes/sec on the rule's estimator and direction
+	Firing    bool    // false when the alert resolves
+	Reports   int     // consecutive reports the condition held for
+	Timestamp time.Time
+}
+
+func (ev alertEvent) String() string {
+	state := "resolved"
+	if ev.Firing {
+		state = "firing"
+	}
+	return fmt.Sprintf("alert %s %s for %s %s: %s %s %s", ev.Rule.Name, state, ev.Entity.Type, ev.Entity.ID,
+		ev.Rule.Direction, humanizeBytes(ev.Value)+"/s", ev.Rule.condition())
+}
+
+// alertActions maps the built-in action names usable in rules to their
+// notifiers. The notifiers declared in the rules file add their own names.
+var alertActions = map[string]notifier{
+	"log": logNotifier{},
+}
+
+// logNotifier writes the events to the log.
+type logNotifier struct{}
+
+func (logNotifier) init(string) error    { return nil }
+func (logNotifier) notify(ev alertEvent) { log.Println(ev) }
+
+func loadAlertRules(path string) ([]*alertRule, error) {
+	var doc alertRulesDoc
+	if err := loadYAML(path, &doc); err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	actions := make(map[string]notifier, len(alertActions))
+	for name, a := range alertActions {
+		actions[name] = a
+	}
+	for _, section := range []struct {
+		key       string
+		notifiers map[string]notifier
+	}{
+		{"webhooks", notifiers(doc.Webhooks)},
+		{"alertmanagers", notifiers(doc.Alertmanagers)},
+		{"slack", notifiers(doc.Slack)},
+		{"email", notifiers(doc.Email)},
+		{"exec", notifiers(doc.Exec)},
+	} {
+		for _, name := range slices.Sorted(maps.Keys(section.notifiers)) {
+			n := section.notifiers[name]
+			if _, ok := actions[name]; ok {
+				errs = append(errs, fmt.Errorf("%s: %s.%s: name clashes with another action", path, section.key, name))
+				continue
+			}
+			if err := n.init(name); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s.%s: %w", path, section.key, name, err))
+				continue
+			}
+			actions[name] = n
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, r := range doc.Rules {
+		if err := r.validate(actions); err != nil {
+			errs = append(errs, fmt.Errorf("%s: rules[%d]: %w", path, i, err))
+		}
+		if names[r.Name] {
+			errs = append(errs, fmt.Errorf("%s: rules[%d]: duplicate rule name %q", path, i, r.Name))
+		}
+		names[r.Name] = true
+	}
+	return doc.Rules, errors.Join(errs...)
+}
+
+func (r *alertRule) validate(actions map[string]notifier) error {
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	if !validEntityType(r.Type) {
+		return fmt.Errorf("type must be app, user or group, got %q", r.Type)
+	}
+	if _, err := parseEstimator(r.Estimator); err != nil {
+		return err
+	}
+	switch r.Direction {
+	case "read", "write", "total":
+	default:
+		return fmt.Errorf("direction must be read, write or total, got %q", r.Direction)
+	}
+	if (r.Above > 0) == (r.Below > 0) {
+		return errors.New("exactly one of above and below is required")
+	}
+	if r.For < 0 {
+		return fmt.Errorf("for must not be negative, got %d", r.For)
+	}
+	if r.For == 0 {
+		r.For = 1
+	}
+	if len(r.Actions) == 0 {
+		r.Actions = []string{"log"}
+	}
+	r.notifiers = nil
+	for _, a := range r.Actions {
+		n, ok := actions[a]
+		if !ok {
+			return fmt.Errorf("unknown action %q", a)
+		}
+		r.notifiers = append(r.notifiers, n)
+	}
+	return nil
+}
+
+func (r *alertRule) condition() string {
+	if r.Above > 0 {
+		return "> " + formatByteRate(float64(r.Above))
+	}
+	return "< " + formatByteRate(float64(r.Below))
+}
+
+func (r *alertRule) matches(e entity) bool {
+	return e.Type == r.Type && (r.ID == "" || e.ID == r.ID)
+}
+
+// value returns the rate of e the rule looks at, and false if the report has
+// no sample of the rule's estimator for it.
+func (r *alertRule) value(e entity) (float64, bool) {
+	for _, s := range e.Stats {
+		if s.Window.String() != r.Estimator {
+			continue
+		}
+		switch r.Direction {
+		case "read":
+			return s.BytesReadPerSec, true
+		case "write":
+			return s.BytesWrittenPerSec, true
+		default:
+			return s.BytesReadPerSec + s.BytesWrittenPerSec, true
+		}
+	}
+	return 0, false
+}
+
+func (r *alertRule) holds(v float64) bool {
+	if r.Above > 0 {
+		return v > float64(r.Above)
+	}
+	return v < float64(r.Below)
+}
+
+type alertKey struct {
+	rule   string
+	entity entityKey
+}
+
+type alertState struct {
+	reports int
+	firing  bool
+	seen    time.Time // of the last report with the entity
+}
+
+// alertEngine evaluates the rules against every report.
+type alertEngine struct {
+	rules  []*alertRule
+	states map[alertKey]*alertState
+}
+
+func newAlertEngine(rules []*alertRule) *alertEngine {
+	return &alertEngine{rules: rules, states: make(map[alertKey]*alertState)}
+}
+
+// Evaluate updates the alert states with report, exports them and runs the
+// actions of the alerts that fired or resolved.
+func (ae *alertEngine) Evaluate(report *pb.TrafficShapingRateResponse) {
+	ts := time.UnixMilli(report.TimestampMs)
+	entities := reportEntities(report)
+
+	var events []alertEvent
+	for _, r := range ae.rules {
+		seen := make(map[entityKey]bool)
+		for _, e := range entities {
+			if !r.matches(e) {
+				continue
+			}
+			v, ok := r.value(e)
+			if !ok {
+				continue
+			}
+			key := entityKey{e.Type, e.ID}
+			seen[key] = true
+			events = ae.observe(events, r, key, v, ts)
+			if st := ae.states[alertKey{r.Name, key}]; st != nil {
+				st.seen = ts
+			}
+		}
+
+		// Entities not in the report (or without the estimator) are at 0:
+		// above rules resolve, below rules keep counting.
+		if r.ID != "" {
+			key := entityKey{r.Type, r.ID}
+			switch st := ae.states[alertKey{r.Name, key}]; {
+			case seen[key]:
+			case r.Above == 0:
+				events = ae.observe(events, r, key, 0, ts)
+			case st != nil:
+				events = ae.clear(events, r, key, st, 0, ts)
+			}
+			continue
+		}
+		for k, st := range ae.states {
+			if k.rule != r.Name || seen[k.entity] {
+				continue
+			}
+			if r.Above > 0 || ts.Sub(st.seen) >= alertAbsentExpiry {
+				events = ae.clear(events, r, k.entity, st, 0, ts)
+			} else {
+				events = ae.observe(events, r, k.entity, 0, ts)
+			}
+		}
+	}
+
+	for _, ev := range events {
+		for _, n := range ev.Rule.notifiers {
+			n.notify(ev)
+		}
+	}
+}
+
+// Close stops the background work of the notifiers of the rules.
+func (ae *alertEngine) Close() {
+	stopped := make(map[notifier]bool)
+	for _, r := range ae.rules {
+		for _, n := range r.notifiers {
+			if s, ok := n.(stoppingNotifier); ok && !stopped[n] {
+				s.stop()
+				stopped[n] = true
+			}
+		}
+	}
+}
+
+// observe updates the state of the rule r for the entity key at rate v.
+func (ae *alertEngine) observe(events []alertEvent, r *alertRule, key entityKey, v float64, ts time.Time) []alertEvent {
+	st := ae.states[alertKey{r.Name, key}]
+	if !r.holds(v) {
+		if st != nil {
+			events = ae.clear(events, r, key, st, v, ts)
+		}
+		return events
+	}
+	if st == nil {
+		st = &alertState{}
+		ae.states[alertKey{r.Name, key}] = st
+	}
+	st.reports++
+	if st.firing {
+		return events
+	}
+	if st.reports >= r.For {
+		st.firing = true
+		alertPending.DeleteLabelValues(r.Name, key.Type, key.ID)
+		alertFiring.WithLabelValues(r.Name, key.Type, key.ID).Set(1)
+		return append(events, alertEvent{Rule: r, Entity: key, Value: v, Firing: true, Reports: st.reports, Timestamp: ts})
+	}
+	alertPending.WithLabelValues(r.Name, key.Type, key.ID).Set(float64(st.reports))
+	return events
+}
+
+func (ae *alertEngine) clear(events []alertEvent, r *alertRule, key entityKey, st *alertState, v float64, ts time.Time) []alertEvent {
+	delete(ae.states, alertKey{r.Name, key})
+	alertPending.DeleteLabelValues(r.Name, key.Type, key.ID)
+	if !st.firing {
+		return events
+	}
+	alertFiring.DeleteLabelValues(r.Name, key.Type, key.ID)
+	return append(events, alertEvent{Rule: r, Entity: key, Value: v, Reports: st.reports, Timestamp: ts})
+}
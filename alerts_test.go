@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// recordingNotifier keeps the events it is notified of.
+type recordingNotifier struct {
+	events []alertEvent
+}
+
+func (n *recordingNotifier) init(string) error    { return nil }
+func (n *recordingNotifier) notify(ev alertEvent) { n.events = append(n.events, ev) }
+
+// appReport returns a report of the app rates, written bytes/sec on
+// SMA_1_MINUTES, at the second ts.
+func appReport(ts int64, rates map[string]float64) *pb.TrafficShapingRateResponse {
+	report := &pb.TrafficShapingRateResponse{TimestampMs: ts * 1000}
+	for app, rate := range rates {
+		report.AppStats = append(report.AppStats, &pb.AppRateEntry{
+			AppName: app,
+			Stats: []*pb.RateStats{{
+				Window:             pb.TrafficShapingRateRequest_SMA_1_MINUTES,
+				BytesWrittenPerSec: rate,
+			}},
+		})
+	}
+	return report
+}
+
+func TestAlertEngineEvaluate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    alertRule
+		reports []map[string]float64
+		step    int64  // seconds between the reports, 1 if 0
+		want    []bool // firing of the events, in order
+	}{
+		{
+			name:    "above fires after for reports",
+			rule:    alertRule{Above: 100, For: 2},
+			reports: []map[string]float64{{"a": 200}, {"a": 200}, {"a": 200}},
+			want:    []bool{true},
+		},
+		{
+			name:    "above resolves when back under",
+			rule:    alertRule{Above: 100, For: 1},
+			reports: []map[string]float64{{"a": 200}, {"a": 50}},
+			want:    []bool{true, false},
+		},
+		{
+			name:    "above resolves when absent",
+			rule:    alertRule{Above: 100, For: 1},
+			reports: []map[string]float64{{"a": 200}, {}},
+			want:    []bool{true, false},
+		},
+		{
+			name:    "above pending resets",
+			rule:    alertRule{Above: 100, For: 2},
+			reports: []map[string]float64{{"a": 200}, {"a": 50}, {"a": 200}},
+			want:    nil,
+		},
+		{
+			name:    "below keeps firing when absent",
+			rule:    alertRule{Below: 100, For: 1},
+			reports: []map[string]float64{{"a": 50}, {}, {}},
+			want:    []bool{true},
+		},
+		{
+			name:    "below fires on absence",
+			rule:    alertRule{Below: 100, For: 3},
+			reports: []map[string]float64{{"a": 50}, {}, {}},
+			want:    []bool{true},
+		},
+		{
+			name:    "below resolves when back over",
+			rule:    alertRule{Below: 100, For: 1},
+			reports: []map[string]float64{{"a": 50}, {}, {"a": 200}},
+			want:    []bool{true, false},
+		},
+		{
+			name:    "below ignores entities never seen",
+			rule:    alertRule{Below: 100, For: 1},
+			reports: []map[string]float64{{}, {}},
+			want:    nil,
+		},
+		{
+			name:    "below with an id fires for an entity never seen",
+			rule:    alertRule{ID: "a", Below: 100, For: 2},
+			reports: []map[string]float64{{"b": 50}, {"b": 50}},
+			want:    []bool{true},
+		},
+		{
+			name:    "below with an id resolves once the entity shows up",
+			rule:    alertRule{ID: "a", Below: 100, For: 1},
+			reports: []map[string]float64{{}, {"a": 200}},
+			want:    []bool{true, false},
+		},
+		{
+			name:    "below with an id is not expired",
+			rule:    alertRule{ID: "a", Below: 100, For: 1},
+			reports: []map[string]float64{{"a": 50}, {}, {}, {}},
+			step:    1800,
+			want:    []bool{true},
+		},
+		{
+			name:    "above with an id ignores absence",
+			rule:    alertRule{ID: "a", Above: 100, For: 1},
+			reports: []map[string]float64{{}, {"b": 200}},
+			want:    nil,
+		},
+		{
+			name:    "below forgets entities absent too long",
+			rule:    alertRule{Below: 100, For: 1},
+			reports: []map[string]float64{{"a": 50}, {}, {}, {}},
+			step:    1800,
+			want:    []bool{true, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &recordingNotifier{}
+			r := tt.rule
+			r.Name, r.Type, r.Estimator, r.Direction = "test", "app", "SMA_1_MINUTES", "write"
+			r.notifiers = []notifier{n}
+			ae := newAlertEngine([]*alertRule{&r})
+			step := tt.step
+			if step == 0 {
+				step = 1
+			}
+			for i, rates := range tt.reports {
+				ae.Evaluate(appReport(int64(i)*step, rates))
+			}
+			if len(n.events) != len(tt.want) {
+				t.Fatalf("got %d events, want %d: %+v", len(n.events), len(tt.want), n.events)
+			}
+			for i, ev := range n.events {
+				if ev.Firing != tt.want[i] {
+					t.Errorf("event %d: firing %v, want %v", i, ev.Firing, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+var anomalyZScore = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "eos_io_anomaly",
+		Help: "Standard deviations between the current rate and the rolling mean of an entity flagged as anomalous",
+	},
+	[]string{"entity_type", "id", "direction"},
+)
+
+func init() {
+	prometheus.MustRegister(anomalyZScore)
+}
+
+// anomalyDetector keeps an exponentially weighted mean and standard
+// deviation of the read and write rates of every entity, over a time
+// constant of window, and flags the entities whose current rate is at least
+// zscore standard deviations away from their mean: the unusual consumers,
+// whatever their usual level. Only series with minSamples reports are
+// judged, and only at rates above minRate, so idle entities twitching and
+// newcomers don't count. An entity missing from a report counts as 0 in it.
+//
+// The flagged entities are shown on the console and exported as
+// eos_io_anomaly, their z-score, which other entities don't have.
+type anomalyDetector struct {
+	estimator  string
+	window     time.Duration
+	zscore     float64
+	minSamples int
+	minRate    float64
+
+	last      time.Time
+	series    map[anomalyKey]*ewStats
+	anomalies []anomaly // of the latest report
+}
+
+type anomalyKey struct {
+	entity    entityKey
+	direction string
+}
+
+type anomaly struct {
+	anomalyKey
+	Rate, Mean, StdDev, ZScore float64
+}
+
+// ewStats are an exponentially weighted mean and variance.
+type ewStats struct {
+	n          int
+	mean, vari float64
+}
+
+func (s *ewStats) add(v, alpha float64) {
+	if s.n == 0 {
+		s.mean = v
+	} else {
+		d := v - s.mean
+		s.mean += alpha * d
+		s.vari = (1 - alpha) * (s.vari + alpha*d*d)
+	}
+	s.n++
+}
+
+func newAnomalyDetector(estimator string, window time.Duration, zscore float64, minSamples int, minRate float64) (*anomalyDetector, error) {
+	if _, err := parseEstimator(estimator); err != nil {
+		return nil, err
+	}
+	if window <= 0 || zscore <= 0 || minSamples < 2 {
+		return nil, errors.New("the anomaly window and z-score must be positive and at least 2 samples are needed")
+	}
+	return &anomalyDetector{
+		estimator:  estimator,
+		window:     window,
+		zscore:     zscore,
+		minSamples: minSamples,
+		minRate:    minRate,
+		series:     make(map[anomalyKey]*ewStats),
+	}, nil
+}
+
+// Update judges the rates of report against the statistics so far, exports
+// the anomalies, then adds the rates to the statistics.
+func (d *anomalyDetector) Update(report *pb.TrafficShapingRateResponse) {
+	ts := time.UnixMilli(report.TimestampMs)
+	alpha := 1.0
+	if !d.last.IsZero() && ts.After(d.last) {
+		alpha = 1 - math.Exp(-ts.Sub(d.last).Seconds()/d.window.Seconds())
+	}
+	d.last = ts
+
+	rates := make(map[anomalyKey]float64)
+	for _, e := range reportEntities(report) {
+		if s, ok := sampleOf(e.Stats, d.estimator); ok {
+			key := entityKey{e.Type, e.ID}
+			rates[anomalyKey{key, "read"}] = s.read
+			rates[anomalyKey{key, "write"}] = s.write
+		}
+	}
+	for key := range d.series {
+		if _, ok := rates[key]; !ok {
+			rates[key] = 0
+		}
+	}
+
+	d.anomalies = d.anomalies[:0]
+	anomalyZScore.Reset()
+	for key, rate := range rates {
+		s := d.series[key]
+		if s == nil {
+			s = &ewStats{}
+			d.series[key] = s
+		}
+		if s.n >= d.minSamples && max(rate, s.mean) >= d.minRate {
+			// A floor on the deviation keeps steady series from turning
+			// any change into a huge z-score.
+			stddev := max(math.Sqrt(s.vari), 0.01*s.mean, 1)
+			if z := (rate - s.mean) / stddev; math.Abs(z) >= d.zscore {
+				d.anomalies = append(d.anomalies, anomaly{key, rate, s.mean, stddev, z})
+				anomalyZScore.WithLabelValues(key.entity.Type, key.entity.ID, key.direction).Set(z)
+			}
+		}
+		s.add(rate, alpha)
+		if rate == 0 && s.mean < 1 {
+			// Gone quiet for good: forget it rather than keep every entity
+			// ever seen.
+			delete(d.series, key)
+		}
+	}
+	sort.Slice(d.anomalies, func(i, j int) bool {
+		if zi, zj := math.Abs(d.anomalies[i].ZScore), math.Abs(d.anomalies[j].ZScore); zi != zj {
+			return zi > zj
+		}
+		a, b := d.anomalies[i].anomalyKey, d.anomalies[j].anomalyKey
+		if a.entity != b.entity {
+			return a.entity.Type+"/"+a.entity.ID < b.entity.Type+"/"+b.entity.ID
+		}
+		return a.direction < b.direction
+	})
+}
+
+func (d *anomalyDetector) print(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "Type\tID\tDirection\tRate\tMean\tz-score\t")
+	for _, a := range d.anomalies {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%+.1f\t\n", a.entity.Type, a.entity.ID, a.direction,
+			humanizeBytes(a.Rate)+"/s", humanizeBytes(a.Mean)+"/s", a.ZScore)
+	}
+	w.Flush()
+}
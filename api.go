@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// apiServer serves the reports over HTTP as JSON:
+//
+//	/api/v1/snapshot        the latest report (also /api/v1/report/latest)
+//	/api/v1/reports         the reports kept in memory, ?since=<ms> for newer ones
+//	/api/v1/top             the top entities of a type on an estimator, e.g.
+//	                        ?type=user&estimator=SMA_1_MINUTES&n=20&direction=write,
+//	                        averaged over the last ?reports=k reports
+//
+// The report endpoints take ?type=app|user|group to keep one entity type.
+// The last reports are kept in a ring buffer so tools can poll without
+// talking gRPC.
+//
+// Responses carry an ETag and Last-Modified derived from the report
+// timestamp, so clients polling faster than reports arrive get a 304 instead
+// of the same multi-hundred-KB body. Encoded bodies are kept in a cache
+// bounded in bytes, as every poller asks for the same few variants.
+type apiServer struct {
+	mu      sync.Mutex
+	reports []*pb.TrafficShapingRateResponse // ring buffer, next at next%len
+	next    int
+	cache   *responseCache
+}
+
+func newAPIServer(cacheBytes, history int) *apiServer {
+	return &apiServer{reports: make([]*pb.TrafficShapingRateResponse, max(history, 1)), cache: newResponseCache(cacheBytes)}
+}
+
+// Update makes report the latest one.
+func (s *apiServer) Update(report *pb.TrafficShapingRateResponse) {
+	s.mu.Lock()
+	s.reports[s.next%len(s.reports)] = report
+	s.next++
+	s.mu.Unlock()
+}
+
+// last returns up to n of the latest reports, oldest first.
+func (s *apiServer) last(n int) []*pb.TrafficShapingRateResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n = min(n, s.next, len(s.reports))
+	out := make([]*pb.TrafficShapingRateResponse, 0, n)
+	for i := s.next - n; i < s.next; i++ {
+		out = append(out, s.reports[i%len(s.reports)])
+	}
+	return out
+}
+
+func (s *apiServer) latest() *pb.TrafficShapingRateResponse {
+	if r := s.last(1); len(r) > 0 {
+		return r[0]
+	}
+	return nil
+}
+
+func (s *apiServer) register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/snapshot", s.serveSnapshot)
+	mux.HandleFunc("/api/v1/report/latest", s.serveSnapshot)
+	mux.HandleFunc("/api/v1/reports", s.serveReports)
+	mux.HandleFunc("/api/v1/top", s.serveTop)
+}
+
+// apiEntityTypes maps the accepted ?type= values to entity types; the
+// request enum names are accepted as well.
+var apiEntityTypes = map[string]string{
+	"app": "app", "user": "user", "group": "group",
+	"uid": "user", "gid": "group",
+}
+
+// readOnly rejects methods other than GET and HEAD.
+func readOnly(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// entityTypeParam returns the ?type= of r, "" if absent.
+func entityTypeParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	v := r.URL.Query().Get("type")
+	if v == "" {
+		return "", true
+	}
+	eType, ok := apiEntityTypes[v]
+	if !ok {
+		http.Error(w, fmt.Sprintf("type must be app, user (uid) or group (gid), got %q", v), http.StatusBadRequest)
+	}
+	return eType, ok
+}
+
+// serveCached serves the body cached under key, encoding it with encode on
+// a miss.
+func (s *apiServer) serveCached(w http.ResponseWriter, r *http.Request, key string, modified time.Time, encode func() ([]byte, error)) {
+	body, ok := s.cache.Get(key)
+	if !ok {
+		var err error
+		if body, err = encode(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.cache.Put(key, body)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, key))
+	w.Header().Set("Cache-Control", "no-cache")
+	// ServeContent answers If-None-Match and If-Modified-Since with 304.
+	http.ServeContent(w, r, "", modified, bytes.NewReader(body))
+}
+
+func (s *apiServer) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !readOnly(w, r) {
+		return
+	}
+	eType, ok := entityTypeParam(w, r)
+	if !ok {
+		return
+	}
+	report := s.latest()
+	if report == nil {
+		http.Error(w, "no report received yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	key := fmt.Sprintf("snapshot/%s@%d", eType, report.TimestampMs)
+	s.serveCached(w, r, key, time.UnixMilli(report.TimestampMs), func() ([]byte, error) {
+		return protojson.Marshal(filterReport(report, eType))
+	})
+}
+
+func (s *apiServer) serveReports(w http.ResponseWriter, r *http.Request) {
+	if !readOnly(w, r) {
+		return
+	}
+	eType, ok := entityTypeParam(w, r)
+	if !ok {
+		return
+	}
+	var since int64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("since must be a timestamp in milliseconds, got %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var reports []*pb.TrafficShapingRateResponse
+	for _, report := range s.last(len(s.reports)) {
+		if report.TimestampMs > since {
+			reports = append(reports, filterReport(report, eType))
+		}
+	}
+	if len(reports) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("[]"))
+		return
+	}
+
+	newest := reports[len(reports)-1].TimestampMs
+	key := fmt.Sprintf("reports/%s/%d-%d", eType, reports[0].TimestampMs, newest)
+	s.serveCached(w, r, key, time.UnixMilli(newest), func() ([]byte, error) {
+		var b bytes.Buffer
+		b.WriteByte('[')
+		for i, report := range reports {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			j, err := protojson.Marshal(report)
+			if err != nil {
+				return nil, err
+			}
+			b.Write(j)
+		}
+		b.WriteByte(']')
+		return b.Bytes(), nil
+	})
+}
+
+// apiTop is the response of /api/v1/top.
+type apiTop struct {
+	Timestamp int64         `json:"timestamp"` // of the latest report, in milliseconds
+	Reports   int           `json:"reports"`   // the rates are averaged over
+	Type      string        `json:"type"`
+	Estimator string        `json:"estimator"`
+	Direction string        `json:"direction"`
+	Entries   []apiTopEntry `json:"entries"`
+}
+
+type apiTopEntry struct {
+	ID    string  `json:"id"`
+	Read  float64 `json:"read_bytes_per_second"`
+	Write float64 `json:"write_bytes_per_second"`
+}
+
+func (e apiTopEntry) rate(direction string) float64 {
+	switch direction {
+	case "read":
+		return e.Read
+	case "write":
+		return e.Write
+	}
+	return e.Read + e.Write
+}
+
+func (s *apiServer) serveTop(w http.ResponseWriter, r *http.Request) {
+	if !readOnly(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	eType, ok := entityTypeParam(w, r)
+	if !ok {
+		return
+	}
+	if eType == "" {
+		http.Error(w, "type is required", http.StatusBadRequest)
+		return
+	}
+	estimator := q.Get("estimator")
+	if estimator == "" {
+		estimator = "SMA_1_MINUTES"
+	}
+	if _, err := parseEstimator(estimator); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	direction := q.Get("direction")
+	switch direction {
+	case "":
+		direction = "total"
+	case "read", "write", "total":
+	default:
+		http.Error(w, fmt.Sprintf("direction must be read, write or total, got %q", direction), http.StatusBadRequest)
+		return
+	}
+	n, nReports := 10, 1
+	for name, v := range map[string]*int{"n": &n, "reports": &nReports} {
+		if p := q.Get(name); p != "" {
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 1 {
+				http.Error(w, fmt.Sprintf("%s must be a positive integer, got %q", name, p), http.StatusBadRequest)
+				return
+			}
+			*v = i
+		}
+	}
+
+	reports := s.last(nReports)
+	if len(reports) == 0 {
+		http.Error(w, "no report received yet", http.StatusServiceUnavailable)
+		return
+	}
+	newest := reports[len(reports)-1].TimestampMs
+	key := fmt.Sprintf("top/%s/%s/%s/%d/%d@%d", eType, estimator, direction, n, len(reports), newest)
+	s.serveCached(w, r, key, time.UnixMilli(newest), func() ([]byte, error) {
+		return json.Marshal(topEntities(reports, eType, estimator, direction, n))
+	})
+}
+
+// topEntities averages the rates of the entities of eType over reports,
+// counting reports without an entity as 0, and returns the n highest.
+func topEntities(reports []*pb.TrafficShapingRateResponse, eType, estimator, direction string, n int) apiTop {
+	sums := make(map[string]*apiTopEntry)
+	for _, report := range reports {
+		for _, e := range reportEntities(report) {
+			if e.Type != eType {
+				continue
+			}
+			for _, st := range e.Stats {
+				if st.Window.String() != estimator {
+					continue
+				}
+				sum := sums[e.ID]
+				if sum == nil {
+					sum = &apiTopEntry{ID: e.ID}
+					sums[e.ID] = sum
+				}
+				sum.Read += st.BytesReadPerSec
+				sum.Write += st.BytesWrittenPerSec
+			}
+		}
+	}
+
+	top := apiTop{
+		Timestamp: reports[len(reports)-1].TimestampMs,
+		Reports:   len(reports),
+		Type:      eType,
+		Estimator: estimator,
+		Direction: direction,
+		Entries:   make([]apiTopEntry, 0, len(sums)),
+	}
+	for _, sum := range sums {
+		sum.Read /= float64(len(reports))
+		sum.Write /= float64(len(reports))
+		top.Entries = append(top.Entries, *sum)
+	}
+	sort.Slice(top.Entries, func(i, j int) bool {
+		if a, b := top.Entries[i].rate(direction), top.Entries[j].rate(direction); a != b {
+			return a > b
+		}
+		return top.Entries[i].ID < top.Entries[j].ID
+	})
+	if len(top.Entries) > n {
+		top.Entries = top.Entries[:n]
+	}
+	return top
+}
+
+// filterReport returns report with only the entries of eType, or report
+// itself if eType is empty.
+func filterReport(report *pb.TrafficShapingRateResponse, eType string) *pb.TrafficShapingRateResponse {
+	if eType == "" {
+		return report
+	}
+	out := &pb.TrafficShapingRateResponse{TimestampMs: report.TimestampMs}
+	switch eType {
+	case "app":
+		out.AppStats = report.AppStats
+	case "user":
+		out.UserStats = report.UserStats
+	case "group":
+		out.GroupStats = report.GroupStats
+	}
+	return out
+}
+
+// responseCache is an LRU cache of encoded responses holding at most max
+// bytes of bodies.
+type responseCache struct {
+	mu      sync.Mutex
+	max     int
+	size    int
+	order   *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	body []byte
+}
+
+func newResponseCache(max int) *responseCache {
+	return &responseCache{max: max, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *responseCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry).body, true
+}
+
+// Put stores body, evicting the least recently used entries to stay within
+// the size limit. Bodies larger than the whole cache are not stored.
+func (c *responseCache) Put(key string, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(body) > c.max {
+		return
+	}
+	if e, ok := c.entries[key]; ok {
+		c.size -= len(e.Value.(*cacheEntry).body)
+		c.order.Remove(e)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, body: body})
+	c.size += len(body)
+	for c.size > c.max {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.entries, e.Value.(*cacheEntry).key)
+		c.size -= len(e.Value.(*cacheEntry).body)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// appNameRule rewrites the app names matching Match to Replace, which may
+// refer to the submatches as $1 or ${name}. Rules collapse the variants of
+// apps that embed job ids in their names, e.g.
+//
+//	match: '^(rucio-download)-\d+$'
+//	replace: '$1'
+//
+// so they don't blow up the label cardinality.
+type appNameRule struct {
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+}
+
+// appNameRules is the -app-name-rule flag, REGEX=REPLACEMENT split at the
+// last =, which may be repeated.
+type appNameRules []appNameRule
+
+func (r *appNameRules) String() string {
+	if r == nil {
+		return ""
+	}
+	specs := make([]string, len(*r))
+	for i, rule := range *r {
+		specs[i] = rule.Match + "=" + rule.Replace
+	}
+	return strings.Join(specs, " ")
+}
+
+func (r *appNameRules) Set(s string) error {
+	i := strings.LastIndex(s, "=")
+	if i < 1 {
+		return fmt.Errorf("expected REGEX=REPLACEMENT, got %q", s)
+	}
+	rule := appNameRule{Match: s[:i], Replace: s[i+1:]}
+	// The command line is parsed again after loading the config file.
+	for _, r := range *r {
+		if r == rule {
+			return nil
+		}
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// appNormalizer applies the first matching rule to every app name of a
+// report, merging the entries that end up with the same name.
+type appNormalizer struct {
+	rules []*regexp.Regexp
+	repl  []string
+}
+
+func newAppNormalizer(rules []appNameRule) (*appNormalizer, error) {
+	n := &appNormalizer{}
+	for i, rule := range rules {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		n.rules = append(n.rules, re)
+		n.repl = append(n.repl, rule.Replace)
+	}
+	return n, nil
+}
+
+func (n *appNormalizer) name(app string) string {
+	for i, re := range n.rules {
+		if re.MatchString(app) {
+			return re.ReplaceAllString(app, n.repl[i])
+		}
+	}
+	return app
+}
+
+// Apply returns report with the app names normalized. Merged entries sum
+// their rates per estimator and take the place of the first of them; report
+// is returned as is if no name changes.
+func (n *appNormalizer) Apply(report *pb.TrafficShapingRateResponse) *pb.TrafficShapingRateResponse {
+	var apps []*pb.AppRateEntry
+	byName := make(map[string]int)
+	changed := false
+	for _, e := range report.AppStats {
+		name := n.name(e.AppName)
+		changed = changed || name != e.AppName
+		i, ok := byName[name]
+		if !ok {
+			byName[name] = len(apps)
+			apps = append(apps, &pb.AppRateEntry{AppName: name, Stats: e.Stats})
+			continue
+		}
+		apps[i].Stats = sumRateStats(apps[i].Stats, e.Stats)
+	}
+	if !changed {
+		return report
+	}
+	return &pb.TrafficShapingRateResponse{
+		TimestampMs:                     report.TimestampMs,
+		AppStats:                        apps,
+		UserStats:                       report.UserStats,
+		GroupStats:                      report.GroupStats,
+		FstLimitsUpdateThreadLoopStats:  report.FstLimitsUpdateThreadLoopStats,
+		EstimatorsUpdateThreadLoopStats: report.EstimatorsUpdateThreadLoopStats,
+	}
+}
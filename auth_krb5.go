@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	krbconfig "github.com/jcmturner/gokrb5/v8/config"
+	krbcreds "github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+// krb5Credentials attaches a SPNEGO token ("authorization: Negotiate ...") to
+// every RPC. With a keytab the TGT is renewed by gokrb5 itself; with a
+// credential cache the file is reloaded whenever kinit/k5start replaces it.
+type krb5Credentials struct {
+	spn     string
+	cfg     *krbconfig.Config
+	keytab  string
+	user    string
+	realm   string
+	ccache  string
+	mu      sync.Mutex
+	client  *client.Client
+	ccMtime time.Time
+}
+
+func newKrb5Credentials(configPath, keytabPath, principal, ccachePath, spn string) (*krb5Credentials, error) {
+	cfg, err := krbconfig.Load(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %w", configPath, err)
+	}
+
+	c := &krb5Credentials{spn: spn, cfg: cfg, keytab: keytabPath, ccache: ccachePath}
+	if keytabPath != "" {
+		user, realm, ok := strings.Cut(principal, "@")
+		if !ok || user == "" || realm == "" {
+			return nil, fmt.Errorf("a keytab needs a user@REALM principal, got %q", principal)
+		}
+		c.user, c.realm = user, realm
+	} else if c.ccache == "" {
+		c.ccache = defaultCCache()
+	}
+
+	if err := c.login(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// defaultCCache follows the MIT conventions for locating the credential cache.
+func defaultCCache() string {
+	if cc := os.Getenv("KRB5CCNAME"); cc != "" {
+		return strings.TrimPrefix(cc, "FILE:")
+	}
+	return fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid())
+}
+
+func (c *krb5Credentials) login() error {
+	if c.keytab != "" {
+		kt, err := keytab.Load(c.keytab)
+		if err != nil {
+			return fmt.Errorf("loading keytab %s: %w", c.keytab, err)
+		}
+		cl := client.NewWithKeytab(c.user, c.realm, kt, c.cfg, client.DisablePAFXFAST(true))
+		if err := cl.Login(); err != nil {
+			return fmt.Errorf("kerberos login as %s@%s: %w", c.user, c.realm, err)
+		}
+		c.client = cl
+		return nil
+	}
+
+	st, err := os.Stat(c.ccache)
+	if err != nil {
+		return err
+	}
+	cc, err := krbcreds.LoadCCache(c.ccache)
+	if err != nil {
+		return fmt.Errorf("loading credential cache %s: %w", c.ccache, err)
+	}
+	cl, err := client.NewFromCCache(cc, c.cfg, client.DisablePAFXFAST(true))
+	if err != nil {
+		return fmt.Errorf("using credential cache %s: %w", c.ccache, err)
+	}
+	if c.client != nil {
+		c.client.Destroy()
+	}
+	c.client, c.ccMtime = cl, st.ModTime()
+	return nil
+}
+
+func (c *krb5Credentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.keytab == "" {
+		if st, err := os.Stat(c.ccache); err == nil && st.ModTime().After(c.ccMtime) {
+			if err := c.login(); err != nil {
+				log.Printf("Keeping previous Kerberos credentials: %v", err)
+			} else {
+				log.Printf("Reloaded Kerberos credential cache %s", c.ccache)
+			}
+		}
+	}
+
+	s := spnego.SPNEGOClient(c.client, c.spn)
+	if err := s.AcquireCred(); err != nil {
+		return nil, fmt.Errorf("acquiring kerberos credentials for %s: %w", c.spn, err)
+	}
+	token, err := s.InitSecContext()
+	if err != nil {
+		return nil, fmt.Errorf("creating kerberos token for %s: %w", c.spn, err)
+	}
+	b, err := token.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"authorization": "Negotiate " + base64.StdEncoding.EncodeToString(b)}, nil
+}
+
+// RequireTransportSecurity is false because the MGM gRPC endpoint is usually
+// plaintext; the Kerberos authenticator is itself protected against replay.
+func (c *krb5Credentials) RequireTransportSecurity() bool {
+	return false
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenRefreshMargin is how long before expiry a token gets replaced.
+const tokenRefreshMargin = time.Minute
+
+// tokenCredentials attaches "authorization: Bearer <token>" to every RPC,
+// fetching a new token from source shortly before the current one expires.
+type tokenCredentials struct {
+	source func(ctx context.Context) (string, time.Time, error)
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (c *tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token == "" || (!c.expiry.IsZero() && time.Until(c.expiry) < tokenRefreshMargin) {
+		token, expiry, err := c.source(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("refreshing bearer token: %w", err)
+		}
+		c.token, c.expiry = token, expiry
+	}
+	return map[string]string{"authorization": "Bearer " + c.token}, nil
+}
+
+func (c *tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// newTokenFileCredentials reads the token from a file that is rotated by an
+// external agent (htgettoken, oidc-agent, ...). The file is re-read whenever
+// it changes, not only when the current token expires.
+func newTokenFileCredentials(path string) *tokenCredentials {
+	var mtime time.Time
+	c := &tokenCredentials{}
+	c.source = func(context.Context) (string, time.Time, error) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		if st, err := os.Stat(path); err == nil {
+			mtime = st.ModTime()
+		}
+		token := strings.TrimSpace(string(b))
+		return token, jwtExpiry(token), nil
+	}
+
+	// Force a reload on the next RPC if the file was rotated in the meantime.
+	go func() {
+		for range time.Tick(10 * time.Second) {
+			st, err := os.Stat(path)
+			c.mu.Lock()
+			if err == nil && st.ModTime().After(mtime) {
+				c.token = ""
+			}
+			c.mu.Unlock()
+		}
+	}()
+	return c
+}
+
+// newStaticTokenCredentials uses a fixed token, e.g. from $BEARER_TOKEN.
+func newStaticTokenCredentials(token string) *tokenCredentials {
+	return &tokenCredentials{source: func(context.Context) (string, time.Time, error) {
+		return token, time.Time{}, nil
+	}}
+}
+
+// discoverTokenFile follows the WLCG bearer token discovery rules, returning
+// "" if no token file can be found.
+func discoverTokenFile() string {
+	if f := os.Getenv("BEARER_TOKEN_FILE"); f != "" {
+		return f
+	}
+	name := fmt.Sprintf("bt_u%d", os.Getuid())
+	for _, dir := range []string{os.Getenv("XDG_RUNTIME_DIR"), "/tmp"} {
+		if dir == "" {
+			continue
+		}
+		if f := filepath.Join(dir, name); fileExists(f) {
+			return f
+		}
+	}
+	return ""
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// newClientCredentials obtains tokens with the OAuth2 client credentials grant.
+func newClientCredentials(tokenURL, clientID, clientSecret, scope, audience string) *tokenCredentials {
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	return &tokenCredentials{source: func(ctx context.Context) (string, time.Time, error) {
+		form := url.Values{"grant_type": {"client_credentials"}}
+		if scope != "" {
+			form.Set("scope", scope)
+		}
+		if audience != "" {
+			form.Set("audience", audience)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		defer resp.Body.Close()
+
+		var body struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int64  `json:"expires_in"`
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			return "", time.Time{}, fmt.Errorf("%s: %s", tokenURL, resp.Status)
+		}
+		if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+			return "", time.Time{}, fmt.Errorf("%s: %s %s %s", tokenURL, resp.Status, body.Error, body.Description)
+		}
+
+		expiry := jwtExpiry(body.AccessToken)
+		if body.ExpiresIn > 0 {
+			expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+		}
+		log.Printf("Obtained bearer token from %s (expires %s)", tokenURL, expiry.Format(time.RFC3339))
+		return body.AccessToken, expiry, nil
+	}}
+}
+
+// jwtExpiry extracts the (unverified) exp claim of a JWT, returning the zero
+// time for opaque tokens.
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
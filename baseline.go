@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// Time-of-day baselines: the mean and spread of the aggregate rates and of a
+// few key entities are learned per hour of the (local) day, so the current
+// rate can be compared with what is typical at that time rather than with a
+// flat threshold. The statistics are kept in a JSON state file that survives
+// restarts; a new state file can be seeded from recordings.
+
+var (
+	baselineTypical = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_baseline_typical_bytes_per_second",
+			Help: "Mean rate at the current hour of the day in the learned baseline",
+		},
+		[]string{"entity_type", "id", "direction"},
+	)
+	baselineDeviation = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_baseline_deviation_ratio",
+			Help: "Current rate divided by the typical rate at this hour of the day",
+		},
+		[]string{"entity_type", "id", "direction"},
+	)
+	baselineZScore = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_baseline_zscore",
+			Help: "Standard deviations between the current rate and the typical rate at this hour of the day",
+		},
+		[]string{"entity_type", "id", "direction"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(baselineTypical, baselineDeviation, baselineZScore)
+}
+
+// baselineAll is the entity type and id of the aggregate series, the sum
+// over all apps.
+const baselineAll = "all"
+
+// hourStats are the running mean and sum of squared deviations (Welford) of
+// the rates seen at one hour of the day.
+type hourStats struct {
+	N    int64   `json:"n"`
+	Mean float64 `json:"mean"`
+	M2   float64 `json:"m2"`
+}
+
+func (h *hourStats) add(v float64) {
+	h.N++
+	d := v - h.Mean
+	h.Mean += d / float64(h.N)
+	h.M2 += d * (v - h.Mean)
+}
+
+func (h *hourStats) stddev() float64 {
+	if h.N < 2 {
+		return 0
+	}
+	return math.Sqrt(h.M2 / float64(h.N-1))
+}
+
+type baselineTracker struct {
+	path       string
+	estimator  string
+	entities   map[entityKey]bool
+	minSamples int64
+
+	// series maps "type/id/direction" to the statistics per hour of the day.
+	series   map[string]*[24]hourStats
+	lastSave time.Time
+}
+
+// newBaselineTracker loads the baselines from the state file at path. If the
+// file doesn't exist yet, the baselines are learned from the recordings
+// first.
+func newBaselineTracker(path, estimator string, entities []string, minSamples int, recordings []string) (*baselineTracker, error) {
+	if _, err := parseEstimator(estimator); err != nil {
+		return nil, err
+	}
+	t := &baselineTracker{
+		path:       path,
+		estimator:  estimator,
+		entities:   make(map[entityKey]bool),
+		minSamples: int64(minSamples),
+		series:     make(map[string]*[24]hourStats),
+		lastSave:   time.Now(),
+	}
+	for _, e := range entities {
+		typ, id, ok := strings.Cut(e, ":")
+		if !ok || !validEntityType(typ) || id == "" {
+			return nil, fmt.Errorf("entity must be app:<name>, user:<uid> or group:<gid>, got %q", e)
+		}
+		t.entities[entityKey{typ, id}] = true
+	}
+
+	b, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &t.series); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		for _, rec := range recordings {
+			if err := t.learn(rec); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, err
+	}
+	return t, nil
+}
+
+// learn adds the reports of a recording to the baselines.
+func (t *baselineTracker) learn(path string) error {
+	r, err := openRecording(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for {
+		f, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		t.observe(f.Report, nil)
+	}
+}
+
+// observe adds the rates of report to the statistics of its hour. If visit is
+// set, it is called with every series and its updated statistics.
+func (t *baselineTracker) observe(report *pb.TrafficShapingRateResponse, visit func(e entityKey, direction string, v float64, h *hourStats)) {
+	hour := time.UnixMilli(report.TimestampMs).Hour()
+	add := func(e entityKey, direction string, v float64) {
+		key := e.Type + "/" + e.ID + "/" + direction
+		hours := t.series[key]
+		if hours == nil {
+			hours = new([24]hourStats)
+			t.series[key] = hours
+		}
+		hours[hour].add(v)
+		if visit != nil {
+			visit(e, direction, v, &hours[hour])
+		}
+	}
+
+	var read, write float64
+	for _, e := range reportEntities(report) {
+		for _, s := range e.Stats {
+			if s.Window.String() != t.estimator {
+				continue
+			}
+			if e.Type == "app" {
+				read += s.BytesReadPerSec
+				write += s.BytesWrittenPerSec
+			}
+			if key := (entityKey{e.Type, e.ID}); t.entities[key] {
+				add(key, "read", s.BytesReadPerSec)
+				add(key, "write", s.BytesWrittenPerSec)
+			}
+		}
+	}
+	all := entityKey{baselineAll, baselineAll}
+	add(all, "read", read)
+	add(all, "write", write)
+}
+
+// Update learns from report and exports how far its rates are from the
+// baseline of the hour, once the hour has enough samples. Key entities
+// absent from the report are neither learned from nor exported.
+func (t *baselineTracker) Update(report *pb.TrafficShapingRateResponse) {
+	baselineTypical.Reset()
+	baselineDeviation.Reset()
+	baselineZScore.Reset()
+	t.observe(report, func(e entityKey, direction string, v float64, h *hourStats) {
+		if h.N < t.minSamples {
+			return
+		}
+		baselineTypical.WithLabelValues(e.Type, e.ID, direction).Set(h.Mean)
+		if h.Mean > 0 {
+			baselineDeviation.WithLabelValues(e.Type, e.ID, direction).Set(v / h.Mean)
+		}
+		if sd := h.stddev(); sd > 0 {
+			baselineZScore.WithLabelValues(e.Type, e.ID, direction).Set((v - h.Mean) / sd)
+		}
+	})
+
+	if time.Since(t.lastSave) >= 5*time.Minute {
+		if err := t.Save(); err != nil {
+			log.Printf("Error saving baselines: %v", err)
+		}
+	}
+}
+
+// Save writes the baselines to the state file, replacing it atomically.
+func (t *baselineTracker) Save() error {
+	t.lastSave = time.Now()
+	b, err := json.Marshal(t.series)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), filepath.Base(t.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), t.path)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+func runBenchmark(args []string) {
+	fs := flag.NewFlagSet("benchmark", flag.ExitOnError)
+	reports := fs.Int("reports", 50, "Number of reports to process")
+	apps := fs.Int("apps", 100, "Number of apps in every report")
+	users := fs.Int("users", 50000, "Number of users in every report")
+	groups := fs.Int("groups", 1000, "Number of groups in every report")
+	pattern := fs.String("pattern", "bursty", "Rate pattern of the mock MGM: steady, diurnal or bursty")
+	churn := fs.Float64("churn", 0.01, "Probability for every entity to be replaced at each report")
+	maxSeries := fs.Int("max-series", 10000, "Per-entity series limit of the cardinality guard (0 to disable it)")
+	buckets := fs.String("rate-buckets", "1K,1M,10M,100M,1G", "Comma separated bucket bounds of the rate histograms (empty to disable them)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s benchmark [flags]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Streams reports with many entities from an in-process mock MGM through the")
+		fmt.Fprintln(fs.Output(), "gRPC client, the export pipeline (cardinality guard, totals, histograms),")
+		fmt.Fprintln(fs.Output(), "a scrape of the metrics and the rendering of the console tables, and")
+		fmt.Fprintln(fs.Output(), "reports the latency, allocations and memory of every stage.")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if *reports < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var bucketList []string
+	if *buckets != "" {
+		(*stringList)(&bucketList).Set(*buckets)
+	}
+	result, err := benchmarkPipeline(benchmarkConfig{
+		Reports:   *reports,
+		MaxSeries: *maxSeries,
+		Buckets:   bucketList,
+		Workload: mockWorkloadConfig{
+			Apps:    *apps,
+			Users:   *users,
+			Groups:  *groups,
+			Pattern: *pattern,
+			Period:  time.Hour,
+			Churn:   *churn,
+			MaxRate: 500 << 20,
+			// The estimators only need a few samples each.
+			Interval: time.Minute,
+			Seed:     1,
+		},
+	})
+	if err != nil {
+		log.Fatalf("Error running benchmark: %v", err)
+	}
+	result.print(os.Stdout)
+}
+
+type benchmarkConfig struct {
+	Reports   int
+	MaxSeries int
+	Buckets   []string
+	Workload  mockWorkloadConfig
+}
+
+// benchmarkStage holds the measures of a stage over every report.
+type benchmarkStage struct {
+	name      string
+	durations []time.Duration
+	allocs    uint64 // objects
+	bytes     uint64
+}
+
+type benchmarkResult struct {
+	cfg       benchmarkConfig
+	entities  int // per report
+	series    int // gathered at the last scrape
+	heapInUse uint64
+	stages    []*benchmarkStage
+}
+
+// benchmarkPipeline streams cfg.Reports reports from a mock MGM served on a
+// loopback port, one at a time so the measures aren't skewed by a backlog.
+func benchmarkPipeline(cfg benchmarkConfig) (*benchmarkResult, error) {
+	w, err := newMockWorkload(cfg.Workload)
+	if err != nil {
+		return nil, err
+	}
+	var guard *cardinalityGuard
+	if cfg.MaxSeries > 0 {
+		if guard, err = newCardinalityGuard(cfg.MaxSeries, "SMA_5_SECONDS"); err != nil {
+			return nil, err
+		}
+	}
+	var histograms *rateHistograms
+	if len(cfg.Buckets) > 0 {
+		if histograms, err = newRateHistograms(cfg.Buckets); err != nil {
+			return nil, err
+		}
+		prometheus.MustRegister(histograms)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	m := newMockMGM()
+	server := grpc.NewServer(grpc.MaxSendMsgSize(1 << 30))
+	pb.RegisterEosServer(server, m)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(1<<30)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sortBy := pb.TrafficShapingRateRequest_SMA_5_SECONDS
+	ts := time.Now()
+	m.publish(w.Step(ts))
+	stream, err := pb.NewEosClient(conn).TrafficShapingRate(ctx, &pb.TrafficShapingRateRequest{SortByEstimator: &sortBy})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &benchmarkResult{cfg: cfg}
+	recv := &benchmarkStage{name: "receive"}
+	export := &benchmarkStage{name: "export"}
+	scrape := &benchmarkStage{name: "scrape"}
+	render := &benchmarkStage{name: "render"}
+	res.stages = []*benchmarkStage{recv, export, scrape, render}
+	view := tableView{columns: []string{"estimator", "read", "write", "total"}, sortBy: sortBy.String()}
+
+	var report *pb.TrafficShapingRateResponse
+	for i := range cfg.Reports {
+		if i > 0 {
+			ts = ts.Add(cfg.Workload.Interval)
+			m.publish(w.Step(ts))
+		}
+		recv.measure(func() {
+			report, err = stream.Recv()
+		})
+		if err != nil {
+			return nil, fmt.Errorf("report %d: %w", i+1, err)
+		}
+		var rows map[string][]entityRow
+		export.measure(func() {
+			rows = map[string][]entityRow{
+				"app":   appRows(report.AppStats, nil),
+				"user":  userRows(report.UserStats, nil, false, nil),
+				"group": groupRows(report.GroupStats, nil, false, nil),
+			}
+			exportRates(rows, guard, nil)
+			exportTotals(report)
+			if histograms != nil {
+				histograms.Update(report)
+			}
+		})
+		scrape.measure(func() {
+			families, gatherErr := prometheus.DefaultGatherer.Gather()
+			if gatherErr != nil {
+				err = gatherErr
+			}
+			res.series = 0
+			for _, f := range families {
+				res.series += len(f.Metric)
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("report %d: %w", i+1, err)
+		}
+		render.measure(func() {
+			printApps(io.Discard, rows["app"], view)
+			printRows(io.Discard, "--- Top Users ---", "UID", "user", rows["user"], false, false, view)
+			printRows(io.Discard, "--- Top Groups ---", "GID", "group", rows["group"], false, false, view)
+		})
+		res.entities = len(report.AppStats) + len(report.UserStats) + len(report.GroupStats)
+	}
+
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	res.heapInUse = ms.HeapInuse
+	return res, nil
+}
+
+// measure runs f, adding its duration and allocations to the stage. The
+// allocations include those of other goroutines meanwhile, such as the
+// gRPC transport's.
+func (s *benchmarkStage) measure(f func()) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	f()
+	s.durations = append(s.durations, time.Since(start))
+	runtime.ReadMemStats(&after)
+	s.allocs += after.Mallocs - before.Mallocs
+	s.bytes += after.TotalAlloc - before.TotalAlloc
+}
+
+// quantile returns the q-quantile of the durations of the stage.
+func (s *benchmarkStage) quantile(q float64) time.Duration {
+	sorted := slices.Clone(s.durations)
+	slices.Sort(sorted)
+	return sorted[min(len(sorted)-1, int(q*float64(len(sorted))))]
+}
+
+func (r *benchmarkResult) print(out io.Writer) {
+	fmt.Fprintf(out, "%d reports of %d entities, %d series at the last scrape, %s heap in use\n\n",
+		r.cfg.Reports, r.entities, r.series, humanizeBytes(float64(r.heapInUse)))
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "Stage\tp50\tp90\tp99\tMax\tAllocs/report\tBytes/report")
+	n := uint64(r.cfg.Reports)
+	for _, s := range r.stages {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", s.name,
+			s.quantile(0.5).Round(time.Microsecond), s.quantile(0.9).Round(time.Microsecond),
+			s.quantile(0.99).Round(time.Microsecond), s.quantile(1).Round(time.Microsecond),
+			s.allocs/n, humanizeBytes(float64(s.bytes/n)))
+	}
+	w.Flush()
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// bundleLogTail is how much of the end of each log file goes into a bundle.
+const bundleLogTail = 4 << 20
+
+func runBundle(args []string) {
+	fs := flag.NewFlagSet("bundle", flag.ExitOnError)
+	last := fs.Duration("last", 15*time.Minute, "Take the reports of this period before the last one of each recording")
+	configPath := fs.String("config", "", "Config file to include, with secrets redacted")
+	var logs stringList
+	fs.Var(&logs, "log", "Comma separated log files whose tail to include")
+	metricsURL := fs.String("metrics-url", "http://localhost:9987/metrics", "Metrics endpoint to snapshot (empty to skip)")
+	out := fs.String("o", "", "Output file (default: eos-monitor-bundle-<time>.tar.gz)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s bundle [flags] [recording...]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Packages the last minutes of the recordings, the config with secrets")
+		fmt.Fprintln(fs.Output(), "redacted, the tail of the logs and a snapshot of the metrics into a")
+		fmt.Fprintln(fs.Output(), "tar.gz to attach to support tickets.")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if *out == "" {
+		*out = "eos-monitor-bundle-" + time.Now().Format("20060102-150405") + ".tar.gz"
+	}
+	if err := writeBundle(*out, fs.Args(), *last, *configPath, logs, *metricsURL); err != nil {
+		log.Fatalf("Error writing bundle: %v", err)
+	}
+	log.Printf("Wrote %s", *out)
+}
+
+// writeBundle writes the bundle to path. Parts that can't be collected are
+// listed in the MANIFEST rather than failing the whole bundle, as it is
+// typically made while something is already wrong.
+func writeBundle(path string, recordings []string, last time.Duration, configPath string, logs []string, metricsURL string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	add := func(name string, body []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(body)), ModTime: now}); err != nil {
+			return err
+		}
+		_, err := tw.Write(body)
+		return err
+	}
+
+	var manifest strings.Builder
+	fmt.Fprintf(&manifest, "created: %s\n", now.Format(time.RFC3339))
+	host, _ := os.Hostname()
+	fmt.Fprintf(&manifest, "host: %s\n", host)
+	note := func(format string, args ...any) {
+		fmt.Fprintf(&manifest, format+"\n", args...)
+		log.Printf(format, args...)
+	}
+
+	err = func() error {
+		tmp, err := os.MkdirTemp("", "eos-monitor-bundle")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		for _, rec := range recordings {
+			name := strings.TrimSuffix(filepath.Base(rec), ".gz")
+			sliced := filepath.Join(tmp, name)
+			n, err := sliceRecording(rec, sliced, last)
+			if err != nil {
+				note("recording %s: %v", rec, err)
+				continue
+			}
+			b, err := os.ReadFile(sliced)
+			if err != nil {
+				return err
+			}
+			if err := add("recordings/"+name, b); err != nil {
+				return err
+			}
+			note("recording %s: last %s, %d reports", rec, last, n)
+		}
+
+		if configPath != "" {
+			b, err := redactedConfig(configPath)
+			if err != nil {
+				note("config %s: %v", configPath, err)
+			} else if err := add("config.yaml", b); err != nil {
+				return err
+			} else {
+				note("config %s: secrets redacted", configPath)
+			}
+		}
+
+		for _, l := range logs {
+			b, err := fileTail(l, bundleLogTail)
+			if err != nil {
+				note("log %s: %v", l, err)
+				continue
+			}
+			if err := add("logs/"+filepath.Base(l), b); err != nil {
+				return err
+			}
+			note("log %s: last %d bytes", l, len(b))
+		}
+
+		if metricsURL != "" {
+			b, err := fetchMetrics(metricsURL)
+			if err != nil {
+				note("metrics %s: %v", redactURL(metricsURL), err)
+			} else if err := add("metrics.txt", b); err != nil {
+				return err
+			} else {
+				note("metrics %s: snapshot", redactURL(metricsURL))
+			}
+		}
+		return add("MANIFEST", []byte(manifest.String()))
+	}()
+
+	if cerr := errors.Join(tw.Close(), gz.Close(), f.Close()); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// sliceRecording copies the reports of the last period of a recording, up to
+// its last report, to outPath.
+func sliceRecording(inPath, outPath string, last time.Duration) (int, error) {
+	in, err := openRecording(inPath)
+	if err != nil {
+		return 0, err
+	}
+	var end int64
+	for {
+		f, err := in.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			in.Close()
+			return 0, err
+		}
+		end = f.Report.TimestampMs
+	}
+	in.Close()
+
+	if in, err = openRecording(inPath); err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := createRecording(outPath)
+	if err != nil {
+		return 0, err
+	}
+	start := end - last.Milliseconds()
+	n := 0
+	for {
+		f, err := in.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			out.Close()
+			return n, err
+		}
+		if f.Report.TimestampMs < start {
+			continue
+		}
+		if err := out.Write(f); err != nil {
+			out.Close()
+			return n, err
+		}
+		n++
+	}
+	return n, out.Close()
+}
+
+// redactedConfig returns the config file with the values of secret-looking
+// keys replaced and the credentials stripped from URLs. Paths to secret
+// files (keys ending in _file) are kept, they help tell how auth was set up.
+func redactedConfig(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(redactYAML(doc, ""))
+}
+
+func redactYAML(v any, key string) any {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		out := make(yaml.MapSlice, len(v))
+		for i, item := range v {
+			out[i] = yaml.MapItem{Key: item.Key, Value: redactYAML(item.Value, strings.ToLower(fmt.Sprint(item.Key)))}
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = redactYAML(item, key)
+		}
+		return out
+	case string:
+		if secretKey(key) {
+			return "REDACTED"
+		}
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			return u.Redacted()
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func secretKey(key string) bool {
+	if strings.HasSuffix(key, "_file") {
+		return false
+	}
+	for _, s := range []string{"password", "secret", "token", "authorization"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileTail returns at most the last n bytes of a file.
+func fileTail(path string, n int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if st.Size() > n {
+		if _, err := f.Seek(-n, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+	return io.ReadAll(f)
+}
+
+func fetchMetrics(metricsURL string) ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(metricsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
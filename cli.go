@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// envPrefix prefixes the environment variables that set flags, e.g.
+// EOS_MONITOR_CONFIG for --config.
+const envPrefix = "EOS_MONITOR_"
+
+// newRootCommand builds the command line interface for args, the command
+// line without the program name. Without a subcommand the tool runs the
+// monitor, as it did before it had any.
+//
+// The monitor and its variants (top, check, record) share the flags of
+// registerFlags and the config file; the subcommands built on the flag
+// package parse their arguments themselves.
+func newRootCommand(args []string) *cobra.Command {
+	root := monitorCommand(args, &cobra.Command{
+		Use:   "eos_traffic_shaping_monitor",
+		Short: "Monitor the IO traffic of an EOS instance",
+		Long: "Streams the IO rates of the apps, users and groups of an EOS MGM, shows\n" +
+			"them on the console and exports them to Prometheus and other monitoring\n" +
+			"systems. Without a subcommand it runs the monitor.",
+		Version:      currentBuildInfo().Version,
+		SilenceUsage: true,
+	}, nil)
+	root.PersistentFlags().String("config", "", "YAML configuration file; flags given explicitly override its settings")
+	root.PersistentPreRunE = func(cmd *cobra.Command, _ []string) error {
+		// Before the config file is read, which takes precedence.
+		return bindEnv(cmd.Flags())
+	}
+	root.CompletionOptions.HiddenDefaultCmd = true
+
+	root.AddCommand(
+		monitorCommand(args, &cobra.Command{
+			Use:   "monitor",
+			Short: "Run the monitor (the default)",
+		}, nil),
+		monitorCommand(args, &cobra.Command{
+			Use:   "top",
+			Short: "Show the top entities on the console, without serving or exporting them",
+			Long: "Runs the console of the monitor alone: the connection, request, filter and\n" +
+				"console settings of the config file apply, its endpoints, exporters and\n" +
+				"sinks don't, so it can run next to the monitor.",
+		}, clientConfig),
+		monitorCommand(args, &cobra.Command{
+			Use:   "check",
+			Short: "Check that a report can be received from the MGM",
+			Long: "Connects to the MGM with the connection and request settings of the config\n" +
+				"file, waits for one report and prints its summary line. Exits with 1 if no\n" +
+				"report arrives within --stream-deadline, e.g. for deployment checks.",
+		}, func(cfg *config) {
+			clientConfig(cfg)
+			cfg.Console.Mode = "append"
+			cfg.Run.MaxReports = 1
+			if cfg.GRPC.StreamDeadline == 0 {
+				cfg.GRPC.StreamDeadline = cfg.GRPC.DialTimeout
+			}
+		}),
+		recordCommand(args),
+		watchCommand(args),
+		replayCommand(),
+		reportCommand(),
+		diffCommand(),
+		flagCommand("simulate", "Replay recordings applying other limits", runSimulate),
+		flagCommand("version", "Print the version of the monitor", runVersion),
+		flagCommand("benchmark", "Measure the monitor on a synthetic workload", runBenchmark),
+		flagCommand("bundle", "Package recordings, config and logs for a support ticket", runBundle),
+		flagCommand("convert", "Convert a recording to another format", runConvert),
+		flagCommand("inspect", "Summarise recordings", runInspect),
+		flagCommand("merge", "Merge recordings of several MGMs", runMerge),
+		flagCommand("migrate-config", "Move deprecated keys of a config file", runMigrateConfig),
+		flagCommand("mock-mgm", "Serve a synthetic workload as an MGM", runMockMGM),
+		flagCommand("query", "Query the local store", runQuery),
+		flagCommand("trim", "Extract a time slice of a recording", runTrim),
+	)
+	root.SetArgs(longFlagArgs(root, args))
+	return root
+}
+
+// monitorCommand makes cmd run the monitor with the flags of registerFlags.
+// override, if set, adjusts the settings of the command over those of the
+// config file; flags given explicitly still take precedence.
+func monitorCommand(args []string, cmd *cobra.Command, override func(*config)) *cobra.Command {
+	cfg := defaultConfig()
+	if override != nil {
+		override(&cfg)
+	}
+	fs := flag.NewFlagSet(cmd.Name(), flag.ContinueOnError)
+	registerFlags(fs, &cfg)
+	registerDeprecatedFlags(fs)
+	cmd.Flags().AddGoFlagSet(fs)
+	if cmd.Args == nil {
+		cmd.Args = cobra.NoArgs
+	}
+	cmd.Run = func(cmd *cobra.Command, _ []string) {
+		if path, _ := cmd.Flags().GetString("config"); path != "" {
+			if err := loadConfig(path, &cfg); err != nil {
+				log.Fatalf("Invalid configuration:\n%v", err)
+			}
+			if override != nil {
+				override(&cfg)
+			}
+			// Apply the flags again over the file. The subcommand
+			// name is taken as a positional argument and ignored.
+			if err := cmd.Flags().Parse(longFlagArgs(cmd.Root(), args)); err != nil {
+				log.Fatal(err)
+			}
+		}
+		monitor(cfg)
+	}
+	return cmd
+}
+
+// clientConfig keeps the settings of cfg about reaching the MGM and showing
+// its reports, leaving the HTTP endpoints, exporters and sinks disabled.
+func clientConfig(cfg *config) {
+	c := defaultConfig()
+	c.GRPC, c.Auth, c.Request, c.Instance = cfg.GRPC, cfg.Auth, cfg.Request, cfg.Instance
+	c.AppNames, c.Names, c.Filter, c.Console = cfg.AppNames, cfg.Names, cfg.Filter, cfg.Console
+	c.Run, c.Idle, c.Limits, c.Shaping = cfg.Run, cfg.Idle, cfg.Limits, cfg.Shaping
+	c.Prometheus.Disable = true
+	*cfg = c
+}
+
+func recordCommand(args []string) *cobra.Command {
+	var path string
+	cmd := monitorCommand(args, &cobra.Command{
+		Use:   "record <recording>",
+		Short: "Record the reports of the MGM to a file",
+		Long: "Records the reports to a .pb, .jsonl or .parquet file, optionally .gz, with\n" +
+			"a summary line per report. As with top, the endpoints, exporters and sinks\n" +
+			"of the config file are left out; --duration and --max-reports bound the\n" +
+			"recording.",
+		Args: cobra.ExactArgs(1),
+	}, func(cfg *config) {
+		clientConfig(cfg)
+		cfg.Console.Mode = "append"
+		cfg.Record = path
+	})
+	run := cmd.Run
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		path = args[0]
+		if err := cmd.Flags().Set("record", path); err != nil {
+			log.Fatal(err)
+		}
+		run(cmd, args)
+	}
+	return cmd
+}
+
+// flagCommand wraps a subcommand parsing its arguments with the flag package.
+func flagCommand(name, short string, run func(args []string)) *cobra.Command {
+	return &cobra.Command{
+		Use:                name,
+		Short:              short,
+		DisableFlagParsing: true,
+		Run: func(_ *cobra.Command, args []string) {
+			run(args)
+		},
+	}
+}
+
+// bindEnv sets the flags of fs not given on the command line from their
+// environment variables, e.g. EOS_MONITOR_GRPC_HOST for --grpc-host.
+func bindEnv(fs *pflag.FlagSet) error {
+	var errs []error
+	fs.VisitAll(func(f *pflag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || f.Changed || renamedFlag(f.Name) || f.Name == "help" || f.Name == "version" {
+			return
+		}
+		if err := fs.Set(f.Name, v); err != nil {
+			errs = append(errs, fmt.Errorf("$%s: %w", envName(f.Name), err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// parseFlags parses args with fs like fs.Parse, for the subcommands built on
+// the flag package, and then sets the flags not given from their
+// environment variables like bindEnv.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || given[f.Name] {
+			return
+		}
+		if err := fs.Set(f.Name, v); err != nil {
+			fmt.Fprintf(fs.Output(), "invalid value %q for $%s: %v\n", v, envName(f.Name), err)
+			fs.Usage()
+			os.Exit(2)
+		}
+	})
+}
+
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// longFlagArgs rewrites the long flags of the commands given with a single
+// dash, e.g. -grpc-host, with two: the flag package took both, pflag
+// would read the former as a group of shorthands.
+func longFlagArgs(root *cobra.Command, args []string) []string {
+	names := map[string]bool{}
+	collect := func(f *pflag.Flag) { names[f.Name] = len(f.Name) > 1 }
+	root.PersistentFlags().VisitAll(collect)
+	for _, cmd := range append(root.Commands(), root) {
+		if !cmd.DisableFlagParsing {
+			cmd.Flags().VisitAll(collect)
+		}
+	}
+
+	out := make([]string, len(args))
+	for i, arg := range args {
+		out[i] = arg
+		if arg == "--" {
+			copy(out[i:], args[i:])
+			break
+		}
+		name, _, _ := strings.Cut(arg, "=")
+		if strings.HasPrefix(name, "-") && !strings.HasPrefix(name, "--") && names[name[1:]] {
+			out[i] = "-" + arg
+		}
+	}
+	return out
+}
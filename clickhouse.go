@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// clickhouseSink inserts every report into a ClickHouse table through the
+// HTTP interface, one row per entity and estimator, for sites keeping months
+// of per-user history. With -clickhouse-create-table the table is created as
+//
+//	CREATE TABLE IF NOT EXISTS eos_io (
+//	  timestamp DateTime64(3),
+//	  mgm LowCardinality(String),
+//	  entity_type LowCardinality(String),
+//	  id String,
+//	  estimator LowCardinality(String),
+//	  read_bytes_per_second Float64,
+//	  write_bytes_per_second Float64
+//	) ENGINE = MergeTree PARTITION BY toYYYYMM(timestamp)
+//	  ORDER BY (entity_type, id, estimator, timestamp)
+//
+// Rows are batched and inserted every flush interval, or as soon as
+// batchSize rows are pending, as gzip compressed JSONEachRow by a background
+// writer that retries failed inserts. When the writer falls behind and
+// maxPending batches are waiting, Send blocks for up to the block timeout to
+// slow the monitor down before it drops the batch. It is a pacedSink, sent
+// the reports without a queue so that the stream loop is the one held up.
+type clickhouseSink struct {
+	endpoint  string // URL with the INSERT query
+	user      string
+	password  string
+	mgm       string
+	batchSize int
+	block     time.Duration
+
+	client *http.Client
+	queue  chan []byte
+	done   chan struct{}
+	stop   func() // of the flush ticker
+
+	// ctx is that of the inserts, cancelled past the close deadline.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	batch  bytes.Buffer
+	rows   int
+	closed bool
+}
+
+type clickhouseRow struct {
+	Timestamp  string  `json:"timestamp"` // RFC3339 with milliseconds
+	MGM        string  `json:"mgm"`
+	EntityType string  `json:"entity_type"`
+	ID         string  `json:"id"`
+	Estimator  string  `json:"estimator"`
+	Read       float64 `json:"read_bytes_per_second"`
+	Write      float64 `json:"write_bytes_per_second"`
+}
+
+var clickhouseTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// newClickHouseSink inserts into table ([database.]name) of the server at
+// baseURL. password may be empty.
+func newClickHouseSink(baseURL, table, user, password string, createTable bool, batchSize, maxPending int, flush, block time.Duration, mgm string) (*clickhouseSink, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("ClickHouse URL must be an http:// or https:// URL, got %q", baseURL)
+	}
+	if !clickhouseTableName.MatchString(table) {
+		return nil, fmt.Errorf("invalid ClickHouse table %q", table)
+	}
+	if batchSize < 1 || maxPending < 1 || flush <= 0 {
+		return nil, errors.New("ClickHouse batch size, pending batches and flush interval must be positive")
+	}
+
+	s := &clickhouseSink{
+		user:      user,
+		password:  password,
+		mgm:       mgm,
+		batchSize: batchSize,
+		block:     block,
+		client:    &http.Client{Timeout: time.Minute},
+		queue:     make(chan []byte, maxPending),
+		done:      make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if createTable {
+		if err := s.exec(u, clickhouseCreateTable(table), nil); err != nil {
+			return nil, fmt.Errorf("creating table: %w", err)
+		}
+	}
+	q := u.Query()
+	q.Set("query", "INSERT INTO "+table+" FORMAT JSONEachRow")
+	q.Set("date_time_input_format", "best_effort")
+	u.RawQuery = q.Encode()
+	s.endpoint = u.String()
+
+	go s.writer()
+	s.stop = every(flush, s.flush)
+	return s, nil
+}
+
+func (s *clickhouseSink) paced() {}
+
+func clickhouseCreateTable(table string) string {
+	return `CREATE TABLE IF NOT EXISTS ` + table + ` (
+  timestamp DateTime64(3),
+  mgm LowCardinality(String),
+  entity_type LowCardinality(String),
+  id String,
+  estimator LowCardinality(String),
+  read_bytes_per_second Float64,
+  write_bytes_per_second Float64
+) ENGINE = MergeTree PARTITION BY toYYYYMM(timestamp)
+ORDER BY (entity_type, id, estimator, timestamp)`
+}
+
+func (s *clickhouseSink) Send(report *pb.TrafficShapingRateResponse) error {
+	ts := time.UnixMilli(report.TimestampMs).UTC().Format("2006-01-02T15:04:05.000Z")
+	s.mu.Lock()
+	enc := json.NewEncoder(&s.batch)
+	for _, e := range reportEntities(report) {
+		for _, st := range e.Stats {
+			enc.Encode(clickhouseRow{
+				Timestamp:  ts,
+				MGM:        s.mgm,
+				EntityType: e.Type,
+				ID:         e.ID,
+				Estimator:  st.Window.String(),
+				Read:       st.BytesReadPerSec,
+				Write:      st.BytesWrittenPerSec,
+			})
+			s.rows++
+		}
+	}
+	full := s.rows >= s.batchSize
+	s.mu.Unlock()
+
+	if full {
+		return s.flushBlocking()
+	}
+	return nil
+}
+
+// take returns the pending rows and their number, leaving none. s.mu must
+// be held.
+func (s *clickhouseSink) take() ([]byte, int) {
+	body, rows := bytes.Clone(s.batch.Bytes()), s.rows
+	s.batch.Reset()
+	s.rows = 0
+	return body, rows
+}
+
+// flush hands the pending rows to the writer, dropping them if it is busy.
+// It runs from the flush ticker, which must never block.
+func (s *clickhouseSink) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rows == 0 || s.closed {
+		return
+	}
+	body, rows := s.take()
+	select {
+	case s.queue <- body:
+	default:
+		log.Printf("ClickHouse: insert queue full, dropping %d rows", rows)
+	}
+}
+
+// flushBlocking hands the pending rows to the writer, waiting up to the
+// block timeout for room in the queue, without holding up the ticker.
+func (s *clickhouseSink) flushBlocking() error {
+	s.mu.Lock()
+	if s.rows == 0 || s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	body, rows := s.take()
+	s.mu.Unlock()
+
+	t := time.NewTimer(s.block)
+	defer t.Stop()
+	select {
+	case s.queue <- body:
+		return nil
+	case <-t.C:
+		return fmt.Errorf("ClickHouse: insert queue full for %s, dropping %d rows", s.block, rows)
+	}
+}
+
+func (s *clickhouseSink) writer() {
+	defer close(s.done)
+	for body := range s.queue {
+		backoff := time.Second
+		for attempt := 0; ; attempt++ {
+			err := s.insert(body)
+			var perm permanentError
+			if err == nil {
+				break
+			}
+			if errors.As(err, &perm) || attempt == 3 || s.ctx.Err() != nil {
+				log.Printf("ClickHouse: %v", err)
+				break
+			}
+			select {
+			case <-time.After(backoff):
+			case <-s.ctx.Done():
+			}
+			backoff *= 2
+		}
+	}
+}
+
+func (s *clickhouseSink) insert(rows []byte) error {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write(rows)
+	if err := gz.Close(); err != nil {
+		return permanentError{err}
+	}
+	u, err := url.Parse(s.endpoint)
+	if err != nil {
+		return permanentError{err}
+	}
+	return s.exec(u, "", &body)
+}
+
+// exec posts query, or the body if query is empty, to the HTTP interface
+// at u.
+func (s *clickhouseSink) exec(u *url.URL, query string, gzipped io.Reader) error {
+	var body io.Reader = strings.NewReader(query)
+	if gzipped != nil {
+		body = gzipped
+	}
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, u.String(), body)
+	if err != nil {
+		return permanentError{err}
+	}
+	if gzipped != nil {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if s.user != "" {
+		req.Header.Set("X-ClickHouse-User", s.user)
+		req.Header.Set("X-ClickHouse-Key", s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("insert: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	default:
+		return permanentError{fmt.Errorf("insert: %s: %s", resp.Status, bytes.TrimSpace(msg))}
+	}
+}
+
+// Close inserts the pending rows and waits for the writer to finish, for a
+// minute at most, past which the inserts and their retries are cancelled.
+func (s *clickhouseSink) Close() error {
+	s.stop()
+	deadline := time.AfterFunc(time.Minute, s.cancel)
+	defer deadline.Stop()
+	defer s.cancel()
+
+	s.mu.Lock()
+	s.closed = true
+	body, rows := s.take()
+	s.mu.Unlock()
+	if rows > 0 {
+		select {
+		case s.queue <- body:
+		case <-s.ctx.Done():
+			log.Printf("ClickHouse: insert queue still full, dropping the last %d rows", rows)
+		}
+	}
+	close(s.queue)
+	<-s.done
+	if s.ctx.Err() != nil {
+		return errors.New("ClickHouse: timed out inserting the last rows")
+	}
+	return nil
+}
@@ -0,0 +1,1018 @@
+package main
+
+import (
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// config holds the monitor settings. Every field can be set in the YAML file
+// passed with -config and is overridden by the corresponding flag.
+type config struct {
+	GRPC       grpcConfig       `yaml:"grpc"`
+	Auth       authConfig       `yaml:"auth"`
+	Prometheus prometheusConfig `yaml:"prometheus"`
+	API        apiConfig        `yaml:"api"`
+	Web        webConfig        `yaml:"web"`
+	Dashboard  dashboardConfig  `yaml:"dashboard"`
+	Relay      relayConfig      `yaml:"relay"`
+	OTLP       otlpConfig       `yaml:"otlp"`
+	Tracing    tracingConfig    `yaml:"tracing"`
+	Influx     influxConfig     `yaml:"influx"`
+	Graphite   graphiteConfig   `yaml:"graphite"`
+	StatsD     statsdConfig     `yaml:"statsd"`
+	Monit      monitConfig      `yaml:"monit"`
+	ClickHouse clickhouseConfig `yaml:"clickhouse"`
+	Profiling  profilingConfig  `yaml:"profiling"`
+	Request    requestConfig    `yaml:"request"`
+	Record     string           `yaml:"record"`
+	Store      storeConfig      `yaml:"store"`
+	Snapshot   snapshotConfig   `yaml:"snapshot"`
+	Limits     string           `yaml:"limits"`
+	Shaping    shapingConfig    `yaml:"shaping"`
+	Idle       idleConfig       `yaml:"idle"`
+	Names      namesConfig      `yaml:"names"`
+	AppNames   appNameRules     `yaml:"app_names"`
+	Filter     filterConfig     `yaml:"filter"`
+	Run        runConfig        `yaml:"run"`
+	Instance   instanceConfig   `yaml:"instance"`
+	Alerts     alertsConfig     `yaml:"alerts"`
+	SLOs       string           `yaml:"slos"`
+	FairShare  string           `yaml:"fair_share"`
+	Groups     string           `yaml:"groups"`
+	Baseline   baselineConfig   `yaml:"baseline"`
+	Checks     checksConfig     `yaml:"estimator_checks"`
+	Rolling    rollingConfig    `yaml:"rolling"`
+	Anomaly    anomalyConfig    `yaml:"anomaly"`
+	Sustained  sustainedConfig  `yaml:"sustained"`
+	Counters   countersConfig   `yaml:"byte_counters"`
+	Hitters    hittersConfig    `yaml:"heavy_hitters"`
+	Loops      loopsConfig      `yaml:"thread_loops"`
+	Sinks      sinksConfig      `yaml:"sinks"`
+	Console    consoleConfig    `yaml:"console"`
+}
+
+type grpcConfig struct {
+	Host           string        `yaml:"host"`
+	Port           string        `yaml:"port"`
+	Compression    string        `yaml:"compression"`
+	Proxy          string        `yaml:"proxy"`
+	DialTimeout    time.Duration `yaml:"dial_timeout"`
+	StreamDeadline time.Duration `yaml:"stream_deadline"`
+	ServiceConfig  string        `yaml:"service_config"`
+	Retry          retryConfig   `yaml:"retry"`
+}
+
+// requestConfig holds the parameters of the TrafficShapingRate request.
+type requestConfig struct {
+	TopN       uint     `yaml:"top_n"`
+	Estimators []string `yaml:"estimators"`
+	SortBy     string   `yaml:"sort_by"`
+}
+
+type authConfig struct {
+	Method string      `yaml:"method"`
+	Krb5   krb5Config  `yaml:"krb5"`
+	Token  tokenConfig `yaml:"token"`
+}
+
+type krb5Config struct {
+	Config    string `yaml:"config"`
+	Keytab    string `yaml:"keytab"`
+	Principal string `yaml:"principal"`
+	CCache    string `yaml:"ccache"`
+	SPN       string `yaml:"spn"`
+}
+
+type tokenConfig struct {
+	File             string `yaml:"file"`
+	OIDCTokenURL     string `yaml:"oidc_token_url"`
+	ClientID         string `yaml:"client_id"`
+	ClientSecretFile string `yaml:"client_secret_file"`
+	Scope            string `yaml:"scope"`
+	Audience         string `yaml:"audience"`
+}
+
+type prometheusConfig struct {
+	Port      string        `yaml:"port"`
+	Disable   bool          `yaml:"disable"`
+	MaxSeries int           `yaml:"max_series"`
+	Relabel   []relabelRule `yaml:"relabel"`
+	Buckets   []string      `yaml:"rate_buckets"`
+	ReadRatio bool          `yaml:"read_ratio"`
+	Export    []string      `yaml:"export_estimators"`
+	Suffix    bool          `yaml:"estimator_suffix"`
+
+	// Pull only streams from the MGM when /metrics is scraped.
+	Pull            bool          `yaml:"pull"`
+	PullMinInterval time.Duration `yaml:"pull_min_interval"`
+	PullTimeout     time.Duration `yaml:"pull_timeout"`
+
+	// ProbeTargets are the MGMs /probe may connect to, none if empty.
+	ProbeTargets []string `yaml:"probe_targets"`
+}
+
+type apiConfig struct {
+	CacheMB uint `yaml:"cache_mb"`
+	History int  `yaml:"history"`
+}
+
+// webConfig describes how the HTTP endpoints are reached from outside.
+type webConfig struct {
+	ExternalURL string        `yaml:"external_url"`
+	RoutePrefix string        `yaml:"route_prefix"`
+	CORSOrigins []string      `yaml:"cors_origins"`
+	ReadyStale  time.Duration `yaml:"ready_stale_after"`
+	ConfigFile  string        `yaml:"config_file"`
+}
+
+// dashboardConfig controls the web dashboard served on the HTTP port.
+type dashboardConfig struct {
+	Disable   bool   `yaml:"disable"`
+	Estimator string `yaml:"estimator"`
+}
+
+// otlpConfig sets up the OpenTelemetry metrics sink.
+type otlpConfig struct {
+	Endpoint string        `yaml:"endpoint"`
+	Protocol string        `yaml:"protocol"`
+	Interval time.Duration `yaml:"interval"`
+	Cluster  string        `yaml:"cluster"`
+}
+
+// tracingConfig sets up the OpenTelemetry trace export.
+type tracingConfig struct {
+	Endpoint    string  `yaml:"endpoint"`
+	Protocol    string  `yaml:"protocol"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// influxConfig sets up the InfluxDB sink.
+type influxConfig struct {
+	URL           string        `yaml:"url"`
+	Version       int           `yaml:"version"`
+	Org           string        `yaml:"org"`
+	Bucket        string        `yaml:"bucket"`
+	Database      string        `yaml:"database"`
+	TokenFile     string        `yaml:"token_file"`
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+// graphiteConfig sets up the Graphite sink.
+type graphiteConfig struct {
+	Address   string `yaml:"address"`
+	Protocol  string `yaml:"protocol"`
+	Template  string `yaml:"template"`
+	BatchSize int    `yaml:"batch_size"`
+	Cluster   string `yaml:"cluster"`
+}
+
+// statsdConfig sets up the StatsD sink.
+type statsdConfig struct {
+	Address string   `yaml:"address"`
+	Flavor  string   `yaml:"flavor"`
+	Prefix  string   `yaml:"prefix"`
+	Tags    []string `yaml:"tags"`
+}
+
+// monitConfig sets up the MONIT sink.
+type monitConfig struct {
+	Broker          string `yaml:"broker"`
+	Destination     string `yaml:"destination"`
+	Producer        string `yaml:"producer"`
+	Type            string `yaml:"type"`
+	CredentialsFile string `yaml:"credentials_file"`
+	BatchSize       int    `yaml:"batch_size"`
+}
+
+// clickhouseConfig sets up the ClickHouse sink.
+type clickhouseConfig struct {
+	URL           string        `yaml:"url"`
+	Table         string        `yaml:"table"`
+	User          string        `yaml:"user"`
+	PasswordFile  string        `yaml:"password_file"`
+	CreateTable   bool          `yaml:"create_table"`
+	BatchSize     int           `yaml:"batch_size"`
+	MaxPending    int           `yaml:"max_pending"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	Block         time.Duration `yaml:"block"`
+}
+
+// sinksConfig controls the queues of the sinks, how long they may take to
+// accept a report and when a failing one is skipped.
+type sinksConfig struct {
+	Queue    int           `yaml:"queue"`
+	Overflow string        `yaml:"overflow"`
+	Timeout  time.Duration `yaml:"timeout"`
+	Failures int           `yaml:"failures"`
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// profilingConfig sets up continuous profiling of the monitor itself.
+type profilingConfig struct {
+	URL      string        `yaml:"url"`
+	Dir      string        `yaml:"dir"`
+	Interval time.Duration `yaml:"interval"`
+	Keep     int           `yaml:"keep"`
+	Debug    bool          `yaml:"debug"`
+	Listen   string        `yaml:"debug_listen"`
+}
+
+// storeConfig sets up the local store of the rate history.
+type storeConfig struct {
+	Dir             string        `yaml:"dir"`
+	Estimator       string        `yaml:"estimator"`
+	Interval        time.Duration `yaml:"interval"`
+	Retention       time.Duration `yaml:"retention"`
+	DownsampleAfter time.Duration `yaml:"downsample_after"`
+}
+
+// snapshotConfig sets up the snapshots of the latest report.
+type snapshotConfig struct {
+	Dir      string        `yaml:"dir"`
+	Interval time.Duration `yaml:"interval"`
+	Format   string        `yaml:"format"`
+	Keep     int           `yaml:"keep"`
+}
+
+type idleConfig struct {
+	ExitAfter time.Duration `yaml:"exit_after"`
+	Threshold string        `yaml:"threshold"`
+	Estimator string        `yaml:"estimator"`
+}
+
+// consoleConfig controls how the reports are drawn on the terminal.
+type consoleConfig struct {
+	Mode       string        `yaml:"mode"`
+	Refresh    time.Duration `yaml:"refresh_interval"`
+	NoColor    bool          `yaml:"no_color"`
+	NoTrends   bool          `yaml:"no_trends"`
+	WarnRate   string        `yaml:"warn_rate"`
+	CritRate   string        `yaml:"crit_rate"`
+	Sparklines time.Duration `yaml:"sparkline_window"`
+	Columns    []string      `yaml:"columns"`
+	Layout     string        `yaml:"layout"`
+	Sort       string        `yaml:"display_sort"`
+	SortExport bool          `yaml:"display_sort_export"`
+	Units      string        `yaml:"units"`
+	NoTotals   bool          `yaml:"no_totals"`
+	Format     string        `yaml:"format"`
+	FormatHead string        `yaml:"format_header"`
+	Watch      string        `yaml:"watch"`
+	Keys       keysConfig    `yaml:"keys"`
+	Export     exportConfig  `yaml:"export"`
+}
+
+// exportConfig controls the files the console view is exported to.
+type exportConfig struct {
+	Dir    string `yaml:"dir"`
+	Format string `yaml:"format"` // csv or json
+}
+
+// keysConfig holds the keys of the console actions, single characters.
+type keysConfig struct {
+	Search string `yaml:"search"`
+	Filter string `yaml:"filter"`
+	Clear  string `yaml:"clear"`
+	Export string `yaml:"export"`
+	Pause  string `yaml:"pause"`
+	Help   string `yaml:"help"`
+}
+
+// namesConfig controls the resolution of uids and gids to names.
+type namesConfig struct {
+	Resolve   bool `yaml:"resolve"`
+	Aggregate bool `yaml:"aggregate"`
+}
+
+// runConfig bounds the run of the monitor, e.g. for batch collection jobs.
+type runConfig struct {
+	Duration   time.Duration `yaml:"duration"`
+	MaxReports uint          `yaml:"max_reports"`
+}
+
+type instanceConfig struct {
+	Expected string `yaml:"expected"`
+	Header   string `yaml:"header"`
+	Mismatch string `yaml:"mismatch"`
+}
+
+// shapingConfig controls when an entity counts as being at its limit.
+type shapingConfig struct {
+	Estimator string  `yaml:"estimator"`
+	AtLimit   float64 `yaml:"at_limit"`
+}
+
+// baselineConfig sets up the time-of-day baselines.
+type baselineConfig struct {
+	State      string   `yaml:"state"`
+	Estimator  string   `yaml:"estimator"`
+	Entities   []string `yaml:"entities"`
+	MinSamples int      `yaml:"min_samples"`
+	Learn      []string `yaml:"learn"`
+}
+
+// checksConfig sets up the estimator cross-checks.
+type checksConfig struct {
+	Pairs     []string `yaml:"pairs"`
+	Tolerance float64  `yaml:"tolerance"`
+	MinRate   string   `yaml:"min_rate"`
+}
+
+// relayConfig sets up the gRPC server relaying the stream to subscribers.
+type relayConfig struct {
+	Listen string `yaml:"listen"`
+	Buffer int    `yaml:"buffer"`
+}
+
+// rollingConfig sets up the rolling aggregates, disabled without a window.
+type rollingConfig struct {
+	Window    time.Duration `yaml:"window"`
+	Estimator string        `yaml:"estimator"`
+}
+
+// anomalyConfig sets up the anomaly detection, disabled without a z-score.
+type anomalyConfig struct {
+	ZScore     float64       `yaml:"zscore"`
+	Estimator  string        `yaml:"estimator"`
+	Window     time.Duration `yaml:"window"`
+	MinSamples int           `yaml:"min_samples"`
+	MinRate    string        `yaml:"min_rate"`
+}
+
+// sustainedConfig sets up the sustained-load detection, disabled without a
+// rate.
+type sustainedConfig struct {
+	Rate      string `yaml:"rate"`
+	Estimator string `yaml:"estimator"`
+	Direction string `yaml:"direction"`
+	For       int    `yaml:"for"`
+	ClearFor  int    `yaml:"clear_for"`
+}
+
+// countersConfig sets up the byte counters integrated from the rates.
+type countersConfig struct {
+	Disable   bool          `yaml:"disable"`
+	Estimator string        `yaml:"estimator"`
+	MaxGap    time.Duration `yaml:"max_gap"`
+	Expiry    time.Duration `yaml:"expiry"`
+}
+
+// hittersConfig sets up the heavy hitters, disabled without windows.
+type hittersConfig struct {
+	Windows   []time.Duration `yaml:"windows"`
+	Estimator string          `yaml:"estimator"`
+	Direction string          `yaml:"direction"`
+	TopK      int             `yaml:"top_k"`
+	Capacity  int             `yaml:"capacity"`
+	Console   int             `yaml:"console"`
+}
+
+// loopsConfig controls the metrics of the MGM thread loop stats.
+type loopsConfig struct {
+	Window time.Duration `yaml:"window"`
+}
+
+// filterConfig restricts the entities shown and exported to Prometheus.
+type filterConfig struct {
+	Apps    []string `yaml:"apps"`
+	UIDs    []string `yaml:"uids"`
+	GIDs    []string `yaml:"gids"`
+	MinRate string   `yaml:"min_rate"`
+	Other   bool     `yaml:"other"`
+}
+
+type alertsConfig struct {
+	Rules string `yaml:"rules"`
+}
+
+func defaultConfig() config {
+	return config{
+		GRPC: grpcConfig{
+			Host:        "localhost",
+			Port:        "50051",
+			Compression: "none",
+			Proxy:       proxyFromEnvironment(),
+			DialTimeout: 30 * time.Second,
+			Retry: retryConfig{
+				InitialBackoff:    time.Second,
+				MaxBackoff:        30 * time.Second,
+				BackoffMultiplier: 2,
+			},
+		},
+		Auth: authConfig{
+			Method: "none",
+			Krb5:   krb5Config{Config: "/etc/krb5.conf"},
+		},
+		Prometheus: prometheusConfig{Port: "9987", Buckets: []string{"1K", "10K", "100K", "1M", "10M", "100M", "1G", "10G"}, PullTimeout: 10 * time.Second},
+		API:        apiConfig{CacheMB: 16, History: 60},
+		Web:        webConfig{ReadyStale: time.Minute},
+		Dashboard:  dashboardConfig{Estimator: "SMA_5_SECONDS"},
+		Relay:      relayConfig{Buffer: 16},
+		OTLP:       otlpConfig{Protocol: "grpc", Interval: 15 * time.Second},
+		Tracing:    tracingConfig{Protocol: "grpc", SampleRatio: 1},
+		Influx:     influxConfig{Version: 2, BatchSize: 5000, FlushInterval: 10 * time.Second},
+		StatsD:     statsdConfig{Flavor: "dogstatsd", Prefix: "eos."},
+		Monit:      monitConfig{Producer: "eos", Type: "traffic_shaping", BatchSize: 1000},
+		Profiling:  profilingConfig{Interval: time.Minute, Keep: 60},
+		ClickHouse: clickhouseConfig{
+			Table:         "eos_io",
+			BatchSize:     100000,
+			MaxPending:    10,
+			FlushInterval: 10 * time.Second,
+			Block:         2 * time.Second,
+		},
+		Graphite: graphiteConfig{
+			Protocol:  "plaintext",
+			Template:  "eos.{cluster}.io.{entity_type}.{id}.{estimator}.{direction}",
+			BatchSize: 500,
+		},
+		Request: requestConfig{
+			TopN: 1000,
+			Estimators: []string{
+				"EMA_1_SECONDS", "EMA_5_SECONDS",
+				"SMA_1_SECONDS", "SMA_5_SECONDS",
+				"SMA_1_MINUTES", "SMA_5_MINUTES",
+			},
+			SortBy: "SMA_1_MINUTES",
+		},
+		Store: storeConfig{
+			Estimator:       "SMA_1_MINUTES",
+			Interval:        time.Minute,
+			Retention:       90 * 24 * time.Hour,
+			DownsampleAfter: 7 * 24 * time.Hour,
+		},
+		Snapshot: snapshotConfig{Format: "json", Keep: 100},
+		Idle:     idleConfig{Threshold: "1MB/s", Estimator: "SMA_5_SECONDS"},
+		Instance: instanceConfig{Mismatch: "warn"},
+		Shaping:  shapingConfig{Estimator: "SMA_5_SECONDS", AtLimit: 0.95},
+		Baseline: baselineConfig{Estimator: "SMA_1_MINUTES", MinSamples: 600},
+		Checks:   checksConfig{Tolerance: 0.2, MinRate: "1MB/s"},
+		Rolling:  rollingConfig{Estimator: "SMA_1_SECONDS"},
+		Anomaly:  anomalyConfig{Estimator: "SMA_1_MINUTES", Window: time.Hour, MinSamples: 60, MinRate: "10MB/s"},
+		Sustained: sustainedConfig{
+			Estimator: "SMA_5_SECONDS",
+			Direction: "total",
+			For:       30,
+			ClearFor:  30,
+		},
+		Counters: countersConfig{Estimator: "SMA_1_SECONDS", MaxGap: 10 * time.Second, Expiry: 15 * time.Minute},
+		Hitters:  hittersConfig{Estimator: "SMA_1_SECONDS", Direction: "total", TopK: 10, Capacity: 1000, Console: 5},
+		Loops:    loopsConfig{Window: 5 * time.Minute},
+		Sinks:    sinksConfig{Queue: 16, Overflow: "drop-oldest", Timeout: 10 * time.Second, Failures: 5, Cooldown: time.Minute},
+		Console: consoleConfig{
+			Mode:       "clear",
+			WarnRate:   "100MB/s",
+			CritRate:   "1GB/s",
+			Sparklines: 5 * time.Minute,
+			Columns:    []string{"name", "estimator", "read", "write", "trend"},
+			Layout:     "rows",
+			Units:      "bytes",
+			Keys:       keysConfig{Search: "/", Filter: "f", Clear: "c", Export: "e", Pause: "p", Help: "?"},
+			Export:     exportConfig{Dir: ".", Format: "csv"},
+		},
+	}
+}
+
+// registerFlags binds the monitor flags directly to the fields of cfg, so
+// parsing the command line after loading the config file makes explicit
+// flags win over the file.
+func registerFlags(fs *flag.FlagSet, cfg *config) {
+	fs.StringVar(&cfg.GRPC.Host, "grpc-host", cfg.GRPC.Host, "EOS MGM gRPC Host")
+	fs.StringVar(&cfg.GRPC.Port, "grpc-port", cfg.GRPC.Port, "EOS MGM gRPC Port")
+	fs.StringVar(&cfg.Prometheus.Port, "prometheus-port", cfg.Prometheus.Port, "Prometheus HTTP Port")
+	fs.BoolVar(&cfg.Prometheus.Disable, "disable-prometheus", cfg.Prometheus.Disable, "Disable Prometheus metrics endpoint")
+	fs.BoolVar(&cfg.Prometheus.ReadRatio, "prometheus-read-ratio", cfg.Prometheus.ReadRatio, "Also export the read share of every rate series as eos_io_read_ratio")
+	fs.Var((*stringList)(&cfg.Prometheus.Export), "export-estimators", "Comma separated estimators, among -estimators, whose rates are exported to Prometheus (empty for all)")
+	fs.BoolVar(&cfg.Prometheus.Suffix, "prometheus-estimator-suffix", cfg.Prometheus.Suffix, "Name the per-entity rate metrics after the estimator, e.g. eos_io_read_bytes_per_second_sma1m, instead of labeling them with it")
+	fs.IntVar(&cfg.Prometheus.MaxSeries, "prometheus-max-series", cfg.Prometheus.MaxSeries, "Export at most this many per-entity rate series, folding the rest into overflow series (0 for no limit)")
+	fs.Var((*stringList)(&cfg.Prometheus.Buckets), "prometheus-rate-buckets", "Comma separated bucket bounds of the per-entity rate histograms, e.g. 1M,100M (empty to disable them)")
+	fs.BoolVar(&cfg.Prometheus.Pull, "prometheus-pull", cfg.Prometheus.Pull, "Only stream from the MGM when /metrics is scraped, taking one report per scrape")
+	fs.DurationVar(&cfg.Prometheus.PullMinInterval, "prometheus-pull-min-interval", cfg.Prometheus.PullMinInterval, "In pull mode, serve scrapes within this long of the last pull the metrics of that pull")
+	fs.DurationVar(&cfg.Prometheus.PullTimeout, "prometheus-pull-timeout", cfg.Prometheus.PullTimeout, "In pull mode and on /probe, time to wait for a report when the scrape doesn't tell its timeout")
+	fs.Var((*stringList)(&cfg.Prometheus.ProbeTargets), "prometheus-probe-targets", "Comma separated host:port patterns (exact, glob or ~regex) of the MGMs /probe?target= may connect to (empty to disable /probe)")
+	fs.UintVar(&cfg.API.CacheMB, "api-cache-mb", cfg.API.CacheMB, "Memory for cached /api responses in MB")
+	fs.IntVar(&cfg.API.History, "api-history", cfg.API.History, "Reports kept in memory for /api/v1/reports and /api/v1/top")
+	fs.StringVar(&cfg.Web.ExternalURL, "web-external-url", cfg.Web.ExternalURL, "URL under which the HTTP endpoints are reachable, e.g. behind a reverse proxy")
+	fs.StringVar(&cfg.Web.RoutePrefix, "web-route-prefix", cfg.Web.RoutePrefix, "Path prefix of the HTTP endpoints (default: path of -web-external-url)")
+	fs.Var((*stringList)(&cfg.Web.CORSOrigins), "web-cors-origins", "Comma separated origins allowed to query the HTTP endpoints from browsers (* for any)")
+	fs.DurationVar(&cfg.Web.ReadyStale, "ready-stale-after", cfg.Web.ReadyStale, "/readyz fails when no report was received for this long")
+	fs.StringVar(&cfg.Web.ConfigFile, "web-config-file", cfg.Web.ConfigFile, "Web config file (Prometheus exporter format) enabling TLS, client certificates and basic auth on the HTTP endpoints")
+	fs.BoolVar(&cfg.Dashboard.Disable, "disable-dashboard", cfg.Dashboard.Disable, "Don't serve the web dashboard on /dashboard/")
+	fs.StringVar(&cfg.Dashboard.Estimator, "dashboard-estimator", cfg.Dashboard.Estimator, "Estimator shown on the web dashboard")
+	fs.StringVar(&cfg.Relay.Listen, "relay-listen", cfg.Relay.Listen, "Serve the TrafficShapingRate gRPC API on this address, relaying the MGM stream to subscribers")
+	fs.IntVar(&cfg.Relay.Buffer, "relay-buffer", cfg.Relay.Buffer, "Reports a relay subscriber may fall behind before it is disconnected")
+	fs.StringVar(&cfg.OTLP.Endpoint, "otlp-endpoint", cfg.OTLP.Endpoint, "Export the rates to this OpenTelemetry collector URL, e.g. http://collector:4317")
+	fs.StringVar(&cfg.OTLP.Protocol, "otlp-protocol", cfg.OTLP.Protocol, "OTLP protocol (grpc or http)")
+	fs.DurationVar(&cfg.OTLP.Interval, "otlp-interval", cfg.OTLP.Interval, "Interval between OTLP exports")
+	fs.StringVar(&cfg.OTLP.Cluster, "otlp-cluster", cfg.OTLP.Cluster, "eos.cluster resource attribute of the OTLP metrics (default: -expected-instance)")
+	fs.StringVar(&cfg.Tracing.Endpoint, "tracing-endpoint", cfg.Tracing.Endpoint, "Export traces of the stream lifecycle to this OpenTelemetry collector URL, e.g. http://collector:4317")
+	fs.StringVar(&cfg.Tracing.Protocol, "tracing-protocol", cfg.Tracing.Protocol, "OTLP protocol of the traces (grpc or http)")
+	fs.Float64Var(&cfg.Tracing.SampleRatio, "tracing-sample-ratio", cfg.Tracing.SampleRatio, "Fraction of the reports traced, between 0 and 1")
+	fs.StringVar(&cfg.Influx.URL, "influx-url", cfg.Influx.URL, "Write the rates to the InfluxDB at this URL, e.g. http://influxdb:8086")
+	fs.IntVar(&cfg.Influx.Version, "influx-version", cfg.Influx.Version, "InfluxDB API version (1 or 2)")
+	fs.StringVar(&cfg.Influx.Org, "influx-org", cfg.Influx.Org, "InfluxDB 2 organization")
+	fs.StringVar(&cfg.Influx.Bucket, "influx-bucket", cfg.Influx.Bucket, "InfluxDB 2 bucket")
+	fs.StringVar(&cfg.Influx.Database, "influx-database", cfg.Influx.Database, "InfluxDB 1.x database")
+	fs.StringVar(&cfg.Influx.TokenFile, "influx-token-file", cfg.Influx.TokenFile, "File containing the InfluxDB token (user:password for 1.x)")
+	fs.IntVar(&cfg.Influx.BatchSize, "influx-batch-size", cfg.Influx.BatchSize, "Maximum points per InfluxDB write")
+	fs.DurationVar(&cfg.Influx.FlushInterval, "influx-flush-interval", cfg.Influx.FlushInterval, "Interval between InfluxDB writes")
+	fs.StringVar(&cfg.Graphite.Address, "graphite-address", cfg.Graphite.Address, "Send the rates to the Carbon daemon at this host:port")
+	fs.StringVar(&cfg.Graphite.Protocol, "graphite-protocol", cfg.Graphite.Protocol, "Graphite protocol (plaintext or pickle)")
+	fs.StringVar(&cfg.Graphite.Template, "graphite-template", cfg.Graphite.Template, "Graphite metric path template")
+	fs.IntVar(&cfg.Graphite.BatchSize, "graphite-batch-size", cfg.Graphite.BatchSize, "Maximum datapoints per Graphite write")
+	fs.StringVar(&cfg.Graphite.Cluster, "graphite-cluster", cfg.Graphite.Cluster, "Value of {cluster} in the Graphite template (default: -expected-instance)")
+	fs.StringVar(&cfg.StatsD.Address, "statsd-address", cfg.StatsD.Address, "Emit the rates as StatsD gauges to this udp://host:port or unix:///path")
+	fs.StringVar(&cfg.StatsD.Flavor, "statsd-flavor", cfg.StatsD.Flavor, "StatsD flavor (statsd or dogstatsd)")
+	fs.StringVar(&cfg.StatsD.Prefix, "statsd-prefix", cfg.StatsD.Prefix, "Prefix of the StatsD metric names")
+	fs.Var((*stringList)(&cfg.StatsD.Tags), "statsd-tags", "Comma separated key:value tags added to every DogStatsD gauge")
+	fs.StringVar(&cfg.Monit.Broker, "monit-broker", cfg.Monit.Broker, "Send the rates to MONIT through the ActiveMQ broker at this stomp:// or stomp+ssl:// URL")
+	fs.StringVar(&cfg.Monit.Destination, "monit-destination", cfg.Monit.Destination, "STOMP destination of the MONIT documents, e.g. /topic/eos")
+	fs.StringVar(&cfg.Monit.Producer, "monit-producer", cfg.Monit.Producer, "MONIT producer of the documents")
+	fs.StringVar(&cfg.Monit.Type, "monit-type", cfg.Monit.Type, "MONIT type of the documents")
+	fs.StringVar(&cfg.Monit.CredentialsFile, "monit-credentials-file", cfg.Monit.CredentialsFile, "File containing the broker login:passcode")
+	fs.IntVar(&cfg.Monit.BatchSize, "monit-batch-size", cfg.Monit.BatchSize, "Maximum documents per MONIT message")
+	fs.StringVar(&cfg.ClickHouse.URL, "clickhouse-url", cfg.ClickHouse.URL, "Insert the rates into ClickHouse through its HTTP interface at this URL, e.g. http://clickhouse:8123")
+	fs.StringVar(&cfg.ClickHouse.Table, "clickhouse-table", cfg.ClickHouse.Table, "ClickHouse table ([database.]name) to insert into")
+	fs.StringVar(&cfg.ClickHouse.User, "clickhouse-user", cfg.ClickHouse.User, "ClickHouse user")
+	fs.StringVar(&cfg.ClickHouse.PasswordFile, "clickhouse-password-file", cfg.ClickHouse.PasswordFile, "File containing the ClickHouse password")
+	fs.BoolVar(&cfg.ClickHouse.CreateTable, "clickhouse-create-table", cfg.ClickHouse.CreateTable, "Create the ClickHouse table if it doesn't exist")
+	fs.IntVar(&cfg.ClickHouse.BatchSize, "clickhouse-batch-size", cfg.ClickHouse.BatchSize, "Maximum rows per ClickHouse insert")
+	fs.IntVar(&cfg.ClickHouse.MaxPending, "clickhouse-max-pending", cfg.ClickHouse.MaxPending, "Batches waiting to be inserted before the monitor is slowed down")
+	fs.DurationVar(&cfg.ClickHouse.FlushInterval, "clickhouse-flush-interval", cfg.ClickHouse.FlushInterval, "Interval between ClickHouse inserts")
+	fs.DurationVar(&cfg.ClickHouse.Block, "clickhouse-block", cfg.ClickHouse.Block, "How long to hold up the stream for ClickHouse to catch up before dropping a full batch (less than -sink-timeout)")
+	fs.IntVar(&cfg.Sinks.Queue, "sink-queue", cfg.Sinks.Queue, "Reports queued per sink so slow sinks don't hold up the stream (0 to send synchronously)")
+	fs.StringVar(&cfg.Sinks.Overflow, "sink-overflow", cfg.Sinks.Overflow, "What to do when a sink queue is full: drop-oldest or block")
+	fs.DurationVar(&cfg.Sinks.Timeout, "sink-timeout", cfg.Sinks.Timeout, "Time a sink may take to accept a report before it counts as failed")
+	fs.IntVar(&cfg.Sinks.Failures, "sink-failures", cfg.Sinks.Failures, "Consecutive failures after which a sink is skipped for -sink-cooldown")
+	fs.DurationVar(&cfg.Sinks.Cooldown, "sink-cooldown", cfg.Sinks.Cooldown, "Time a failing sink is skipped before trying it again")
+	fs.StringVar(&cfg.Profiling.URL, "profiling-url", cfg.Profiling.URL, "Push CPU and heap profiles of the monitor to this Pyroscope server")
+	fs.StringVar(&cfg.Profiling.Dir, "profiling-dir", cfg.Profiling.Dir, "Write CPU and heap profiles of the monitor to this directory")
+	fs.DurationVar(&cfg.Profiling.Interval, "profiling-interval", cfg.Profiling.Interval, "Period covered by each profile")
+	fs.IntVar(&cfg.Profiling.Keep, "profiling-keep", cfg.Profiling.Keep, "Profiles of each kind kept in -profiling-dir")
+	fs.BoolVar(&cfg.Profiling.Debug, "debug-endpoints", cfg.Profiling.Debug, "Serve /debug/pprof and /debug/vars on the metrics endpoint")
+	fs.StringVar(&cfg.Profiling.Listen, "debug-listen", cfg.Profiling.Listen, "Serve /debug/pprof and /debug/vars on this address instead, e.g. localhost:6060")
+	fs.UintVar(&cfg.Request.TopN, "top-n", cfg.Request.TopN, "Top N entries to request")
+	fs.Var((*stringList)(&cfg.Request.Estimators), "estimators", "Comma separated estimators to request")
+	fs.StringVar(&cfg.Request.SortBy, "sort-by", cfg.Request.SortBy, "Estimator the MGM sorts the top N entries by")
+	fs.Var(&cfg.AppNames, "app-name-rule", "Rewrite the app names matching REGEX=REPLACEMENT (may be repeated), merging their rates")
+	fs.Var((*stringList)(&cfg.Filter.Apps), "filter-app", "Comma separated app patterns (exact, glob or ~regex, ! to exclude) shown and exported")
+	fs.Var((*stringList)(&cfg.Filter.UIDs), "filter-uid", "Comma separated uid patterns (exact, range, glob or ~regex, ! to exclude) shown and exported")
+	fs.Var((*stringList)(&cfg.Filter.GIDs), "filter-gid", "Comma separated gid patterns (exact, range, glob or ~regex, ! to exclude) shown and exported")
+	fs.StringVar(&cfg.Filter.MinRate, "min-rate", cfg.Filter.MinRate, "Filter out the entities whose total rate on the sort estimator is below this, e.g. 1MB/s")
+	fs.BoolVar(&cfg.Filter.Other, "filter-other", cfg.Filter.Other, "Sum the rates of the filtered out entities into an \"other\" row")
+	fs.StringVar(&cfg.GRPC.Compression, "grpc-compression", cfg.GRPC.Compression, "Compression for the gRPC stream (gzip or none)")
+	fs.DurationVar(&cfg.GRPC.DialTimeout, "dial-timeout", cfg.GRPC.DialTimeout, "Maximum time to wait for the MGM connection at startup (0 waits forever)")
+	fs.DurationVar(&cfg.GRPC.StreamDeadline, "stream-deadline", cfg.GRPC.StreamDeadline, "Fail if the stream is still open after this long (0 disables)")
+	fs.StringVar(&cfg.GRPC.ServiceConfig, "grpc-service-config", cfg.GRPC.ServiceConfig, "gRPC service config of the MGM connection, as JSON or the file containing it, e.g. for retry or hedging policies")
+	fs.IntVar(&cfg.GRPC.Retry.MaxAttempts, "grpc-retry-max-attempts", cfg.GRPC.Retry.MaxAttempts, "Attempts to open the stream when the MGM is UNAVAILABLE, at most 5 (0 or 1 disables retries)")
+	fs.DurationVar(&cfg.GRPC.Retry.InitialBackoff, "grpc-retry-initial-backoff", cfg.GRPC.Retry.InitialBackoff, "Backoff before the first retry, randomized by gRPC")
+	fs.DurationVar(&cfg.GRPC.Retry.MaxBackoff, "grpc-retry-max-backoff", cfg.GRPC.Retry.MaxBackoff, "Upper bound of the backoff between retries")
+	fs.Float64Var(&cfg.GRPC.Retry.BackoffMultiplier, "grpc-retry-backoff-multiplier", cfg.GRPC.Retry.BackoffMultiplier, "Factor the backoff grows by after every retry")
+	fs.StringVar(&cfg.GRPC.Proxy, "grpc-proxy", cfg.GRPC.Proxy, "Dial the MGM through this socks5:// or http:// proxy (defaults to a socks5 HTTPS_PROXY)")
+	fs.StringVar(&cfg.Auth.Method, "auth", cfg.Auth.Method, "Authentication towards the MGM (none, krb5 or token)")
+	fs.StringVar(&cfg.Auth.Krb5.Config, "krb5-config", cfg.Auth.Krb5.Config, "Kerberos configuration file")
+	fs.StringVar(&cfg.Auth.Krb5.Keytab, "krb5-keytab", cfg.Auth.Krb5.Keytab, "Keytab to authenticate with (default: use the credential cache)")
+	fs.StringVar(&cfg.Auth.Krb5.Principal, "krb5-principal", cfg.Auth.Krb5.Principal, "user@REALM principal to use with -krb5-keytab")
+	fs.StringVar(&cfg.Auth.Krb5.CCache, "krb5-ccache", cfg.Auth.Krb5.CCache, "Kerberos credential cache (default: $KRB5CCNAME or /tmp/krb5cc_<uid>)")
+	fs.StringVar(&cfg.Auth.Krb5.SPN, "krb5-spn", cfg.Auth.Krb5.SPN, "Service principal of the MGM (default: host/<grpc-host>)")
+	fs.StringVar(&cfg.Auth.Token.File, "token-file", cfg.Auth.Token.File, "Bearer token file for -auth=token (default: WLCG token discovery)")
+	fs.StringVar(&cfg.Auth.Token.OIDCTokenURL, "oidc-token-url", cfg.Auth.Token.OIDCTokenURL, "Obtain bearer tokens from this OAuth2 token endpoint (client credentials grant)")
+	fs.StringVar(&cfg.Auth.Token.ClientID, "oidc-client-id", cfg.Auth.Token.ClientID, "OAuth2 client ID")
+	fs.StringVar(&cfg.Auth.Token.ClientSecretFile, "oidc-client-secret-file", cfg.Auth.Token.ClientSecretFile, "File containing the OAuth2 client secret")
+	fs.StringVar(&cfg.Auth.Token.Scope, "oidc-scope", cfg.Auth.Token.Scope, "Space separated OAuth2 scopes to request")
+	fs.StringVar(&cfg.Auth.Token.Audience, "oidc-audience", cfg.Auth.Token.Audience, "OAuth2 audience to request")
+	fs.StringVar(&cfg.Record, "record", cfg.Record, "Record received reports to this file (.pb, .jsonl or .parquet, optionally .gz)")
+	fs.StringVar(&cfg.Snapshot.Dir, "snapshot-dir", cfg.Snapshot.Dir, "Dump the latest report to a timestamped file of this directory on SIGUSR1")
+	fs.DurationVar(&cfg.Snapshot.Interval, "snapshot-interval", cfg.Snapshot.Interval, "Also write the top consumers shown to -snapshot-dir at this interval")
+	fs.StringVar(&cfg.Snapshot.Format, "snapshot-format", cfg.Snapshot.Format, "Format of the periodic snapshots (json or csv)")
+	fs.IntVar(&cfg.Snapshot.Keep, "snapshot-keep", cfg.Snapshot.Keep, "Number of periodic snapshots kept")
+	fs.StringVar(&cfg.Store.Dir, "store-dir", cfg.Store.Dir, "Keep the history of the per-entity rates in this directory for the query subcommand")
+	fs.StringVar(&cfg.Store.Estimator, "store-estimator", cfg.Store.Estimator, "Estimator whose rates are stored")
+	fs.DurationVar(&cfg.Store.Interval, "store-interval", cfg.Store.Interval, "Interval between stored samples")
+	fs.DurationVar(&cfg.Store.Retention, "store-retention", cfg.Store.Retention, "Remove stored days older than this")
+	fs.DurationVar(&cfg.Store.DownsampleAfter, "store-downsample-after", cfg.Store.DownsampleAfter, "Average stored days older than this over 10 minutes")
+	fs.DurationVar(&cfg.Idle.ExitAfter, "exit-when-idle", cfg.Idle.ExitAfter, fmt.Sprintf("Exit with code %d once all entities stayed below -idle-threshold for this long (0 disables)", exitIdle))
+	fs.StringVar(&cfg.Idle.Threshold, "idle-threshold", cfg.Idle.Threshold, "Read and write rate below which an entity counts as idle")
+	fs.StringVar(&cfg.Idle.Estimator, "idle-estimator", cfg.Idle.Estimator, "Estimator compared against -idle-threshold")
+	fs.StringVar(&cfg.Console.Mode, "console-mode", cfg.Console.Mode, "clear to redraw the tables on every report, or append to print a summary line per report")
+	fs.StringVar(&cfg.Console.Format, "format", cfg.Console.Format, "Go text/template printed per entity shown instead of the console tables, e.g. '{{.Type}} {{.ID}} {{.Read}} {{.Write}}'")
+	fs.StringVar(&cfg.Console.Watch, "watch", cfg.Console.Watch, "Follow this type:id entity full screen instead of showing the console tables, e.g. user:12345")
+	fs.StringVar(&cfg.Console.Export.Dir, "export-dir", cfg.Console.Export.Dir, "Directory the export key of the console writes the rows on screen to")
+	fs.StringVar(&cfg.Console.Export.Format, "export-format", cfg.Console.Export.Format, "Format of the console exports: csv or json")
+	fs.StringVar(&cfg.Console.FormatHead, "format-header", cfg.Console.FormatHead, "Go text/template printed per report before the -format lines")
+	fs.DurationVar(&cfg.Console.Refresh, "refresh-interval", cfg.Console.Refresh, "Redraw the console at most this often, showing the latest report (0 to redraw on every report)")
+	fs.Var((*stringList)(&cfg.Console.Columns), "columns", "Comma separated columns of the console tables: name, estimator, read, write, total, ratio, trend")
+	fs.StringVar(&cfg.Console.Layout, "layout", cfg.Console.Layout, "rows for a line per entity and estimator, or pivot for a line per entity with the estimators as columns")
+	fs.StringVar(&cfg.Console.Sort, "display-sort", cfg.Console.Sort, "Sort the console tables by the read, write or total rate on the sort estimator, or by id (default: the MGM's order)")
+	fs.BoolVar(&cfg.Console.SortExport, "display-sort-export", cfg.Console.SortExport, "Also pass the reports sorted by -display-sort to the API, stream and sinks")
+	fs.StringVar(&cfg.Console.Units, "units", cfg.Console.Units, "Units the rates are printed in: bytes, iec (MiB), si (MB), bits (Mb), or a fixed unit such as GB, GiB or Gb")
+	fs.BoolVar(&cfg.Console.NoColor, "no-color", cfg.Console.NoColor, "Don't color the console tables (also set by the NO_COLOR environment variable)")
+	fs.BoolVar(&cfg.Console.NoTrends, "no-trends", cfg.Console.NoTrends, "Don't show the change of the rates since the previous report on the console")
+	fs.BoolVar(&cfg.Console.NoTotals, "no-totals", cfg.Console.NoTotals, "Don't show the TOTAL rows of the console tables")
+	fs.DurationVar(&cfg.Console.Sparklines, "sparkline-window", cfg.Console.Sparklines, "History of the cluster rates drawn as sparklines at the top of the console (0 to hide them)")
+	fs.StringVar(&cfg.Console.WarnRate, "color-warn-rate", cfg.Console.WarnRate, "Rate from which console rows are shown in yellow")
+	fs.StringVar(&cfg.Console.CritRate, "color-crit-rate", cfg.Console.CritRate, "Rate from which console rows are shown in red")
+	fs.BoolVar(&cfg.Names.Resolve, "resolve-names", cfg.Names.Resolve, "Show the user and group names of uids and gids")
+	fs.BoolVar(&cfg.Names.Aggregate, "aggregate-by-name", cfg.Names.Aggregate, "Merge uids (gids) resolving to the same user (group) name, summing their rates in display and metrics")
+	fs.DurationVar(&cfg.Run.Duration, "duration", cfg.Run.Duration, "Stop cleanly after running for this long (0 runs until interrupted)")
+	fs.UintVar(&cfg.Run.MaxReports, "max-reports", cfg.Run.MaxReports, "Stop cleanly after this many reports (0 for no limit)")
+	fs.StringVar(&cfg.Instance.Expected, "expected-instance", cfg.Instance.Expected, "Verify the MGM belongs to this EOS instance before monitoring it")
+	fs.StringVar(&cfg.Instance.Header, "instance-header", cfg.Instance.Header, "Response header carrying the instance, set e.g. by a proxy in front of the MGM (required with -expected-instance)")
+	fs.StringVar(&cfg.Instance.Mismatch, "instance-mismatch", cfg.Instance.Mismatch, "What to do if the instance differs from -expected-instance (refuse or warn)")
+	fs.StringVar(&cfg.Alerts.Rules, "alert-rules", cfg.Alerts.Rules, "YAML file with alert rules evaluated on every report")
+	fs.StringVar(&cfg.SLOs, "slos", cfg.SLOs, "YAML file with sustained-rate SLOs whose compliance is exported")
+	fs.StringVar(&cfg.Baseline.State, "baseline-state", cfg.Baseline.State, "Learn time-of-day baselines and keep them in this file")
+	fs.StringVar(&cfg.Baseline.Estimator, "baseline-estimator", cfg.Baseline.Estimator, "Estimator the baselines are learned on")
+	fs.Var((*stringList)(&cfg.Baseline.Entities), "baseline-entities", "Comma separated type:id entities to learn baselines for besides the aggregate, e.g. app:rucio,group:2000")
+	fs.IntVar(&cfg.Baseline.MinSamples, "baseline-min-samples", cfg.Baseline.MinSamples, "Reports an hour of the day needs before its baseline is exported")
+	fs.Var((*stringList)(&cfg.Baseline.Learn), "baseline-learn", "Comma separated recordings to learn from when the baseline state file doesn't exist yet")
+	fs.Var((*stringList)(&cfg.Checks.Pairs), "estimator-checks", "Comma separated ESTIMATOR:ESTIMATOR pairs to cross-check, e.g. SMA_1_SECONDS:EMA_1_SECONDS,SMA_1_MINUTES:SMA_1_SECONDS")
+	fs.Float64Var(&cfg.Checks.Tolerance, "estimator-check-tolerance", cfg.Checks.Tolerance, "Relative difference from which cross-checked estimators diverge")
+	fs.StringVar(&cfg.Checks.MinRate, "estimator-check-min-rate", cfg.Checks.MinRate, "Rate below which cross-checked estimators are not compared")
+	fs.DurationVar(&cfg.Rolling.Window, "rolling-window", cfg.Rolling.Window, "Export the max, mean and p95 of every entity over this window of reports")
+	fs.StringVar(&cfg.Rolling.Estimator, "rolling-estimator", cfg.Rolling.Estimator, "Estimator whose rates are aggregated over the rolling window")
+	fs.Float64Var(&cfg.Anomaly.ZScore, "anomaly-zscore", cfg.Anomaly.ZScore, "Flag the entities whose rate is this many standard deviations away from their rolling mean")
+	fs.StringVar(&cfg.Anomaly.Estimator, "anomaly-estimator", cfg.Anomaly.Estimator, "Estimator whose rates are checked for anomalies")
+	fs.DurationVar(&cfg.Anomaly.Window, "anomaly-window", cfg.Anomaly.Window, "Time constant of the rolling mean and standard deviation of the anomaly detection")
+	fs.IntVar(&cfg.Anomaly.MinSamples, "anomaly-min-samples", cfg.Anomaly.MinSamples, "Reports an entity needs before it can be flagged as anomalous")
+	fs.StringVar(&cfg.Anomaly.MinRate, "anomaly-min-rate", cfg.Anomaly.MinRate, "Don't flag entities below this rate, now and on average")
+	fs.StringVar(&cfg.Sustained.Rate, "sustained-rate", cfg.Sustained.Rate, "Flag the entities whose rate stays at or above this rate, e.g. 1GB/s")
+	fs.StringVar(&cfg.Sustained.Estimator, "sustained-estimator", cfg.Sustained.Estimator, "Estimator whose rates are checked against -sustained-rate")
+	fs.StringVar(&cfg.Sustained.Direction, "sustained-direction", cfg.Sustained.Direction, "Rate checked against -sustained-rate (read, write or total)")
+	fs.IntVar(&cfg.Sustained.For, "sustained-for", cfg.Sustained.For, "Consecutive reports at or above -sustained-rate that start a violation")
+	fs.IntVar(&cfg.Sustained.ClearFor, "sustained-clear-for", cfg.Sustained.ClearFor, "Consecutive reports below -sustained-rate that clear a violation")
+	fs.BoolVar(&cfg.Counters.Disable, "disable-byte-counters", cfg.Counters.Disable, "Don't export the eos_io_*_bytes_total counters integrated from the rates")
+	fs.StringVar(&cfg.Counters.Estimator, "byte-counter-estimator", cfg.Counters.Estimator, "Estimator whose rates are integrated into the byte counters")
+	fs.DurationVar(&cfg.Counters.MaxGap, "byte-counter-max-gap", cfg.Counters.MaxGap, "Intervals between reports longer than this are not integrated into the byte counters")
+	fs.DurationVar(&cfg.Counters.Expiry, "byte-counter-expiry", cfg.Counters.Expiry, "Delete the byte counters of entities missing from the reports for this long")
+	fs.Var((*durationList)(&cfg.Hitters.Windows), "heavy-hitter-windows", "Comma separated windows over which the entities that moved the most bytes are tracked, e.g. 1h,24h")
+	fs.StringVar(&cfg.Hitters.Estimator, "heavy-hitter-estimator", cfg.Hitters.Estimator, "Estimator whose rates are integrated into the bytes of the heavy hitters")
+	fs.StringVar(&cfg.Hitters.Direction, "heavy-hitter-direction", cfg.Hitters.Direction, "Bytes the heavy hitters are ranked by: read, write or total")
+	fs.IntVar(&cfg.Hitters.TopK, "heavy-hitter-top-k", cfg.Hitters.TopK, "Heavy hitters exported per window and entity type")
+	fs.IntVar(&cfg.Hitters.Capacity, "heavy-hitter-capacity", cfg.Hitters.Capacity, "Entities counted per entity type and twelfth of a window; more makes the counts of the heavy hitters more accurate")
+	fs.IntVar(&cfg.Hitters.Console, "heavy-hitter-console", cfg.Hitters.Console, "Heavy hitters shown on the console per window and entity type (0 for none)")
+	fs.DurationVar(&cfg.Loops.Window, "thread-loop-window", cfg.Loops.Window, "Window over which eos_io_thread_loop_max_seconds keeps the longest thread loop")
+	fs.StringVar(&cfg.FairShare, "fair-share", cfg.FairShare, "YAML file with group share weights to compare actual throughput shares against")
+	fs.StringVar(&cfg.Groups, "groups", cfg.Groups, "YAML file mapping uids, gids and apps to named groups whose rates are aggregated")
+	fs.StringVar(&cfg.Limits, "limits", cfg.Limits, "YAML file with the configured traffic-shaping limits, to export utilization metrics")
+	fs.StringVar(&cfg.Shaping.Estimator, "shaping-estimator", cfg.Shaping.Estimator, "Estimator compared against the limits to tell whether an entity is at its limit")
+	fs.Float64Var(&cfg.Shaping.AtLimit, "at-limit-ratio", cfg.Shaping.AtLimit, "Utilization from which an entity counts as at its limit")
+}
+
+// stringList is a comma separated list flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// durationList is a comma separated list of durations flag.
+type durationList []time.Duration
+
+func (l *durationList) String() string {
+	s := make([]string, len(*l))
+	for i, d := range *l {
+		s[i] = d.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *durationList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*l = append(*l, d)
+	}
+	return nil
+}
+
+// --- Strict YAML decoding ---
+
+// loadYAML decodes a YAML file into out, which must be a pointer to a struct
+// with yaml tags. Unlike yaml.Unmarshal it rejects unknown keys and values of
+// the wrong type, reporting every problem with its key path, e.g.
+//
+//	config.yaml: grpc.dial_timeout: expected duration (e.g. 30s), got "soon"
+//	config.yaml: estimatros: unknown key (did you mean "estimators"?)
+//
+// Keys absent from the file keep the value they already have in out.
+func loadYAML(path string, out any) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return decodeYAMLFile(path, b, out)
+}
+
+func decodeYAMLFile(path string, b []byte, out any) error {
+	var doc any
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	var errs []error
+	decodeYAML(doc, reflect.ValueOf(out).Elem(), "", &errs)
+	for i, err := range errs {
+		errs[i] = fmt.Errorf("%s: %w", path, err)
+	}
+	return errors.Join(errs...)
+}
+
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+func decodeYAML(node any, v reflect.Value, path string, errs *[]error) {
+	if node == nil {
+		return
+	}
+	fail := func(expected string) {
+		*errs = append(*errs, fmt.Errorf("%s: expected %s, got %s", displayPath(path), expected, describeYAML(node)))
+	}
+
+	if reflect.PointerTo(v.Type()).Implements(textUnmarshalerType) {
+		if !isScalar(node) {
+			fail("a scalar value")
+			return
+		}
+		if err := v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(fmt.Sprint(node))); err != nil {
+			*errs = append(*errs, fmt.Errorf("%s: %w", displayPath(path), err))
+		}
+		return
+	}
+
+	if v.Type() == durationType {
+		s, ok := node.(string)
+		d, err := time.ParseDuration(s)
+		if n, isInt := node.(int); isInt && n == 0 {
+			ok, d, err = true, 0, nil
+		}
+		if !ok || err != nil {
+			fail("duration (e.g. 30s)")
+			return
+		}
+		v.SetInt(int64(d))
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		decodeYAML(node, v.Elem(), path, errs)
+
+	case reflect.String:
+		switch n := node.(type) {
+		case string:
+			v.SetString(n)
+		case int, float64:
+			// Unquoted numbers such as ports are fine as strings.
+			v.SetString(fmt.Sprint(n))
+		default:
+			fail("string")
+		}
+
+	case reflect.Bool:
+		b, ok := node.(bool)
+		if !ok {
+			fail("boolean")
+			return
+		}
+		v.SetBool(b)
+
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, ok := node.(int)
+		if !ok {
+			fail("integer")
+			return
+		}
+		v.SetInt(int64(n))
+
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		n, ok := node.(int)
+		if !ok || n < 0 {
+			fail("non-negative integer")
+			return
+		}
+		v.SetUint(uint64(n))
+
+	case reflect.Float32, reflect.Float64:
+		switch n := node.(type) {
+		case int:
+			v.SetFloat(float64(n))
+		case float64:
+			v.SetFloat(n)
+		default:
+			fail("number")
+		}
+
+	case reflect.Slice:
+		items, ok := node.([]any)
+		if !ok {
+			fail("list of " + describeType(v.Type().Elem()))
+			return
+		}
+		s := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			decodeYAML(item, s.Index(i), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+		v.Set(s)
+
+	case reflect.Map:
+		m, ok := node.(map[any]any)
+		if !ok || v.Type().Key().Kind() != reflect.String {
+			fail("mapping")
+			return
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for _, k := range sortedKeys(m) {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			decodeYAML(m[k], elem, joinPath(path, k), errs)
+			v.SetMapIndex(reflect.ValueOf(k).Convert(v.Type().Key()), elem)
+		}
+
+	case reflect.Struct:
+		m, ok := node.(map[any]any)
+		if !ok {
+			fail("mapping")
+			return
+		}
+		fields := yamlFields(v.Type())
+		for _, k := range sortedKeys(m) {
+			i, known := fields[k]
+			if !known {
+				msg := fmt.Sprintf("%s: unknown key", displayPath(joinPath(path, k)))
+				if s := suggestKey(k, fields); s != "" {
+					msg += fmt.Sprintf(" (did you mean %q?)", s)
+				}
+				*errs = append(*errs, errors.New(msg))
+				continue
+			}
+			decodeYAML(m[k], v.Field(i), joinPath(path, k), errs)
+		}
+
+	default:
+		fail(describeType(v.Type()))
+	}
+}
+
+// yamlFields maps the yaml key of every exported field to its index.
+func yamlFields(t reflect.Type) map[string]int {
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = i
+	}
+	return fields
+}
+
+// sortedKeys returns the string keys of m in order, so errors come out
+// deterministically. Non-string keys are reported as unknown by callers.
+func sortedKeys(m map[any]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, fmt.Sprint(k))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "(top level)"
+	}
+	return path
+}
+
+func isScalar(node any) bool {
+	switch node.(type) {
+	case string, int, float64, bool:
+		return true
+	}
+	return false
+}
+
+func describeYAML(node any) string {
+	switch n := node.(type) {
+	case string:
+		return fmt.Sprintf("%q", n)
+	case int:
+		return fmt.Sprintf("integer %d", n)
+	case float64:
+		return fmt.Sprintf("number %g", n)
+	case bool:
+		return fmt.Sprintf("boolean %t", n)
+	case []any:
+		return "a list"
+	case map[any]any:
+		return "a mapping"
+	}
+	return fmt.Sprintf("%T", node)
+}
+
+func describeType(t reflect.Type) string {
+	if t == durationType {
+		return "duration"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Pointer:
+		return describeType(t.Elem())
+	case reflect.Slice:
+		return "list of " + describeType(t.Elem())
+	case reflect.Map, reflect.Struct:
+		return "mapping"
+	}
+	return t.String()
+}
+
+// suggestKey returns the known key closest to key if it looks like a typo.
+func suggestKey(key string, fields map[string]int) string {
+	best, bestDist := "", 3
+	for name := range fields {
+		if d := editDistance(key, name); d < bestDist || (d == bestDist && name < best) {
+			best, bestDist = name, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Damerau-Levenshtein (optimal string alignment)
+// distance, so swapped letters as in "estimatros" count as one edit.
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeYAMLFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		errs  []string // substrings of the error, nil for none
+		check func(t *testing.T, cfg config)
+	}{
+		{
+			name: "valid",
+			yaml: "grpc:\n  host: mgm.example.org\n  port: 50051\n  dial_timeout: 5s\n" +
+				"request:\n  top_n: 50\n  estimators: [SMA_1_MINUTES, SMA_5_MINUTES]\n" +
+				"prometheus:\n  disable: true\n",
+			check: func(t *testing.T, cfg config) {
+				if cfg.GRPC.Host != "mgm.example.org" || cfg.GRPC.Port != "50051" || cfg.GRPC.DialTimeout != 5*time.Second {
+					t.Errorf("grpc = %+v", cfg.GRPC)
+				}
+				if cfg.Request.TopN != 50 || !slices.Equal(cfg.Request.Estimators, []string{"SMA_1_MINUTES", "SMA_5_MINUTES"}) {
+					t.Errorf("request = %+v", cfg.Request)
+				}
+				if !cfg.Prometheus.Disable {
+					t.Error("prometheus.disable not set")
+				}
+			},
+		},
+		{
+			name: "defaults kept",
+			yaml: "grpc:\n  host: mgm\n",
+			check: func(t *testing.T, cfg config) {
+				if want := defaultConfig().GRPC.Port; cfg.GRPC.Port != want {
+					t.Errorf("grpc.port = %q, want the default %q", cfg.GRPC.Port, want)
+				}
+			},
+		},
+		{
+			name: "empty",
+			yaml: "",
+		},
+		{
+			name: "typo",
+			yaml: "grpc:\n  hots: mgm\n",
+			errs: []string{`grpc.hots: unknown key (did you mean "host"?)`},
+		},
+		{
+			name: "swapped letters",
+			yaml: "request:\n  estimatros: [SMA_1_MINUTES]\n",
+			errs: []string{`request.estimatros: unknown key (did you mean "estimators"?)`},
+		},
+		{
+			name: "unknown key",
+			yaml: "grpc:\n  bandwidth: 10\n",
+			errs: []string{"grpc.bandwidth: unknown key"},
+		},
+		{
+			name: "unknown section",
+			yaml: "grcp:\n  host: mgm\n",
+			errs: []string{`grcp: unknown key (did you mean "grpc"?)`},
+		},
+		{
+			name: "duration",
+			yaml: "grpc:\n  dial_timeout: fast\n",
+			errs: []string{`grpc.dial_timeout: expected duration (e.g. 30s), got "fast"`},
+		},
+		{
+			name: "negative count",
+			yaml: "request:\n  top_n: -1\n",
+			errs: []string{"request.top_n: expected non-negative integer, got integer -1"},
+		},
+		{
+			name: "scalar for list",
+			yaml: "request:\n  estimators: SMA_1_MINUTES\n",
+			errs: []string{`request.estimators: expected list of string, got "SMA_1_MINUTES"`},
+		},
+		{
+			name: "integer for boolean",
+			yaml: "prometheus:\n  disable: 1\n",
+			errs: []string{"prometheus.disable: expected boolean, got integer 1"},
+		},
+		{
+			name: "scalar for mapping",
+			yaml: "grpc: mgm:50051\n",
+			errs: []string{`grpc: expected mapping, got "mgm:50051"`},
+		},
+		{
+			name: "top level",
+			yaml: "42\n",
+			errs: []string{"(top level): expected mapping, got integer 42"},
+		},
+		{
+			name: "all errors",
+			yaml: "grpc:\n  hots: mgm\n  dial_timeout: fast\n",
+			errs: []string{"grpc.hots: unknown key", "grpc.dial_timeout: expected duration"},
+		},
+		{
+			name: "syntax",
+			yaml: "grpc:\n  host: [mgm\n",
+			errs: []string{"yaml:"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			err := decodeYAMLFile("config.yaml", []byte(tt.yaml), &cfg)
+			if tt.errs == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else if err == nil {
+				t.Fatalf("no error, want %q", tt.errs)
+			}
+			for _, want := range tt.errs {
+				if !strings.Contains(err.Error(), "config.yaml: "+want) {
+					t.Errorf("error %q doesn't contain %q", err, want)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, cfg)
+			}
+		})
+	}
+}
+
+func TestSuggestKey(t *testing.T) {
+	fields := map[string]int{"host": 0, "port": 1, "dial_timeout": 2, "proxy": 3}
+	tests := []struct {
+		key, want string
+	}{
+		{"hots", "host"},
+		{"hostt", "host"},
+		{"prot", "port"},
+		{"dial_timout", "dial_timeout"},
+		{"proxies", ""},
+		{"timeout", ""},
+		{"completely_different", ""},
+	}
+	for _, tt := range tests {
+		if got := suggestKey(tt.key, fields); got != tt.want {
+			t.Errorf("suggestKey(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"host", "host", 0},
+		{"", "port", 4},
+		{"host", "hosts", 1},
+		{"host", "hst", 1},
+		{"host", "hast", 1},
+		{"estimators", "estimatros", 1},
+		{"kitten", "sitting", 3},
+		{"ca", "abc", 3},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := editDistance(tt.b, tt.a); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+var connStates = []connectivity.State{
+	connectivity.Idle,
+	connectivity.Connecting,
+	connectivity.Ready,
+	connectivity.TransientFailure,
+	connectivity.Shutdown,
+}
+
+var (
+	connStateDesc = prometheus.NewDesc(
+		"eos_grpc_connection_state",
+		"1 for the current connectivity state of the connection to the MGM, 0 for the others",
+		[]string{"state"}, nil,
+	)
+	connTransitionsDesc = prometheus.NewDesc(
+		"eos_grpc_connection_transitions_total",
+		"Times the connection to the MGM entered each connectivity state",
+		[]string{"state"}, nil,
+	)
+	connStateSecondsDesc = prometheus.NewDesc(
+		"eos_grpc_connection_state_seconds_total",
+		"Time the connection to the MGM spent in each connectivity state",
+		[]string{"state"}, nil,
+	)
+)
+
+// connStateTracker follows the connectivity state of the connection to the
+// MGM, logging every transition and exporting how often and how long it
+// was in each state, so flapping network paths show up even when the
+// stream survives them.
+type connStateTracker struct {
+	target string
+
+	mu      sync.Mutex
+	state   connectivity.State
+	since   time.Time
+	entered map[connectivity.State]float64
+	seconds map[connectivity.State]float64 // excluding the current stay
+}
+
+func newConnStateTracker(target string, state connectivity.State) *connStateTracker {
+	return &connStateTracker{
+		target:  target,
+		state:   state,
+		since:   time.Now(),
+		entered: map[connectivity.State]float64{state: 1},
+		seconds: map[connectivity.State]float64{},
+	}
+}
+
+// Watch tracks the state of conn until ctx is done.
+func (t *connStateTracker) Watch(ctx context.Context, conn *grpc.ClientConn) {
+	for {
+		t.mu.Lock()
+		state := t.state
+		t.mu.Unlock()
+		if !conn.WaitForStateChange(ctx, state) {
+			return
+		}
+		t.transition(conn.GetState())
+	}
+}
+
+func (t *connStateTracker) transition(state connectivity.State) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if state == t.state {
+		return
+	}
+	now := time.Now()
+	log.Printf("gRPC connection to %s: %s -> %s (after %s)", t.target, t.state, state, now.Sub(t.since).Round(time.Millisecond))
+	t.seconds[t.state] += now.Sub(t.since).Seconds()
+	t.state, t.since = state, now
+	t.entered[state]++
+}
+
+func (t *connStateTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connStateDesc
+	ch <- connTransitionsDesc
+	ch <- connStateSecondsDesc
+}
+
+func (t *connStateTracker) Collect(ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range connStates {
+		current, seconds := 0.0, t.seconds[s]
+		if s == t.state {
+			current = 1
+			seconds += time.Since(t.since).Seconds()
+		}
+		ch <- prometheus.MustNewConstMetric(connStateDesc, prometheus.GaugeValue, current, s.String())
+		ch <- prometheus.MustNewConstMetric(connTransitionsDesc, prometheus.CounterValue, t.entered[s], s.String())
+		ch <- prometheus.MustNewConstMetric(connStateSecondsDesc, prometheus.CounterValue, seconds, s.String())
+	}
+}
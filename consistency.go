@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// Estimator cross-checks compare estimators the MGM computes over overlapping
+// windows. A check "A:B" with windows of the same length (SMA_1_SECONDS:
+// EMA_1_SECONDS) compares the two rates of every entity directly; if B has
+// a shorter window (SMA_1_MINUTES:SMA_1_SECONDS), B's samples are averaged
+// over A's window first, which is what A should be. Rates that diverge by
+// more than the tolerance have historically pointed at estimator bugs in the
+// MGM, so every new divergence is logged with the values to report upstream.
+
+var (
+	estimatorDivergence = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_estimator_max_divergence_ratio",
+			Help: "Largest relative difference between the two estimators of the check over the entities of the last report",
+		},
+		[]string{"check", "direction"},
+	)
+	estimatorDivergentEntities = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_estimator_divergent_entities",
+			Help: "Entities of the last report whose estimators diverge beyond the tolerance",
+		},
+		[]string{"check"},
+	)
+	estimatorDivergences = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "eos_estimator_divergences_total",
+			Help: "Times an entity started diverging beyond the tolerance",
+		},
+		[]string{"check"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(estimatorDivergence, estimatorDivergentEntities, estimatorDivergences)
+}
+
+// estimatorWindow returns the length of the window of an estimator such as
+// SMA_5_SECONDS.
+func estimatorWindow(name string) (time.Duration, error) {
+	parts := strings.Split(name, "_")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("unknown estimator %q", name)
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, fmt.Errorf("unknown estimator %q", name)
+	}
+	switch parts[2] {
+	case "SECONDS":
+		return time.Duration(n) * time.Second, nil
+	case "MINUTES":
+		return time.Duration(n) * time.Minute, nil
+	}
+	return 0, fmt.Errorf("unknown estimator %q", name)
+}
+
+type consistencyCheck struct {
+	name       string // "A:B"
+	a, b       string
+	window     time.Duration // of a
+	integrated bool          // b is averaged over window
+}
+
+func parseConsistencyCheck(s string) (consistencyCheck, error) {
+	a, b, ok := strings.Cut(s, ":")
+	if !ok {
+		return consistencyCheck{}, fmt.Errorf("check must be ESTIMATOR:ESTIMATOR, got %q", s)
+	}
+	for _, name := range []string{a, b} {
+		if _, err := parseEstimator(name); err != nil {
+			return consistencyCheck{}, err
+		}
+	}
+	wa, err := estimatorWindow(a)
+	if err != nil {
+		return consistencyCheck{}, err
+	}
+	wb, err := estimatorWindow(b)
+	if err != nil {
+		return consistencyCheck{}, err
+	}
+	if a == b || wb > wa {
+		return consistencyCheck{}, fmt.Errorf("%s: the second estimator must differ and not have a longer window than the first", s)
+	}
+	return consistencyCheck{name: s, a: a, b: b, window: wa, integrated: wb < wa}, nil
+}
+
+type consistencyKey struct {
+	check  string
+	entity entityKey
+}
+
+// rateSample is the read and write rate of an entity at a report time.
+type rateSample struct {
+	ts          time.Time
+	read, write float64
+}
+
+// consistencyChecker evaluates the cross-checks on every report.
+type consistencyChecker struct {
+	checks    []consistencyCheck
+	tolerance float64 // relative difference
+	minRate   float64 // rates below this on both estimators are not compared
+
+	history   map[consistencyKey][]rateSample // samples of b for the integrated checks
+	divergent map[consistencyKey]bool
+}
+
+func newConsistencyChecker(checks []string, tolerance, minRate float64) (*consistencyChecker, error) {
+	if tolerance <= 0 {
+		return nil, fmt.Errorf("tolerance must be positive, got %g", tolerance)
+	}
+	c := &consistencyChecker{
+		tolerance: tolerance,
+		minRate:   minRate,
+		history:   make(map[consistencyKey][]rateSample),
+		divergent: make(map[consistencyKey]bool),
+	}
+	for _, s := range checks {
+		check, err := parseConsistencyCheck(s)
+		if err != nil {
+			return nil, err
+		}
+		c.checks = append(c.checks, check)
+	}
+	return c, nil
+}
+
+// divergence is the difference of a and b relative to the larger one.
+func divergence(a, b float64) float64 {
+	if m := math.Max(a, b); m > 0 {
+		return math.Abs(a-b) / m
+	}
+	return 0
+}
+
+func sampleOf(stats []*pb.RateStats, estimator string) (rateSample, bool) {
+	for _, s := range stats {
+		if s.Window.String() == estimator {
+			return rateSample{read: s.BytesReadPerSec, write: s.BytesWrittenPerSec}, true
+		}
+	}
+	return rateSample{}, false
+}
+
+// Update compares the estimators of every entity in report and exports the
+// outcome of the checks.
+func (c *consistencyChecker) Update(report *pb.TrafficShapingRateResponse) {
+	ts := time.UnixMilli(report.TimestampMs)
+	seen := make(map[consistencyKey]bool)
+	for _, check := range c.checks {
+		var maxRead, maxWrite float64
+		divergent := 0
+		for _, e := range reportEntities(report) {
+			key := consistencyKey{check.name, entityKey{e.Type, e.ID}}
+			a, okA := sampleOf(e.Stats, check.a)
+			b, okB := sampleOf(e.Stats, check.b)
+			if !okA || !okB {
+				continue
+			}
+			seen[key] = true
+			if check.integrated {
+				if b, okB = c.integrate(key, ts, b, check.window); !okB {
+					continue
+				}
+			}
+
+			var dRead, dWrite float64
+			if math.Max(a.read, b.read) >= c.minRate {
+				dRead = divergence(a.read, b.read)
+			}
+			if math.Max(a.write, b.write) >= c.minRate {
+				dWrite = divergence(a.write, b.write)
+			}
+			maxRead, maxWrite = math.Max(maxRead, dRead), math.Max(maxWrite, dWrite)
+
+			if dRead <= c.tolerance && dWrite <= c.tolerance {
+				delete(c.divergent, key)
+				continue
+			}
+			divergent++
+			if !c.divergent[key] {
+				c.divergent[key] = true
+				estimatorDivergences.WithLabelValues(check.name).Inc()
+				log.Printf("Estimator check %s: %s %s diverges: read %s vs %s, write %s vs %s",
+					check.name, e.Type, e.ID,
+					humanizeBytes(a.read), humanizeBytes(b.read), humanizeBytes(a.write), humanizeBytes(b.write))
+			}
+		}
+		estimatorDivergence.WithLabelValues(check.name, "read").Set(maxRead)
+		estimatorDivergence.WithLabelValues(check.name, "write").Set(maxWrite)
+		estimatorDivergentEntities.WithLabelValues(check.name).Set(float64(divergent))
+	}
+
+	// An entity missing from a report leaves a gap in its history, so start
+	// over when it comes back.
+	for key := range c.history {
+		if !seen[key] {
+			delete(c.history, key)
+		}
+	}
+	for key := range c.divergent {
+		if !seen[key] {
+			delete(c.divergent, key)
+		}
+	}
+}
+
+// integrate adds the sample to the history of key and returns the mean of
+// the samples in the window ending at ts, once the history covers it.
+func (c *consistencyChecker) integrate(key consistencyKey, ts time.Time, s rateSample, window time.Duration) (rateSample, bool) {
+	s.ts = ts
+	h := append(c.history[key], s)
+	start := ts.Add(-window)
+	i := 0
+	for i < len(h) && !h[i].ts.After(start) {
+		i++
+	}
+	// Keep the last sample before the window to tell whether it is covered.
+	covered := i > 0
+	if i > 1 {
+		h = h[i-1:]
+	}
+	c.history[key] = h
+	if !covered {
+		return rateSample{}, false
+	}
+
+	var mean rateSample
+	for _, x := range h[1:] {
+		mean.read += x.read
+		mean.write += x.write
+	}
+	n := float64(len(h) - 1)
+	mean.read /= n
+	mean.write /= n
+	return mean, true
+}
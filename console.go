@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// console draws the frames rendered from the reports on the terminal, at
+// most once every interval: a frame arriving sooner replaces the pending
+// one, which is drawn when the interval is up, so busy MGMs don't make the
+// terminal flicker and intermediate reports are coalesced. With a zero
+// interval every frame is drawn as it comes.
+//
+// Frames are rendered for the width of the terminal when drawn, and the
+// last one is drawn again when the terminal is resized.
+//
+// In append mode the frames are single summary lines instead of tables
+// redrawn over the screen, so the output scrolls and can be teed into a
+// file or left to nohup.
+//
+// In clear mode on a terminal, the keys typed act on the search and show
+// the help, the last frame being drawn again for them.
+//
+// The pause key, or SIGUSR2 where there are no keys, freezes the frame on
+// screen while the reports keep being processed, e.g. to copy values off it;
+// resuming draws the latest frame.
+//
+// The export key writes the rows of the table on screen, as filtered and
+// sorted, to a timestamped file of the export directory.
+//
+// Frames are written to out in one Write each.
+type console struct {
+	out      io.Writer
+	interval time.Duration
+	append   bool
+	resize   chan os.Signal
+	pause    chan os.Signal
+	keys     keyBindings
+	restore  func() // of the terminal mode, nil if not reading keys
+	export   exportConfig
+
+	mu     sync.Mutex
+	last   time.Time // of the last draw
+	render func(out io.Writer, width int)
+	table  *consoleTable // of render, nil if not a table
+	drawn  bool          // whether render was drawn
+	timer  *time.Timer
+	search consoleSearch
+	help   bool // whether the help is shown instead of the frames
+	paused bool // whether the frames are held, shown staying on screen
+	shown  func(out io.Writer, width int)
+	notice string // shown under the frame until the next key
+	// shownTable is the table of shown, nil if not a table.
+	shownTable *consoleTable
+}
+
+// consoleTable holds the rows of a table frame, before the filter.
+type consoleTable struct {
+	target string
+	ts     time.Time
+	rows   map[string][]entityRow
+}
+
+func newConsole(out io.Writer, interval time.Duration, mode string, keys keyBindings, export exportConfig) (*console, error) {
+	if export.Format != "csv" && export.Format != "json" {
+		return nil, fmt.Errorf("unsupported export format %q (expected csv or json)", export.Format)
+	}
+	c := &console{out: out, interval: interval, keys: keys, export: export}
+	switch mode {
+	case "clear":
+		c.resize = make(chan os.Signal, 1)
+		notifyResize(c.resize)
+		go c.redraw()
+		if restore, err := cbreak(os.Stdin); err == nil {
+			c.restore = restore
+			go c.readKeys(os.Stdin)
+		}
+	case "append":
+		c.append = true
+	default:
+		return nil, fmt.Errorf("unknown console mode %q (expected clear or append)", mode)
+	}
+	c.pause = make(chan os.Signal, 1)
+	notifyPause(c.pause)
+	go c.pauses()
+	return c, nil
+}
+
+// Frame draws the frame written by render, which must only use data that
+// stays unchanged, or keeps it for later if the last draw is too recent.
+// width is the number of columns of the terminal, 0 if unknown. render may
+// read the search of c, being called with c locked.
+func (c *console) Frame(render func(out io.Writer, width int)) {
+	c.frame(render, nil)
+}
+
+// Table draws like Frame the frame of the table view of t, which the export
+// key writes.
+func (c *console) Table(t consoleTable, render func(out io.Writer, width int)) {
+	c.frame(render, &t)
+}
+
+func (c *console) frame(render func(out io.Writer, width int), t *consoleTable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.render, c.table, c.drawn = render, t, false
+	if c.paused {
+		return
+	}
+	wait := c.interval - time.Since(c.last)
+	if wait <= 0 {
+		c.draw()
+		return
+	}
+	if c.timer == nil {
+		c.timer = time.AfterFunc(wait, c.flush)
+	}
+}
+
+func (c *console) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer = nil
+	if !c.drawn && !c.paused {
+		c.draw()
+	}
+}
+
+// redraw draws the last frame again for the new width on every resize.
+func (c *console) redraw() {
+	for range c.resize {
+		c.mu.Lock()
+		if c.render != nil {
+			c.draw()
+		}
+		c.mu.Unlock()
+	}
+}
+
+// readKeys handles the keys typed on in until it fails, drawing the last
+// frame again when they change it.
+func (c *console) readKeys(in io.Reader) {
+	buf := make([]byte, 64)
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		c.mu.Lock()
+		if c.key(buf[:n]) && c.render != nil {
+			c.draw()
+		}
+		c.mu.Unlock()
+	}
+}
+
+// key acts on the keys of in, clearing the notice, and returns whether the
+// screen changed.
+func (c *console) key(in []byte) bool {
+	cleared := c.notice != ""
+	c.notice = ""
+	return c.act(in) || cleared
+}
+
+func (c *console) act(in []byte) bool {
+	switch {
+	case c.help:
+		c.help = false
+		return true
+	case c.search.prompt != 0:
+		c.search.edit(in)
+		return true
+	}
+	switch c.keys[in[0]] {
+	case "search":
+		c.search.start('/')
+	case "filter":
+		c.search.start('f')
+	case "clear":
+		return c.search.clear()
+	case "help":
+		c.help = true
+		return true
+	case "pause":
+		c.togglePause()
+		return false // drawn if needed
+	case "export":
+		path, err := c.exportView()
+		if err != nil {
+			c.notice = fmt.Sprintf("Error exporting the view: %v", err)
+		} else {
+			c.notice = "View exported to " + path
+		}
+		return true
+	default:
+		return false
+	}
+	c.search.edit(in[1:])
+	return true
+}
+
+// exportView writes the rows of the table on screen, filtered, to a new
+// file of the export directory and returns its path.
+func (c *console) exportView() (string, error) {
+	t := c.shownTable
+	if t == nil {
+		return "", errors.New("no table on screen")
+	}
+	rows := make(map[string][]entityRow, len(t.rows))
+	for eType, list := range t.rows {
+		rows[eType] = c.search.apply(list)
+	}
+	b, err := encodeSnapshotRows(snapshotRows(t.ts, t.target, rows), c.export.Format)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(c.export.Dir, fmt.Sprintf("view-%s.%s", time.Now().UTC().Format(snapshotTime), c.export.Format))
+	return path, os.WriteFile(path, b, 0o644)
+}
+
+// pauses toggles the pause on every SIGUSR2.
+func (c *console) pauses() {
+	for range c.pause {
+		c.mu.Lock()
+		c.togglePause()
+		if c.paused {
+			log.Println("Console paused, send SIGUSR2 again to resume")
+		} else {
+			log.Println("Console resumed")
+		}
+		c.mu.Unlock()
+	}
+}
+
+// togglePause pauses or resumes the drawing of the frames. In clear mode
+// the frame on screen is drawn again with the pause notice, or without it
+// for the latest frame.
+func (c *console) togglePause() {
+	c.paused = !c.paused
+	switch {
+	case c.render == nil:
+	case !c.append, !c.paused && !c.drawn:
+		c.draw()
+	}
+}
+
+// draw draws the latest frame or, paused, the frame on screen again.
+func (c *console) draw() {
+	render := c.render
+	if c.paused && c.shown != nil {
+		render = c.shown
+	} else {
+		c.shown, c.shownTable, c.drawn = render, c.table, true
+	}
+	var frame bytes.Buffer
+	if c.help {
+		c.keys.print(&frame)
+	} else {
+		render(&frame, terminalWidth())
+	}
+	if c.paused && !c.append {
+		fmt.Fprintf(&frame, "\n--- Paused: press %s or send SIGUSR2 to resume ---\n", c.keys.key("pause"))
+	}
+	if c.notice != "" {
+		fmt.Fprintf(&frame, "\n%s\n", c.notice)
+	}
+	c.out.Write(frame.Bytes())
+	c.last = time.Now()
+}
+
+// Close draws the pending frame, so the terminal is left with the last
+// report.
+func (c *console) Close() {
+	if c.resize != nil {
+		signal.Stop(c.resize)
+		close(c.resize)
+	}
+	signal.Stop(c.pause)
+	close(c.pause)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = false
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if c.render != nil && !c.drawn {
+		c.draw()
+	}
+	if c.restore != nil {
+		c.restore()
+	}
+}
+
+// summaryLine is the line printed per report in append mode, e.g.
+//
+//	2026-10-16T10:00:00Z SMA_1_MINUTES app 12 R 1.20 GB/s W 300.00 MB/s top rucio 800.00 MB/s | user ...
+//
+// with the number of rows of each entity type shown, their summed read and
+// write rates on estimator and the busiest row.
+func summaryLine(ts time.Time, estimator string, rows map[string][]entityRow) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s", ts.Format(time.RFC3339), estimator)
+	sep := " "
+	for _, eType := range []string{"app", "user", "group"} {
+		list := rows[eType]
+		if len(list) == 0 {
+			continue
+		}
+		var read, write, top float64
+		topID := "-"
+		for _, row := range list {
+			for _, s := range row.Stats {
+				if s.Window.String() != estimator {
+					continue
+				}
+				read += s.BytesReadPerSec
+				write += s.BytesWrittenPerSec
+				if total := s.BytesReadPerSec + s.BytesWrittenPerSec; total > top {
+					top, topID = total, row.ID
+				}
+			}
+		}
+		fmt.Fprintf(&b, "%s%s %d R %s/s W %s/s top %s %s/s", sep, eType, len(list),
+			humanizeBytes(read), humanizeBytes(write), topID, humanizeBytes(top))
+		sep = " | "
+	}
+	return b.String()
+}
+
+// ANSI escape sequences of the console colors.
+const (
+	ansiReset  = "\033[0m"
+	ansiBold   = "\033[1m"
+	ansiRed    = "\033[31m"
+	ansiGreen  = "\033[32m"
+	ansiYellow = "\033[33m"
+)
+
+// colorScheme colors the rows of the console tables green, yellow from the
+// warn rate and red from the crit rate, by the total rate of each row, and
+// makes the rows of the sort estimator bold.
+type colorScheme struct {
+	warn, crit float64
+	sortBy     string
+}
+
+func newColorScheme(warn, crit, sortBy string) (*colorScheme, error) {
+	c := &colorScheme{sortBy: sortBy}
+	var err error
+	if c.warn, err = parseByteRate(warn); err != nil {
+		return nil, err
+	}
+	if c.crit, err = parseByteRate(crit); err != nil {
+		return nil, err
+	}
+	if c.warn > c.crit {
+		return nil, fmt.Errorf("warn rate %s is above crit rate %s", warn, crit)
+	}
+	return c, nil
+}
+
+// style returns the ANSI style of the row of s, "" if c is nil.
+func (c *colorScheme) style(s *pb.RateStats) string {
+	if c == nil {
+		return ""
+	}
+	style := ansiGreen
+	switch rate := s.BytesReadPerSec + s.BytesWrittenPerSec; {
+	case rate >= c.crit:
+		style = ansiRed
+	case rate >= c.warn:
+		style = ansiYellow
+	}
+	if s.Window.String() == c.sortBy {
+		style = ansiBold + style
+	}
+	return style
+}
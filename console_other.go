@@ -0,0 +1,24 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// terminalWidth returns 0, the width of the terminal being unknown.
+func terminalWidth() int {
+	return 0
+}
+
+// notifyResize does nothing, resizes not being signaled.
+func notifyResize(chan<- os.Signal) {}
+
+// notifyPause does nothing, there being no SIGUSR2 to pause the console.
+func notifyPause(chan<- os.Signal) {}
+
+// cbreak fails, the keys not being read on this platform.
+func cbreak(*os.File) (func(), error) {
+	return nil, errors.New("keys aren't supported on this platform")
+}
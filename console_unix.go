@@ -0,0 +1,48 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+
+	"golang.org/x/sys/unix"
+)
+
+// terminalWidth returns the number of columns of the terminal on stdout, 0
+// if stdout isn't a terminal.
+func terminalWidth() int {
+	ws, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return 0
+	}
+	return int(ws.Col)
+}
+
+// notifyResize relays the resizes of the terminal to c.
+func notifyResize(c chan<- os.Signal) {
+	signal.Notify(c, unix.SIGWINCH)
+}
+
+// notifyPause relays the pause toggles, SIGUSR2, to c.
+func notifyPause(c chan<- os.Signal) {
+	signal.Notify(c, unix.SIGUSR2)
+}
+
+// cbreak puts the terminal on f in cbreak mode, passing the keys as they
+// are typed without echoing them while Ctrl-C still interrupts, and returns
+// the function restoring it. It fails if f isn't a terminal.
+func cbreak(f *os.File) (restore func(), err error) {
+	fd := int(f.Fd())
+	old, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, err
+	}
+	t := *old
+	t.Lflag &^= unix.ICANON | unix.ECHO
+	t.Cc[unix.VMIN], t.Cc[unix.VTIME] = 1, 0
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &t); err != nil {
+		return nil, err
+	}
+	return func() { unix.IoctlSetTermios(fd, ioctlSetTermios, old) }, nil
+}
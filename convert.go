@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+func runConvert(args []string) {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s convert <input> <output>\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Converts a .pb or .jsonl recording to the .pb, .jsonl or .parquet format, parquet")
+		fmt.Fprintln(fs.Output(), "being export-only. Formats are taken from the file extensions; a .gz suffix")
+		fmt.Fprintln(fs.Output(), "(re)compresses the output.")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	n, err := convertRecording(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		log.Fatalf("Error converting recording: %v", err)
+	}
+	log.Printf("Converted %d reports from %s to %s", n, fs.Arg(0), fs.Arg(1))
+}
+
+func convertRecording(inPath, outPath string) (int, error) {
+	// Creating the output truncates it, so it can't be the input.
+	if inInfo, err := os.Stat(inPath); err == nil {
+		if outInfo, err := os.Stat(outPath); err == nil && os.SameFile(inInfo, outInfo) {
+			return 0, fmt.Errorf("%s: input and output are the same file", outPath)
+		}
+	}
+	in, err := openRecording(inPath)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := createRecording(outPath)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for {
+		f, err := in.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			out.Close()
+			return n, fmt.Errorf("%s: report %d: %w", inPath, n+1, err)
+		}
+		if err := out.Write(f); err != nil {
+			out.Close()
+			return n, fmt.Errorf("%s: %w", outPath, err)
+		}
+		n++
+	}
+	return n, out.Close()
+}
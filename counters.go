@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+var (
+	readBytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "eos_io_read_bytes_total",
+			Help: "Bytes read, integrated from the reported rates",
+		},
+		[]string{"entity_type", "id"},
+	)
+	writeBytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "eos_io_write_bytes_total",
+			Help: "Bytes written, integrated from the reported rates",
+		},
+		[]string{"entity_type", "id"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(readBytesTotal, writeBytesTotal)
+}
+
+// byteCounters integrates the rates of one estimator over the time between
+// reports into monotonic counters per entity, which unlike the rate gauges
+// work with rate() and increase() and lose nothing to scrape gaps.
+//
+// An interval longer than maxGap, as after a reconnection, or going back in
+// time is not integrated rather than guessed. An entity missing from a
+// report (below the top N) adds nothing, and its counters are deleted once
+// it has been missing for expiry, so churning entities don't accumulate
+// series; if it comes back its counters start again from 0, which
+// Prometheus handles as a counter reset, as it does for a restart of the
+// monitor.
+type byteCounters struct {
+	estimator string
+	maxGap    time.Duration
+	expiry    time.Duration
+
+	last     time.Time
+	lastSeen map[entityKey]time.Time
+}
+
+func newByteCounters(estimator string, maxGap, expiry time.Duration) (*byteCounters, error) {
+	if _, err := parseEstimator(estimator); err != nil {
+		return nil, err
+	}
+	if maxGap <= 0 || expiry <= 0 {
+		return nil, errors.New("byte counter gap and expiry must be positive")
+	}
+	return &byteCounters{
+		estimator: estimator,
+		maxGap:    maxGap,
+		expiry:    expiry,
+		lastSeen:  make(map[entityKey]time.Time),
+	}, nil
+}
+
+// Update adds the bytes of the interval since the previous report.
+func (c *byteCounters) Update(report *pb.TrafficShapingRateResponse) {
+	ts := time.UnixMilli(report.TimestampMs)
+	dt := ts.Sub(c.last)
+	integrate := !c.last.IsZero() && dt > 0 && dt <= c.maxGap
+	c.last = ts
+
+	for _, e := range reportEntities(report) {
+		for _, s := range e.Stats {
+			if s.Window.String() != c.estimator {
+				continue
+			}
+			c.lastSeen[entityKey{e.Type, e.ID}] = ts
+			read := readBytesTotal.WithLabelValues(e.Type, e.ID)
+			write := writeBytesTotal.WithLabelValues(e.Type, e.ID)
+			if integrate {
+				read.Add(s.BytesReadPerSec * dt.Seconds())
+				write.Add(s.BytesWrittenPerSec * dt.Seconds())
+			}
+		}
+	}
+
+	for k, seen := range c.lastSeen {
+		if ts.Sub(seen) > c.expiry {
+			readBytesTotal.DeleteLabelValues(k.Type, k.ID)
+			writeBytesTotal.DeleteLabelValues(k.Type, k.ID)
+			delete(c.lastSeen, k)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// dashboard serves a single-page view of the live top apps, users and groups
+// on /dashboard/ for operators without Grafana. The page keeps the history
+// for its sparklines itself; the server only pushes a summary of every
+// report, the rates of one estimator, as Server-Sent Events on
+// /dashboard/events.
+type dashboard struct {
+	estimator string
+	hub       *eventHub
+}
+
+// dashboardSummary is the event sent for every report.
+type dashboardSummary struct {
+	Timestamp int64                      `json:"timestamp"` // milliseconds
+	Estimator string                     `json:"estimator"`
+	Entities  map[string][]dashboardRate `json:"entities"` // by entity type
+}
+
+type dashboardRate struct {
+	ID    string  `json:"id"`
+	Read  float64 `json:"read"`
+	Write float64 `json:"write"`
+}
+
+func newDashboard(estimator string) (*dashboard, error) {
+	if _, err := parseEstimator(estimator); err != nil {
+		return nil, err
+	}
+	return &dashboard{estimator: estimator, hub: newEventHub()}, nil
+}
+
+func (d *dashboard) register(mux *http.ServeMux) {
+	mux.HandleFunc("/dashboard", func(w http.ResponseWriter, r *http.Request) {
+		// A relative Location keeps the route prefix, which http.Redirect
+		// would resolve away against the stripped request path.
+		w.Header().Set("Location", "dashboard/")
+		w.WriteHeader(http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/dashboard/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dashboard/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardHTML)
+	})
+	mux.Handle("/dashboard/events", d.hub)
+}
+
+// Update sends the summary of report to the connected pages.
+func (d *dashboard) Update(report *pb.TrafficShapingRateResponse) {
+	summary := dashboardSummary{
+		Timestamp: report.TimestampMs,
+		Estimator: d.estimator,
+		Entities:  map[string][]dashboardRate{"app": {}, "user": {}, "group": {}},
+	}
+	for _, e := range reportEntities(report) {
+		for _, s := range e.Stats {
+			if s.Window.String() == d.estimator {
+				summary.Entities[e.Type] = append(summary.Entities[e.Type], dashboardRate{e.ID, s.BytesReadPerSec, s.BytesWrittenPerSec})
+			}
+		}
+	}
+	for _, rates := range summary.Entities {
+		sort.Slice(rates, func(i, j int) bool {
+			return rates[i].Read+rates[i].Write > rates[j].Read+rates[j].Write
+		})
+	}
+	b, err := json.Marshal(summary)
+	if err != nil {
+		log.Printf("Dashboard: %v", err)
+		return
+	}
+	d.hub.Publish(b)
+}
+
+// eventHub fans messages out to any number of Server-Sent Events clients.
+// A client that can't keep up misses messages rather than holding up the
+// others; a newly connected client first gets the latest message.
+type eventHub struct {
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+	latest  []byte
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{clients: make(map[chan []byte]struct{})}
+}
+
+// Publish sends msg, a single line of JSON, to every client. A nil msg only
+// forgets the latest one.
+func (h *eventHub) Publish(msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.latest = msg
+	if msg == nil {
+		return
+	}
+	for c := range h.clients {
+		select {
+		case c <- msg:
+		default:
+		}
+	}
+}
+
+// Clients returns the number of connected clients.
+func (h *eventHub) Clients() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+func (h *eventHub) subscribe() (chan []byte, []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := make(chan []byte, 4)
+	h.clients[c] = struct{}{}
+	return c, h.latest
+}
+
+func (h *eventHub) unsubscribe(c chan []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, c)
+}
+
+func (h *eventHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.serveEvents(w, r, nil)
+}
+
+// serveEvents streams the messages to one client, starting with the latest
+// one or, if there is none and initial is set, what initial returns.
+func (h *eventHub) serveEvents(w http.ResponseWriter, r *http.Request, initial func() []byte) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	c, latest := h.subscribe()
+	defer h.unsubscribe(c)
+	if latest == nil && initial != nil {
+		latest = initial()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	if latest != nil {
+		fmt.Fprintf(w, "data: %s\n\n", latest)
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg := <-c:
+			fmt.Fprintf(w, "data: %s\n\n", msg)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// rename records a flag or config key that was renamed. Old names keep
+// working with a deprecation warning until they are dropped in a later
+// release; migrate-config rewrites config files to the new keys.
+type rename struct {
+	Old, New string
+}
+
+var renamedFlags = []rename{
+	{"enable-prometheus", "disable-prometheus"}, // the old name did the opposite of what it said
+	{"n", "top-n"},
+}
+
+// renamedConfigKeys are dotted key paths, moved in the order listed.
+var renamedConfigKeys = []rename{
+	{"top_n", "request.top_n"},
+	{"estimators", "request.estimators"},
+	{"sort_by", "request.sort_by"},
+}
+
+func renamedFlag(name string) bool {
+	for _, r := range renamedFlags {
+		if r.Old == name {
+			return true
+		}
+	}
+	return false
+}
+
+// registerDeprecatedFlags registers the old name of every renamed flag as an
+// alias of the new one. Call it after registerFlags.
+func registerDeprecatedFlags(fs *flag.FlagSet) {
+	for _, r := range renamedFlags {
+		f := fs.Lookup(r.New)
+		if f == nil {
+			panic("renamed flag -" + r.New + " is not registered")
+		}
+		fs.Var(&deprecatedFlag{Value: f.Value, rename: r}, r.Old, fmt.Sprintf("Deprecated: use -%s", r.New))
+	}
+}
+
+// deprecatedFlag forwards to the flag that replaced it, warning once.
+type deprecatedFlag struct {
+	flag.Value
+	rename rename
+	warned bool
+}
+
+func (f *deprecatedFlag) Set(s string) error {
+	if !f.warned {
+		slog.Warn("deprecated flag", "flag", f.rename.Old, "replacement", f.rename.New)
+		f.warned = true
+	}
+	return f.Value.Set(s)
+}
+
+func (f *deprecatedFlag) IsBoolFlag() bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// loadConfig is loadYAML for the monitor configuration: deprecated keys are
+// moved to their new place, with a warning, before the file is validated.
+func loadConfig(path string, cfg *config) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	b, applied, err := migrateConfig(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, r := range applied {
+		slog.Warn("deprecated config key", "file", path, "key", r.Old, "replacement", r.New)
+	}
+	return decodeYAMLFile(path, b, cfg)
+}
+
+// migrateConfig moves the renamed keys of a config file and returns the
+// renames it applied. Key order is preserved; comments are not.
+func migrateConfig(b []byte) ([]byte, []rename, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, nil, err
+	}
+
+	var applied []rename
+	for _, r := range renamedConfigKeys {
+		v, ok := takeKey(&doc, strings.Split(r.Old, "."))
+		if !ok {
+			continue
+		}
+		if !putKey(&doc, strings.Split(r.New, "."), v) {
+			return nil, nil, fmt.Errorf("both %s and its replacement %s are set", r.Old, r.New)
+		}
+		applied = append(applied, r)
+	}
+	if len(applied) == 0 {
+		return b, nil, nil
+	}
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, applied, nil
+}
+
+// takeKey removes the value at path from m.
+func takeKey(m *yaml.MapSlice, path []string) (any, bool) {
+	for i, item := range *m {
+		if fmt.Sprint(item.Key) != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			*m = append((*m)[:i], (*m)[i+1:]...)
+			return item.Value, true
+		}
+		sub, ok := item.Value.(yaml.MapSlice)
+		if !ok {
+			return nil, false
+		}
+		v, ok := takeKey(&sub, path[1:])
+		(*m)[i].Value = sub
+		return v, ok
+	}
+	return nil, false
+}
+
+// putKey sets path in m to v, creating intermediate mappings. It returns
+// false if the key already exists.
+func putKey(m *yaml.MapSlice, path []string, v any) bool {
+	for i, item := range *m {
+		if fmt.Sprint(item.Key) != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return false
+		}
+		sub, ok := item.Value.(yaml.MapSlice)
+		if !ok {
+			return false
+		}
+		if !putKey(&sub, path[1:], v) {
+			return false
+		}
+		(*m)[i].Value = sub
+		return true
+	}
+
+	for j := len(path) - 1; j > 0; j-- {
+		v = yaml.MapSlice{{Key: path[j], Value: v}}
+	}
+	*m = append(*m, yaml.MapItem{Key: path[0], Value: v})
+	return true
+}
+
+// runMigrateConfig rewrites a config file to the current schema.
+func runMigrateConfig(args []string) {
+	fs := flag.NewFlagSet("migrate-config", flag.ExitOnError)
+	inPlace := fs.Bool("w", false, "Rewrite the file in place instead of printing the result")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s migrate-config [-w] <config.yaml>\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Moves deprecated keys to their current place. Comments are not preserved.")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path := fs.Arg(0)
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, applied, err := migrateConfig(b)
+	if err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+	for _, r := range applied {
+		log.Printf("%s -> %s", r.Old, r.New)
+	}
+	if err := decodeYAMLFile(path, out, new(config)); err != nil {
+		log.Fatalf("Migrated configuration is still invalid:\n%v", err)
+	}
+
+	if !*inPlace {
+		os.Stdout.Write(out)
+		return
+	}
+	if len(applied) == 0 {
+		log.Printf("%s is up to date", path)
+		return
+	}
+	if err := writeFileAtomic(path, out); err != nil {
+		log.Fatalf("Error writing %s: %v", path, err)
+	}
+	log.Printf("Updated %s", path)
+}
+
+// writeFileAtomic replaces path through a temporary file in the same
+// directory, so readers never see a partial write.
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if st, err := os.Stat(path); err == nil {
+		tmp.Chmod(st.Mode().Perm())
+	} else {
+		tmp.Chmod(0o644)
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		applied []string // old keys
+		err     string
+	}{
+		{
+			name: "current",
+			in:   "grpc:\n  host: mgm\nrequest:\n  top_n: 50\n",
+			want: "grpc:\n  host: mgm\nrequest:\n  top_n: 50\n",
+		},
+		{
+			name:    "moved to a new section",
+			in:      "grpc:\n  host: mgm\ntop_n: 50\n",
+			want:    "grpc:\n  host: mgm\nrequest:\n  top_n: 50\n",
+			applied: []string{"top_n"},
+		},
+		{
+			name:    "moved to an existing section",
+			in:      "request:\n  estimators: [SMA_1_MINUTES]\nsort_by: SMA_1_MINUTES\n",
+			want:    "request:\n  estimators:\n  - SMA_1_MINUTES\n  sort_by: SMA_1_MINUTES\n",
+			applied: []string{"sort_by"},
+		},
+		{
+			name:    "all in order",
+			in:      "sort_by: SMA_5_SECONDS\nestimators: [SMA_5_SECONDS]\ntop_n: 10\n",
+			want:    "request:\n  top_n: 10\n  estimators:\n  - SMA_5_SECONDS\n  sort_by: SMA_5_SECONDS\n",
+			applied: []string{"top_n", "estimators", "sort_by"},
+		},
+		{
+			name: "both set",
+			in:   "top_n: 10\nrequest:\n  top_n: 50\n",
+			err:  "both top_n and its replacement request.top_n are set",
+		},
+		{
+			name: "replacement parent not a mapping",
+			in:   "top_n: 10\nrequest: 50\n",
+			err:  "both top_n and its replacement request.top_n are set",
+		},
+		{
+			name: "invalid",
+			in:   "top_n: [10\n",
+			err:  "yaml:",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, applied, err := migrateConfig([]byte(tt.in))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("migrated to\n%s\nwant\n%s", out, tt.want)
+			}
+			var old []string
+			for _, r := range applied {
+				old = append(old, r.Old)
+			}
+			if !slices.Equal(old, tt.applied) {
+				t.Errorf("applied %v, want %v", old, tt.applied)
+			}
+			cfg := defaultConfig()
+			if err := decodeYAMLFile("config.yaml", out, &cfg); err != nil {
+				t.Errorf("migrated config is invalid: %v", err)
+			}
+		})
+	}
+}
+
+func TestDeprecatedFlags(t *testing.T) {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	registerFlags(fs, &cfg)
+	registerDeprecatedFlags(fs)
+	if err := fs.Parse([]string{"-n", "5"}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Request.TopN != 5 {
+		t.Errorf("-n 5 set top_n to %d", cfg.Request.TopN)
+	}
+	if !renamedFlag("n") || renamedFlag("top-n") {
+		t.Error("renamedFlag doesn't tell the old name from the new one")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+func diffCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff [flags] <before> <after>",
+		Short: "Compare the rates of two recordings or snapshots",
+		Long: "Compares the mean rate of every entity over two recordings or snapshots,\n" +
+			"e.g. taken before and after a change of the shaping policy, and lists the\n" +
+			"entities that appeared, disappeared or whose rate changed by more than\n" +
+			"--threshold.",
+		Args: cobra.ExactArgs(2),
+	}
+	estimator := cmd.Flags().String("estimator", "SMA_1_MINUTES", "Estimator whose rates are compared")
+	direction := cmd.Flags().String("direction", "total", "Rate compared (read, write or total)")
+	threshold := cmd.Flags().Float64("threshold", 0.5, "Relative change from which a rate counts as changed, e.g. 0.5 for 50%")
+	minRate := cmd.Flags().String("min-rate", "1MB/s", "Ignore the entities below this rate in both files")
+	target := cmd.Flags().String("target", "", "Only compare the reports of this target of multi-target recordings")
+	cmd.Run = func(cmd *cobra.Command, paths []string) {
+		if _, err := parseEstimator(*estimator); err != nil {
+			log.Fatalf("Invalid --estimator: %v", err)
+		}
+		switch *direction {
+		case "read", "write", "total":
+		default:
+			log.Fatalf("Invalid --direction %q (expected read, write or total)", *direction)
+		}
+		if *threshold <= 0 {
+			log.Fatal("--threshold must be positive")
+		}
+		floor, err := parseByteRate(*minRate)
+		if err != nil {
+			log.Fatalf("Invalid --min-rate: %v", err)
+		}
+
+		var means [2]*recordingMeans
+		for i, path := range paths {
+			if means[i], err = meanRates(path, *target, *estimator, *direction); err != nil {
+				log.Fatalf("Error reading recording: %v", err)
+			}
+			if means[i].reports == 0 {
+				log.Fatalf("%s: no reports", path)
+			}
+		}
+		fmt.Printf("Comparing the mean %s rates on %s of %s (%d reports) and %s (%d reports)\n\n",
+			*direction, *estimator, paths[0], means[0].reports, paths[1], means[1].reports)
+		printRateDiff(os.Stdout, diffRates(means[0].rates, means[1].rates, *threshold, floor), *threshold)
+	}
+	return cmd
+}
+
+// recordingMeans holds the mean rate of every entity over the reports of a
+// recording, counting the reports an entity is missing from as 0.
+type recordingMeans struct {
+	reports int
+	rates   map[entityKey]float64
+}
+
+func meanRates(path, target, estimator, direction string) (*recordingMeans, error) {
+	r, err := openRecording(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	m := &recordingMeans{rates: make(map[entityKey]float64)}
+	for {
+		f, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if target != "" && f.Target != target {
+			continue
+		}
+		m.reports++
+		for _, e := range reportEntities(f.Report) {
+			s, ok := sampleOf(e.Stats, estimator)
+			if !ok {
+				continue
+			}
+			rate := s.read + s.write
+			switch direction {
+			case "read":
+				rate = s.read
+			case "write":
+				rate = s.write
+			}
+			m.rates[entityKey{e.Type, e.ID}] += rate
+		}
+	}
+	for key := range m.rates {
+		m.rates[key] /= float64(m.reports)
+	}
+	return m, nil
+}
+
+type rateChange struct {
+	entity        entityKey
+	before, after float64
+}
+
+// change returns the change of the rate relative to before, +Inf for an
+// entity that appeared.
+func (c rateChange) change() float64 {
+	if c.before == 0 {
+		return math.Inf(1)
+	}
+	return (c.after - c.before) / c.before
+}
+
+type rateDiff struct {
+	appeared, disappeared, changed []rateChange
+}
+
+// diffRates compares the rates before and after, ignoring the entities
+// below floor in both.
+func diffRates(before, after map[entityKey]float64, threshold, floor float64) rateDiff {
+	var d rateDiff
+	for key, b := range before {
+		a := after[key]
+		switch {
+		case b < floor && a < floor:
+		case a == 0:
+			d.disappeared = append(d.disappeared, rateChange{key, b, 0})
+		case math.Abs(a-b) > threshold*b:
+			d.changed = append(d.changed, rateChange{key, b, a})
+		}
+	}
+	for key, a := range after {
+		if _, ok := before[key]; !ok && a >= floor {
+			d.appeared = append(d.appeared, rateChange{key, 0, a})
+		}
+	}
+
+	typeOrder := map[string]int{"app": 0, "user": 1, "group": 2}
+	for _, list := range [][]rateChange{d.appeared, d.disappeared, d.changed} {
+		sort.Slice(list, func(i, j int) bool {
+			if ti, tj := typeOrder[list[i].entity.Type], typeOrder[list[j].entity.Type]; ti != tj {
+				return ti < tj
+			}
+			if di, dj := math.Abs(list[i].after-list[i].before), math.Abs(list[j].after-list[j].before); di != dj {
+				return di > dj
+			}
+			return list[i].entity.ID < list[j].entity.ID
+		})
+	}
+	return d
+}
+
+func printRateDiff(out io.Writer, d rateDiff, threshold float64) {
+	if len(d.appeared)+len(d.disappeared)+len(d.changed) == 0 {
+		fmt.Fprintf(out, "No entity appeared, disappeared or changed by more than %.0f%%.\n", threshold*100)
+		return
+	}
+	for _, section := range []struct {
+		title string
+		list  []rateChange
+	}{
+		{"Appeared", d.appeared},
+		{"Disappeared", d.disappeared},
+		{fmt.Sprintf("Changed by more than %.0f%%", threshold*100), d.changed},
+	} {
+		if len(section.list) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "%s:\n", section.title)
+		w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "Type\tID\tBefore\tAfter\tChange")
+		for _, c := range section.list {
+			change := "new"
+			if !math.IsInf(c.change(), 1) {
+				change = fmt.Sprintf("%+.0f%%", c.change()*100)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s/s\t%s/s\t%s\n", c.entity.Type, c.entity.ID,
+				humanizeBytes(c.before), humanizeBytes(c.after), change)
+		}
+		w.Flush()
+		fmt.Fprintln(out)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// rowSorter orders the entities client-side, independently of the
+// SortByEstimator the MGM sorts by: by decreasing read, write or total
+// rate on estimator, or by id, numerically for uids and gids.
+type rowSorter struct {
+	by        string
+	estimator string
+}
+
+func newRowSorter(by, estimator string) (*rowSorter, error) {
+	switch by {
+	case "read", "write", "total", "id":
+	default:
+		return nil, fmt.Errorf("unknown sort %q (expected read, write, total or id)", by)
+	}
+	if _, err := parseEstimator(estimator); err != nil {
+		return nil, err
+	}
+	return &rowSorter{by: by, estimator: estimator}, nil
+}
+
+func (s *rowSorter) rate(stats []*pb.RateStats) float64 {
+	for _, st := range stats {
+		if st.Window.String() != s.estimator {
+			continue
+		}
+		switch s.by {
+		case "read":
+			return st.BytesReadPerSec
+		case "write":
+			return st.BytesWrittenPerSec
+		}
+		return st.BytesReadPerSec + st.BytesWrittenPerSec
+	}
+	return 0
+}
+
+func (s *rowSorter) compare(idA string, statsA []*pb.RateStats, idB string, statsB []*pb.RateStats) int {
+	if s.by != "id" {
+		if a, b := s.rate(statsA), s.rate(statsB); a != b {
+			if a > b {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	}
+	a, errA := strconv.Atoi(idA)
+	b, errB := strconv.Atoi(idB)
+	if errA == nil && errB == nil {
+		return a - b
+	}
+	if idA < idB {
+		return -1
+	} else if idA > idB {
+		return 1
+	}
+	return 0
+}
+
+// Sort orders rows in place. The other and overflow rows stay last.
+func (s *rowSorter) Sort(rows []entityRow) {
+	slices.SortStableFunc(rows, func(a, b entityRow) int {
+		if sa, sb := summaryRow(a.ID), summaryRow(b.ID); sa != sb {
+			if sa {
+				return 1
+			}
+			return -1
+		}
+		return s.compare(a.ID, a.Stats, b.ID, b.Stats)
+	})
+}
+
+func summaryRow(id string) bool {
+	return id == filterOther || id == overflowID
+}
+
+// SortReport returns a copy of report with its entries sorted, so the
+// API, stream and sinks get them in the order shown.
+func (s *rowSorter) SortReport(report *pb.TrafficShapingRateResponse) *pb.TrafficShapingRateResponse {
+	apps := slices.Clone(report.AppStats)
+	slices.SortStableFunc(apps, func(a, b *pb.AppRateEntry) int {
+		return s.compare(a.AppName, a.Stats, b.AppName, b.Stats)
+	})
+	users := slices.Clone(report.UserStats)
+	slices.SortStableFunc(users, func(a, b *pb.UserRateEntry) int {
+		return s.compare(strconv.Itoa(int(a.Uid)), a.Stats, strconv.Itoa(int(b.Uid)), b.Stats)
+	})
+	groups := slices.Clone(report.GroupStats)
+	slices.SortStableFunc(groups, func(a, b *pb.GroupRateEntry) int {
+		return s.compare(strconv.Itoa(int(a.Gid)), a.Stats, strconv.Itoa(int(b.Gid)), b.Stats)
+	})
+	return &pb.TrafficShapingRateResponse{
+		TimestampMs:                     report.TimestampMs,
+		AppStats:                        apps,
+		UserStats:                       users,
+		GroupStats:                      groups,
+		FstLimitsUpdateThreadLoopStats:  report.FstLimitsUpdateThreadLoopStats,
+		EstimatorsUpdateThreadLoopStats: report.EstimatorsUpdateThreadLoopStats,
+	}
+}
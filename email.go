@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// Email notifiers are declared next to the rules and used as actions by
+// name:
+//
+//	email:
+//	  oncall:
+//	    server: smtp.example.org:587
+//	    tls: starttls                 # starttls (default), tls or none
+//	    username: eos-monitor         # omit to send without authentication
+//	    password_file: /etc/eos-monitor/smtp-password
+//	    from: eos-monitor@example.org
+//	    to: [eos-oncall@example.org]
+//	    subject: '[eos] {{.Rule}} {{.State}} for {{.EntityType}} {{.ID}}'
+//	    body: '{{.Summary}}'          # text/template, see webhookPayload
+//	    digest: 15m                   # batch alerts, one mail per interval (default 0: immediately)
+//
+// In digest mode the mail lists the body of every alert of the interval and
+// digest_subject, a template over the list of payloads, is its subject.
+
+const (
+	defaultEmailSubject       = "[eos] {{.Rule}} {{.State}} for {{.EntityType}} {{.ID}}"
+	defaultEmailBody          = "Alert {{.Rule}} is {{.State}} for {{.EntityType}} {{.ID}}.\n\n{{.Direction}} rate on {{.Estimator}}: {{humanize .Value}} ({{.Condition}})\nSince {{.Reports}} reports, at {{.Timestamp.Format \"2006-01-02 15:04:05 MST\"}}.\n"
+	defaultEmailDigestSubject = "[eos] {{len .}} alert notifications"
+
+	// emailDialTimeout bounds connecting to the SMTP server, emailTimeout the
+	// whole conversation of a mail.
+	emailDialTimeout = 30 * time.Second
+	emailTimeout     = 2 * time.Minute
+)
+
+type emailNotifier struct {
+	Server        string        `yaml:"server"`
+	TLS           string        `yaml:"tls"`
+	Username      string        `yaml:"username"`
+	PasswordFile  string        `yaml:"password_file"`
+	From          string        `yaml:"from"`
+	To            []string      `yaml:"to"`
+	Subject       string        `yaml:"subject"`
+	Body          string        `yaml:"body"`
+	Digest        time.Duration `yaml:"digest"`
+	DigestSubject string        `yaml:"digest_subject"`
+
+	name                         string
+	host                         string
+	password                     string
+	subject, body, digestSubject *template.Template
+	queue                        chan []webhookPayload
+	sent                         chan struct{} // closed once the queue is drained
+	stopDigest                   func()        // nil without digests
+
+	mu      sync.Mutex
+	pending []webhookPayload
+}
+
+// init validates the notifier and starts its queue and, in digest mode, the
+// digest timer.
+func (n *emailNotifier) init(name string) error {
+	host, _, err := net.SplitHostPort(n.Server)
+	if err != nil {
+		return fmt.Errorf("server must be host:port, got %q", n.Server)
+	}
+	n.host = host
+	switch n.TLS {
+	case "":
+		n.TLS = "starttls"
+	case "starttls", "tls", "none":
+	default:
+		return fmt.Errorf("tls must be starttls, tls or none, got %q", n.TLS)
+	}
+	if n.Username != "" {
+		b, err := os.ReadFile(n.PasswordFile)
+		if err != nil {
+			return err
+		}
+		n.password = strings.TrimSpace(string(b))
+	}
+	if n.From == "" || len(n.To) == 0 {
+		return errors.New("from and to are required")
+	}
+	if n.Digest < 0 {
+		return fmt.Errorf("digest must not be negative, got %s", n.Digest)
+	}
+
+	for _, t := range []struct {
+		field string
+		text  *string
+		def   string
+		tmpl  **template.Template
+	}{
+		{"subject", &n.Subject, defaultEmailSubject, &n.subject},
+		{"body", &n.Body, defaultEmailBody, &n.body},
+		{"digest_subject", &n.DigestSubject, defaultEmailDigestSubject, &n.digestSubject},
+	} {
+		if *t.text == "" {
+			*t.text = t.def
+		}
+		if *t.tmpl, err = template.New(t.field).Funcs(webhookFuncs).Parse(*t.text); err != nil {
+			return fmt.Errorf("%s: %w", t.field, err)
+		}
+	}
+
+	n.name = name
+	n.queue = make(chan []webhookPayload, webhookQueueSize)
+	n.sent = make(chan struct{})
+	go func() {
+		defer close(n.sent)
+		for payloads := range n.queue {
+			if err := n.send(payloads); err != nil {
+				log.Printf("Email %s: %v", n.name, err)
+			}
+		}
+	}()
+	if n.Digest > 0 {
+		n.stopDigest = every(n.Digest, n.digest)
+	}
+	return nil
+}
+
+// digest sends the alerts of the last digest interval in one mail.
+func (n *emailNotifier) digest() {
+	n.mu.Lock()
+	payloads := n.pending
+	n.pending = nil
+	n.mu.Unlock()
+	if len(payloads) > 0 {
+		n.enqueue(payloads)
+	}
+}
+
+// stop sends the pending digest and the queued mails.
+func (n *emailNotifier) stop() {
+	if n.stopDigest != nil {
+		n.stopDigest()
+		n.digest()
+	}
+	close(n.queue)
+	<-n.sent
+}
+
+// notify is the alert action of the notifier.
+func (n *emailNotifier) notify(ev alertEvent) {
+	p := newWebhookPayload(ev)
+	if n.Digest > 0 {
+		n.mu.Lock()
+		n.pending = append(n.pending, p)
+		n.mu.Unlock()
+		return
+	}
+	n.enqueue([]webhookPayload{p})
+}
+
+func (n *emailNotifier) enqueue(payloads []webhookPayload) {
+	select {
+	case n.queue <- payloads:
+	default:
+		log.Printf("Email %s: queue full, dropping %d alerts", n.name, len(payloads))
+	}
+}
+
+// message renders the mail for payloads: a single alert uses the subject
+// template, several the digest subject.
+func (n *emailNotifier) message(payloads []webhookPayload) ([]byte, error) {
+	var subject, body bytes.Buffer
+	var err error
+	if len(payloads) == 1 && n.Digest == 0 {
+		err = n.subject.Execute(&subject, payloads[0])
+	} else {
+		err = n.digestSubject.Execute(&subject, payloads)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rendering subject: %w", err)
+	}
+	for i, p := range payloads {
+		if i > 0 {
+			body.WriteString("\r\n----\r\n\r\n")
+		}
+		if err := n.body.Execute(&body, p); err != nil {
+			return nil, fmt.Errorf("rendering body: %w", err)
+		}
+	}
+
+	return n.compose(subject.String(), "text/plain", body.String()), nil
+}
+
+// compose returns the mail with subject and body, of the MIME type
+// contentType. The subject, rendered from ids the clients choose, has its
+// control characters replaced and is Q-encoded where needed, so it can't
+// add headers.
+func (n *emailNotifier) compose(subject, contentType, body string) []byte {
+	subject = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, subject)
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\nContent-Type: %s; charset=utf-8\r\n\r\n", contentType)
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return msg.Bytes()
+}
+
+func (n *emailNotifier) send(payloads []webhookPayload) error {
+	msg, err := n.message(payloads)
+	if err != nil {
+		return err
+	}
+	return n.deliver(msg)
+}
+
+// deliver sends msg to the recipients over SMTP, giving up after
+// emailTimeout so a stalled server doesn't hold up the following mails.
+func (n *emailNotifier) deliver(msg []byte) error {
+	dialer := &net.Dialer{Timeout: emailDialTimeout}
+	var conn net.Conn
+	var err error
+	if n.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", n.Server, &tls.Config{ServerName: n.host})
+	} else {
+		conn, err = dialer.Dial("tcp", n.Server)
+	}
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(emailTimeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, n.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if n.TLS == "starttls" {
+		if err := c.StartTLS(&tls.Config{ServerName: n.host}); err != nil {
+			c.Close()
+			return fmt.Errorf("STARTTLS: %w", err)
+		}
+	}
+	defer c.Close()
+
+	if n.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.Username, n.password, n.host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(n.From); err != nil {
+		return err
+	}
+	for _, to := range n.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEmailComposeSubject(t *testing.T) {
+	n := &emailNotifier{From: "monitor@example.org", To: []string{"ops@example.org"}}
+	for _, subject := range []string{
+		"[eos] high\r\nBcc: victim@example.org",
+		"[eos] high\rBcc: victim@example.org",
+		"[eos] high\nBcc: victim@example.org",
+		"[eos] high\x00\x1b[31m",
+	} {
+		msg := n.compose(subject, "text/plain", "body")
+		header, _, _ := bytes.Cut(msg, []byte("\r\n\r\n"))
+		for _, line := range strings.Split(string(header), "\r\n") {
+			if strings.HasPrefix(line, "Bcc:") || strings.ContainsAny(line, "\r\n\x00\x1b") {
+				t.Errorf("subject %q gave the header line %q", subject, line)
+			}
+		}
+	}
+
+	msg := n.compose("[eos] rate high for app rucio", "text/plain", "body")
+	if !bytes.Contains(msg, []byte("\r\nSubject: [eos] rate high for app rucio\r\n")) {
+		t.Errorf("plain subject encoded in\n%s", msg)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// entity is one app, user or group entry of a report, flattened so callers
+// don't have to handle the three entry types separately. Type uses the same
+// values as the entity_type metric label.
+type entity struct {
+	Type  string
+	ID    string
+	Stats []*pb.RateStats
+}
+
+// entityKey identifies an entity across reports.
+type entityKey struct {
+	Type, ID string
+}
+
+func reportEntities(report *pb.TrafficShapingRateResponse) []entity {
+	entities := make([]entity, 0, len(report.AppStats)+len(report.UserStats)+len(report.GroupStats))
+	for _, e := range report.AppStats {
+		entities = append(entities, entity{Type: "app", ID: e.AppName, Stats: e.Stats})
+	}
+	for _, e := range report.UserStats {
+		entities = append(entities, entity{Type: "user", ID: idString(e.Uid), Stats: e.Stats})
+	}
+	for _, e := range report.GroupStats {
+		entities = append(entities, entity{Type: "group", ID: idString(e.Gid), Stats: e.Stats})
+	}
+	return entities
+}
+
+// maxInternedIDs bounds the uids and gids idString keeps, as churning
+// entities would otherwise grow it forever; it starts over when full.
+const maxInternedIDs = 1 << 17
+
+var internedIDs = struct {
+	sync.Mutex
+	m map[uint32]string
+}{m: make(map[uint32]string)}
+
+// idString returns the decimal form of a uid or gid. The strings are
+// interned, so the same entities in every report don't allocate them again.
+func idString(id uint32) string {
+	internedIDs.Lock()
+	defer internedIDs.Unlock()
+	if s, ok := internedIDs.m[id]; ok {
+		return s
+	}
+	if len(internedIDs.m) >= maxInternedIDs {
+		clear(internedIDs.m)
+	}
+	s := strconv.FormatUint(uint64(id), 10)
+	internedIDs.m[id] = s
+	return s
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// estimatorSet is the set of estimators whose rates are exported to
+// Prometheus, all of them if nil, so a site can show every estimator on the
+// console but export only one, with a fraction of the series.
+type estimatorSet map[string]bool
+
+// newEstimatorSet returns the set of names, which must be among the
+// requested estimators, nil if names is empty.
+func newEstimatorSet(names, requested []string) (estimatorSet, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	s := make(estimatorSet, len(names))
+	for _, name := range names {
+		if _, err := parseEstimator(name); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(requested, name) {
+			return nil, fmt.Errorf("%s is not requested from the MGM (-estimators)", name)
+		}
+		s[name] = true
+	}
+	return s, nil
+}
+
+// stats returns the stats of the estimators of s.
+func (s estimatorSet) stats(stats []*pb.RateStats) []*pb.RateStats {
+	if s == nil {
+		return stats
+	}
+	out := make([]*pb.RateStats, 0, len(s))
+	for _, st := range stats {
+		if s[st.Window.String()] {
+			out = append(out, st)
+		}
+	}
+	return out
+}
+
+// rows returns rows with the stats of the estimators of s only.
+func (s estimatorSet) rows(rows map[string][]entityRow) map[string][]entityRow {
+	if s == nil {
+		return rows
+	}
+	out := make(map[string][]entityRow, len(rows))
+	for eType, list := range rows {
+		kept := make([]entityRow, len(list))
+		for i, row := range list {
+			kept[i] = entityRow{ID: row.ID, Name: row.Name, Stats: s.stats(row.Stats)}
+		}
+		out[eType] = kept
+	}
+	return out
+}
+
+// report returns the entities of report with the stats of the estimators of
+// s only.
+func (s estimatorSet) report(report *pb.TrafficShapingRateResponse) *pb.TrafficShapingRateResponse {
+	if s == nil {
+		return report
+	}
+	out := &pb.TrafficShapingRateResponse{TimestampMs: report.TimestampMs}
+	for _, e := range report.AppStats {
+		out.AppStats = append(out.AppStats, &pb.AppRateEntry{AppName: e.AppName, Stats: s.stats(e.Stats)})
+	}
+	for _, e := range report.UserStats {
+		out.UserStats = append(out.UserStats, &pb.UserRateEntry{Uid: e.Uid, Stats: s.stats(e.Stats)})
+	}
+	for _, e := range report.GroupStats {
+		out.GroupStats = append(out.GroupStats, &pb.GroupRateEntry{Gid: e.Gid, Stats: s.stats(e.Stats)})
+	}
+	return out
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// The fair-share policy is read from a YAML file passed with -fair-share:
+//
+//	estimator: SMA_1_MINUTES   # default SMA_1_MINUTES
+//	direction: total           # read, write or total (default total)
+//	active: 1MB/s              # rate above which a group competes (default 1MB/s)
+//	default_weight: 0          # weight of the groups not listed; 0 ignores them
+//	starved: 0.5               # usage below this share of the entitlement is starvation (default 0.5)
+//	over: 2                    # usage above this share is over-consumption (default 2)
+//	weights:
+//	  "2000": 3                # gid: weight
+//	  "2001": 1
+//
+// With every report, the throughput of the active groups is summed and each
+// one's actual share of it is compared with its entitled share, its weight
+// divided by the weights of all active groups. Idle groups don't count, as
+// their share is free for the others to use.
+
+var (
+	fairShareActual = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_fairshare_actual_ratio",
+			Help: "Share of the throughput of the active weighted groups used by the group",
+		},
+		[]string{"id"},
+	)
+	fairShareEntitled = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_fairshare_entitled_ratio",
+			Help: "Share of the throughput the group is entitled to by its weight among the active groups",
+		},
+		[]string{"id"},
+	)
+	fairShareUsage = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_fairshare_usage_ratio",
+			Help: "Actual share divided by entitled share; below 1 the group gets less than its share, above 1 more",
+		},
+		[]string{"id"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(fairShareActual, fairShareEntitled, fairShareUsage)
+}
+
+type fairShare struct {
+	Estimator     string             `yaml:"estimator"`
+	Direction     string             `yaml:"direction"`
+	Active        byteRate           `yaml:"active"`
+	DefaultWeight float64            `yaml:"default_weight"`
+	Starved       float64            `yaml:"starved"`
+	Over          float64            `yaml:"over"`
+	Weights       map[string]float64 `yaml:"weights"`
+
+	shares []groupShare // of the last report
+}
+
+// groupShare is the standing of one active group in a report.
+type groupShare struct {
+	ID       string
+	Rate     float64
+	Actual   float64
+	Entitled float64
+}
+
+// usage is the actual share relative to the entitled one.
+func (g groupShare) usage() float64 {
+	return g.Actual / g.Entitled
+}
+
+func loadFairShare(path string) (*fairShare, error) {
+	f := &fairShare{Estimator: "SMA_1_MINUTES", Direction: "total", Active: 1 << 20, Starved: 0.5, Over: 2}
+	if err := loadYAML(path, f); err != nil {
+		return nil, err
+	}
+	if err := f.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+func (f *fairShare) validate() error {
+	if _, err := parseEstimator(f.Estimator); err != nil {
+		return err
+	}
+	switch f.Direction {
+	case "read", "write", "total":
+	default:
+		return fmt.Errorf("direction must be read, write or total, got %q", f.Direction)
+	}
+	if f.Active < 0 {
+		return errors.New("active must not be negative")
+	}
+	if f.DefaultWeight < 0 {
+		return fmt.Errorf("default_weight must not be negative, got %g", f.DefaultWeight)
+	}
+	if f.Starved <= 0 || f.Over <= f.Starved {
+		return fmt.Errorf("need 0 < starved < over, got starved %g and over %g", f.Starved, f.Over)
+	}
+	if len(f.Weights) == 0 && f.DefaultWeight == 0 {
+		return errors.New("weights is required")
+	}
+	for id, w := range f.Weights {
+		if w <= 0 {
+			return fmt.Errorf("weights: %s: weight must be positive, got %g", id, w)
+		}
+	}
+	return nil
+}
+
+// value returns the rate of the group the policy looks at, and false if the
+// report has no sample of the policy's estimator for it.
+func (f *fairShare) value(stats []*pb.RateStats) (float64, bool) {
+	for _, s := range stats {
+		if s.Window.String() != f.Estimator {
+			continue
+		}
+		switch f.Direction {
+		case "read":
+			return s.BytesReadPerSec, true
+		case "write":
+			return s.BytesWrittenPerSec, true
+		default:
+			return s.BytesReadPerSec + s.BytesWrittenPerSec, true
+		}
+	}
+	return 0, false
+}
+
+func (f *fairShare) weight(id string) float64 {
+	if w, ok := f.Weights[id]; ok {
+		return w
+	}
+	return f.DefaultWeight
+}
+
+// Update computes the shares of the groups in report and exports them.
+func (f *fairShare) Update(report *pb.TrafficShapingRateResponse) {
+	var total, weights float64
+	f.shares = f.shares[:0]
+	for _, e := range reportEntities(report) {
+		if e.Type != "group" {
+			continue
+		}
+		w := f.weight(e.ID)
+		v, ok := f.value(e.Stats)
+		if w == 0 || !ok || v < float64(f.Active) {
+			continue
+		}
+		f.shares = append(f.shares, groupShare{ID: e.ID, Rate: v, Entitled: w})
+		total += v
+		weights += w
+	}
+	for i := range f.shares {
+		f.shares[i].Actual = f.shares[i].Rate / total
+		f.shares[i].Entitled /= weights
+	}
+	sort.Slice(f.shares, func(i, j int) bool {
+		return f.shares[i].usage() < f.shares[j].usage()
+	})
+
+	fairShareActual.Reset()
+	fairShareEntitled.Reset()
+	fairShareUsage.Reset()
+	for _, g := range f.shares {
+		fairShareActual.WithLabelValues(g.ID).Set(g.Actual)
+		fairShareEntitled.WithLabelValues(g.ID).Set(g.Entitled)
+		fairShareUsage.WithLabelValues(g.ID).Set(g.usage())
+	}
+}
+
+// status tells whether the usage of a group is outside the policy.
+func (f *fairShare) status(g groupShare) string {
+	switch u := g.usage(); {
+	case u < f.Starved:
+		return "STARVED"
+	case u > f.Over:
+		return "OVER"
+	default:
+		return ""
+	}
+}
+
+// print writes the shares of the last report, the most starved group first.
+func (f *fairShare) print(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "Group\tRate\tActual\tEntitled\tUsage\t")
+	for _, g := range f.shares {
+		fmt.Fprintf(w, "%s\t%s\t%.1f%%\t%.1f%%\t%.2f\t%s\n",
+			g.ID, humanizeBytes(g.Rate)+"/s", 100*g.Actual, 100*g.Entitled, g.usage(), f.status(g))
+	}
+	w.Flush()
+}
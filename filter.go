@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// entityFilter restricts the entities shown on the console and exported to
+// Prometheus. Each entity type has a list of id patterns (see match.go);
+// those prefixed with ! exclude. An entity is kept if it matches one of the
+// including patterns, or there are none, and none of the excluding ones.
+// Entities whose total rate on estimator is below minRate are filtered out
+// as well, which keeps the console and the metrics to meaningful traffic.
+// With other set, the rates of the entities filtered out are summed into an
+// "other" row, so totals still add up.
+type entityFilter struct {
+	include, exclude map[string]idPatterns // by entity type
+	minRate          float64
+	estimator        string
+	other            bool
+}
+
+// filterOther is the id of the row summing the entities filtered out.
+const filterOther = "other"
+
+// newEntityFilter parses the patterns of the apps, uids and gids.
+func newEntityFilter(apps, uids, gids []string, minRate float64, estimator string, other bool) (*entityFilter, error) {
+	if _, err := parseEstimator(estimator); err != nil {
+		return nil, err
+	}
+	f := &entityFilter{
+		include:   make(map[string]idPatterns),
+		exclude:   make(map[string]idPatterns),
+		minRate:   minRate,
+		estimator: estimator,
+		other:     other,
+	}
+	for eType, specs := range map[string][]string{"app": apps, "user": uids, "group": gids} {
+		for _, spec := range specs {
+			list := f.include
+			if s, ok := strings.CutPrefix(spec, "!"); ok {
+				spec, list = s, f.exclude
+			}
+			p, err := parseIDPattern(spec)
+			if err != nil {
+				return nil, fmt.Errorf("%s filter: %w", eType, err)
+			}
+			list[eType] = append(list[eType], p)
+		}
+	}
+	return f, nil
+}
+
+// RequestTypes returns the entity types to ask the MGM for: every type but
+// those the filter drops entirely, because none of its including patterns can
+// match an id of the type or one of its excluding patterns matches them all.
+// The request has no field for ids, so the patterns themselves are applied
+// to the reports as they come. With other, every type is asked for, to sum
+// the entities filtered out.
+func (f *entityFilter) RequestTypes() []pb.TrafficShapingRateRequest_EntityType {
+	var types []pb.TrafficShapingRateRequest_EntityType
+	for _, eType := range []string{"app", "user", "group"} {
+		if f == nil || f.other || !f.dropsAll(eType) {
+			types = append(types, entityTypeValues[eType])
+		}
+	}
+	return types
+}
+
+// dropsAll reports whether the patterns of eType filter out every entity
+// of the type.
+func (f *entityFilter) dropsAll(eType string) bool {
+	numeric := eType != "app"
+	for _, p := range f.exclude[eType] {
+		if p.matchesEvery(numeric) {
+			return true
+		}
+	}
+	inc := f.include[eType]
+	if !numeric || len(inc) == 0 {
+		return false
+	}
+	for _, p := range inc {
+		if !p.matchesNoNumber() {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *entityFilter) keep(eType string, row entityRow) bool {
+	if inc := f.include[eType]; len(inc) > 0 && !inc.Match(row.ID) {
+		return false
+	}
+	if f.exclude[eType].Match(row.ID) {
+		return false
+	}
+	if f.minRate <= 0 {
+		return true
+	}
+	for _, s := range row.Stats {
+		if s.Window.String() == f.estimator {
+			return s.BytesReadPerSec+s.BytesWrittenPerSec >= f.minRate
+		}
+	}
+	return false
+}
+
+// Apply returns the rows of eType that pass the filter, followed by the
+// other row if enabled and anything was filtered out.
+func (f *entityFilter) Apply(eType string, rows []entityRow) []entityRow {
+	if f == nil {
+		return rows
+	}
+	out := make([]entityRow, 0, len(rows))
+	var other *entityRow
+	for _, row := range rows {
+		if f.keep(eType, row) {
+			out = append(out, row)
+			continue
+		}
+		if !f.other {
+			continue
+		}
+		if other == nil {
+			other = &entityRow{ID: filterOther}
+		}
+		other.Stats = addRateStats(other.Stats, row.Stats)
+	}
+	if other != nil {
+		out = append(out, *other)
+	}
+	return out
+}
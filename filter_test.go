@@ -0,0 +1,49 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+func TestEntityFilterRequestTypes(t *testing.T) {
+	const (
+		app   = pb.TrafficShapingRateRequest_ENTITY_APP
+		user  = pb.TrafficShapingRateRequest_ENTITY_UID
+		group = pb.TrafficShapingRateRequest_ENTITY_GID
+	)
+	tests := []struct {
+		name             string
+		apps, uids, gids []string
+		other            bool
+		want             []pb.TrafficShapingRateRequest_EntityType
+	}{
+		{name: "no patterns", want: []pb.TrafficShapingRateRequest_EntityType{app, user, group}},
+		{name: "including patterns", apps: []string{"rucio*"}, uids: []string{"1000-1999"}, want: []pb.TrafficShapingRateRequest_EntityType{app, user, group}},
+		{name: "excluding every uid and gid", uids: []string{"!*"}, gids: []string{"!**"}, want: []pb.TrafficShapingRateRequest_EntityType{app}},
+		{name: "excluding every app", apps: []string{"!~.*"}, want: []pb.TrafficShapingRateRequest_EntityType{user, group}},
+		{name: "glob not excluding every app", apps: []string{"!*"}, want: []pb.TrafficShapingRateRequest_EntityType{app, user, group}},
+		{name: "excluding some", uids: []string{"!~^0$", "!0-99"}, want: []pb.TrafficShapingRateRequest_EntityType{app, user, group}},
+		{name: "uids can't match", uids: []string{"atlas", "cms*"}, want: []pb.TrafficShapingRateRequest_EntityType{app, group}},
+		{name: "uids may match", uids: []string{"atlas", "1[0-9]*"}, want: []pb.TrafficShapingRateRequest_EntityType{app, user, group}},
+		{name: "uid regex may match", uids: []string{"~atlas"}, want: []pb.TrafficShapingRateRequest_EntityType{app, user, group}},
+		{name: "other", uids: []string{"!*"}, other: true, want: []pb.TrafficShapingRateRequest_EntityType{app, user, group}},
+		{name: "everything dropped", apps: []string{"!~.*"}, uids: []string{"!*"}, gids: []string{"x"}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newEntityFilter(tt.apps, tt.uids, tt.gids, 0, "SMA_1_MINUTES", tt.other)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.RequestTypes(); !slices.Equal(got, tt.want) {
+				t.Errorf("RequestTypes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	var none *entityFilter
+	if got := none.RequestTypes(); len(got) != 3 {
+		t.Errorf("RequestTypes() without a filter = %v", got)
+	}
+}
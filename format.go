@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"text/template"
+	"time"
+)
+
+// outputFormat prints every report as lines of text built by templates
+// instead of the console tables, for log pipelines expecting a given
+// format: the header template once per report, if set, then the entity
+// template once per entity shown. For example
+//
+//	-format-header '# {{.Time.Unix}} {{.Entities}} entities'
+//	-format '{{.Time.Unix}} {{.Type}}={{.ID}} read={{.Read}} write={{.Write}}'
+//
+// A newline is added to the lines that don't end with one. The templates
+// have the json and humanize functions of the webhook bodies.
+type outputFormat struct {
+	header *template.Template
+	entity *template.Template
+}
+
+// formatHeader is the data of the header template. The rates are on the
+// sort estimator, summed over the entities shown.
+type formatHeader struct {
+	Time        time.Time
+	Estimator   string
+	Entities    int
+	Read, Write float64
+}
+
+// formatEntity is the data of the entity template. Read, Write and Total
+// are on the sort estimator; Rates has them for every estimator reported.
+type formatEntity struct {
+	Time      time.Time
+	Type      string // app, user or group
+	ID        string
+	Name      string // resolved with -resolve-names
+	Estimator string
+	formatRate
+	Rates map[string]formatRate
+}
+
+type formatRate struct {
+	Read, Write, Total float64
+}
+
+func newOutputFormat(entity, header string) (*outputFormat, error) {
+	f := &outputFormat{}
+	var err error
+	if f.entity, err = template.New("format").Funcs(webhookFuncs).Parse(entity); err != nil {
+		return nil, err
+	}
+	if header != "" {
+		if f.header, err = template.New("format-header").Funcs(webhookFuncs).Parse(header); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Write prints the lines of the report of ts, whose rows of every entity
+// type are shown, to out.
+func (f *outputFormat) Write(out io.Writer, ts time.Time, estimator string, rows map[string][]entityRow) error {
+	var entities []formatEntity
+	head := formatHeader{Time: ts, Estimator: estimator}
+	for _, eType := range []string{"app", "user", "group"} {
+		for _, row := range rows[eType] {
+			e := formatEntity{Time: ts, Type: eType, ID: row.ID, Name: row.Name, Estimator: estimator, Rates: make(map[string]formatRate)}
+			for _, s := range row.Stats {
+				rate := formatRate{s.BytesReadPerSec, s.BytesWrittenPerSec, s.BytesReadPerSec + s.BytesWrittenPerSec}
+				e.Rates[s.Window.String()] = rate
+				if s.Window.String() == estimator {
+					e.formatRate = rate
+				}
+			}
+			head.Entities++
+			head.Read += e.Read
+			head.Write += e.Write
+			entities = append(entities, e)
+		}
+	}
+
+	var b bytes.Buffer
+	if f.header != nil {
+		if err := execLine(&b, f.header, head); err != nil {
+			return err
+		}
+	}
+	for _, e := range entities {
+		if err := execLine(&b, f.entity, e); err != nil {
+			return err
+		}
+	}
+	_, err := out.Write(b.Bytes())
+	return err
+}
+
+func execLine(b *bytes.Buffer, t *template.Template, data any) error {
+	start := b.Len()
+	if err := t.Execute(b, data); err != nil {
+		return err
+	}
+	if b.Len() > start && b.Bytes()[b.Len()-1] != '\n' {
+		b.WriteByte('\n')
+	}
+	return nil
+}
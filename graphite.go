@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// graphiteSink sends every report to a Carbon daemon, one datapoint per
+// entity, estimator and direction, named after a template such as
+//
+//	eos.{cluster}.io.{entity_type}.{id}.{estimator}.{direction}
+//
+// Placeholders are {cluster}, {mgm}, {entity_type}, {id}, {estimator} and
+// {direction}; a template without {direction} gets ".{direction}" appended.
+// Dots and whitespace in the values are replaced by underscores so every
+// placeholder stays one path node.
+//
+// Datapoints go over a single TCP connection in batches, either as plaintext
+// lines or with the pickle protocol. A background writer reconnects with
+// backoff when the connection drops and resends the batch that failed.
+type graphiteSink struct {
+	address   string
+	pickle    bool
+	template  string
+	cluster   string
+	mgm       string
+	batchSize int
+
+	queue chan []graphitePoint
+	done  chan struct{}
+	conn  net.Conn
+}
+
+type graphitePoint struct {
+	path  string
+	value float64
+	ts    int64 // seconds
+}
+
+func newGraphiteSink(address, protocol, template string, batchSize int, cluster, mgm string) (*graphiteSink, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("Graphite address must be host:port: %w", err)
+	}
+	if protocol != "plaintext" && protocol != "pickle" {
+		return nil, fmt.Errorf("unsupported Graphite protocol %q (expected plaintext or pickle)", protocol)
+	}
+	if batchSize < 1 {
+		return nil, fmt.Errorf("Graphite batch size must be positive, got %d", batchSize)
+	}
+	if !strings.Contains(template, "{direction}") {
+		template += ".{direction}"
+	}
+	s := &graphiteSink{
+		address:   address,
+		pickle:    protocol == "pickle",
+		template:  template,
+		cluster:   cluster,
+		mgm:       mgm,
+		batchSize: batchSize,
+		queue:     make(chan []graphitePoint, 100),
+		done:      make(chan struct{}),
+	}
+	go s.writer()
+	return s, nil
+}
+
+var graphiteNodeEscaper = strings.NewReplacer(".", "_", " ", "_", "\t", "_", "\n", "_")
+
+func graphiteNode(v string) string {
+	if v == "" {
+		return "_"
+	}
+	return graphiteNodeEscaper.Replace(v)
+}
+
+func (s *graphiteSink) path(e entity, estimator, direction string) string {
+	return strings.NewReplacer(
+		"{cluster}", graphiteNode(s.cluster),
+		"{mgm}", graphiteNode(s.mgm),
+		"{entity_type}", graphiteNode(e.Type),
+		"{id}", graphiteNode(e.ID),
+		"{estimator}", graphiteNode(estimator),
+		"{direction}", direction,
+	).Replace(s.template)
+}
+
+func (s *graphiteSink) Send(report *pb.TrafficShapingRateResponse) error {
+	ts := report.TimestampMs / 1000
+	batch := make([]graphitePoint, 0, s.batchSize)
+	for _, e := range reportEntities(report) {
+		for _, st := range e.Stats {
+			est := st.Window.String()
+			batch = append(batch,
+				graphitePoint{s.path(e, est, "read"), st.BytesReadPerSec, ts},
+				graphitePoint{s.path(e, est, "write"), st.BytesWrittenPerSec, ts})
+			if len(batch) >= s.batchSize {
+				s.enqueue(batch)
+				batch = make([]graphitePoint, 0, s.batchSize)
+			}
+		}
+	}
+	if len(batch) > 0 {
+		s.enqueue(batch)
+	}
+	return nil
+}
+
+func (s *graphiteSink) enqueue(batch []graphitePoint) {
+	select {
+	case s.queue <- batch:
+	default:
+		log.Printf("Graphite: queue full, dropping %d datapoints", len(batch))
+	}
+}
+
+func (s *graphiteSink) writer() {
+	defer close(s.done)
+	defer func() {
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	}()
+	for batch := range s.queue {
+		backoff := time.Second
+		for attempt := 0; ; attempt++ {
+			err := s.write(batch)
+			if err == nil {
+				break
+			}
+			if s.conn != nil {
+				s.conn.Close()
+				s.conn = nil
+			}
+			if attempt == 3 {
+				log.Printf("Graphite: dropping %d datapoints: %v", len(batch), err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (s *graphiteSink) write(batch []graphitePoint) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.address, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	w := bufio.NewWriter(s.conn)
+	if s.pickle {
+		body := graphitePickle(batch)
+		binary.Write(w, binary.BigEndian, uint32(len(body)))
+		w.Write(body)
+	} else {
+		for _, p := range batch {
+			fmt.Fprintf(w, "%s %s %d\n", p.path, strconv.FormatFloat(p.value, 'f', -1, 64), p.ts)
+		}
+	}
+	return w.Flush()
+}
+
+// graphitePickle encodes the batch as the pickled list of
+// (path, (timestamp, value)) tuples Carbon expects, using the protocol 2
+// opcodes its safe unpickler accepts.
+func graphitePickle(batch []graphitePoint) []byte {
+	b := []byte{0x80, 2, ']', '('} // PROTO 2, EMPTY_LIST, MARK
+	for _, p := range batch {
+		b = append(b, 'X') // BINUNICODE
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(p.path)))
+		b = append(b, p.path...)
+		if p.ts >= math.MinInt32 && p.ts <= math.MaxInt32 {
+			b = append(b, 'J') // BININT
+			b = binary.LittleEndian.AppendUint32(b, uint32(int32(p.ts)))
+		} else {
+			b = append(b, 'G') // BINFLOAT
+			b = binary.BigEndian.AppendUint64(b, math.Float64bits(float64(p.ts)))
+		}
+		b = append(b, 'G')
+		b = binary.BigEndian.AppendUint64(b, math.Float64bits(p.value))
+		b = append(b, 0x86, 0x86) // TUPLE2, TUPLE2
+	}
+	return append(b, 'e', '.') // APPENDS, STOP
+}
+
+// Close sends the queued datapoints and closes the connection.
+func (s *graphiteSink) Close() error {
+	close(s.queue)
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(30 * time.Second):
+		return errors.New("Graphite: timed out sending the last datapoints")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// Named groups map uids, gids and apps to the experiments or activities they
+// belong to, and are read from a YAML file passed with -groups:
+//
+//	estimator: SMA_1_MINUTES   # shown on the console (default SMA_1_MINUTES)
+//	groups:
+//	  - name: ATLAS
+//	    uids: [10000-10999]    # patterns, see match.go
+//	    gids: ["2766"]
+//	    apps: ["atlas*"]
+//	  - name: CMS
+//	    uids: [20000-20999]
+//	    apps: ["~^(crab|cms)"]
+//
+// The rates of the entities of each group are summed per entity type, as the
+// apps, users and groups of a report are different views of the same
+// traffic and adding them up would count it several times. An entity
+// belongs to the first group that matches it.
+
+var (
+	groupReadBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_group_read_bytes_per_second",
+			Help: "Read throughput summed over the entities of a type in the named group",
+		},
+		[]string{"group", "entity_type", "estimator"},
+	)
+	groupWriteBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_group_write_bytes_per_second",
+			Help: "Write throughput summed over the entities of a type in the named group",
+		},
+		[]string{"group", "entity_type", "estimator"},
+	)
+	groupEntities = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_group_entities",
+			Help: "Number of entities of a type of the last report in the named group",
+		},
+		[]string{"group", "entity_type"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(groupReadBytes, groupWriteBytes, groupEntities)
+}
+
+type namedGroups struct {
+	Estimator string       `yaml:"estimator"`
+	Groups    []namedGroup `yaml:"groups"`
+
+	rates []groupRate // of the last report, on Estimator
+}
+
+type namedGroup struct {
+	Name string     `yaml:"name"`
+	UIDs idPatterns `yaml:"uids"`
+	GIDs idPatterns `yaml:"gids"`
+	Apps idPatterns `yaml:"apps"`
+}
+
+// groupRate is the rate of one named group in a report.
+type groupRate struct {
+	Name              string
+	App, User, Group  [2]float64 // read, write
+	Apps, Users, Gids int        // matching entities
+}
+
+func loadNamedGroups(path string) (*namedGroups, error) {
+	g := &namedGroups{Estimator: "SMA_1_MINUTES"}
+	if err := loadYAML(path, g); err != nil {
+		return nil, err
+	}
+	if err := g.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return g, nil
+}
+
+func (g *namedGroups) validate() error {
+	if _, err := parseEstimator(g.Estimator); err != nil {
+		return err
+	}
+	if len(g.Groups) == 0 {
+		return errors.New("groups is required")
+	}
+	seen := make(map[string]bool)
+	for i, group := range g.Groups {
+		switch {
+		case group.Name == "":
+			return fmt.Errorf("groups[%d]: name is required", i)
+		case seen[group.Name]:
+			return fmt.Errorf("groups[%d]: duplicate name %q", i, group.Name)
+		case len(group.UIDs)+len(group.GIDs)+len(group.Apps) == 0:
+			return fmt.Errorf("groups[%d]: %s has no uids, gids or apps", i, group.Name)
+		}
+		seen[group.Name] = true
+	}
+	return nil
+}
+
+// lookup returns the index of the group of an entity, -1 if none.
+func (g *namedGroups) lookup(eType, id string) int {
+	for i, group := range g.Groups {
+		var patterns idPatterns
+		switch eType {
+		case "app":
+			patterns = group.Apps
+		case "user":
+			patterns = group.UIDs
+		case "group":
+			patterns = group.GIDs
+		}
+		if patterns.Match(id) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Update sums the rates of the groups in report and exports them.
+func (g *namedGroups) Update(report *pb.TrafficShapingRateResponse) {
+	type key struct {
+		group int
+		eType string
+	}
+	sums := make(map[key]map[string][2]float64) // by estimator
+	counts := make(map[key]int)
+	for _, e := range reportEntities(report) {
+		i := g.lookup(e.Type, e.ID)
+		if i < 0 {
+			continue
+		}
+		k := key{i, e.Type}
+		counts[k]++
+		if sums[k] == nil {
+			sums[k] = make(map[string][2]float64)
+		}
+		for _, s := range e.Stats {
+			sum := sums[k][s.Window.String()]
+			sums[k][s.Window.String()] = [2]float64{sum[0] + s.BytesReadPerSec, sum[1] + s.BytesWrittenPerSec}
+		}
+	}
+
+	groupReadBytes.Reset()
+	groupWriteBytes.Reset()
+	groupEntities.Reset()
+	g.rates = g.rates[:0]
+	for i, group := range g.Groups {
+		for _, eType := range []string{"app", "user", "group"} {
+			k := key{i, eType}
+			groupEntities.WithLabelValues(group.Name, eType).Set(float64(counts[k]))
+			for estimator, sum := range sums[k] {
+				groupReadBytes.WithLabelValues(group.Name, eType, estimator).Set(sum[0])
+				groupWriteBytes.WithLabelValues(group.Name, eType, estimator).Set(sum[1])
+			}
+		}
+		r := groupRate{
+			Name:  group.Name,
+			App:   sums[key{i, "app"}][g.Estimator],
+			User:  sums[key{i, "user"}][g.Estimator],
+			Group: sums[key{i, "group"}][g.Estimator],
+			Apps:  counts[key{i, "app"}],
+			Users: counts[key{i, "user"}],
+			Gids:  counts[key{i, "group"}],
+		}
+		if r.Apps+r.Users+r.Gids > 0 {
+			g.rates = append(g.rates, r)
+		}
+	}
+	sort.SliceStable(g.rates, func(i, j int) bool {
+		return g.rates[i].total() > g.rates[j].total()
+	})
+}
+
+// total is the rate of the group by the view with the most traffic, which
+// is the most complete one when not every type is mapped.
+func (r groupRate) total() float64 {
+	return max(r.App[0]+r.App[1], r.User[0]+r.User[1], r.Group[0]+r.Group[1])
+}
+
+// print writes the rates of the groups of the last report per view, the
+// busiest group first.
+func (g *namedGroups) print(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(w, "Group\tApps Read\tApps Write\tUsers Read\tUsers Write\tGroups Read\tGroups Write\t\n")
+	for _, r := range g.rates {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", r.Name,
+			groupRateCell(r.App[0], r.Apps), groupRateCell(r.App[1], r.Apps),
+			groupRateCell(r.User[0], r.Users), groupRateCell(r.User[1], r.Users),
+			groupRateCell(r.Group[0], r.Gids), groupRateCell(r.Group[1], r.Gids))
+	}
+	w.Flush()
+}
+
+func groupRateCell(rate float64, entities int) string {
+	if entities == 0 {
+		return "-"
+	}
+	return humanizeBytes(rate) + "/s"
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	exporterSeries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "eos_exporter_rate_series",
+			Help: "Number of per-entity rate series exported for the last report",
+		},
+	)
+	exporterDropped = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_exporter_dropped_entities",
+			Help: "Entities of the last report folded into the overflow series by the series limit",
+		},
+		[]string{"entity_type"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(exporterSeries, exporterDropped)
+}
+
+// overflowID is the id of the series summing the entities over the limit.
+const overflowID = "overflow"
+
+// cardinalityGuard caps the number of per-entity rate series exported to
+// Prometheus, as a large top N produces tens of thousands of them. When a
+// report has more, the entities with the highest total rate on estimator
+// are kept, across entity types, and the rest of each type is summed into
+// an "overflow" series.
+type cardinalityGuard struct {
+	maxSeries int
+	estimator string
+}
+
+func newCardinalityGuard(maxSeries int, estimator string) (*cardinalityGuard, error) {
+	if maxSeries < 1 {
+		return nil, errors.New("series limit must be positive")
+	}
+	if _, err := parseEstimator(estimator); err != nil {
+		return nil, err
+	}
+	return &cardinalityGuard{maxSeries: maxSeries, estimator: estimator}, nil
+}
+
+// Limit returns the rows by entity type to export within the limit.
+func (g *cardinalityGuard) Limit(rows map[string][]entityRow) map[string][]entityRow {
+	type ranked struct {
+		eType string
+		row   entityRow
+		rate  float64
+	}
+	n := 0
+	for _, list := range rows {
+		n += len(list)
+	}
+	all := make([]ranked, 0, n)
+	series, maxStats := 0, 0
+	for eType, list := range rows {
+		exporterDropped.WithLabelValues(eType).Set(0)
+		for _, row := range list {
+			r := ranked{eType: eType, row: row}
+			for _, s := range row.Stats {
+				if s.Window.String() == g.estimator {
+					r.rate = s.BytesReadPerSec + s.BytesWrittenPerSec
+				}
+			}
+			all = append(all, r)
+			series += 2 * len(row.Stats)
+			maxStats = max(maxStats, len(row.Stats))
+		}
+	}
+	if series <= g.maxSeries {
+		exporterSeries.Set(float64(series))
+		return rows
+	}
+
+	// Leave room for an overflow series of every type.
+	budget := g.maxSeries - 2*maxStats*len(rows)
+	sort.SliceStable(all, func(i, j int) bool { return all[i].rate > all[j].rate })
+	out := make(map[string][]entityRow, len(rows))
+	overflow := make(map[string]*entityRow)
+	dropped := make(map[string]int)
+	series = 0
+	for _, r := range all {
+		if cost := 2 * len(r.row.Stats); series+cost <= budget {
+			out[r.eType] = append(out[r.eType], r.row)
+			series += cost
+			continue
+		}
+		o := overflow[r.eType]
+		if o == nil {
+			o = &entityRow{ID: overflowID}
+			overflow[r.eType] = o
+		}
+		o.Stats = addRateStats(o.Stats, r.row.Stats)
+		dropped[r.eType]++
+	}
+	for eType, o := range overflow {
+		out[eType] = append(out[eType], *o)
+		series += 2 * len(o.Stats)
+		exporterDropped.WithLabelValues(eType).Set(float64(dropped[eType]))
+	}
+	exporterSeries.Set(float64(series))
+	return out
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamHealth tracks the report stream for the health endpoints: /healthz
+// answers as long as the process serves HTTP, /readyz only while the stream
+// to the MGM is open and a report came within stale, so Kubernetes and load
+// balancers can tell a monitor exporting current rates from one stuck with
+// old ones.
+type streamHealth struct {
+	stale time.Duration
+
+	mu        sync.Mutex
+	connected bool
+	last      time.Time // when the last report was received
+}
+
+func newStreamHealth(stale time.Duration) (*streamHealth, error) {
+	if stale <= 0 {
+		return nil, errors.New("staleness window must be positive")
+	}
+	return &streamHealth{stale: stale}, nil
+}
+
+// Connected records whether the stream is open.
+func (h *streamHealth) Connected(connected bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.connected = connected
+}
+
+// Received records that a report was received.
+func (h *streamHealth) Received() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = time.Now()
+}
+
+// ready returns why the monitor isn't ready, nil if it is.
+func (h *streamHealth) ready() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case !h.connected:
+		return errors.New("not connected to the MGM")
+	case h.last.IsZero():
+		return errors.New("no report received yet")
+	case time.Since(h.last) > h.stale:
+		return fmt.Errorf("last report received %s ago (stale after %s)", time.Since(h.last).Round(time.Second), h.stale)
+	}
+	return nil
+}
+
+func (h *streamHealth) register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := h.ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+var (
+	entityReadRateDesc = prometheus.NewDesc(
+		"eos_io_entity_read_rate",
+		"Distribution of the read throughput in bytes/sec across the reported entities of a type",
+		[]string{"entity_type", "estimator"}, nil,
+	)
+	entityWriteRateDesc = prometheus.NewDesc(
+		"eos_io_entity_write_rate",
+		"Distribution of the write throughput in bytes/sec across the reported entities of a type",
+		[]string{"entity_type", "estimator"}, nil,
+	)
+)
+
+// rateHistograms exports the distribution of the per-entity rates of the
+// last report as histograms, so dashboards can show how many users are
+// above 100MB/s without the per-entity gauges. Each report replaces the
+// previous histograms rather than adding to them: they are a snapshot, like
+// the gauges, and their _count is the number of entities of the report.
+type rateHistograms struct {
+	buckets []float64
+
+	mu    sync.Mutex
+	hists map[[2]string]*rateHistogram // by entity type, estimator
+}
+
+type rateHistogram struct {
+	read, write rateDistribution
+}
+
+type rateDistribution struct {
+	count   uint64
+	sum     float64
+	buckets map[float64]uint64 // cumulative
+}
+
+// newRateHistograms parses the bucket upper bounds, byte rates such as
+// 100M.
+func newRateHistograms(buckets []string) (*rateHistograms, error) {
+	if len(buckets) == 0 {
+		return nil, errors.New("no buckets")
+	}
+	h := &rateHistograms{hists: make(map[[2]string]*rateHistogram)}
+	for _, b := range buckets {
+		v, err := parseByteRate(b)
+		if err != nil {
+			return nil, err
+		}
+		h.buckets = append(h.buckets, v)
+	}
+	sort.Float64s(h.buckets)
+	for i := 1; i < len(h.buckets); i++ {
+		if h.buckets[i] == h.buckets[i-1] {
+			return nil, fmt.Errorf("duplicate bucket %s", humanizeBytes(h.buckets[i]))
+		}
+	}
+	return h, nil
+}
+
+// Update replaces the histograms with the rates of report.
+func (h *rateHistograms) Update(report *pb.TrafficShapingRateResponse) {
+	hists := make(map[[2]string]*rateHistogram)
+	for _, e := range reportEntities(report) {
+		for _, s := range e.Stats {
+			k := [2]string{e.Type, s.Window.String()}
+			hist := hists[k]
+			if hist == nil {
+				hist = &rateHistogram{
+					read:  rateDistribution{buckets: make(map[float64]uint64, len(h.buckets))},
+					write: rateDistribution{buckets: make(map[float64]uint64, len(h.buckets))},
+				}
+				hists[k] = hist
+			}
+			h.observe(&hist.read, s.BytesReadPerSec)
+			h.observe(&hist.write, s.BytesWrittenPerSec)
+		}
+	}
+	h.mu.Lock()
+	h.hists = hists
+	h.mu.Unlock()
+}
+
+func (h *rateHistograms) observe(d *rateDistribution, v float64) {
+	d.count++
+	d.sum += v
+	for _, b := range h.buckets {
+		if v <= b {
+			d.buckets[b]++
+		}
+	}
+}
+
+func (h *rateHistograms) Describe(ch chan<- *prometheus.Desc) {
+	ch <- entityReadRateDesc
+	ch <- entityWriteRateDesc
+}
+
+func (h *rateHistograms) Collect(ch chan<- prometheus.Metric) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for k, hist := range h.hists {
+		ch <- prometheus.MustNewConstHistogram(entityReadRateDesc, hist.read.count, hist.read.sum, hist.read.buckets, k[0], k[1])
+		ch <- prometheus.MustNewConstHistogram(entityWriteRateDesc, hist.write.count, hist.write.sum, hist.write.buckets, k[0], k[1])
+	}
+}
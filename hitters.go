@@ -0,0 +1,406 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+var heavyHitterBytes = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "eos_io_heavy_hitter_bytes",
+		Help: "Estimated bytes moved over the window by the entities with the most, integrated from the rates",
+	},
+	[]string{"window", "entity_type", "id"},
+)
+
+func init() {
+	prometheus.MustRegister(heavyHitterBytes)
+}
+
+// hitterBuckets is the number of buckets a window is split into: the
+// windows slide in steps of a twelfth of their length.
+const hitterBuckets = 12
+
+// heavyHitters tracks the entities that moved the most bytes over windows
+// far longer than the estimators of the MGM, such as a day, answering who
+// moved the most data today. The bytes are integrated from the rates of one
+// estimator as for the byte counters, intervals longer than maxGap being
+// skipped, and counted in space-saving sketches, which keep capacity
+// counters per entity type whatever the number of entities: the counts of
+// the heavy hitters are off by at most their error, which is shown along
+// with them.
+//
+// Every window keeps a sketch per entity type for each twelfth of it, the
+// oldest being dropped as the window slides. The top k of every window and
+// type are exported with every report and served on /api/v1/heavy-hitters,
+// and the first show of them are shown on the console. They start from
+// scratch when the monitor restarts.
+type heavyHitters struct {
+	estimator string
+	direction string // read, write or total
+	k         int
+	capacity  int
+	maxGap    time.Duration
+	show      int
+
+	last    time.Time
+	windows []*hitterWindow
+
+	mu      sync.Mutex
+	ts      time.Time     // of the latest report
+	hitters []heavyHitter // top k of every window and type
+}
+
+type hitterWindow struct {
+	length  time.Duration
+	buckets []hitterBucket // oldest first
+}
+
+type hitterBucket struct {
+	start    time.Time
+	sketches map[string]*spaceSaving // by entity type
+}
+
+// heavyHitter is an entity among the top k of a window and type.
+type heavyHitter struct {
+	Window string  `json:"window"`
+	Type   string  `json:"type"`
+	ID     string  `json:"id"`
+	Bytes  float64 `json:"bytes"`
+	Error  float64 `json:"error"` // bound on how far off Bytes is
+}
+
+func newHeavyHitters(windows []time.Duration, estimator, direction string, k, capacity, show int, maxGap time.Duration) (*heavyHitters, error) {
+	if _, err := parseEstimator(estimator); err != nil {
+		return nil, err
+	}
+	switch direction {
+	case "read", "write", "total":
+	default:
+		return nil, errors.New("the direction must be read, write or total")
+	}
+	if k < 1 || capacity < k {
+		return nil, errors.New("at least one heavy hitter must be tracked, with a capacity of at least as many")
+	}
+	h := &heavyHitters{estimator: estimator, direction: direction, k: k, capacity: capacity, maxGap: maxGap, show: show}
+	for _, w := range windows {
+		if w < hitterBuckets*time.Second {
+			return nil, fmt.Errorf("heavy hitter window %s is shorter than %ds", w, hitterBuckets)
+		}
+		h.windows = append(h.windows, &hitterWindow{length: w})
+	}
+	if len(h.windows) == 0 {
+		return nil, errors.New("no heavy hitter window")
+	}
+	return h, nil
+}
+
+func (h *heavyHitters) register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/heavy-hitters", h.serve)
+}
+
+// Update counts the bytes of the interval since the previous report and
+// exports the heavy hitters.
+func (h *heavyHitters) Update(report *pb.TrafficShapingRateResponse) {
+	ts := time.UnixMilli(report.TimestampMs)
+	dt := ts.Sub(h.last)
+	integrate := !h.last.IsZero() && dt > 0 && dt <= h.maxGap
+	h.last = ts
+
+	for _, w := range h.windows {
+		w.slide(ts)
+	}
+	if integrate {
+		for _, e := range reportEntities(report) {
+			s, ok := sampleOf(e.Stats, h.estimator)
+			if !ok {
+				continue
+			}
+			rate := s.read + s.write
+			switch h.direction {
+			case "read":
+				rate = s.read
+			case "write":
+				rate = s.write
+			}
+			if rate <= 0 {
+				continue
+			}
+			for _, w := range h.windows {
+				w.buckets[len(w.buckets)-1].sketch(e.Type, h.capacity).Add(entityKey{e.Type, e.ID}, rate*dt.Seconds())
+			}
+		}
+	}
+
+	var hitters []heavyHitter
+	for _, w := range h.windows {
+		for _, eType := range []string{"app", "user", "group"} {
+			hitters = append(hitters, w.top(eType, h.k)...)
+		}
+	}
+	heavyHitterBytes.Reset()
+	for _, hh := range hitters {
+		heavyHitterBytes.WithLabelValues(hh.Window, hh.Type, hh.ID).Set(hh.Bytes)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ts, h.hitters = ts, hitters
+}
+
+// slide starts a new bucket if ts is past the current one and drops the
+// buckets that are out of the window.
+func (w *hitterWindow) slide(ts time.Time) {
+	step := w.length / hitterBuckets
+	if n := len(w.buckets); n == 0 || !ts.Before(w.buckets[n-1].start.Add(step)) {
+		w.buckets = append(w.buckets, hitterBucket{start: ts.Truncate(step), sketches: make(map[string]*spaceSaving)})
+	}
+	old := 0
+	for old < len(w.buckets) && !w.buckets[old].start.Add(step).After(ts.Add(-w.length)) {
+		old++
+	}
+	w.buckets = append(w.buckets[:0], w.buckets[old:]...)
+}
+
+// shortDuration formats d without its zero minutes and seconds, e.g. 24h
+// rather than 24h0m0s.
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+func (b hitterBucket) sketch(eType string, capacity int) *spaceSaving {
+	s := b.sketches[eType]
+	if s == nil {
+		s = newSpaceSaving(capacity)
+		b.sketches[eType] = s
+	}
+	return s
+}
+
+// top merges the sketches of eType over the buckets of the window and
+// returns the k entities with the most bytes. An entity missing from a full
+// sketch may have moved up to its smallest count there, which is added to
+// its error.
+func (w *hitterWindow) top(eType string, k int) []heavyHitter {
+	merged := make(map[entityKey]*heavyHitter)
+	for _, b := range w.buckets {
+		if s := b.sketches[eType]; s != nil {
+			for _, c := range s.counters {
+				hh := merged[c.key]
+				if hh == nil {
+					hh = &heavyHitter{Window: shortDuration(w.length), Type: c.key.Type, ID: c.key.ID}
+					merged[c.key] = hh
+				}
+				hh.Bytes += c.count
+				hh.Error += c.err
+			}
+		}
+	}
+	for _, b := range w.buckets {
+		s := b.sketches[eType]
+		if s == nil || !s.full() {
+			continue
+		}
+		for key, hh := range merged {
+			if _, ok := s.index[key]; !ok {
+				hh.Error += s.smallest()
+			}
+		}
+	}
+
+	out := make([]heavyHitter, 0, len(merged))
+	for _, hh := range merged {
+		out = append(out, *hh)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Bytes != out[j].Bytes {
+			return out[i].Bytes > out[j].Bytes
+		}
+		return out[i].ID < out[j].ID
+	})
+	if len(out) > k {
+		out = out[:k]
+	}
+	return out
+}
+
+// print prints the first show heavy hitters of every window and type.
+func (h *heavyHitters) print(out io.Writer) {
+	h.mu.Lock()
+	hitters := h.hitters
+	h.mu.Unlock()
+
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "Window\tType\tID\tBytes\tError\t")
+	shown := make(map[[2]string]int)
+	for _, hh := range hitters {
+		group := [2]string{hh.Window, hh.Type}
+		if shown[group] >= h.show {
+			continue
+		}
+		shown[group]++
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t±%s\t\n", hh.Window, hh.Type, hh.ID, humanizeBytes(hh.Bytes), humanizeBytes(hh.Error))
+	}
+	w.Flush()
+}
+
+// heavyHittersResponse is the response of /api/v1/heavy-hitters.
+type heavyHittersResponse struct {
+	Timestamp int64         `json:"timestamp"` // of the latest report, in milliseconds
+	Estimator string        `json:"estimator"`
+	Direction string        `json:"direction"`
+	Hitters   []heavyHitter `json:"hitters"`
+}
+
+// serve answers /api/v1/heavy-hitters with the first n (default all)
+// heavy hitters of every window, or of one ?window=, and type, or of one
+// ?type=, by decreasing bytes.
+func (h *heavyHitters) serve(w http.ResponseWriter, r *http.Request) {
+	if !readOnly(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	eType, ok := entityTypeParam(w, r)
+	if !ok {
+		return
+	}
+	window := q.Get("window")
+	if window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("window must be a duration, got %q", window), http.StatusBadRequest)
+			return
+		}
+		window = shortDuration(d)
+	}
+	n := h.k
+	if v := q.Get("n"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 1 {
+			http.Error(w, fmt.Sprintf("n must be a positive integer, got %q", v), http.StatusBadRequest)
+			return
+		}
+		n = i
+	}
+
+	h.mu.Lock()
+	if h.ts.IsZero() {
+		h.mu.Unlock()
+		http.Error(w, "no report received yet", http.StatusServiceUnavailable)
+		return
+	}
+	resp := heavyHittersResponse{
+		Timestamp: h.ts.UnixMilli(),
+		Estimator: h.estimator,
+		Direction: h.direction,
+		Hitters:   []heavyHitter{},
+	}
+	shown := make(map[[2]string]int)
+	for _, hh := range h.hitters {
+		group := [2]string{hh.Window, hh.Type}
+		if (window != "" && hh.Window != window) || (eType != "" && hh.Type != eType) || shown[group] >= n {
+			continue
+		}
+		shown[group]++
+		resp.Hitters = append(resp.Hitters, hh)
+	}
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// spaceSaving is a space-saving sketch (Metwally et al., 2005) of the bytes
+// of at most capacity entities. Once full, an entity not counted yet takes
+// over the counter with the smallest count, which becomes its error: its
+// count overestimates its bytes by at most that, and the entities with more
+// bytes than the smallest count are never missed.
+type spaceSaving struct {
+	capacity int
+	counters []ssCounter       // min-heap on count
+	index    map[entityKey]int // into counters
+}
+
+type ssCounter struct {
+	key        entityKey
+	count, err float64
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, index: make(map[entityKey]int)}
+}
+
+// Add counts bytes for key.
+func (s *spaceSaving) Add(key entityKey, bytes float64) {
+	if i, ok := s.index[key]; ok {
+		s.counters[i].count += bytes
+		heap.Fix(s, i)
+		return
+	}
+	if !s.full() {
+		heap.Push(s, ssCounter{key: key, count: bytes})
+		return
+	}
+	evicted := s.counters[0]
+	delete(s.index, evicted.key)
+	s.counters[0] = ssCounter{key: key, count: evicted.count + bytes, err: evicted.count}
+	s.index[key] = 0
+	heap.Fix(s, 0)
+}
+
+func (s *spaceSaving) full() bool {
+	return len(s.counters) >= s.capacity
+}
+
+// smallest returns the smallest count.
+func (s *spaceSaving) smallest() float64 {
+	if len(s.counters) == 0 {
+		return 0
+	}
+	return s.counters[0].count
+}
+
+// heap.Interface, keeping index up to date.
+
+func (s *spaceSaving) Len() int           { return len(s.counters) }
+func (s *spaceSaving) Less(i, j int) bool { return s.counters[i].count < s.counters[j].count }
+
+func (s *spaceSaving) Swap(i, j int) {
+	s.counters[i], s.counters[j] = s.counters[j], s.counters[i]
+	s.index[s.counters[i].key] = i
+	s.index[s.counters[j].key] = j
+}
+
+func (s *spaceSaving) Push(x any) {
+	c := x.(ssCounter)
+	s.index[c.key] = len(s.counters)
+	s.counters = append(s.counters, c)
+}
+
+func (s *spaceSaving) Pop() any {
+	c := s.counters[len(s.counters)-1]
+	s.counters = s.counters[:len(s.counters)-1]
+	delete(s.index, c.key)
+	return c
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Neither the TrafficShapingRate response nor the MGM's response metadata
+// carry a cluster identifier, so the instance can only be verified against a
+// response header that a proxy in front of the MGM sets, named by the
+// operator with -instance-header.
+
+// checkInstance compares the instance advertised under key with expected.
+// Mismatches are fatal if refuse is set and only logged otherwise; an MGM that
+// doesn't advertise its instance can't be verified and is always just logged.
+func checkInstance(header metadata.MD, key, expected string, refuse bool) error {
+	values := header.Get(key)
+	if len(values) == 0 {
+		log.Printf("Warning: MGM does not advertise its instance in the %q header, cannot verify it is %q", key, expected)
+		return nil
+	}
+
+	if values[0] != expected {
+		err := fmt.Errorf("MGM reports instance %q but %q was expected", values[0], expected)
+		if refuse {
+			return err
+		}
+		log.Printf("Warning: %v", err)
+		return nil
+	}
+
+	log.Printf("MGM instance verified: %s", values[0])
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// influxSink writes every report to InfluxDB in line protocol, one point per
+// entity and estimator:
+//
+//	eos_io,entity_type=app,id=rucio-download,estimator=SMA_5_SECONDS,mgm=mgm:50051 read_bytes_per_second=1.2e+08,write_bytes_per_second=0 1700000000000
+//
+// Points are batched and written every flush interval, or as soon as
+// batchSize points are pending, by a background writer that retries failed
+// writes.
+type influxSink struct {
+	endpoint  string // write URL including the query
+	auth      string // Authorization header, "" for none
+	mgm       string
+	batchSize int
+
+	client *http.Client
+	queue  chan []byte
+	done   chan struct{}
+	stop   func() // of the flush ticker
+
+	mu     sync.Mutex
+	batch  bytes.Buffer
+	points int
+	closed bool
+}
+
+// newInfluxSink writes to an InfluxDB 2 bucket (version 2) or a 1.x database
+// (version 1). For version 1, token may be "user:password".
+func newInfluxSink(baseURL string, version int, org, bucket, database, token string, batchSize int, flush time.Duration, mgm string) (*influxSink, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("InfluxDB URL must be an http:// or https:// URL, got %q", baseURL)
+	}
+	q := url.Values{"precision": {"ms"}}
+	switch version {
+	case 1:
+		if database == "" {
+			return nil, errors.New("InfluxDB 1.x needs a database")
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+		q.Set("db", database)
+	case 2:
+		if org == "" || bucket == "" {
+			return nil, errors.New("InfluxDB 2 needs an org and a bucket")
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+		q.Set("org", org)
+		q.Set("bucket", bucket)
+	default:
+		return nil, fmt.Errorf("unsupported InfluxDB version %d (expected 1 or 2)", version)
+	}
+	u.RawQuery = q.Encode()
+
+	s := &influxSink{
+		endpoint:  u.String(),
+		mgm:       mgm,
+		batchSize: batchSize,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		queue:     make(chan []byte, 10),
+		done:      make(chan struct{}),
+	}
+	if token != "" {
+		s.auth = "Token " + token
+	}
+
+	go s.writer()
+	s.stop = every(flush, s.flush)
+	return s, nil
+}
+
+func (s *influxSink) Send(report *pb.TrafficShapingRateResponse) error {
+	s.mu.Lock()
+	for _, e := range reportEntities(report) {
+		for _, st := range e.Stats {
+			fmt.Fprintf(&s.batch, "eos_io,entity_type=%s,id=%s,estimator=%s,mgm=%s read_bytes_per_second=%s,write_bytes_per_second=%s %d\n",
+				influxTag(e.Type), influxTag(e.ID), influxTag(st.Window.String()), influxTag(s.mgm),
+				strconv.FormatFloat(st.BytesReadPerSec, 'g', -1, 64),
+				strconv.FormatFloat(st.BytesWrittenPerSec, 'g', -1, 64),
+				report.TimestampMs)
+			s.points++
+		}
+	}
+	full := s.points >= s.batchSize
+	s.mu.Unlock()
+
+	if full {
+		s.flush()
+	}
+	return nil
+}
+
+// flush hands the pending points to the writer.
+func (s *influxSink) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.points == 0 || s.closed {
+		return
+	}
+	select {
+	case s.queue <- bytes.Clone(s.batch.Bytes()):
+	default:
+		log.Printf("InfluxDB: write queue full, dropping %d points", s.points)
+	}
+	s.batch.Reset()
+	s.points = 0
+}
+
+func (s *influxSink) writer() {
+	defer close(s.done)
+	for body := range s.queue {
+		backoff := time.Second
+		for attempt := 0; ; attempt++ {
+			err := s.write(body)
+			var perm permanentError
+			if err == nil {
+				break
+			}
+			if errors.As(err, &perm) || attempt == 3 {
+				log.Printf("InfluxDB: %v", err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (s *influxSink) write(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.auth != "" {
+		req.Header.Set("Authorization", s.auth)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("write: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	default:
+		return permanentError{fmt.Errorf("write: %s: %s", resp.Status, bytes.TrimSpace(msg))}
+	}
+}
+
+// Close writes the pending points, waiting for room in the queue, and waits
+// for the writer to finish.
+func (s *influxSink) Close() error {
+	s.stop()
+	s.mu.Lock()
+	s.closed = true
+	body, points := bytes.Clone(s.batch.Bytes()), s.points
+	s.batch.Reset()
+	s.points = 0
+	s.mu.Unlock()
+
+	deadline := time.After(30 * time.Second)
+	if points > 0 {
+		select {
+		case s.queue <- body:
+		case <-deadline:
+			close(s.queue)
+			return fmt.Errorf("InfluxDB: write queue still full, dropping the last %d points", points)
+		}
+	}
+	close(s.queue)
+	select {
+	case <-s.done:
+		return nil
+	case <-deadline:
+		return errors.New("InfluxDB: timed out writing the last points")
+	}
+}
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// influxTag escapes a tag value for line protocol; empty values are not
+// allowed there and become "-".
+func influxTag(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return influxTagEscaper.Replace(v)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// recordingStats summarises the reports of one target in a recording.
+type recordingStats struct {
+	reports  int
+	first    time.Time
+	last     time.Time
+	entities map[string]map[string]struct{} // entity type -> ids
+	peaks    map[string]*peakRate           // entity type -> peak aggregate rate
+	gaps     []gap
+	shaping  *shapingTracker // nil without -limits
+}
+
+type peakRate struct {
+	read, write     float64
+	readAt, writeAt time.Time
+}
+
+type gap struct {
+	from, to time.Time
+}
+
+func runInspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	estimator := fs.String("estimator", "SMA_1_MINUTES", "Estimator used for the aggregate rates")
+	minGap := fs.Duration("gap", 10*time.Second, "Report intervals longer than this are listed as gaps")
+	limitsPath := fs.String("limits", "", "Limits file to summarise how often each entity was at its limit")
+	shapingEstimator := fs.String("shaping-estimator", "SMA_5_SECONDS", "Estimator compared against the limits")
+	atLimit := fs.Float64("at-limit-ratio", 0.95, "Utilization from which an entity counts as at its limit")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s inspect [flags] <recording>...\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Prints the time range, report count, unique entities, peak aggregate rates")
+		fmt.Fprintln(fs.Output(), "and gaps of each recording, and with -limits how often each entity was")
+		fmt.Fprintln(fs.Output(), "throttled.")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var limits map[entityKey]limit
+	if *limitsPath != "" {
+		var err error
+		if limits, err = readLimits(*limitsPath); err != nil {
+			log.Fatalf("Error loading limits: %v", err)
+		}
+		if _, err := parseEstimator(*shapingEstimator); err != nil {
+			log.Fatalf("Invalid -shaping-estimator: %v", err)
+		}
+	}
+
+	for _, path := range fs.Args() {
+		stats, err := inspectRecording(path, *estimator, *minGap, limits, *shapingEstimator, *atLimit)
+		if err != nil {
+			log.Fatalf("Error inspecting recording: %v", err)
+		}
+		printRecordingStats(path, stats)
+	}
+}
+
+func inspectRecording(path, estimator string, minGap time.Duration, limits map[entityKey]limit, shapingEstimator string, atLimit float64) (map[string]*recordingStats, error) {
+	r, err := openRecording(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	targets := make(map[string]*recordingStats)
+	for {
+		f, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return targets, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		st := targets[f.Target]
+		if st == nil {
+			st = &recordingStats{
+				entities: make(map[string]map[string]struct{}),
+				peaks:    make(map[string]*peakRate),
+			}
+			if limits != nil {
+				st.shaping = newShapingTracker(shapingEstimator, atLimit)
+			}
+			targets[f.Target] = st
+		}
+		if st.shaping != nil {
+			st.shaping.Add(f.Report, limits)
+		}
+
+		ts := time.UnixMilli(f.Report.TimestampMs)
+		if st.reports == 0 {
+			st.first = ts
+		} else if ts.Sub(st.last) > minGap {
+			st.gaps = append(st.gaps, gap{from: st.last, to: ts})
+		}
+		st.last = ts
+		st.reports++
+
+		totals := make(map[string]*peakRate)
+		for _, e := range reportEntities(f.Report) {
+			if st.entities[e.Type] == nil {
+				st.entities[e.Type] = make(map[string]struct{})
+			}
+			st.entities[e.Type][e.ID] = struct{}{}
+
+			if totals[e.Type] == nil {
+				totals[e.Type] = &peakRate{}
+			}
+			for _, s := range e.Stats {
+				if s.Window.String() == estimator {
+					totals[e.Type].read += s.BytesReadPerSec
+					totals[e.Type].write += s.BytesWrittenPerSec
+				}
+			}
+		}
+
+		for eType, t := range totals {
+			peak := st.peaks[eType]
+			if peak == nil {
+				peak = &peakRate{}
+				st.peaks[eType] = peak
+			}
+			if t.read > peak.read {
+				peak.read, peak.readAt = t.read, ts
+			}
+			if t.write > peak.write {
+				peak.write, peak.writeAt = t.write, ts
+			}
+		}
+	}
+}
+
+func printRecordingStats(path string, targets map[string]*recordingStats) {
+	fmt.Printf("=== %s ===\n\n", path)
+	if len(targets) == 0 {
+		fmt.Printf("No reports.\n\n")
+		return
+	}
+
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		st := targets[name]
+		fmt.Printf("Target:   %s\n", name)
+		fmt.Printf("Reports:  %d\n", st.reports)
+		fmt.Printf("Covers:   %s - %s (%s)\n\n",
+			st.first.Format(time.RFC3339), st.last.Format(time.RFC3339), st.last.Sub(st.first))
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "Type\tEntities\tPeak Read/s\tAt\tPeak Write/s\tAt")
+		for _, eType := range []string{"app", "user", "group"} {
+			peak := st.peaks[eType]
+			if peak == nil {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n",
+				eType,
+				len(st.entities[eType]),
+				humanizeBytes(peak.read),
+				peak.readAt.Format(time.TimeOnly),
+				humanizeBytes(peak.write),
+				peak.writeAt.Format(time.TimeOnly),
+			)
+		}
+		w.Flush()
+		fmt.Println()
+
+		if st.shaping != nil && len(st.shaping.stats) > 0 {
+			fmt.Println("Shaping:")
+			st.shaping.print(os.Stdout, false)
+			fmt.Println()
+		}
+
+		if len(st.gaps) > 0 {
+			fmt.Println("Gaps:")
+			for _, g := range st.gaps {
+				fmt.Printf("  %s - %s (%s)\n", g.from.Format(time.RFC3339), g.to.Format(time.RFC3339), g.to.Sub(g.from))
+			}
+			fmt.Println()
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// keyActions are the actions of the console keys, in the order of the help.
+var keyActions = []struct {
+	name string
+	key  func(keysConfig) string
+	help string
+}{
+	{"search", func(k keysConfig) string { return k.Search }, "Search the apps, ids and names, highlighting the matching rows"},
+	{"filter", func(k keysConfig) string { return k.Filter }, "Show only the rows matching a filter"},
+	{"clear", func(k keysConfig) string { return k.Clear }, "Clear the search and the filter"},
+	{"export", func(k keysConfig) string { return k.Export }, "Write the rows on screen to a file of the export directory"},
+	{"pause", func(k keysConfig) string { return k.Pause }, "Freeze the screen or resume, the reports still being processed"},
+	{"help", func(k keysConfig) string { return k.Help }, "Show this help"},
+}
+
+// keyBindings map the keys of the console to their actions.
+type keyBindings map[byte]string
+
+// newKeyBindings checks that the keys of cfg are single printable ASCII
+// characters bound to one action each.
+func newKeyBindings(cfg keysConfig) (keyBindings, error) {
+	b := make(keyBindings)
+	for _, a := range keyActions {
+		key := a.key(cfg)
+		if len(key) != 1 || key[0] <= ' ' || key[0] > '~' {
+			return nil, fmt.Errorf("the key of %s must be a single printable ASCII character, not %q", a.name, key)
+		}
+		if other, ok := b[key[0]]; ok {
+			return nil, fmt.Errorf("%q is the key of both %s and %s", key, other, a.name)
+		}
+		b[key[0]] = a.name
+	}
+	return b, nil
+}
+
+// key returns the key of action.
+func (b keyBindings) key(action string) string {
+	for key, a := range b {
+		if a == action {
+			return string(key)
+		}
+	}
+	return ""
+}
+
+// print prints the help screen of the keys.
+func (b keyBindings) print(out io.Writer) {
+	keys := make(map[string]byte, len(b))
+	for key, action := range b {
+		keys[action] = key
+	}
+	fmt.Fprint(out, "\033[H\033[2J")
+	fmt.Fprintln(out, "EOS IO Monitor | Keys")
+	fmt.Fprintln(out)
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	for _, a := range keyActions {
+		fmt.Fprintf(w, "  %c\t%s\n", keys[a.name], a.help)
+	}
+	fmt.Fprintf(w, "  Enter\tKeep the search or apply the filter being typed\n")
+	fmt.Fprintf(w, "  Esc\tCancel the search or filter being typed\n")
+	fmt.Fprintf(w, "  Ctrl-C\tStop the monitor\n")
+	w.Flush()
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "The keys are set in the console.keys section of the config file.")
+	fmt.Fprintln(out, "Press any key to return.")
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// The EOS gRPC API in eos-grpc-proto only streams rates; it has no endpoint
+// returning the configured limits. They are therefore read from a limits file
+// meant to mirror the MGM's traffic-shaping configuration, and exported as
+// eos_monitor_limits_file_* since nothing keeps the two in line:
+//
+//	limits:
+//	  - type: app          # app, user (uid) or group (gid)
+//	    id: rucio-download
+//	    read: 500MB/s
+//	    write: 200MB/s
+
+var (
+	limitBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_monitor_limits_file_bytes_per_second",
+			Help: "Traffic-shaping limit in bytes/sec of the -limits file of the monitor, not read from the MGM",
+		},
+		[]string{"entity_type", "id", "direction"},
+	)
+	limitUtilization = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_monitor_limits_file_utilization_ratio",
+			Help: "Current throughput divided by the limit of the -limits file",
+		},
+		[]string{"entity_type", "id", "direction", "estimator"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(limitBytes, limitUtilization)
+}
+
+// byteRate is a rate in bytes/sec that can be written as "500MB/s" in YAML.
+type byteRate float64
+
+func (r *byteRate) UnmarshalText(text []byte) error {
+	v, err := parseByteRate(string(text))
+	if err != nil {
+		return err
+	}
+	*r = byteRate(v)
+	return nil
+}
+
+// limit is the configured cap of one entity; zero means unlimited.
+type limit struct {
+	Type  string   `yaml:"type"`
+	ID    string   `yaml:"id"`
+	Read  byteRate `yaml:"read"`
+	Write byteRate `yaml:"write"`
+}
+
+// limitsFile holds the limits of a file and reloads them when it changes.
+type limitsFile struct {
+	path string
+
+	mu     sync.Mutex
+	mtime  time.Time
+	limits map[entityKey]limit
+}
+
+func loadLimitsFile(path string) (*limitsFile, error) {
+	lf := &limitsFile{path: path}
+	if err := lf.reload(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+func (lf *limitsFile) reload() error {
+	st, err := os.Stat(lf.path)
+	if err != nil {
+		return err
+	}
+	limits, err := readLimits(lf.path)
+	if err != nil {
+		return err
+	}
+	lf.limits, lf.mtime = limits, st.ModTime()
+	return nil
+}
+
+func readLimits(path string) (map[entityKey]limit, error) {
+	var doc struct {
+		Limits []limit `yaml:"limits"`
+	}
+	if err := loadYAML(path, &doc); err != nil {
+		return nil, err
+	}
+
+	limits := make(map[entityKey]limit, len(doc.Limits))
+	for i, l := range doc.Limits {
+		if !validEntityType(l.Type) {
+			return nil, fmt.Errorf("%s: limits[%d]: type must be app, user or group, got %q", path, i, l.Type)
+		}
+		limits[entityKey{l.Type, l.ID}] = l
+	}
+	return limits, nil
+}
+
+func validEntityType(t string) bool {
+	return t == "app" || t == "user" || t == "group"
+}
+
+// Limits returns the current limits, re-reading the file if it was modified.
+// A broken edit keeps the previous limits in place.
+func (lf *limitsFile) Limits() map[entityKey]limit {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if st, err := os.Stat(lf.path); err == nil && st.ModTime().After(lf.mtime) {
+		if err := lf.reload(); err != nil {
+			log.Printf("Keeping previous limits: %v", err)
+		} else {
+			log.Printf("Reloaded %d limits from %s", len(lf.limits), lf.path)
+		}
+	}
+	return lf.limits
+}
+
+// exportLimits publishes the configured limits and, for the entities in the
+// report, how much of them is currently used.
+func exportLimits(report *pb.TrafficShapingRateResponse, limits map[entityKey]limit) {
+	limitBytes.Reset()
+	limitUtilization.Reset()
+
+	for _, l := range limits {
+		if l.Read > 0 {
+			limitBytes.WithLabelValues(l.Type, l.ID, "read").Set(float64(l.Read))
+		}
+		if l.Write > 0 {
+			limitBytes.WithLabelValues(l.Type, l.ID, "write").Set(float64(l.Write))
+		}
+	}
+
+	for _, e := range reportEntities(report) {
+		l, ok := limits[entityKey{e.Type, e.ID}]
+		if !ok {
+			continue
+		}
+		for _, s := range e.Stats {
+			win := s.Window.String()
+			if l.Read > 0 {
+				limitUtilization.WithLabelValues(e.Type, e.ID, "read", win).Set(s.BytesReadPerSec / float64(l.Read))
+			}
+			if l.Write > 0 {
+				limitUtilization.WithLabelValues(e.Type, e.ID, "write", win).Set(s.BytesWrittenPerSec / float64(l.Write))
+			}
+		}
+	}
+}
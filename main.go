@@ -3,20 +3,29 @@ package main
 //go:generate buf generate
 
 import (
+	"bytes"
 	"context"
-	"flag"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
-	"strconv"
-	"text/tabwriter"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
 
 	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
 )
@@ -36,216 +45,1474 @@ var (
 		},
 		[]string{"entity_type", "id", "estimator"},
 	)
-	threadLoopMicros = prometheus.NewGaugeVec(
+	readRatio = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "eos_io_thread_loop_microseconds",
-			Help: "Time taken to execute internal thread loops in microseconds",
+			Name: "eos_io_read_ratio",
+			Help: "Share of the throughput that is read, from 0 for write only to 1 for read only, with -prometheus-read-ratio",
 		},
-		[]string{"loop_name", "stat_type"}, // Labels: loop_name (fst_limits, estimators), stat_type (mean, min, max)
+		[]string{"entity_type", "id", "estimator"},
+	)
+	serverCapability = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_server_capability",
+			Help: "1 if the MGM provides the optional part of the report, 0 if it omits it",
+		},
+		[]string{"capability"},
 	)
 )
 
 func init() {
-	prometheus.MustRegister(readBytes, writeBytes, threadLoopMicros)
+	prometheus.MustRegister(readBytes, writeBytes, readRatio, serverCapability)
 }
 
 func main() {
-	eosGrpcHost := flag.String("grpc-host", "localhost", "EOS MGM gRPC Host")
-	eosGrpcPort := flag.String("grpc-port", "50051", "EOS MGM gRPC Port")
-	prometheusPort := flag.String("prometheus-port", "9987", "Prometheus HTTP Port")
-	prometheusDisable := flag.Bool("enable-prometheus", false, "Disable Prometheus metrics endpoint")
-	topN := flag.Uint("n", 1000, "Top N entries to request")
-	flag.Parse()
-
-	if !*prometheusDisable {
+	if err := newRootCommand(os.Args[1:]).Execute(); err != nil {
+		os.Exit(2)
+	}
+}
+
+// monitor runs the monitor with cfg until the stream ends or it is
+// interrupted.
+func monitor(cfg config) {
+	build := currentBuildInfo()
+	log.Printf("eos_traffic_shaping_monitor %s (commit %s, built %s)", build.Version, build.Commit, build.Date)
+
+	if cfg.Instance.Mismatch != "refuse" && cfg.Instance.Mismatch != "warn" {
+		log.Fatalf("Invalid -instance-mismatch %q (expected refuse or warn)", cfg.Instance.Mismatch)
+	}
+	if cfg.Instance.Expected != "" && cfg.Instance.Header == "" {
+		log.Fatal("-expected-instance needs -instance-header: the MGM doesn't advertise its instance, only a proxy in front of it can")
+	}
+
+	estimators, err := parseEstimators(cfg.Request.Estimators)
+	if err != nil {
+		log.Fatalf("Invalid estimators: %v", err)
+	}
+	sortBy, err := parseEstimator(cfg.Request.SortBy)
+	if err != nil {
+		log.Fatalf("Invalid sort estimator: %v", err)
+	}
+
+	idleRate, err := parseByteRate(cfg.Idle.Threshold)
+	if err != nil {
+		log.Fatalf("Invalid -idle-threshold: %v", err)
+	}
+
+	var appNames *appNormalizer
+	if len(cfg.AppNames) > 0 {
+		if appNames, err = newAppNormalizer(cfg.AppNames); err != nil {
+			log.Fatalf("Invalid -app-name-rule: %v", err)
+		}
+	}
+
+	var minRate float64
+	if cfg.Filter.MinRate != "" {
+		if minRate, err = parseByteRate(cfg.Filter.MinRate); err != nil {
+			log.Fatalf("Invalid -min-rate: %v", err)
+		}
+	}
+	var filter *entityFilter
+	if len(cfg.Filter.Apps)+len(cfg.Filter.UIDs)+len(cfg.Filter.GIDs) > 0 || minRate > 0 {
+		if filter, err = newEntityFilter(cfg.Filter.Apps, cfg.Filter.UIDs, cfg.Filter.GIDs, minRate, cfg.Request.SortBy, cfg.Filter.Other); err != nil {
+			log.Fatalf("Invalid filter: %v", err)
+		}
+	}
+	entityTypes := filter.RequestTypes()
+	if len(entityTypes) == 0 {
+		log.Fatal("The filters drop every app, user and group")
+	}
+
+	exported, err := newEstimatorSet(cfg.Prometheus.Export, cfg.Request.Estimators)
+	if err != nil {
+		log.Fatalf("Invalid -export-estimators: %v", err)
+	}
+
+	var guard *cardinalityGuard
+	if cfg.Prometheus.MaxSeries > 0 {
+		if guard, err = newCardinalityGuard(cfg.Prometheus.MaxSeries, cfg.Request.SortBy); err != nil {
+			log.Fatalf("Invalid -prometheus-max-series: %v", err)
+		}
+		if exported != nil && !exported[cfg.Request.SortBy] {
+			log.Fatalf("-prometheus-max-series ranks the entities on -sort-by %s, which -export-estimators leaves out", cfg.Request.SortBy)
+		}
+	}
+
+	var relabeled *relabeledRates
+	if len(cfg.Prometheus.Relabel) > 0 {
+		if cfg.Prometheus.Suffix {
+			log.Fatalf("-prometheus-estimator-suffix doesn't apply to relabeled rates")
+		}
+		if relabeled, err = newRelabeledRates(cfg.Prometheus.Relabel); err != nil {
+			log.Fatalf("Invalid relabeling rules: %v", err)
+		}
+		prometheus.MustRegister(relabeled)
+	}
+
+	var histograms *rateHistograms
+	if len(cfg.Prometheus.Buckets) > 0 {
+		if histograms, err = newRateHistograms(cfg.Prometheus.Buckets); err != nil {
+			log.Fatalf("Invalid -prometheus-rate-buckets: %v", err)
+		}
+		prometheus.MustRegister(histograms)
+	}
+
+	var names *nameResolver
+	if cfg.Names.Resolve || cfg.Names.Aggregate {
+		names = newNameResolver()
+	}
+
+	var limits *limitsFile
+	if cfg.Limits != "" {
+		if limits, err = loadLimitsFile(cfg.Limits); err != nil {
+			log.Fatalf("Error loading limits: %v", err)
+		}
+	}
+	if _, err := parseEstimator(cfg.Shaping.Estimator); err != nil {
+		log.Fatalf("Invalid -shaping-estimator: %v", err)
+	}
+	if cfg.Shaping.AtLimit <= 0 {
+		log.Fatalf("Invalid -at-limit-ratio %g (must be positive)", cfg.Shaping.AtLimit)
+	}
+
+	var alerts *alertEngine
+	if cfg.Alerts.Rules != "" {
+		rules, err := loadAlertRules(cfg.Alerts.Rules)
+		if err != nil {
+			log.Fatalf("Invalid alert rules:\n%v", err)
+		}
+		alerts = newAlertEngine(rules)
+		log.Printf("Loaded %d alert rules from %s", len(rules), cfg.Alerts.Rules)
+	}
+
+	var slos *sloTracker
+	if cfg.SLOs != "" {
+		list, err := loadSLOs(cfg.SLOs)
+		if err != nil {
+			log.Fatalf("Invalid SLOs:\n%v", err)
+		}
+		slos = newSLOTracker(list)
+		log.Printf("Loaded %d SLOs from %s", len(list), cfg.SLOs)
+	}
+
+	var baselines *baselineTracker
+	if cfg.Baseline.State != "" {
+		baselines, err = newBaselineTracker(cfg.Baseline.State, cfg.Baseline.Estimator, cfg.Baseline.Entities, cfg.Baseline.MinSamples, cfg.Baseline.Learn)
+		if err != nil {
+			log.Fatalf("Error loading baselines: %v", err)
+		}
+	}
+
+	var checks *consistencyChecker
+	if len(cfg.Checks.Pairs) > 0 {
+		minRate, err := parseByteRate(cfg.Checks.MinRate)
+		if err != nil {
+			log.Fatalf("Invalid -estimator-check-min-rate: %v", err)
+		}
+		if checks, err = newConsistencyChecker(cfg.Checks.Pairs, cfg.Checks.Tolerance, minRate); err != nil {
+			log.Fatalf("Invalid -estimator-checks: %v", err)
+		}
+	}
+
+	var rolling *rollingAggregator
+	if cfg.Rolling.Window > 0 {
+		if rolling, err = newRollingAggregator(cfg.Rolling.Window, cfg.Rolling.Estimator); err != nil {
+			log.Fatalf("Invalid -rolling-estimator: %v", err)
+		}
+	}
+
+	var hitters *heavyHitters
+	if len(cfg.Hitters.Windows) > 0 {
+		if hitters, err = newHeavyHitters(cfg.Hitters.Windows, cfg.Hitters.Estimator, cfg.Hitters.Direction,
+			cfg.Hitters.TopK, cfg.Hitters.Capacity, cfg.Hitters.Console, cfg.Counters.MaxGap); err != nil {
+			log.Fatalf("Invalid heavy hitter settings: %v", err)
+		}
+	}
+
+	loops, err := newThreadLoopStats(cfg.Loops.Window)
+	if err != nil {
+		log.Fatalf("Invalid -thread-loop-window: %v", err)
+	}
+
+	var counters *byteCounters
+	if !cfg.Counters.Disable {
+		if counters, err = newByteCounters(cfg.Counters.Estimator, cfg.Counters.MaxGap, cfg.Counters.Expiry); err != nil {
+			log.Fatalf("Invalid byte counter settings: %v", err)
+		}
+	}
+
+	var fair *fairShare
+	if cfg.FairShare != "" {
+		if fair, err = loadFairShare(cfg.FairShare); err != nil {
+			log.Fatalf("Invalid fair-share policy: %v", err)
+		}
+	}
+
+	var groups *namedGroups
+	if cfg.Groups != "" {
+		if groups, err = loadNamedGroups(cfg.Groups); err != nil {
+			log.Fatalf("Invalid groups:\n%v", err)
+		}
+		log.Printf("Loaded %d named groups from %s", len(groups.Groups), cfg.Groups)
+	}
+
+	var anomalies *anomalyDetector
+	if cfg.Anomaly.ZScore > 0 {
+		minRate, err := parseByteRate(cfg.Anomaly.MinRate)
+		if err != nil {
+			log.Fatalf("Invalid -anomaly-min-rate: %v", err)
+		}
+		if anomalies, err = newAnomalyDetector(cfg.Anomaly.Estimator, cfg.Anomaly.Window, cfg.Anomaly.ZScore, cfg.Anomaly.MinSamples, minRate); err != nil {
+			log.Fatalf("Invalid anomaly detection settings: %v", err)
+		}
+	}
+
+	var sustained *sustainedDetector
+	if cfg.Sustained.Rate != "" {
+		rate, err := parseByteRate(cfg.Sustained.Rate)
+		if err != nil {
+			log.Fatalf("Invalid -sustained-rate: %v", err)
+		}
+		if sustained, err = newSustainedDetector(rate, cfg.Sustained.Estimator, cfg.Sustained.Direction, cfg.Sustained.For, cfg.Sustained.ClearFor); err != nil {
+			log.Fatalf("Invalid sustained-load settings: %v", err)
+		}
+	}
+
+	var web *webConfigFile
+	if cfg.Web.ConfigFile != "" {
+		if web, err = loadWebConfigFile(cfg.Web.ConfigFile); err != nil {
+			log.Fatalf("Invalid -web-config-file: %v", err)
+		}
+	}
+	var api *apiServer
+	var dash *dashboard
+	var health *streamHealth
+	var stream *reportStream
+	var pull *puller
+	var probe *prober
+	if !cfg.Prometheus.Disable {
 		log.Println("Prometheus metrics endpoint enabled.")
 
+		prefix, err := routePrefix(cfg.Web.ExternalURL, cfg.Web.RoutePrefix)
+		if err != nil {
+			log.Fatalf("Invalid -web-external-url: %v", err)
+		}
+		api = newAPIServer(int(cfg.API.CacheMB)<<20, cfg.API.History)
+		if health, err = newStreamHealth(cfg.Web.ReadyStale); err != nil {
+			log.Fatalf("Invalid -ready-stale-after: %v", err)
+		}
+		mux := http.NewServeMux()
+		if cfg.Prometheus.Pull {
+			if pull, err = newPuller(cfg.Prometheus.PullMinInterval, cfg.Prometheus.PullTimeout, health); err != nil {
+				log.Fatalf("Invalid pull mode settings: %v", err)
+			}
+			log.Println("Pull mode: streaming from the MGM on scrapes only.")
+			mux.Handle("/metrics", pull.handler(promhttp.Handler()))
+		} else {
+			mux.Handle("/metrics", promhttp.Handler())
+		}
+		if len(cfg.Prometheus.ProbeTargets) > 0 {
+			if cfg.Auth.Method != "none" {
+				log.Fatalf("-prometheus-probe-targets can't be used with -auth=%s: the credentials are those of -grpc-host", cfg.Auth.Method)
+			}
+			if probe, err = newProber(cfg.Prometheus.ProbeTargets, cfg.Prometheus.PullTimeout); err != nil {
+				log.Fatalf("Invalid -prometheus-probe-targets: %v", err)
+			}
+			mux.Handle("/probe", probe)
+		}
+		health.register(mux)
+		api.register(mux)
+		if rolling != nil {
+			rolling.register(mux)
+		}
+		if hitters != nil {
+			hitters.register(mux)
+		}
+		stream = newReportStream()
+		stream.register(mux)
+		if !cfg.Dashboard.Disable {
+			if dash, err = newDashboard(cfg.Dashboard.Estimator); err != nil {
+				log.Fatalf("Invalid -dashboard-estimator: %v", err)
+			}
+			dash.register(mux)
+		}
+		if cfg.Profiling.Debug && cfg.Profiling.Listen == "" {
+			registerDebug(mux)
+		}
 		go func() {
-			http.Handle("/metrics", promhttp.Handler())
-			log.Printf("Prometheus metrics available at :%s/metrics", *prometheusPort)
-			log.Fatal(http.ListenAndServe(":"+*prometheusPort, nil))
+			if cfg.Web.ExternalURL != "" {
+				log.Printf("Prometheus metrics available at %s/metrics (listening on :%s%s)", strings.TrimRight(cfg.Web.ExternalURL, "/"), cfg.Prometheus.Port, prefix)
+			} else {
+				log.Printf("Prometheus metrics available at :%s%s/metrics", cfg.Prometheus.Port, prefix)
+			}
+			log.Fatal(serveWeb(":"+cfg.Prometheus.Port, webHandler(mux, prefix, cfg.Web.CORSOrigins), web))
 		}()
 	} else {
 		log.Println("Prometheus metrics endpoint disabled.")
+		if cfg.Prometheus.Pull || len(cfg.Prometheus.ProbeTargets) > 0 {
+			log.Fatalf("-prometheus-pull and -prometheus-probe-targets need the metrics endpoint")
+		}
+		if cfg.Profiling.Debug && cfg.Profiling.Listen == "" {
+			log.Fatalf("-debug-endpoints needs the metrics endpoint or -debug-listen")
+		}
+	}
+	if cfg.Profiling.Listen != "" {
+		mux := http.NewServeMux()
+		registerDebug(mux)
+		go func() {
+			log.Printf("Debug endpoints available at %s/debug/pprof/", cfg.Profiling.Listen)
+			log.Fatal(serveWeb(cfg.Profiling.Listen, mux, web))
+		}()
+	}
+
+	var mgmHost = fmt.Sprintf("%s:%s", cfg.GRPC.Host, cfg.GRPC.Port)
+	dialOpts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	switch cfg.GRPC.Compression {
+	case "none":
+	case gzip.Name:
+		// gRPC servers answer with the encoding of the request, so compressing the
+		// tiny request is what gets the (large) reports compressed too.
+		dialOpts = append(dialOpts, grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)))
+	default:
+		log.Fatalf("Unsupported gRPC compression %q (expected gzip or none)", cfg.GRPC.Compression)
+	}
+	serviceConfig, err := serviceConfigJSON(cfg.GRPC)
+	if err != nil {
+		log.Fatalf("Invalid gRPC service config: %v", err)
+	}
+	if serviceConfig != "" {
+		dialOpts = append(dialOpts, grpc.WithDefaultServiceConfig(serviceConfig))
+	}
+	if cfg.GRPC.Proxy != "" {
+		dialer, err := proxyDialer(cfg.GRPC.Proxy)
+		if err != nil {
+			log.Fatalf("Error configuring proxy: %v", err)
+		}
+		if cfg.GRPC.Proxy == proxyFromEnvironment() {
+			dialer = noProxyDialer(dialer)
+		}
+		dialOpts = append(dialOpts, grpc.WithContextDialer(dialer))
+		if cfg.GRPC.Proxy == proxyFromEnvironment() && noProxy(mgmHost) {
+			log.Printf("Dialing %s directly, exempted from proxy %s", mgmHost, redactURL(cfg.GRPC.Proxy))
+		} else {
+			log.Printf("Dialing %s through proxy %s", mgmHost, redactURL(cfg.GRPC.Proxy))
+		}
+	}
+
+	// The probes dial other MGMs, so they get the options above but never the
+	// credentials below, which are those of -grpc-host.
+	probeDialOpts := slices.Clip(dialOpts)
+
+	switch cfg.Auth.Method {
+	case "none":
+	case "krb5":
+		spn := cfg.Auth.Krb5.SPN
+		if spn == "" {
+			spn = "host/" + cfg.GRPC.Host
+		}
+		creds, err := newKrb5Credentials(cfg.Auth.Krb5.Config, cfg.Auth.Krb5.Keytab, cfg.Auth.Krb5.Principal, cfg.Auth.Krb5.CCache, spn)
+		if err != nil {
+			log.Fatalf("Error setting up Kerberos authentication: %v", err)
+		}
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(creds))
+	case "token":
+		var creds *tokenCredentials
+		switch {
+		case cfg.Auth.Token.OIDCTokenURL != "":
+			secret, err := os.ReadFile(cfg.Auth.Token.ClientSecretFile)
+			if err != nil {
+				log.Fatalf("Error reading OAuth2 client secret: %v", err)
+			}
+			creds = newClientCredentials(cfg.Auth.Token.OIDCTokenURL, cfg.Auth.Token.ClientID, strings.TrimSpace(string(secret)), cfg.Auth.Token.Scope, cfg.Auth.Token.Audience)
+		case cfg.Auth.Token.File != "":
+			creds = newTokenFileCredentials(cfg.Auth.Token.File)
+		case os.Getenv("BEARER_TOKEN") != "":
+			creds = newStaticTokenCredentials(strings.TrimSpace(os.Getenv("BEARER_TOKEN")))
+		case discoverTokenFile() != "":
+			creds = newTokenFileCredentials(discoverTokenFile())
+		default:
+			log.Fatal("-auth=token needs -oidc-token-url, -token-file, $BEARER_TOKEN or a discoverable token file")
+		}
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(creds))
+	default:
+		log.Fatalf("Unsupported authentication %q (expected none, krb5 or token)", cfg.Auth.Method)
+	}
+
+	if probe != nil {
+		// Before dialing, so the probes don't depend on -grpc-host.
+		probe.Start(probeDialOpts, trafficShapingRequest(uint32(cfg.Request.TopN), estimators, sortBy, entityTypes), appNames)
+	}
+
+	// Stop cleanly on Ctrl-C / SIGTERM so the recording is flushed and closed.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var tracing *sdktrace.TracerProvider
+	if cfg.Tracing.Endpoint != "" {
+		cluster := cfg.OTLP.Cluster
+		if cluster == "" {
+			cluster = cfg.Instance.Expected
+		}
+		tracing, err = newTracerProvider(ctx, cfg.Tracing.Endpoint, cfg.Tracing.Protocol, cfg.Tracing.SampleRatio, cluster, mgmHost)
+		if err != nil {
+			log.Fatalf("Error setting up tracing: %v", err)
+		}
+		log.Printf("Exporting traces to %s over OTLP/%s", redactURL(cfg.Tracing.Endpoint), cfg.Tracing.Protocol)
 	}
 
-	var mgmHost = fmt.Sprintf("%s:%s", *eosGrpcHost, *eosGrpcPort)
-	conn, err := grpc.NewClient(mgmHost, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	_, span := tracer.Start(ctx, "dial", trace.WithAttributes(attribute.String("eos.mgm.host", mgmHost)))
+	conn, err := dialMGM(ctx, mgmHost, cfg.GRPC.DialTimeout, dialOpts...)
 	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		if tracing != nil {
+			tracing.Shutdown(context.Background())
+		}
 		log.Fatalf("did not connect: %v", err)
 	}
+	span.End()
 	defer conn.Close()
+	connState := newConnStateTracker(mgmHost, conn.GetState())
+	prometheus.MustRegister(connState)
+	go connState.Watch(ctx, conn)
+
+	var sinks []sink
+	addSink := func(name string, s sink) {
+		b, err := newBreakerSink(name, s, cfg.Sinks.Timeout, cfg.Sinks.Failures, cfg.Sinks.Cooldown)
+		if err != nil {
+			log.Fatalf("Invalid sink settings: %v", err)
+		}
+		if _, paced := s.(pacedSink); paced || cfg.Sinks.Queue == 0 {
+			sinks = append(sinks, b)
+			return
+		}
+		q, err := newQueuedSink(name, b, cfg.Sinks.Queue, cfg.Sinks.Overflow)
+		if err != nil {
+			log.Fatalf("Invalid sink settings: %v", err)
+		}
+		sinks = append(sinks, q)
+	}
+	if cfg.OTLP.Endpoint != "" {
+		cluster := cfg.OTLP.Cluster
+		if cluster == "" {
+			cluster = cfg.Instance.Expected
+		}
+		s, err := newOTLPSink(ctx, cfg.OTLP.Endpoint, cfg.OTLP.Protocol, cfg.OTLP.Interval, cluster, mgmHost)
+		if err != nil {
+			log.Fatalf("Error setting up OTLP export: %v", err)
+		}
+		addSink("otlp", s)
+		log.Printf("Exporting metrics to %s over OTLP/%s", redactURL(cfg.OTLP.Endpoint), cfg.OTLP.Protocol)
+	}
+	if cfg.Influx.URL != "" {
+		var token string
+		if cfg.Influx.TokenFile != "" {
+			b, err := os.ReadFile(cfg.Influx.TokenFile)
+			if err != nil {
+				log.Fatalf("Error reading InfluxDB token: %v", err)
+			}
+			token = strings.TrimSpace(string(b))
+		}
+		if cfg.Influx.BatchSize < 1 || cfg.Influx.FlushInterval <= 0 {
+			log.Fatal("-influx-batch-size and -influx-flush-interval must be positive")
+		}
+		s, err := newInfluxSink(cfg.Influx.URL, cfg.Influx.Version, cfg.Influx.Org, cfg.Influx.Bucket, cfg.Influx.Database,
+			token, cfg.Influx.BatchSize, cfg.Influx.FlushInterval, mgmHost)
+		if err != nil {
+			log.Fatalf("Error setting up InfluxDB export: %v", err)
+		}
+		addSink("influx", s)
+		log.Printf("Writing metrics to InfluxDB at %s", redactURL(cfg.Influx.URL))
+	}
+	if cfg.Graphite.Address != "" {
+		cluster := cfg.Graphite.Cluster
+		if cluster == "" {
+			cluster = cfg.Instance.Expected
+		}
+		s, err := newGraphiteSink(cfg.Graphite.Address, cfg.Graphite.Protocol, cfg.Graphite.Template, cfg.Graphite.BatchSize, cluster, mgmHost)
+		if err != nil {
+			log.Fatalf("Error setting up Graphite export: %v", err)
+		}
+		addSink("graphite", s)
+		log.Printf("Sending metrics to Graphite at %s (%s)", cfg.Graphite.Address, cfg.Graphite.Protocol)
+	}
+	if cfg.StatsD.Address != "" {
+		s, err := newStatsDSink(cfg.StatsD.Address, cfg.StatsD.Flavor, cfg.StatsD.Prefix, cfg.StatsD.Tags, mgmHost)
+		if err != nil {
+			log.Fatalf("Error setting up StatsD export: %v", err)
+		}
+		addSink("statsd", s)
+		log.Printf("Sending metrics to %s over %s", cfg.StatsD.Address, cfg.StatsD.Flavor)
+	}
+	if cfg.Monit.Broker != "" {
+		s, err := newMonitSink(cfg.Monit.Broker, cfg.Monit.Destination, cfg.Monit.Producer, cfg.Monit.Type, cfg.Monit.CredentialsFile, cfg.Monit.BatchSize, mgmHost)
+		if err != nil {
+			log.Fatalf("Error setting up MONIT export: %v", err)
+		}
+		addSink("monit", s)
+		log.Printf("Sending documents to MONIT through %s%s", cfg.Monit.Broker, cfg.Monit.Destination)
+	}
+
+	if cfg.ClickHouse.URL != "" {
+		// The sink waits for room within Send, which the breaker gives
+		// -sink-timeout before counting it failed and skipping reports.
+		if cfg.ClickHouse.Block >= cfg.Sinks.Timeout {
+			log.Fatalf("-clickhouse-block %s must be less than -sink-timeout %s", cfg.ClickHouse.Block, cfg.Sinks.Timeout)
+		}
+		var password string
+		if cfg.ClickHouse.PasswordFile != "" {
+			b, err := os.ReadFile(cfg.ClickHouse.PasswordFile)
+			if err != nil {
+				log.Fatalf("Error reading ClickHouse password: %v", err)
+			}
+			password = strings.TrimSpace(string(b))
+		}
+		s, err := newClickHouseSink(cfg.ClickHouse.URL, cfg.ClickHouse.Table, cfg.ClickHouse.User, password, cfg.ClickHouse.CreateTable,
+			cfg.ClickHouse.BatchSize, cfg.ClickHouse.MaxPending, cfg.ClickHouse.FlushInterval, cfg.ClickHouse.Block, mgmHost)
+		if err != nil {
+			log.Fatalf("Error setting up ClickHouse export: %v", err)
+		}
+		addSink("clickhouse", s)
+		log.Printf("Inserting metrics into ClickHouse table %s at %s", cfg.ClickHouse.Table, redactURL(cfg.ClickHouse.URL))
+	}
+	if cfg.Store.Dir != "" {
+		s, err := newStoreSink(cfg.Store.Dir, cfg.Store.Estimator, cfg.Store.Interval, cfg.Store.Retention, cfg.Store.DownsampleAfter, cfg.Counters.MaxGap)
+		if err != nil {
+			log.Fatalf("Error setting up the store: %v", err)
+		}
+		addSink("store", s)
+		log.Printf("Storing %s rates in %s", cfg.Store.Estimator, cfg.Store.Dir)
+	}
+
+	if cfg.Relay.Listen != "" {
+		s, err := newRelayServer(cfg.Relay.Listen, estimators, cfg.Relay.Buffer)
+		if err != nil {
+			log.Fatalf("Error setting up the relay: %v", err)
+		}
+		addSink("relay", s)
+		log.Printf("Relaying the stream to gRPC subscribers on %s", cfg.Relay.Listen)
+	}
+
+	if cfg.Profiling.URL != "" || cfg.Profiling.Dir != "" {
+		p, err := newProfiler(cfg.Profiling.URL, cfg.Profiling.Dir, cfg.Profiling.Interval, cfg.Profiling.Keep, mgmHost)
+		if err != nil {
+			log.Fatalf("Error setting up profiling: %v", err)
+		}
+		go p.run(ctx)
+		log.Printf("Profiling the monitor every %s", cfg.Profiling.Interval)
+	}
+
+	var rec recordingWriter
+	if cfg.Record != "" {
+		rec, err = createRecording(cfg.Record)
+		if err != nil {
+			log.Fatalf("Error creating recording: %v", err)
+		}
+		log.Printf("Recording reports to %s", cfg.Record)
+	}
+
+	if cfg.GRPC.StreamDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.GRPC.StreamDeadline)
+		defer cancel()
+	}
 
 	client := pb.NewEosClient(conn)
+	keys, err := newKeyBindings(cfg.Console.Keys)
+	if err != nil {
+		log.Fatalf("Invalid console.keys: %v", err)
+	}
+	// The console and -format write through a queue like the sinks, so a
+	// stalled terminal doesn't back up the stream. In clear mode every frame
+	// replaces the previous one, so only the latest is kept.
+	var stdout io.Writer = os.Stdout
+	var stdoutQueue *queuedWriter
+	if cfg.Sinks.Queue > 0 {
+		size := cfg.Sinks.Queue
+		if cfg.Console.Mode == "clear" && cfg.Console.Format == "" {
+			size = 1
+		}
+		if stdoutQueue, err = newQueuedWriter("stdout", os.Stdout, size, cfg.Sinks.Overflow); err != nil {
+			log.Fatalf("Invalid sink settings: %v", err)
+		}
+		stdout = stdoutQueue
+	}
+	term, err := newConsole(stdout, cfg.Console.Refresh, cfg.Console.Mode, keys, cfg.Console.Export)
+	if err != nil {
+		log.Fatalf("Invalid console settings: %v", err)
+	}
+	colors, err := newColorScheme(cfg.Console.WarnRate, cfg.Console.CritRate, cfg.Request.SortBy)
+	if err != nil {
+		log.Fatalf("Invalid console color thresholds: %v", err)
+	}
+	if cfg.Console.NoColor || os.Getenv("NO_COLOR") != "" || terminalWidth() == 0 {
+		colors = nil
+	}
+	columns, err := parseColumns(cfg.Console.Columns)
+	if err != nil {
+		log.Fatalf("Invalid -columns: %v", err)
+	}
+	if cfg.Console.Layout != "rows" && cfg.Console.Layout != "pivot" {
+		log.Fatalf("Invalid -layout %q (expected rows or pivot)", cfg.Console.Layout)
+	}
+	var trends *rateTrends
+	if !cfg.Console.NoTrends && slices.Contains(columns, "trend") {
+		trends = &rateTrends{}
+	}
+	exportedRates.ratio = cfg.Prometheus.ReadRatio
+	exportedRates.suffix = cfg.Prometheus.Suffix
+	if displayUnits, err = parseUnits(cfg.Console.Units); err != nil {
+		log.Fatalf("Invalid -units: %v", err)
+	}
+	var format *outputFormat
+	if cfg.Console.Format != "" {
+		if format, err = newOutputFormat(cfg.Console.Format, cfg.Console.FormatHead); err != nil {
+			log.Fatalf("Invalid -format: %v", err)
+		}
+	} else if cfg.Console.FormatHead != "" {
+		log.Fatalf("-format-header needs -format")
+	}
+	var sorter *rowSorter
+	if cfg.Console.Sort != "" {
+		if sorter, err = newRowSorter(cfg.Console.Sort, cfg.Request.SortBy); err != nil {
+			log.Fatalf("Invalid -display-sort: %v", err)
+		}
+	}
+	var history *throughputHistory
+	if cfg.Console.Sparklines > 0 {
+		if history, err = newThroughputHistory(cfg.Console.Sparklines, cfg.Request.SortBy); err != nil {
+			log.Fatalf("Invalid -sparkline-window: %v", err)
+		}
+	}
+	var watch *entityWatch
+	if cfg.Console.Watch != "" {
+		if watch, err = newEntityWatch(cfg.Console.Watch, cfg.Request.SortBy, cfg.Console.Sparklines, names); err != nil {
+			log.Fatalf("Invalid -watch: %v", err)
+		}
+	}
+
+	var snapshots *snapshotter
+	if cfg.Snapshot.Dir != "" {
+		if snapshots, err = newSnapshotter(cfg.Snapshot.Dir, mgmHost, cfg.Snapshot.Interval, cfg.Snapshot.Format, cfg.Snapshot.Keep); err != nil {
+			log.Fatalf("Error setting up snapshots: %v", err)
+		}
+		go snapshots.Run(ctx)
+	}
+
+	notifier, err := newSystemdNotifier()
+	if err != nil {
+		log.Printf("Error connecting to $NOTIFY_SOCKET, not notifying systemd: %v", err)
+	}
+
+	opts := monitorOptions{
+		TopN:          uint32(cfg.Request.TopN),
+		Estimators:    estimators,
+		SortBy:        sortBy,
+		Types:         entityTypes,
+		Target:        mgmHost,
+		Recording:     rec,
+		Snapshots:     snapshots,
+		IdleTimeout:   cfg.Idle.ExitAfter,
+		IdleThreshold: idleRate,
+		IdleEstimator: cfg.Idle.Estimator,
+		Duration:      cfg.Run.Duration,
+		MaxReports:    cfg.Run.MaxReports,
+		Console:       term,
+		Colors:        colors,
+		Columns:       columns,
+		Pivot:         cfg.Console.Layout == "pivot",
+		Trends:        trends,
+		History:       history,
+		Watch:         watch,
+		Sort:          sorter,
+		SortExport:    cfg.Console.SortExport,
+		Totals:        !cfg.Console.NoTotals,
+		Format:        format,
+
+		AppNames:        appNames,
+		Filter:          filter,
+		Guard:           guard,
+		Exported:        exported,
+		Relabel:         relabeled,
+		Histograms:      histograms,
+		Loops:           loops,
+		Names:           names,
+		AggregateByName: cfg.Names.Aggregate,
+
+		ExpectedInstance: cfg.Instance.Expected,
+		InstanceHeader:   cfg.Instance.Header,
+		RefuseMismatch:   cfg.Instance.Mismatch == "refuse",
 
-	runMonitor(client, uint32(*topN))
+		Limits:    limits,
+		Shaping:   newShapingTracker(cfg.Shaping.Estimator, cfg.Shaping.AtLimit),
+		Alerts:    alerts,
+		SLOs:      slos,
+		FairShare: fair,
+		Groups:    groups,
+		Anomalies: anomalies,
+		Sustained: sustained,
+		Hitters:   hitters,
+		Baselines: baselines,
+		Checks:    checks,
+		Rolling:   rolling,
+		Counters:  counters,
+		API:       api,
+		Health:    health,
+		Systemd:   notifier,
+		Dashboard: dash,
+		Stream:    stream,
+		Sinks:     sinks,
+	}
+	if pull != nil {
+		pull.Start(client, opts)
+		<-ctx.Done()
+		log.Println("Interrupted, stopping monitor.")
+	} else {
+		err = runMonitor(ctx, client, opts)
+	}
+	if notifier != nil {
+		notifier.Stopping()
+	}
+	term.Close()
+	if stdoutQueue != nil {
+		stdoutQueue.Close()
+	}
+	if alerts != nil {
+		alerts.Close()
+	}
+
+	if baselines != nil {
+		if err := baselines.Save(); err != nil {
+			log.Printf("Error saving baselines: %v", err)
+		}
+	}
+	for _, s := range sinks {
+		if err := s.Close(); err != nil {
+			log.Printf("Error closing sink: %v", err)
+		}
+	}
+	if tracing != nil {
+		// Flush the spans of the last reports.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := tracing.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error flushing traces: %v", err)
+		}
+		cancel()
+	}
+
+	if rec != nil {
+		if err := rec.Close(); err != nil {
+			log.Printf("Error closing recording: %v", err)
+		}
+	}
+	if errors.Is(err, errIdle) {
+		log.Println(err)
+		os.Exit(exitIdle)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-func runMonitor(client pb.EosClient, topN uint32) {
-	req := &pb.TrafficShapingRateRequest{
-		Estimators: []pb.TrafficShapingRateRequest_Estimators{
-			pb.TrafficShapingRateRequest_EMA_1_SECONDS,
-			pb.TrafficShapingRateRequest_EMA_5_SECONDS,
-			pb.TrafficShapingRateRequest_SMA_1_SECONDS,
-			pb.TrafficShapingRateRequest_SMA_5_SECONDS,
-			pb.TrafficShapingRateRequest_SMA_1_MINUTES,
-			pb.TrafficShapingRateRequest_SMA_5_MINUTES,
-		},
-		IncludeTypes: []pb.TrafficShapingRateRequest_EntityType{
-			pb.TrafficShapingRateRequest_ENTITY_APP,
-			pb.TrafficShapingRateRequest_ENTITY_UID,
-			pb.TrafficShapingRateRequest_ENTITY_GID,
-		},
+// exitIdle is the exit code used when -exit-when-idle stops the monitor, so
+// capture jobs can tell it apart from failures (1) and interruptions (0).
+const exitIdle = 3
+
+var errIdle = errors.New("All entities idle, stopping monitor")
+
+// errRunDuration is the cancellation cause once -duration elapsed.
+var errRunDuration = errors.New("run duration reached")
+
+type monitorOptions struct {
+	TopN       uint32
+	Estimators []pb.TrafficShapingRateRequest_Estimators
+	SortBy     pb.TrafficShapingRateRequest_Estimators
+	Target     string
+	Recording  recordingWriter
+
+	// Snapshots, if set, is handed every report as received, to dump the
+	// latest on SIGUSR1, and the rows shown, for the periodic snapshots.
+	Snapshots *snapshotter
+
+	// Types are the entity types the MGM is asked for, those of the filter,
+	// so it doesn't stream entries the monitor would drop.
+	Types []pb.TrafficShapingRateRequest_EntityType
+
+	// Once every entity stayed below IdleThreshold on IdleEstimator for
+	// IdleTimeout, runMonitor returns errIdle.
+	IdleTimeout   time.Duration
+	IdleThreshold float64
+	IdleEstimator string
+
+	// Duration and MaxReports, if set, make runMonitor return nil once the
+	// monitor ran for that long or processed that many reports.
+	Duration   time.Duration
+	MaxReports uint
+
+	// Quiet leaves out the logs of the stream being opened and ended, for
+	// the pull mode opening one per scrape.
+	Quiet bool
+
+	// ExpectedInstance, if set, is checked against the InstanceHeader response
+	// header of the stream.
+	ExpectedInstance string
+	InstanceHeader   string
+	RefuseMismatch   bool
+
+	// Console draws the frame rendered from every report, in Colors if
+	// set.
+	Console *console
+	Colors  *colorScheme
+	// Columns are shown in the tables after the ids, with a line per entity
+	// and estimator or, if Pivot, per entity with the estimators as columns.
+	Columns []string
+	Pivot   bool
+	// Trends, if set, shows the change of every rate since the previous
+	// report.
+	Trends *rateTrends
+	// History, if set, keeps the cluster rates drawn as sparklines.
+	History *throughputHistory
+	// Watch, if set, shows its entity full screen instead of the tables.
+	Watch *entityWatch
+	// Sort, if set, orders the rows shown and, with SortExport, the
+	// entries of the reports passed on.
+	Sort       *rowSorter
+	SortExport bool
+	// Totals shows the rows summing every table.
+	Totals bool
+	// Format, if set, prints the reports instead of the console, to its
+	// output.
+	Format *outputFormat
+
+	// AppNames, if set, normalizes the app names of every report after it
+	// is recorded.
+	AppNames *appNormalizer
+
+	// Filter, if set, restricts the entities shown on the console and
+	// exported to Prometheus.
+	Filter *entityFilter
+
+	// Guard, if set, caps the number of rate series exported to Prometheus.
+	Guard *cardinalityGuard
+
+	// Exported, if set, restricts the estimators of the rates exported to
+	// Prometheus, the console still showing them all.
+	Exported estimatorSet
+
+	// Relabel, if set, exports the rate series through relabeling rules.
+	Relabel *relabeledRates
+	// Histograms, if set, exports the distribution of the rates per report.
+	Histograms *rateHistograms
+	// Loops accumulates the thread loop stats.
+	Loops *threadLoopStats
+
+	// Names, if set, resolves uids and gids for display. AggregateByName
+	// merges the users and groups that resolve to the same name, summing their
+	// rates in the console and the exported metrics.
+	Names           *nameResolver
+	AggregateByName bool
+
+	// Limits, if set, are exported along with their utilization, and Shaping
+	// tracks how often each entity is at its limit.
+	Limits  *limitsFile
+	Shaping *shapingTracker
+
+	// Alerts, if set, evaluates the alert rules on every report.
+	Alerts *alertEngine
+
+	// SLOs, if set, tracks the compliance of the SLOs with every report.
+	SLOs *sloTracker
+
+	// FairShare, if set, compares the share of each weighted group with its
+	// entitlement.
+	FairShare *fairShare
+
+	// Groups, if set, aggregates the rates of the named groups.
+	Groups *namedGroups
+
+	// Anomalies, if set, flags the entities whose rate is far from their
+	// rolling mean.
+	Anomalies *anomalyDetector
+
+	// Sustained, if set, flags the entities staying above a rate.
+	Sustained *sustainedDetector
+
+	// Hitters, if set, tracks the entities moving the most bytes over long
+	// windows.
+	Hitters *heavyHitters
+
+	// Baselines, if set, learns the typical rates per hour of the day and
+	// exports how far the current ones are from them.
+	Baselines *baselineTracker
+
+	// Checks, if set, cross-checks the estimators of every report.
+	Checks *consistencyChecker
+
+	// Rolling, if set, aggregates the rates over a rolling window.
+	Rolling *rollingAggregator
+
+	// Counters, if set, integrates the rates into byte counters.
+	Counters *byteCounters
+
+	// API, if set, serves the latest report over HTTP.
+	API *apiServer
+
+	// Health, if set, tracks the stream for /readyz.
+	Health *streamHealth
+
+	// Systemd, if set, notifies systemd of the readiness and status of the
+	// monitor and pets its watchdog on every report.
+	Systemd *systemdNotifier
+
+	// Dashboard, if set, pushes every report to the web dashboard.
+	Dashboard *dashboard
+
+	// Stream, if set, re-broadcasts every report to the /stream clients.
+	Stream *reportStream
+
+	// Sinks forward every report to other monitoring systems.
+	Sinks []sink
+}
+
+// trafficShapingRequest returns the request of the report stream.
+func trafficShapingRequest(topN uint32, estimators []pb.TrafficShapingRateRequest_Estimators, sortBy pb.TrafficShapingRateRequest_Estimators, types []pb.TrafficShapingRateRequest_EntityType) *pb.TrafficShapingRateRequest {
+	return &pb.TrafficShapingRateRequest{
+		Estimators:      estimators,
+		IncludeTypes:    types,
 		TopN:            &topN,
-		SortByEstimator: pb.TrafficShapingRateRequest_SMA_1_MINUTES.Enum(),
+		SortByEstimator: sortBy.Enum(),
+	}
+}
+
+// runMonitor consumes the report stream until ctx is cancelled (returning nil)
+// or the stream fails.
+func runMonitor(ctx context.Context, client pb.EosClient, opts monitorOptions) error {
+	if opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.Duration, errRunDuration)
+		defer cancel()
 	}
 
-	stream, err := client.TrafficShapingRate(context.Background(), req)
+	_, span := tracer.Start(ctx, "stream.open", trace.WithAttributes(attribute.String("eos.mgm.host", opts.Target)))
+	stream, err := client.TrafficShapingRate(ctx, trafficShapingRequest(opts.TopN, opts.Estimators, opts.SortBy, opts.Types))
 	if err != nil {
-		log.Fatalf("Error opening stream: %v", err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return fmt.Errorf("Error opening stream: %w", err)
 	}
 
-	log.Println("Connected to EOS IO Stream...")
+	if opts.ExpectedInstance != "" {
+		header, err := stream.Header()
+		if err == nil {
+			err = checkInstance(header, opts.InstanceHeader, opts.ExpectedInstance, opts.RefuseMismatch)
+		} else {
+			err = fmt.Errorf("Error reading stream header: %w", err)
+		}
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
+			return err
+		}
+	}
+	span.End()
+
+	if !opts.Quiet {
+		log.Println("Connected to EOS IO Stream...")
+	}
+	if opts.Health != nil {
+		opts.Health.Connected(true)
+		defer opts.Health.Connected(false)
+	}
 
+	var idleSince time.Time
+	var reports uint
 	for {
 		report, err := stream.Recv()
 		if err != nil {
-			log.Fatalf("Stream closed: %v", err)
+			if errors.Is(context.Cause(ctx), errRunDuration) {
+				log.Println("Run duration reached, stopping monitor.")
+				return nil
+			}
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("Stream deadline exceeded: %w", err)
+			}
+			if ctx.Err() != nil {
+				if !opts.Quiet {
+					log.Println("Interrupted, stopping monitor.")
+				}
+				return nil
+			}
+			return fmt.Errorf("Stream closed: %w", err)
 		}
+		if opts.Health != nil {
+			opts.Health.Received()
+		}
+		// The report span starts when the MGM emitted the report, so its
+		// duration is the latency until every exporter saw it.
+		_, span := tracer.Start(ctx, "report", trace.WithTimestamp(time.UnixMilli(report.TimestampMs)))
+		span.AddEvent("received")
 
-		// 1. Clear console and print headers FIRST
-		fmt.Print("\033[H\033[2J")
-		fmt.Printf("EOS IO Monitor | Last Update: %s\n\n", time.UnixMilli(report.TimestampMs).Format(time.RFC3339))
-
-		// 2. Safely extract and print Thread Loop Stats
-		if fst := report.FstLimitsUpdateThreadLoopStats; fst != nil {
-			fmt.Printf("FST Limits Update | Mean: %s | Min: %s | Max: %s\n",
-				time.Duration(fst.MeanElapsedTimeMicroSec)*time.Microsecond,
-				time.Duration(fst.MinElapsedTimeMicroSec)*time.Microsecond,
-				time.Duration(fst.MaxElapsedTimeMicroSec)*time.Microsecond,
-			)
-
-			// Export to Prometheus
-			threadLoopMicros.WithLabelValues("fst_limits", "mean").Set(float64(fst.MeanElapsedTimeMicroSec))
-			threadLoopMicros.WithLabelValues("fst_limits", "min").Set(float64(fst.MinElapsedTimeMicroSec))
-			threadLoopMicros.WithLabelValues("fst_limits", "max").Set(float64(fst.MaxElapsedTimeMicroSec))
+		if opts.Recording != nil {
+			if err := opts.Recording.Write(&frame{Target: opts.Target, Report: report}); err != nil {
+				span.End()
+				return fmt.Errorf("Error writing recording: %w", err)
+			}
+		}
+		if opts.Snapshots != nil {
+			opts.Snapshots.Update(report)
 		}
 
-		if est := report.EstimatorsUpdateThreadLoopStats; est != nil {
-			fmt.Printf("Estimators Update | Mean: %s | Min: %s | Max: %s\n",
-				time.Duration(est.MeanElapsedTimeMicroSec)*time.Microsecond,
-				time.Duration(est.MinElapsedTimeMicroSec)*time.Microsecond,
-				time.Duration(est.MaxElapsedTimeMicroSec)*time.Microsecond,
-			)
+		if opts.AppNames != nil {
+			report = opts.AppNames.Apply(report)
+		}
+		if opts.Sort != nil && opts.SortExport {
+			report = opts.Sort.SortReport(report)
+		}
 
-			// Export to Prometheus
-			threadLoopMicros.WithLabelValues("estimators", "mean").Set(float64(est.MeanElapsedTimeMicroSec))
-			threadLoopMicros.WithLabelValues("estimators", "min").Set(float64(est.MinElapsedTimeMicroSec))
-			threadLoopMicros.WithLabelValues("estimators", "max").Set(float64(est.MaxElapsedTimeMicroSec))
+		// 1. Render the header and the thread loop stats the MGM reports,
+		// exporting the latter; in append mode only a summary line is
+		// printed
+		var head, tail bytes.Buffer
+		var out, outTail io.Writer = &head, &tail
+		if opts.Console.append {
+			out, outTail = io.Discard, io.Discard
+		}
+		ts := time.UnixMilli(report.TimestampMs)
+		fmt.Fprint(out, "\033[H\033[2J")
+		fmt.Fprintf(out, "EOS IO Monitor | Last Update: %s\n\n", ts.Format(time.RFC3339))
+		printAndExportLoopStats(out, "FST Limits Update", "fst_limits", report.FstLimitsUpdateThreadLoopStats, opts.Loops, ts)
+		printAndExportLoopStats(out, "Estimators Update", "estimators", report.EstimatorsUpdateThreadLoopStats, opts.Loops, ts)
+		if report.FstLimitsUpdateThreadLoopStats == nil && report.EstimatorsUpdateThreadLoopStats == nil {
+			fmt.Fprintln(out, "Thread loop stats: not reported by this MGM")
 		}
-		fmt.Println()
+		fmt.Fprintln(out)
 
-		// 3. Reset the vector metrics BEFORE processing the new batch
-		readBytes.Reset()
-		writeBytes.Reset()
+		// 2. Replace the exported rates with the rows shown
+		rows := map[string][]entityRow{
+			"app":   appRows(report.AppStats, opts.Filter),
+			"user":  userRows(report.UserStats, opts.Names, opts.AggregateByName, opts.Filter),
+			"group": groupRows(report.GroupStats, opts.Names, opts.AggregateByName, opts.Filter),
+		}
+		if opts.Sort != nil {
+			for _, list := range rows {
+				opts.Sort.Sort(list)
+			}
+		}
+		exportRates(opts.Exported.rows(rows), opts.Guard, opts.Relabel)
+		if opts.Snapshots != nil {
+			opts.Snapshots.UpdateTop(ts, rows)
+		}
+		exported := opts.Exported.report(report)
+		exportTotals(exported)
+		span.AddEvent("exported")
+		if opts.Histograms != nil {
+			opts.Histograms.Update(exported)
+		}
+		if opts.Limits != nil {
+			limits := opts.Limits.Limits()
+			exportLimits(exported, limits)
+			opts.Shaping.Add(report, limits)
+			opts.Shaping.export()
+			printShaping(outTail, opts.Shaping)
+		}
+		if opts.Alerts != nil {
+			opts.Alerts.Evaluate(report)
+		}
+		if opts.SLOs != nil {
+			opts.SLOs.Update(report)
+		}
+		if opts.FairShare != nil {
+			opts.FairShare.Update(report)
+			printFairShare(outTail, opts.FairShare)
+		}
+		if opts.Groups != nil {
+			opts.Groups.Update(report)
+			printNamedGroups(outTail, opts.Groups)
+		}
+		if opts.Anomalies != nil {
+			opts.Anomalies.Update(report)
+			printAnomalies(outTail, opts.Anomalies)
+		}
+		if opts.Sustained != nil {
+			opts.Sustained.Update(report)
+		}
+		if opts.Hitters != nil {
+			opts.Hitters.Update(report)
+			printHeavyHitters(outTail, opts.Hitters)
+		}
+		if opts.Systemd != nil {
+			opts.Systemd.Report(summaryLine(ts, opts.SortBy.String(), rows))
+		}
+		if opts.Watch != nil {
+			frame := opts.Watch.Update(report)
+			opts.Console.Frame(frame.print)
+		} else if opts.Format != nil {
+			if err := opts.Format.Write(opts.Console.out, ts, opts.SortBy.String(), rows); err != nil {
+				log.Printf("Error formatting report: %v", err)
+			}
+		} else if opts.Console.append {
+			line := summaryLine(ts, opts.SortBy.String(), rows)
+			opts.Console.Frame(func(out io.Writer, _ int) { fmt.Fprintln(out, line) })
+		} else {
+			showNames, aggregate := opts.Names != nil, opts.AggregateByName
+			view := tableView{colors: opts.Colors, columns: opts.Columns, pivot: opts.Pivot, sortBy: opts.SortBy.String()}
+			shown := rows
+			if opts.Totals {
+				shown = withTotals(report, rows, int(opts.TopN))
+			}
+			if opts.Trends != nil {
+				view.trends, view.prev = true, opts.Trends.Update(shown)
+			}
+			var history []throughputSample
+			if opts.History != nil {
+				history = opts.History.Update(report)
+			}
+			opts.Console.Table(consoleTable{opts.Target, ts, shown}, func(out io.Writer, width int) {
+				view := view
+				view.width, view.search = width, opts.Console.search
+				out.Write(head.Bytes())
+				view.search.print(out)
+				printSparklines(out, history, width)
+				printApps(out, view.search.apply(shown["app"]), view)
+				printRows(out, "--- Top Users ---", "UID", "user", view.search.apply(shown["user"]), showNames, aggregate, view)
+				printRows(out, "--- Top Groups ---", "GID", "group", view.search.apply(shown["group"]), showNames, aggregate, view)
+				out.Write(tail.Bytes())
+			})
+		}
+		if opts.Baselines != nil {
+			opts.Baselines.Update(report)
+		}
+		if opts.Checks != nil {
+			opts.Checks.Update(report)
+		}
+		if opts.Rolling != nil {
+			opts.Rolling.Update(report)
+		}
+		if opts.Counters != nil {
+			opts.Counters.Update(report)
+		}
+		if opts.API != nil {
+			opts.API.Update(report)
+		}
+		if opts.Dashboard != nil {
+			opts.Dashboard.Update(report)
+		}
+		if opts.Stream != nil {
+			opts.Stream.Update(report)
+		}
+		reportSpans.Add(report, span.SpanContext())
+		for _, s := range opts.Sinks {
+			if err := s.Send(report); err != nil {
+				log.Printf("Sink error: %v", err)
+			}
+		}
+		span.End()
 
-		// 4. Process, Print, and Export the details LAST
-		printAndExportApps(report.AppStats)
-		printAndExportUsers(report.UserStats)
-		printAndExportGroups(report.GroupStats)
+		// 4. Stop after the requested number of reports, or once everything
+		// has been quiet for long enough
+		reports++
+		if opts.MaxReports > 0 && reports >= opts.MaxReports {
+			if !opts.Quiet {
+				log.Printf("Processed %d reports, stopping monitor.", reports)
+			}
+			return nil
+		}
+		if opts.IdleTimeout > 0 {
+			if !reportIdle(report, opts.IdleEstimator, opts.IdleThreshold) {
+				idleSince = time.Time{}
+			} else if idleSince.IsZero() {
+				idleSince = time.Now()
+			} else if time.Since(idleSince) >= opts.IdleTimeout {
+				return errIdle
+			}
+		}
 	}
 }
 
 // --- Helper Functions ---
-func printAndExportApps(stats []*pb.AppRateEntry) {
-	if len(stats) == 0 {
+
+// printAndExportLoopStats shows the stats of one MGM thread loop and adds
+// them to loops. Older MGMs omit them; the loop's metrics are then removed
+// rather than left stale, and the capability gauge tells dashboards why the
+// panel is empty.
+func printAndExportLoopStats(out io.Writer, title, loop string, stats *pb.ThreadLoopStats, loops *threadLoopStats, ts time.Time) {
+	loops.Update(loop, stats, ts)
+	if stats == nil {
+		serverCapability.WithLabelValues(loop + "_thread_loop_stats").Set(0)
 		return
 	}
-	fmt.Println("--- Top Applications ---")
+	serverCapability.WithLabelValues(loop + "_thread_loop_stats").Set(1)
+
+	fmt.Fprintf(out, "%s | Mean: %s | Min: %s | Max: %s\n", title,
+		time.Duration(stats.MeanElapsedTimeMicroSec)*time.Microsecond,
+		time.Duration(stats.MinElapsedTimeMicroSec)*time.Microsecond,
+		time.Duration(stats.MaxElapsedTimeMicroSec)*time.Microsecond,
+	)
+}
+
+// appRows returns the app rows that pass the filter.
+func appRows(stats []*pb.AppRateEntry, filter *entityFilter) []entityRow {
+	rows := make([]entityRow, 0, len(stats))
+	for _, entry := range stats {
+		rows = append(rows, entityRow{ID: entry.AppName, Stats: entry.Stats})
+	}
+	return filter.Apply("app", rows)
+}
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-	fmt.Fprintln(w, "App\tEstimator\tRead/s\tWrite/s")
+// userRows returns the user rows that pass the filter, merged by name when
+// aggregating.
+func userRows(stats []*pb.UserRateEntry, names *nameResolver, aggregate bool, filter *entityFilter) []entityRow {
+	rows := make([]entityRow, 0, len(stats))
+	for _, entry := range stats {
+		row := entityRow{ID: idString(entry.Uid), Stats: entry.Stats}
+		if names != nil {
+			row.Name = names.user(entry.Uid)
+		}
+		rows = append(rows, row)
+	}
+	rows = filter.Apply("user", rows)
+	if aggregate && len(rows) > 0 {
+		rows = aggregateByName(rows)
+	}
+	return rows
+}
 
+// groupRows returns the group rows that pass the filter, merged by name
+// when aggregating.
+func groupRows(stats []*pb.GroupRateEntry, names *nameResolver, aggregate bool, filter *entityFilter) []entityRow {
+	rows := make([]entityRow, 0, len(stats))
 	for _, entry := range stats {
-		for _, s := range entry.Stats {
-			estimatorName := s.Window.String()
-			exportMetric("app", entry.AppName, estimatorName, s)
-			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
-				entry.AppName,
-				estimatorName,
-				humanizeBytes(s.BytesReadPerSec),
-				humanizeBytes(s.BytesWrittenPerSec),
-			)
+		row := entityRow{ID: idString(entry.Gid), Stats: entry.Stats}
+		if names != nil {
+			row.Name = names.group(entry.Gid)
 		}
+		rows = append(rows, row)
 	}
-	w.Flush()
-	fmt.Println()
+	rows = filter.Apply("group", rows)
+	if aggregate && len(rows) > 0 {
+		rows = aggregateByName(rows)
+	}
+	return rows
 }
 
-func printAndExportUsers(stats []*pb.UserRateEntry) {
-	if len(stats) == 0 {
+// printApps prints the app rows as set by view.
+func printApps(out io.Writer, rows []entityRow, view tableView) {
+	if len(rows) == 0 {
 		return
 	}
-	fmt.Println("--- Top Users ---")
+	fmt.Fprintln(out, "--- Top Applications ---")
+	table, styles, flex := view.entityTable("App", "app", rows, false)
+	writeTable(out, table, styles, view.width, flex)
+	fmt.Fprintln(out)
+}
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-	fmt.Fprintln(w, "UID\tWindow\tRead/s\tWrite/s")
+// printRows prints the user or group rows of eType as set by view, with a
+// name column when resolving names. Aggregated rows are identified by their
+// name only.
+func printRows(out io.Writer, title, idHeader, eType string, rows []entityRow, showNames, aggregate bool, view tableView) {
+	if len(rows) == 0 {
+		return
+	}
+	if aggregate {
+		idHeader += "/Name"
+		showNames = false
+	}
+	fmt.Fprintln(out, title)
+	table, styles, flex := view.entityTable(idHeader, eType, rows, showNames)
+	writeTable(out, table, styles, view.width, flex)
+	fmt.Fprintln(out)
+}
 
-	for _, entry := range stats {
-		uidStr := strconv.Itoa(int(entry.Uid))
-		for _, s := range entry.Stats {
-			winName := s.Window.String()
-			exportMetric("user", uidStr, winName, s)
-			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
-				uidStr,
-				winName,
-				humanizeBytes(s.BytesReadPerSec),
-				humanizeBytes(s.BytesWrittenPerSec),
-			)
+func printShaping(out io.Writer, t *shapingTracker) {
+	if len(t.stats) == 0 {
+		return
+	}
+	fmt.Fprintln(out, "--- Shaping ---")
+	t.print(out, true)
+	fmt.Fprintln(out)
+}
+
+func printFairShare(out io.Writer, f *fairShare) {
+	if len(f.shares) == 0 {
+		return
+	}
+	fmt.Fprintln(out, "--- Fair Share ---")
+	f.print(out)
+	fmt.Fprintln(out)
+}
+
+func printNamedGroups(out io.Writer, g *namedGroups) {
+	if len(g.rates) == 0 {
+		return
+	}
+	fmt.Fprintf(out, "--- Groups (%s) ---\n", g.Estimator)
+	g.print(out)
+	fmt.Fprintln(out)
+}
+
+func printAnomalies(out io.Writer, d *anomalyDetector) {
+	if len(d.anomalies) == 0 {
+		return
+	}
+	fmt.Fprintf(out, "--- Anomalies (%s) ---\n", d.estimator)
+	d.print(out)
+	fmt.Fprintln(out)
+}
+
+func printHeavyHitters(out io.Writer, h *heavyHitters) {
+	if h.show == 0 || len(h.hitters) == 0 {
+		return
+	}
+	fmt.Fprintf(out, "--- Heavy Hitters (%s %s) ---\n", h.direction, h.estimator)
+	h.print(out)
+	fmt.Fprintln(out)
+}
+
+func parseEstimator(name string) (pb.TrafficShapingRateRequest_Estimators, error) {
+	v, ok := pb.TrafficShapingRateRequest_Estimators_value[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown estimator %q", name)
+	}
+	return pb.TrafficShapingRateRequest_Estimators(v), nil
+}
+
+// entityTypeValues maps the entity_type label values to the request enum.
+var entityTypeValues = map[string]pb.TrafficShapingRateRequest_EntityType{
+	"app":   pb.TrafficShapingRateRequest_ENTITY_APP,
+	"user":  pb.TrafficShapingRateRequest_ENTITY_UID,
+	"group": pb.TrafficShapingRateRequest_ENTITY_GID,
+}
+
+func parseEstimators(names []string) ([]pb.TrafficShapingRateRequest_Estimators, error) {
+	if len(names) == 0 {
+		return nil, errors.New("at least one estimator is needed")
+	}
+	estimators := make([]pb.TrafficShapingRateRequest_Estimators, 0, len(names))
+	for _, name := range names {
+		e, err := parseEstimator(name)
+		if err != nil {
+			return nil, err
+		}
+		estimators = append(estimators, e)
+	}
+	return estimators, nil
+}
+
+// reportIdle reports whether no entity reaches threshold on the estimator.
+func reportIdle(report *pb.TrafficShapingRateResponse, estimator string, threshold float64) bool {
+	for _, e := range reportEntities(report) {
+		for _, s := range e.Stats {
+			if s.Window.String() == estimator && (s.BytesReadPerSec >= threshold || s.BytesWrittenPerSec >= threshold) {
+				return false
+			}
 		}
 	}
-	w.Flush()
-	fmt.Println()
+	return true
 }
 
-func printAndExportGroups(stats []*pb.GroupRateEntry) {
-	if len(stats) == 0 {
+// exportRates exports the rates of the rows of every entity type, through
+// guard and the relabeling rules if set.
+func exportRates(rows map[string][]entityRow, guard *cardinalityGuard, relabeled *relabeledRates) {
+	if guard != nil {
+		rows = guard.Limit(rows)
+	}
+	if relabeled != nil {
+		exportedRates.prune(true)
+		relabeled.Set(rows)
 		return
 	}
-	fmt.Println("--- Top Groups ---")
+	exportedRates.report++
+	for eType, list := range rows {
+		for _, row := range list {
+			for _, s := range row.Stats {
+				exportedRates.set(eType, row.ID, s)
+			}
+		}
+	}
+	exportedRates.prune(false)
+}
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-	fmt.Fprintln(w, "GID\tWindow\tRead/s\tWrite/s")
+// rateSeries keeps the label values of the exported rate series with the
+// report that last set them, so that every report updates the series in
+// place and only deletes those it doesn't have, rather than resetting the
+// gauges and creating all the series again. With ratio, the read ratio of
+// every series is exported too, except for the idle ones. With suffix, the
+// estimator is a suffix of the metric names instead of a label.
+type rateSeries struct {
+	report uint64
+	seen   map[[3]string]uint64 // by entity type, id, estimator
+	ratio  bool
+	suffix bool
 
-	for _, entry := range stats {
-		gidStr := strconv.Itoa(int(entry.Gid))
-		for _, s := range entry.Stats {
-			winName := s.Window.String()
-			exportMetric("group", gidStr, winName, s)
-			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
-				gidStr,
-				winName,
-				humanizeBytes(s.BytesReadPerSec),
-				humanizeBytes(s.BytesWrittenPerSec),
-			)
+	suffixed map[string]rateGauges // by estimator, with suffix
+}
+
+// rateGauges are the rate gauges of one estimator, named after it.
+type rateGauges struct {
+	read, write, ratio *prometheus.GaugeVec
+}
+
+var exportedRates = rateSeries{seen: make(map[[3]string]uint64), suffixed: make(map[string]rateGauges)}
+
+// gauges returns the gauges of the series k and its label values.
+func (r *rateSeries) gauges(k [3]string) (rateGauges, []string) {
+	if !r.suffix {
+		return rateGauges{readBytes, writeBytes, readRatio}, k[:]
+	}
+	g, ok := r.suffixed[k[2]]
+	if !ok {
+		suffix := "_" + strings.ToLower(strings.ReplaceAll(shortEstimator(k[2]), " ", ""))
+		labels := []string{"entity_type", "id"}
+		g = rateGauges{
+			read: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Name: "eos_io_read_bytes_per_second" + suffix,
+				Help: "Current read throughput in bytes/sec on " + k[2],
+			}, labels),
+			write: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Name: "eos_io_write_bytes_per_second" + suffix,
+				Help: "Current write throughput in bytes/sec on " + k[2],
+			}, labels),
+			ratio: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Name: "eos_io_read_ratio" + suffix,
+				Help: "Share of the throughput on " + k[2] + " that is read, with -prometheus-read-ratio",
+			}, labels),
 		}
+		prometheus.MustRegister(g.read, g.write, g.ratio)
+		r.suffixed[k[2]] = g
+	}
+	return g, k[:2]
+}
+
+func (r *rateSeries) set(eType, id string, s *pb.RateStats) {
+	k := [3]string{eType, id, s.Window.String()}
+	r.seen[k] = r.report
+	g, labels := r.gauges(k)
+	g.read.WithLabelValues(labels...).Set(s.BytesReadPerSec)
+	g.write.WithLabelValues(labels...).Set(s.BytesWrittenPerSec)
+	if !r.ratio {
+		return
+	}
+	if total := s.BytesReadPerSec + s.BytesWrittenPerSec; total > 0 {
+		g.ratio.WithLabelValues(labels...).Set(s.BytesReadPerSec / total)
+	} else {
+		g.ratio.DeleteLabelValues(labels...)
 	}
-	w.Flush()
-	fmt.Println()
 }
 
-func exportMetric(eType, id, win string, s *pb.RateStats) {
-	readBytes.WithLabelValues(eType, id, win).Set(s.BytesReadPerSec)
-	writeBytes.WithLabelValues(eType, id, win).Set(s.BytesWrittenPerSec)
+// prune deletes the series not set by the current report, or all of them.
+func (r *rateSeries) prune(all bool) {
+	for k, report := range r.seen {
+		if all || report != r.report {
+			g, labels := r.gauges(k)
+			g.read.DeleteLabelValues(labels...)
+			g.write.DeleteLabelValues(labels...)
+			g.ratio.DeleteLabelValues(labels...)
+			delete(r.seen, k)
+		}
+	}
 }
 
+// humanizeBytes formats a number of bytes in the display units chosen with
+// -units.
 func humanizeBytes(s float64) string {
-	sizes := []string{"B", "KB", "MB", "GB", "TB"}
-	i := 0
-	val := s
-	for val >= 1024 && i < len(sizes)-1 {
-		val /= 1024
-		i++
-	}
-	return fmt.Sprintf("%.2f %s", val, sizes[i])
+	return displayUnits.format(s)
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// idPattern matches entity ids (uids, gids or app names) in configuration
+// files and flags. A pattern is one of
+//
+//	1234           the exact id
+//	10000-10999    an inclusive range of numeric ids
+//	atlas*         a shell glob (*, ? and [...])
+//	~^rucio-\d+$   a regular expression, after the ~
+type idPattern struct {
+	text     string
+	exact    string
+	from, to uint64
+	isRange  bool
+	glob     string
+	re       *regexp.Regexp
+}
+
+func parseIDPattern(s string) (idPattern, error) {
+	p := idPattern{text: s}
+	switch {
+	case s == "":
+		return p, errors.New("empty id pattern")
+	case strings.HasPrefix(s, "~"):
+		re, err := regexp.Compile(s[1:])
+		if err != nil {
+			return p, fmt.Errorf("invalid regular expression %q: %w", s[1:], err)
+		}
+		p.re = re
+	case strings.ContainsAny(s, "*?["):
+		if _, err := path.Match(s, ""); err != nil {
+			return p, fmt.Errorf("invalid glob %q: %w", s, err)
+		}
+		p.glob = s
+	default:
+		from, to, ok := strings.Cut(s, "-")
+		a, errA := strconv.ParseUint(from, 10, 32)
+		b, errB := strconv.ParseUint(to, 10, 32)
+		if !ok || errA != nil || errB != nil {
+			p.exact = s
+			break
+		}
+		if a > b {
+			return p, fmt.Errorf("empty id range %q", s)
+		}
+		p.from, p.to, p.isRange = a, b, true
+	}
+	return p, nil
+}
+
+func (p *idPattern) UnmarshalText(text []byte) error {
+	var err error
+	*p, err = parseIDPattern(string(text))
+	return err
+}
+
+func (p idPattern) String() string {
+	return p.text
+}
+
+// Match reports whether id matches the pattern.
+func (p idPattern) Match(id string) bool {
+	switch {
+	case p.re != nil:
+		return p.re.MatchString(id)
+	case p.glob != "":
+		ok, _ := path.Match(p.glob, id)
+		return ok
+	case p.isRange:
+		n, err := strconv.ParseUint(id, 10, 32)
+		return err == nil && n >= p.from && n <= p.to
+	}
+	return id == p.exact
+}
+
+// matchesNoNumber reports whether p can't match a numeric id, as uids and
+// gids are: it is an exact id or a glob with other characters than digits
+// outside of its [...] classes. Regular expressions are assumed to match.
+func (p idPattern) matchesNoNumber() bool {
+	switch {
+	case p.exact != "":
+		_, err := strconv.ParseUint(p.exact, 10, 32)
+		return err != nil
+	case p.glob != "":
+		inClass := false
+		for _, c := range p.glob {
+			switch {
+			case inClass:
+				inClass = c != ']'
+			case c == '[':
+				inClass = true
+			case c != '*' && c != '?' && c != '\\' && (c < '0' || c > '9'):
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesEvery reports whether p matches every id, of numeric ids only if
+// numeric: a glob of * alone, which doesn't match the / of some app names,
+// or one of the regular expressions matching anything.
+func (p idPattern) matchesEvery(numeric bool) bool {
+	switch {
+	case p.re != nil:
+		switch p.re.String() {
+		case "", ".*", "^.*", ".*$", "^.*$", "(?s).*":
+			return true
+		}
+	case p.glob != "":
+		return numeric && strings.Trim(p.glob, "*") == ""
+	}
+	return false
+}
+
+// idPatterns matches ids matching any of its patterns.
+type idPatterns []idPattern
+
+func (ps idPatterns) Match(id string) bool {
+	for _, p := range ps {
+		if p.Match(id) {
+			return true
+		}
+	}
+	return false
+}
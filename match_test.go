@@ -0,0 +1,104 @@
+package main
+
+import "testing"
+
+func TestIDPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		match   []string
+		noMatch []string
+	}{
+		{
+			pattern: "1234",
+			match:   []string{"1234"},
+			noMatch: []string{"123", "12345", "01234", ""},
+		},
+		{
+			pattern: "rucio-download",
+			match:   []string{"rucio-download"},
+			noMatch: []string{"rucio-downloads", "rucio"},
+		},
+		{
+			pattern: "10000-10999",
+			match:   []string{"10000", "10500", "10999"},
+			noMatch: []string{"9999", "11000", "10000-10999", "atlas", ""},
+		},
+		{
+			pattern: "5-5",
+			match:   []string{"5"},
+			noMatch: []string{"4", "6"},
+		},
+		{
+			pattern: "atlas*",
+			match:   []string{"atlas", "atlas-prod"},
+			noMatch: []string{"cms", "xatlas", "atlas/sub"},
+		},
+		{
+			pattern: "user?",
+			match:   []string{"user1", "userx"},
+			noMatch: []string{"user", "user12"},
+		},
+		{
+			pattern: "[ab]*",
+			match:   []string{"atlas", "b"},
+			noMatch: []string{"cms"},
+		},
+		{
+			pattern: `~^rucio-\d+$`,
+			match:   []string{"rucio-1", "rucio-42"},
+			noMatch: []string{"rucio-", "rucio-x", "xrucio-1"},
+		},
+		{
+			pattern: "~prod",
+			match:   []string{"prod", "atlas-prod-1"},
+			noMatch: []string{"dev"},
+		},
+	}
+	for _, tt := range tests {
+		p, err := parseIDPattern(tt.pattern)
+		if err != nil {
+			t.Errorf("parseIDPattern(%q): %v", tt.pattern, err)
+			continue
+		}
+		if p.String() != tt.pattern {
+			t.Errorf("parseIDPattern(%q).String() = %q", tt.pattern, p.String())
+		}
+		for _, id := range tt.match {
+			if !p.Match(id) {
+				t.Errorf("%q doesn't match %q", tt.pattern, id)
+			}
+		}
+		for _, id := range tt.noMatch {
+			if p.Match(id) {
+				t.Errorf("%q matches %q", tt.pattern, id)
+			}
+		}
+	}
+}
+
+func TestIDPatternErrors(t *testing.T) {
+	for _, pattern := range []string{"", "10-5", "~(", "~[a-", "atlas[", "a[b-"} {
+		if _, err := parseIDPattern(pattern); err == nil {
+			t.Errorf("parseIDPattern(%q) succeeded", pattern)
+		}
+	}
+}
+
+func TestIDPatterns(t *testing.T) {
+	var ps idPatterns
+	for _, s := range []string{"1000-1999", "atlas*", "42"} {
+		var p idPattern
+		if err := p.UnmarshalText([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+		ps = append(ps, p)
+	}
+	for id, want := range map[string]bool{"1500": true, "atlas-prod": true, "42": true, "43": false, "cms": false} {
+		if got := ps.Match(id); got != want {
+			t.Errorf("Match(%q) = %v, want %v", id, got, want)
+		}
+	}
+	if (idPatterns{}).Match("42") {
+		t.Error("no patterns match an id")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func runMerge(args []string) {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s merge <output> <input>...\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Interleaves the reports of several recordings (e.g. one per MGM) by")
+		fmt.Fprintln(fs.Output(), "timestamp into a single multi-target recording.")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() < 3 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	n, err := mergeRecordings(fs.Arg(0), fs.Args()[1:])
+	if err != nil {
+		log.Fatalf("Error merging recordings: %v", err)
+	}
+	log.Printf("Merged %d reports into %s", n, fs.Arg(0))
+}
+
+// mergeSource is the next pending frame of one input recording.
+type mergeSource struct {
+	order int
+	path  string
+	r     recordingReader
+	next  *frame
+}
+
+// mergeQueue orders sources by the timestamp of their next frame, falling
+// back to the input order for identical timestamps.
+type mergeQueue []*mergeSource
+
+func (q mergeQueue) Len() int { return len(q) }
+func (q mergeQueue) Less(i, j int) bool {
+	ti, tj := q[i].next.Report.TimestampMs, q[j].next.Report.TimestampMs
+	if ti != tj {
+		return ti < tj
+	}
+	return q[i].order < q[j].order
+}
+func (q mergeQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *mergeQueue) Push(x any)   { *q = append(*q, x.(*mergeSource)) }
+func (q *mergeQueue) Pop() any {
+	old := *q
+	s := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return s
+}
+
+// advance reads the next frame of s. Frames without a target (e.g. from
+// hand-made recordings) are attributed to the input file name.
+func (s *mergeSource) advance() error {
+	f, err := s.r.Read()
+	if err != nil {
+		s.next = nil
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	if f.Target == "" {
+		name := filepath.Base(s.path)
+		f.Target = strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), filepath.Ext(strings.TrimSuffix(name, ".gz")))
+	}
+	s.next = f
+	return nil
+}
+
+func mergeRecordings(outPath string, inPaths []string) (int, error) {
+	q := make(mergeQueue, 0, len(inPaths))
+	defer func() {
+		for _, s := range q {
+			s.r.Close()
+		}
+	}()
+
+	for i, path := range inPaths {
+		r, err := openRecording(path)
+		if err != nil {
+			return 0, err
+		}
+		s := &mergeSource{order: i, path: path, r: r}
+		if err := s.advance(); err != nil {
+			r.Close()
+			return 0, err
+		}
+		if s.next == nil {
+			r.Close()
+			continue
+		}
+		q = append(q, s)
+	}
+	heap.Init(&q)
+
+	out, err := createRecording(outPath)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for q.Len() > 0 {
+		s := q[0]
+		if err := out.Write(s.next); err != nil {
+			out.Close()
+			return n, fmt.Errorf("%s: %w", outPath, err)
+		}
+		n++
+
+		if err := s.advance(); err != nil {
+			out.Close()
+			return n, err
+		}
+		if s.next == nil {
+			s.r.Close()
+			heap.Pop(&q)
+		} else {
+			heap.Fix(&q, 0)
+		}
+	}
+	return n, out.Close()
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+func runMockMGM(args []string) {
+	fs := flag.NewFlagSet("mock-mgm", flag.ExitOnError)
+	listen := fs.String("listen", ":50051", "Address to serve the TrafficShapingRate API on")
+	interval := fs.Duration("interval", time.Second, "Time between reports")
+	apps := fs.Int("apps", 10, "Number of apps doing IO")
+	users := fs.Int("users", 100, "Number of users doing IO")
+	groups := fs.Int("groups", 10, "Number of groups doing IO")
+	pattern := fs.String("pattern", "steady", "Rate pattern: steady, diurnal (a sine over -period) or bursty")
+	period := fs.Duration("period", 10*time.Minute, "Period of the diurnal pattern")
+	churn := fs.Float64("churn", 0.01, "Probability for every entity to be replaced by a new one at each report")
+	maxRate := fs.String("max-rate", "500MB/s", "Highest base rate of an entity, the others being spread down to 1KB/s")
+	seed := fs.Uint64("seed", 1, "Seed of the workload, for reproducible runs")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s mock-mgm [flags]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Serves the TrafficShapingRate gRPC API of an MGM with a synthetic workload,")
+		fmt.Fprintln(fs.Output(), "so the monitor, its exporters and sinks can be tried without a real MGM:")
+		fmt.Fprintln(fs.Output(), "point -grpc-host and -grpc-port at it.")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	top, err := parseByteRate(*maxRate)
+	if err != nil {
+		log.Fatalf("Invalid -max-rate: %v", err)
+	}
+	w, err := newMockWorkload(mockWorkloadConfig{
+		Apps:     *apps,
+		Users:    *users,
+		Groups:   *groups,
+		Pattern:  *pattern,
+		Period:   *period,
+		Churn:    *churn,
+		MaxRate:  top,
+		Interval: *interval,
+		Seed:     *seed,
+	})
+	if err != nil {
+		log.Fatalf("Invalid workload: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("Error listening: %v", err)
+	}
+	m := newMockMGM()
+	server := grpc.NewServer()
+	pb.RegisterEosServer(server, m)
+	go func() {
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			m.publish(w.Step(now))
+		}
+	}()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		server.Stop()
+	}()
+	log.Printf("Serving a mock MGM on %s with %d apps, %d users and %d groups", lis.Addr(), *apps, *users, *groups)
+	if err := server.Serve(lis); err != nil {
+		log.Fatalf("Error serving: %v", err)
+	}
+}
+
+// mockMGM serves the reports of a mockWorkload to every client, filtered
+// to what each asks for like the relay does. A new client gets the latest
+// report at once, and then every report published.
+type mockMGM struct {
+	pb.UnimplementedEosServer
+
+	mu     sync.Mutex
+	latest *pb.TrafficShapingRateResponse
+	seq    int           // of latest, from 1
+	next   chan struct{} // closed when latest is replaced
+	ended  bool
+
+	subscribed     chan struct{} // closed once a client connected
+	subscribedOnce sync.Once
+}
+
+func newMockMGM() *mockMGM {
+	return &mockMGM{next: make(chan struct{}), subscribed: make(chan struct{})}
+}
+
+func (m *mockMGM) publish(report *pb.TrafficShapingRateResponse) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latest = report
+	m.seq++
+	close(m.next)
+	m.next = make(chan struct{})
+}
+
+// end closes the streams once they sent the latest report.
+func (m *mockMGM) end() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ended = true
+	close(m.next)
+}
+
+func (m *mockMGM) TrafficShapingRate(req *pb.TrafficShapingRateRequest, stream pb.Eos_TrafficShapingRateServer) error {
+	m.subscribedOnce.Do(func() { close(m.subscribed) })
+	sent := 0
+	for {
+		m.mu.Lock()
+		report, seq, next, ended := m.latest, m.seq, m.next, m.ended
+		m.mu.Unlock()
+		if seq > sent {
+			if err := stream.Send(relayFilter(report, req)); err != nil {
+				return err
+			}
+			sent = seq
+			continue
+		}
+		if ended {
+			return nil
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-next:
+		}
+	}
+}
+
+type mockWorkloadConfig struct {
+	Apps, Users, Groups int
+	Pattern             string
+	Period              time.Duration
+	Churn               float64
+	MaxRate             float64
+	Interval            time.Duration
+	Seed                uint64
+}
+
+// mockWorkload generates the rates of synthetic entities. Every entity has
+// a base read and write rate, log-uniform between 1KB/s and MaxRate, which
+// the pattern modulates over time with some noise. The estimators are
+// computed from these samples like the MGM does from the IO it sees: the
+// SMAs average the samples of their window, the EMAs smooth them with their
+// time constant.
+type mockWorkload struct {
+	cfg     mockWorkloadConfig
+	rng     *rand.Rand
+	start   time.Time
+	nextID  int
+	apps    []*mockEntity
+	users   []*mockEntity
+	groups  []*mockEntity
+	windows map[pb.TrafficShapingRateRequest_Estimators]int // samples per SMA
+}
+
+type mockEntity struct {
+	id          int
+	read, write float64 // base rates
+	phase       float64 // of the diurnal pattern
+	burst       int     // reports left in the current burst
+
+	samples [][2]float64 // read and write, newest last
+	ema1    [2]float64
+	ema5    [2]float64
+}
+
+// mockSMAs are the windows of the SMA estimators.
+var mockSMAs = map[pb.TrafficShapingRateRequest_Estimators]time.Duration{
+	pb.TrafficShapingRateRequest_SMA_1_SECONDS: time.Second,
+	pb.TrafficShapingRateRequest_SMA_5_SECONDS: 5 * time.Second,
+	pb.TrafficShapingRateRequest_SMA_1_MINUTES: time.Minute,
+	pb.TrafficShapingRateRequest_SMA_5_MINUTES: 5 * time.Minute,
+}
+
+func newMockWorkload(cfg mockWorkloadConfig) (*mockWorkload, error) {
+	if cfg.Apps < 0 || cfg.Users < 0 || cfg.Groups < 0 {
+		return nil, errors.New("entity counts must not be negative")
+	}
+	if cfg.Pattern != "steady" && cfg.Pattern != "diurnal" && cfg.Pattern != "bursty" {
+		return nil, fmt.Errorf("unknown pattern %q (expected steady, diurnal or bursty)", cfg.Pattern)
+	}
+	if cfg.Interval <= 0 || cfg.Period <= 0 {
+		return nil, errors.New("interval and period must be positive")
+	}
+	if cfg.Churn < 0 || cfg.Churn > 1 {
+		return nil, fmt.Errorf("churn must be between 0 and 1, got %g", cfg.Churn)
+	}
+	if cfg.MaxRate < 1024 {
+		return nil, errors.New("max rate must be at least 1KB/s")
+	}
+	w := &mockWorkload{
+		cfg:     cfg,
+		rng:     rand.New(rand.NewPCG(cfg.Seed, cfg.Seed)),
+		windows: make(map[pb.TrafficShapingRateRequest_Estimators]int),
+	}
+	for e, d := range mockSMAs {
+		w.windows[e] = max(1, int(math.Round(float64(d)/float64(cfg.Interval))))
+	}
+	for range cfg.Apps {
+		w.apps = append(w.apps, w.newEntity())
+	}
+	for range cfg.Users {
+		w.users = append(w.users, w.newEntity())
+	}
+	for range cfg.Groups {
+		w.groups = append(w.groups, w.newEntity())
+	}
+	return w, nil
+}
+
+func (w *mockWorkload) newEntity() *mockEntity {
+	w.nextID++
+	rate := func() float64 {
+		return 1024 * math.Pow(w.cfg.MaxRate/1024, w.rng.Float64())
+	}
+	return &mockEntity{id: w.nextID, read: rate(), write: rate() / 4, phase: 2 * math.Pi * w.rng.Float64()}
+}
+
+// Step advances the workload to now and returns its report.
+func (w *mockWorkload) Step(now time.Time) *pb.TrafficShapingRateResponse {
+	if w.start.IsZero() {
+		w.start = now
+	}
+	report := &pb.TrafficShapingRateResponse{
+		TimestampMs: now.UnixMilli(),
+		FstLimitsUpdateThreadLoopStats: &pb.ThreadLoopStats{
+			MeanElapsedTimeMicroSec: uint64(200 + w.rng.IntN(100)),
+			MinElapsedTimeMicroSec:  100,
+			MaxElapsedTimeMicroSec:  uint64(500 + w.rng.IntN(1000)),
+		},
+		EstimatorsUpdateThreadLoopStats: &pb.ThreadLoopStats{
+			MeanElapsedTimeMicroSec: uint64(1000 + w.rng.IntN(500)),
+			MinElapsedTimeMicroSec:  500,
+			MaxElapsedTimeMicroSec:  uint64(2000 + w.rng.IntN(3000)),
+		},
+	}
+	elapsed := now.Sub(w.start)
+	for _, e := range w.advance(w.apps, elapsed) {
+		report.AppStats = append(report.AppStats, &pb.AppRateEntry{AppName: fmt.Sprintf("app%d", e.id), Stats: w.stats(e)})
+	}
+	for _, e := range w.advance(w.users, elapsed) {
+		report.UserStats = append(report.UserStats, &pb.UserRateEntry{Uid: uint32(10000 + e.id), Stats: w.stats(e)})
+	}
+	for _, e := range w.advance(w.groups, elapsed) {
+		report.GroupStats = append(report.GroupStats, &pb.GroupRateEntry{Gid: uint32(10000 + e.id), Stats: w.stats(e)})
+	}
+	return report
+}
+
+// advance replaces the churned entities and samples the rates of all of
+// them at elapsed.
+func (w *mockWorkload) advance(entities []*mockEntity, elapsed time.Duration) []*mockEntity {
+	keep := w.windows[pb.TrafficShapingRateRequest_SMA_5_MINUTES]
+	for i, e := range entities {
+		if w.rng.Float64() < w.cfg.Churn {
+			e = w.newEntity()
+			entities[i] = e
+		}
+		factor := 1.0
+		switch w.cfg.Pattern {
+		case "diurnal":
+			factor = 1 + 0.8*math.Sin(2*math.Pi*elapsed.Seconds()/w.cfg.Period.Seconds()+e.phase)
+		case "bursty":
+			if e.burst == 0 && w.rng.Float64() < 0.01 {
+				e.burst = 5 + w.rng.IntN(20)
+			}
+			if e.burst > 0 {
+				e.burst--
+				factor = 10
+			}
+		}
+		noise := func() float64 { return 0.8 + 0.4*w.rng.Float64() }
+		sample := [2]float64{e.read * factor * noise(), e.write * factor * noise()}
+		e.samples = append(e.samples, sample)
+		if len(e.samples) > keep {
+			e.samples = e.samples[len(e.samples)-keep:]
+		}
+		for d := range 2 {
+			e.ema1[d] = ema(e.ema1[d], sample[d], w.cfg.Interval, time.Second, len(e.samples) == 1)
+			e.ema5[d] = ema(e.ema5[d], sample[d], w.cfg.Interval, 5*time.Second, len(e.samples) == 1)
+		}
+	}
+	return entities
+}
+
+// ema returns the exponential moving average with time constant tau after
+// prev and a sample dt later, or the sample itself if first.
+func ema(prev, sample float64, dt, tau time.Duration, first bool) float64 {
+	if first {
+		return sample
+	}
+	alpha := 1 - math.Exp(-dt.Seconds()/tau.Seconds())
+	return prev + alpha*(sample-prev)
+}
+
+func (w *mockWorkload) stats(e *mockEntity) []*pb.RateStats {
+	stats := []*pb.RateStats{
+		{Window: pb.TrafficShapingRateRequest_EMA_1_SECONDS, BytesReadPerSec: e.ema1[0], BytesWrittenPerSec: e.ema1[1]},
+		{Window: pb.TrafficShapingRateRequest_EMA_5_SECONDS, BytesReadPerSec: e.ema5[0], BytesWrittenPerSec: e.ema5[1]},
+	}
+	for _, window := range []pb.TrafficShapingRateRequest_Estimators{
+		pb.TrafficShapingRateRequest_SMA_1_SECONDS,
+		pb.TrafficShapingRateRequest_SMA_5_SECONDS,
+		pb.TrafficShapingRateRequest_SMA_1_MINUTES,
+		pb.TrafficShapingRateRequest_SMA_5_MINUTES,
+	} {
+		n := min(w.windows[window], len(e.samples))
+		var read, write float64
+		for _, s := range e.samples[len(e.samples)-n:] {
+			read += s[0]
+			write += s[1]
+		}
+		stats = append(stats, &pb.RateStats{Window: window, BytesReadPerSec: read / float64(n), BytesWrittenPerSec: write / float64(n)})
+	}
+	return stats
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// monitSink sends every report to CERN's MONIT infrastructure through an
+// ActiveMQ broker over STOMP. Every entity and estimator becomes one JSON
+// document carrying the metadata MONIT routes on:
+//
+//	{"producer":"eos","type":"traffic_shaping","timestamp":1700000000000,"host":"mgm:50051",
+//	 "entity_type":"app","id":"rucio","estimator":"SMA_5_SECONDS",
+//	 "read_bytes_per_second":1.2e+08,"write_bytes_per_second":0}
+//
+// Documents are sent as JSON arrays of up to batchSize documents, one STOMP
+// message each, by a background writer that reconnects with backoff when the
+// broker connection drops.
+type monitSink struct {
+	address     string
+	tls         bool
+	vhost       string
+	login       string
+	passcode    string
+	destination string
+	producer    string
+	docType     string
+	mgm         string
+	batchSize   int
+
+	queue chan []monitDocument
+	done  chan struct{}
+	conn  net.Conn
+	r     *bufio.Reader
+}
+
+type monitDocument struct {
+	Producer   string  `json:"producer"`
+	Type       string  `json:"type"`
+	Timestamp  int64   `json:"timestamp"` // milliseconds
+	Host       string  `json:"host"`
+	EntityType string  `json:"entity_type"`
+	ID         string  `json:"id"`
+	Estimator  string  `json:"estimator"`
+	Read       float64 `json:"read_bytes_per_second"`
+	Write      float64 `json:"write_bytes_per_second"`
+}
+
+// newMonitSink sends to the broker at brokerURL, stomp://host:port or
+// stomp+ssl://host:port. credentialsFile, if set, holds "login:passcode".
+func newMonitSink(brokerURL, destination, producer, docType, credentialsFile string, batchSize int, mgm string) (*monitSink, error) {
+	u, err := url.Parse(brokerURL)
+	if err != nil || (u.Scheme != "stomp" && u.Scheme != "stomp+ssl") || u.Port() == "" {
+		return nil, fmt.Errorf("MONIT broker must be a stomp:// or stomp+ssl:// URL with a port, got %q", brokerURL)
+	}
+	if destination == "" {
+		return nil, errors.New("MONIT needs a destination, e.g. /topic/eos")
+	}
+	if producer == "" || docType == "" {
+		return nil, errors.New("MONIT needs a producer and a type")
+	}
+	if batchSize < 1 {
+		return nil, fmt.Errorf("MONIT batch size must be positive, got %d", batchSize)
+	}
+	s := &monitSink{
+		address:     u.Host,
+		tls:         u.Scheme == "stomp+ssl",
+		vhost:       u.Hostname(),
+		destination: destination,
+		producer:    producer,
+		docType:     docType,
+		mgm:         mgm,
+		batchSize:   batchSize,
+		queue:       make(chan []monitDocument, 100),
+		done:        make(chan struct{}),
+	}
+	if credentialsFile != "" {
+		b, err := os.ReadFile(credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		login, passcode, ok := strings.Cut(strings.TrimSpace(string(b)), ":")
+		if !ok {
+			return nil, fmt.Errorf("%s: expected login:passcode", credentialsFile)
+		}
+		// They are sent unescaped, STOMP 1.2 having no escapes in CONNECT.
+		if strings.ContainsAny(login+passcode, "\r\n") {
+			return nil, fmt.Errorf("%s: login and passcode must be on one line", credentialsFile)
+		}
+		s.login, s.passcode = login, passcode
+	}
+	go s.writer()
+	return s, nil
+}
+
+func (s *monitSink) Send(report *pb.TrafficShapingRateResponse) error {
+	batch := make([]monitDocument, 0, s.batchSize)
+	for _, e := range reportEntities(report) {
+		for _, st := range e.Stats {
+			batch = append(batch, monitDocument{
+				Producer:   s.producer,
+				Type:       s.docType,
+				Timestamp:  report.TimestampMs,
+				Host:       s.mgm,
+				EntityType: e.Type,
+				ID:         e.ID,
+				Estimator:  st.Window.String(),
+				Read:       st.BytesReadPerSec,
+				Write:      st.BytesWrittenPerSec,
+			})
+			if len(batch) >= s.batchSize {
+				s.enqueue(batch)
+				batch = make([]monitDocument, 0, s.batchSize)
+			}
+		}
+	}
+	if len(batch) > 0 {
+		s.enqueue(batch)
+	}
+	return nil
+}
+
+func (s *monitSink) enqueue(batch []monitDocument) {
+	select {
+	case s.queue <- batch:
+	default:
+		log.Printf("MONIT: queue full, dropping %d documents", len(batch))
+	}
+}
+
+func (s *monitSink) writer() {
+	defer close(s.done)
+	defer s.disconnect()
+	for batch := range s.queue {
+		body, err := json.Marshal(batch)
+		if err != nil {
+			log.Printf("MONIT: dropping %d documents: %v", len(batch), err)
+			continue
+		}
+		backoff := time.Second
+		for attempt := 0; ; attempt++ {
+			err := s.send(body)
+			if err == nil {
+				break
+			}
+			s.disconnect()
+			if attempt == 3 {
+				log.Printf("MONIT: dropping %d documents: %v", len(batch), err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// connect opens the broker connection and performs the STOMP 1.2 handshake.
+func (s *monitSink) connect() error {
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if s.tls {
+		conn, err = tls.DialWithDialer(d, "tcp", s.address, &tls.Config{ServerName: s.vhost})
+	} else {
+		conn, err = d.Dial("tcp", s.address)
+	}
+	if err != nil {
+		return err
+	}
+	headers := []string{"accept-version:1.2", "host:" + s.vhost, "heart-beat:0,0"}
+	if s.login != "" {
+		headers = append(headers, "login:"+s.login, "passcode:"+s.passcode)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := conn.Write(stompFrame("CONNECT", headers, nil)); err != nil {
+		conn.Close()
+		return err
+	}
+	r := bufio.NewReader(conn)
+	command, msg, err := readStompFrame(r)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if command != "CONNECTED" {
+		conn.Close()
+		return fmt.Errorf("broker refused the connection: %s %s", command, msg)
+	}
+	s.conn, s.r = conn, r
+	return nil
+}
+
+func (s *monitSink) disconnect() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn, s.r = nil, nil
+	}
+}
+
+// send publishes one message and waits for the broker's receipt, so a batch
+// only counts as sent once the broker has it.
+func (s *monitSink) send(body []byte) error {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	s.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	headers := []string{
+		"destination:" + stompEscape(s.destination),
+		"content-type:application/json",
+		"content-length:" + strconv.Itoa(len(body)),
+		"persistent:true",
+		"receipt:monit",
+	}
+	if _, err := s.conn.Write(stompFrame("SEND", headers, body)); err != nil {
+		return err
+	}
+	command, msg, err := readStompFrame(s.r)
+	if err != nil {
+		return err
+	}
+	if command != "RECEIPT" {
+		return fmt.Errorf("broker rejected the message: %s %s", command, msg)
+	}
+	return nil
+}
+
+// Close sends the queued documents and disconnects from the broker.
+func (s *monitSink) Close() error {
+	close(s.queue)
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(30 * time.Second):
+		return errors.New("MONIT: timed out sending the last documents")
+	}
+}
+
+// stompEscaper escapes the header values of the frames but CONNECT and
+// CONNECTED, where STOMP 1.2 takes them as they are.
+var stompEscaper = strings.NewReplacer(`\`, `\\`, "\r", `\r`, "\n", `\n`, ":", `\c`)
+
+func stompEscape(v string) string {
+	return stompEscaper.Replace(v)
+}
+
+func stompFrame(command string, headers []string, body []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(command)
+	b.WriteByte('\n')
+	for _, h := range headers {
+		b.WriteString(h)
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.Write(body)
+	b.WriteByte(0)
+	return b.Bytes()
+}
+
+// readStompFrame reads the next frame, skipping heart-beat newlines. For
+// ERROR frames the returned message is the "message" header and body.
+func readStompFrame(r *bufio.Reader) (command, message string, err error) {
+	for command == "" {
+		if command, err = r.ReadString('\n'); err != nil {
+			return "", "", err
+		}
+		command = strings.TrimRight(command, "\r\n")
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if k, v, _ := strings.Cut(line, ":"); k == "message" {
+			message = v
+		}
+	}
+	body, err := r.ReadString(0)
+	if err != nil {
+		return "", "", err
+	}
+	if body = strings.TrimSpace(strings.TrimSuffix(body, "\x00")); body != "" {
+		message = strings.TrimSpace(message + ": " + body)
+	}
+	return command, message, nil
+}
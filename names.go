@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os/user"
+	"slices"
+	"strconv"
+	"sync"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// nameResolver maps uids and gids to user and group names through the name
+// service of the host (passwd/group files, SSSD, LDAP...). Lookups are cached
+// for the lifetime of the process, including failed ones, as the same few
+// thousand ids come back with every report.
+type nameResolver struct {
+	mu     sync.Mutex
+	users  map[uint32]string
+	groups map[uint32]string
+}
+
+func newNameResolver() *nameResolver {
+	return &nameResolver{users: make(map[uint32]string), groups: make(map[uint32]string)}
+}
+
+// user returns the name of uid, or "" if it has none.
+func (r *nameResolver) user(uid uint32) string {
+	return r.lookup(r.users, uid, func(id string) (string, error) {
+		u, err := user.LookupId(id)
+		if err != nil {
+			return "", err
+		}
+		return u.Username, nil
+	})
+}
+
+// group returns the name of gid, or "" if it has none.
+func (r *nameResolver) group(gid uint32) string {
+	return r.lookup(r.groups, gid, func(id string) (string, error) {
+		g, err := user.LookupGroupId(id)
+		if err != nil {
+			return "", err
+		}
+		return g.Name, nil
+	})
+}
+
+func (r *nameResolver) lookup(cache map[uint32]string, id uint32, resolve func(string) (string, error)) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if name, ok := cache[id]; ok {
+		return name
+	}
+	name, err := resolve(strconv.FormatUint(uint64(id), 10))
+	if err != nil {
+		name = ""
+	}
+	cache[id] = name
+	return name
+}
+
+// entityRow is a user or group line of the console and the metrics.
+type entityRow struct {
+	ID    string // numeric id, or the name once aggregated
+	Name  string // resolved name, "" if unknown or not resolving
+	Stats []*pb.RateStats
+}
+
+// aggregateByName merges the rows that resolve to the same name, e.g. the old
+// and new uid of a migrated account, summing their rates per estimator. The
+// merged row is identified by the name. Rows without a name are kept as is.
+func aggregateByName(rows []entityRow) []entityRow {
+	out := make([]entityRow, 0, len(rows))
+	byName := make(map[string]int)
+	for _, row := range rows {
+		if row.Name == "" {
+			out = append(out, row)
+			continue
+		}
+		i, ok := byName[row.Name]
+		if !ok {
+			byName[row.Name] = len(out)
+			out = append(out, entityRow{ID: row.Name, Name: row.Name, Stats: row.Stats})
+			continue
+		}
+		out[i].Stats = sumRateStats(out[i].Stats, row.Stats)
+	}
+	return out
+}
+
+// sumRateStats adds the rates of b to those of a with the same estimator.
+func sumRateStats(a, b []*pb.RateStats) []*pb.RateStats {
+	sum := make([]*pb.RateStats, 0, len(a))
+	index := make(map[pb.TrafficShapingRateRequest_Estimators]int)
+	for _, stats := range [][]*pb.RateStats{a, b} {
+		for _, s := range stats {
+			i, ok := index[s.Window]
+			if !ok {
+				index[s.Window] = len(sum)
+				sum = append(sum, &pb.RateStats{Window: s.Window, BytesReadPerSec: s.BytesReadPerSec, BytesWrittenPerSec: s.BytesWrittenPerSec})
+				continue
+			}
+			sum[i].BytesReadPerSec += s.BytesReadPerSec
+			sum[i].BytesWrittenPerSec += s.BytesWrittenPerSec
+		}
+	}
+	return sum
+}
+
+// addRateStats adds b to sum in place and returns it, so summing many rows
+// doesn't copy the sum for every row. sum must not share its stats with a
+// report, e.g. start from nil.
+func addRateStats(sum, b []*pb.RateStats) []*pb.RateStats {
+	for _, s := range b {
+		i := slices.IndexFunc(sum, func(t *pb.RateStats) bool { return t.Window == s.Window })
+		if i < 0 {
+			sum = append(sum, &pb.RateStats{Window: s.Window, BytesReadPerSec: s.BytesReadPerSec, BytesWrittenPerSec: s.BytesWrittenPerSec})
+			continue
+		}
+		sum[i].BytesReadPerSec += s.BytesReadPerSec
+		sum[i].BytesWrittenPerSec += s.BytesWrittenPerSec
+	}
+	return sum
+}
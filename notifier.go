@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// notifier delivers alert events. Notifiers are declared by name in a
+// section of the alert rules file per kind (webhooks, alertmanagers, slack,
+// email, exec) and rules refer to them in their actions.
+type notifier interface {
+	// init validates the settings decoded from the rules file and starts
+	// whatever the notifier needs to run in the background.
+	init(name string) error
+	// notify must not block the processing of reports.
+	notify(ev alertEvent)
+}
+
+// stoppingNotifier is implemented by the notifiers with periodic work in
+// the background, stopped when the monitor exits.
+type stoppingNotifier interface {
+	notifier
+	stop()
+}
+
+// notifiers returns m with its values as notifiers.
+func notifiers[N notifier](m map[string]N) map[string]notifier {
+	out := make(map[string]notifier, len(m))
+	for name, n := range m {
+		out[name] = n
+	}
+	return out
+}
+
+// Exec notifiers run an external program for every event, so sites can hook
+// paging systems the monitor doesn't know about:
+//
+//	exec:
+//	  pager:
+//	    command: [/usr/local/bin/page-oncall, --team, storage]
+//	    env: {PAGER_URL: https://pager.example.org}
+//	    timeout: 30s     # per run (default 30s)
+//	    retries: 3       # runs exiting with code 75 are retried (default 3)
+//
+// The program gets the event as a JSON object (see webhookPayload) on stdin.
+// Exit code 0 means delivered, 75 (EX_TEMPFAIL) a temporary failure worth
+// retrying with backoff, and anything else a permanent failure that is
+// logged together with the program's stderr.
+
+const exitTempFail = 75
+
+type execNotifier struct {
+	Command []string          `yaml:"command"`
+	Env     map[string]string `yaml:"env"`
+	Timeout time.Duration     `yaml:"timeout"`
+	Retries *int              `yaml:"retries"`
+
+	name  string
+	queue chan alertEvent
+}
+
+func (n *execNotifier) init(name string) error {
+	if len(n.Command) == 0 {
+		return errors.New("command is required")
+	}
+	if _, err := exec.LookPath(n.Command[0]); err != nil {
+		return fmt.Errorf("command: %w", err)
+	}
+	if n.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative, got %s", n.Timeout)
+	}
+	if n.Timeout == 0 {
+		n.Timeout = 30 * time.Second
+	}
+	if n.Retries == nil {
+		n.Retries = new(int)
+		*n.Retries = 3
+	}
+	if *n.Retries < 0 {
+		return fmt.Errorf("retries must not be negative, got %d", *n.Retries)
+	}
+
+	n.name = name
+	n.queue = make(chan alertEvent, webhookQueueSize)
+	go func() {
+		for ev := range n.queue {
+			if err := n.deliver(ev); err != nil {
+				log.Printf("Exec notifier %s: %v", n.name, err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (n *execNotifier) notify(ev alertEvent) {
+	select {
+	case n.queue <- ev:
+	default:
+		log.Printf("Exec notifier %s: queue full, dropping %s", n.name, ev)
+	}
+}
+
+func (n *execNotifier) deliver(ev alertEvent) error {
+	payload, err := json.Marshal(newWebhookPayload(ev))
+	if err != nil {
+		return err
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := n.run(payload)
+		var exitErr *exec.ExitError
+		if err == nil || !errors.As(err, &exitErr) || exitErr.ExitCode() != exitTempFail || attempt == *n.Retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (n *execNotifier) run(payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), n.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, n.Command[0], n.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = os.Environ()
+	for k, v := range n.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+			return fmt.Errorf("%s: %w: %s", n.Command[0], err, msg)
+		}
+		return fmt.Errorf("%s: %w", n.Command[0], err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// otlpSink exports the per-entity rates of the latest report to an
+// OpenTelemetry collector every interval, as gauges with the same
+// entity_type, id and estimator attributes as the Prometheus metrics. The
+// resource carries the EOS cluster and MGM host so one collector can take
+// the metrics of several monitors.
+type otlpSink struct {
+	provider *sdkmetric.MeterProvider
+
+	mu     sync.Mutex
+	report *pb.TrafficShapingRateResponse
+}
+
+// otlpResource describes the monitor of mgmHost to the OpenTelemetry
+// collectors.
+func otlpResource(cluster, mgmHost string) *resource.Resource {
+	attrs := []attribute.KeyValue{
+		attribute.String("service.name", "eos-traffic-shaping-monitor"),
+		attribute.String("eos.mgm.host", mgmHost),
+	}
+	if cluster != "" {
+		attrs = append(attrs, attribute.String("eos.cluster", cluster))
+	}
+	return resource.NewSchemaless(attrs...)
+}
+
+func newOTLPSink(ctx context.Context, endpoint, protocol string, interval time.Duration, cluster, mgmHost string) (*otlpSink, error) {
+	var exporter sdkmetric.Exporter
+	var err error
+	switch protocol {
+	case "grpc":
+		exporter, err = otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithEndpointURL(endpoint))
+	case "http":
+		// Unlike with WithEndpoint, the exporter uses the URL path as is.
+		if u, perr := url.Parse(endpoint); perr == nil && strings.TrimSuffix(u.Path, "/") == "" {
+			u.Path = "/v1/metrics"
+			endpoint = u.String()
+		}
+		exporter, err = otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(endpoint))
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q (expected grpc or http)", protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &otlpSink{}
+	s.provider = sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(otlpResource(cluster, mgmHost)),
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(interval))),
+	)
+
+	meter := s.provider.Meter("eos_traffic_shaping_monitor")
+	read, err := meter.Float64ObservableGauge("eos.io.read.rate", metric.WithUnit("By/s"), metric.WithDescription("Current read throughput"))
+	if err != nil {
+		return nil, err
+	}
+	write, err := meter.Float64ObservableGauge("eos.io.write.rate", metric.WithUnit("By/s"), metric.WithDescription("Current write throughput"))
+	if err != nil {
+		return nil, err
+	}
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		s.mu.Lock()
+		report := s.report
+		s.mu.Unlock()
+		if report == nil {
+			return nil
+		}
+		for _, e := range reportEntities(report) {
+			for _, st := range e.Stats {
+				attrs := metric.WithAttributes(
+					attribute.String("entity_type", e.Type),
+					attribute.String("id", e.ID),
+					attribute.String("estimator", st.Window.String()),
+				)
+				o.ObserveFloat64(read, st.BytesReadPerSec, attrs)
+				o.ObserveFloat64(write, st.BytesWrittenPerSec, attrs)
+			}
+		}
+		return nil
+	}, read, write)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *otlpSink) Send(report *pb.TrafficShapingRateResponse) error {
+	s.mu.Lock()
+	s.report = report
+	s.mu.Unlock()
+	return nil
+}
+
+// Close exports the last report and shuts the exporter down.
+func (s *otlpSink) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.provider.Shutdown(ctx)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// prober serves /probe?target=host:port like the blackbox exporter: it
+// connects to the MGM of the query string, takes one report with the
+// request of the monitor and answers with its rates, so one deployment can
+// cover many EOS instances, driven by the relabeling of the scrape configs:
+//
+//	scrape_configs:
+//	  - job_name: eos
+//	    metrics_path: /probe
+//	    static_configs:
+//	      - targets: [mgm1.example.org:50051, mgm2.example.org:50051]
+//	    relabel_configs:
+//	      - source_labels: [__address__]
+//	        target_label: __param_target
+//	      - source_labels: [__param_target]
+//	        target_label: instance
+//	      - target_label: __address__
+//	        replacement: monitor.example.org:9987
+//
+// Only targets matching one of the patterns can be probed, so the endpoint
+// can't be used to reach arbitrary hosts.
+type prober struct {
+	targets idPatterns
+	timeout time.Duration // without the scrape timeout of Prometheus
+
+	mu       sync.Mutex
+	dialOpts []grpc.DialOption // nil until Start
+	req      *pb.TrafficShapingRateRequest
+	appNames *appNormalizer
+}
+
+func newProber(targets []string, timeout time.Duration) (*prober, error) {
+	p := &prober{timeout: timeout}
+	for _, t := range targets {
+		pattern, err := parseIDPattern(t)
+		if err != nil {
+			return nil, err
+		}
+		p.targets = append(p.targets, pattern)
+	}
+	return p, nil
+}
+
+// Start makes the probes dial with dialOpts, the options of the connection
+// of the monitor without its credentials, and send its request.
+func (p *prober) Start(dialOpts []grpc.DialOption, req *pb.TrafficShapingRateRequest, appNames *appNormalizer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialOpts, p.req, p.appNames = dialOpts, req, appNames
+}
+
+func (p *prober) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		http.Error(w, "target must be given as host:port", http.StatusBadRequest)
+		return
+	}
+	if !p.targets.Match(target) {
+		http.Error(w, fmt.Sprintf("target %s is not in -prometheus-probe-targets", target), http.StatusForbidden)
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	success := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_success",
+		Help: "1 if a report was received from the target, 0 otherwise",
+	})
+	duration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_duration_seconds",
+		Help: "Time taken to connect to the target and receive a report",
+	})
+	read := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eos_io_read_bytes_per_second",
+		Help: "Current read throughput in bytes/sec",
+	}, []string{"entity_type", "id", "estimator"})
+	write := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "eos_io_write_bytes_per_second",
+		Help: "Current write throughput in bytes/sec",
+	}, []string{"entity_type", "id", "estimator"})
+	registry.MustRegister(success, duration, read, write)
+
+	ctx, cancel := context.WithTimeout(r.Context(), scrapeTimeout(r, p.timeout))
+	defer cancel()
+	start := time.Now()
+	report, err := p.probe(ctx, target)
+	duration.Set(time.Since(start).Seconds())
+	if err != nil {
+		log.Printf("Probe of %s failed: %v", target, err)
+	} else {
+		success.Set(1)
+		for _, e := range reportEntities(report) {
+			for _, s := range e.Stats {
+				read.WithLabelValues(e.Type, e.ID, s.Window.String()).Set(s.BytesReadPerSec)
+				write.WithLabelValues(e.Type, e.ID, s.Window.String()).Set(s.BytesWrittenPerSec)
+			}
+		}
+	}
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// probe returns the first report of target.
+func (p *prober) probe(ctx context.Context, target string) (*pb.TrafficShapingRateResponse, error) {
+	p.mu.Lock()
+	dialOpts, req, appNames := p.dialOpts, p.req, p.appNames
+	p.mu.Unlock()
+	if dialOpts == nil {
+		return nil, fmt.Errorf("monitor not started yet")
+	}
+	conn, err := grpc.NewClient(target, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stream, err := pb.NewEosClient(conn).TrafficShapingRate(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	report, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if appNames != nil {
+		report = appNames.Apply(report)
+	}
+	return report, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// profiler continuously profiles the monitor: it records a CPU profile over
+// every interval and takes a heap profile at its end, then pushes both to a
+// Pyroscope server and/or writes them to a directory, keeping the newest
+// ones. This shows the long-term CPU and memory behavior on large clusters
+// without anyone having to attach to the process at the right time.
+type profiler struct {
+	url      string // Pyroscope server, "" to not push
+	dir      string // directory for the profiles, "" to not write them
+	interval time.Duration
+	keep     int
+	name     string // application name, with labels in Pyroscope syntax
+	client   *http.Client
+}
+
+func newProfiler(serverURL, dir string, interval time.Duration, keep int, mgm string) (*profiler, error) {
+	if serverURL != "" {
+		u, err := url.Parse(serverURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("profiling URL must be an http:// or https:// URL, got %q", serverURL)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/ingest"
+		serverURL = u.String()
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	if interval < 10*time.Second {
+		return nil, fmt.Errorf("profiling interval must be at least 10s, got %s", interval)
+	}
+	if keep < 1 {
+		return nil, fmt.Errorf("profiles to keep must be positive, got %d", keep)
+	}
+	return &profiler{
+		url:      serverURL,
+		dir:      dir,
+		interval: interval,
+		keep:     keep,
+		name:     fmt.Sprintf("eos_traffic_shaping_monitor{mgm=%s}", mgm),
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// run profiles until ctx is cancelled.
+func (p *profiler) run(ctx context.Context) {
+	for {
+		from := time.Now()
+		var cpu bytes.Buffer
+		if err := pprof.StartCPUProfile(&cpu); err != nil {
+			// Someone else is profiling; try again next interval.
+			log.Printf("Profiling: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(p.interval):
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(p.interval):
+		}
+		pprof.StopCPUProfile()
+		until := time.Now()
+
+		var heap bytes.Buffer
+		if err := pprof.Lookup("heap").WriteTo(&heap, 0); err != nil {
+			log.Printf("Profiling: heap: %v", err)
+		}
+		for kind, b := range map[string][]byte{"cpu": cpu.Bytes(), "heap": heap.Bytes()} {
+			if len(b) == 0 {
+				continue
+			}
+			if err := p.store(kind, b, from, until); err != nil {
+				log.Printf("Profiling: %s: %v", kind, err)
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (p *profiler) store(kind string, profile []byte, from, until time.Time) error {
+	var errs []error
+	if p.dir != "" {
+		if err := p.write(kind, profile, until); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if p.url != "" {
+		if err := p.push(profile, from, until); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// write saves the profile as <kind>-<time>.pb.gz and removes the oldest
+// profiles of the kind beyond the number to keep.
+func (p *profiler) write(kind string, profile []byte, at time.Time) error {
+	name := filepath.Join(p.dir, fmt.Sprintf("%s-%s.pb.gz", kind, at.UTC().Format("20060102T150405Z")))
+	if err := os.WriteFile(name, profile, 0o644); err != nil {
+		return err
+	}
+	old, err := filepath.Glob(filepath.Join(p.dir, kind+"-*.pb.gz"))
+	if err != nil {
+		return err
+	}
+	slices.Sort(old) // the timestamps sort chronologically
+	for len(old) > p.keep {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+	return nil
+}
+
+// push uploads the profile to the ingest API of Pyroscope, which derives the
+// profile type from the pprof sample types.
+func (p *profiler) push(profile []byte, from, until time.Time) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("profile", "profile.pprof")
+	if err != nil {
+		return err
+	}
+	fw.Write(profile)
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	q := url.Values{
+		"name":   {p.name},
+		"from":   {strconv.FormatInt(from.Unix(), 10)},
+		"until":  {strconv.FormatInt(until.Unix(), 10)},
+		"format": {"pprof"},
+	}
+	req, err := http.NewRequest(http.MethodPost, p.url+"?"+q.Encode(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("push: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
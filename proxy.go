@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// proxyFromEnvironment returns HTTPS_PROXY if it points at a SOCKS5 proxy.
+// Plain HTTP proxies in the environment are already honoured by grpc-go
+// itself (including NO_PROXY), so those are left alone. A SOCKS5 one is
+// installed as a dialer, which grpc-go doesn't check against NO_PROXY, so its
+// dialer has to be wrapped with noProxyDialer.
+func proxyFromEnvironment() string {
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy"} {
+		if p := os.Getenv(name); strings.HasPrefix(p, "socks5://") || strings.HasPrefix(p, "socks5h://") {
+			return p
+		}
+	}
+	return ""
+}
+
+// proxyDialer returns a gRPC context dialer that tunnels connections through
+// a socks5:// or http:// (CONNECT) proxy.
+func proxyDialer(proxyURL string) (func(context.Context, string) (net.Conn, error), error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, &net.Dialer{})
+		if err != nil {
+			return nil, err
+		}
+		cd, ok := d.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("%s proxy does not support contexts", u.Scheme)
+		}
+		return func(ctx context.Context, addr string) (net.Conn, error) {
+			return cd.DialContext(ctx, "tcp", addr)
+		}, nil
+	case "http":
+		return func(ctx context.Context, addr string) (net.Conn, error) {
+			return httpConnect(ctx, u, addr)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (expected socks5 or http)", u.Scheme)
+	}
+}
+
+// noProxyDialer dials the addresses exempted from the proxy by NO_PROXY
+// directly and the others with dial, as grpc-go does for HTTP proxies.
+func noProxyDialer(dial func(context.Context, string) (net.Conn, error)) func(context.Context, string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		if noProxy(addr) {
+			return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		}
+		return dial(ctx, addr)
+	}
+}
+
+// noProxy reports whether NO_PROXY exempts the host:port addr from the
+// proxies of the environment, loopback addresses always being exempt.
+func noProxy(addr string) bool {
+	u, err := httpproxy.FromEnvironment().ProxyFunc()(&url.URL{Scheme: "https", Host: addr})
+	return err == nil && u == nil
+}
+
+// httpConnect opens a tunnel to addr through an HTTP proxy with the CONNECT
+// method.
+func httpConnect(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s failed: %s", addr, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn returns bytes the proxy sent right after its CONNECT response
+// before reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// redactURL hides the password of URLs that are about to be logged.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Redacted()
+}
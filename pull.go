@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+var pullDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "eos_monitor_pull_duration_seconds",
+	Help:    "Time taken in pull mode to stream a report from the MGM on a scrape",
+	Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+})
+
+func init() {
+	prometheus.MustRegister(pullDuration)
+}
+
+// puller implements the pull mode, for sites that want the semantics of a
+// classic exporter instead of continuous streaming: the connection to the
+// MGM is kept, but a stream is only opened when /metrics is scraped, to take
+// one report through the monitor before the metrics are served. Scrapes
+// within minInterval of the last pull, and concurrent ones, are served the
+// metrics of that pull. A failed pull fails the scrape, so Prometheus sees
+// the MGM down instead of old rates.
+type puller struct {
+	minInterval time.Duration
+	timeout     time.Duration // without the scrape timeout of Prometheus
+	health      *streamHealth
+
+	mu     sync.Mutex
+	client pb.EosClient // nil until Start
+	opts   monitorOptions
+	last   time.Time // of the last pull
+	err    error     // of the last pull
+}
+
+func newPuller(minInterval, timeout time.Duration, health *streamHealth) (*puller, error) {
+	if minInterval < 0 || timeout <= 0 {
+		return nil, errors.New("the interval must not be negative and the timeout must be positive")
+	}
+	return &puller{minInterval: minInterval, timeout: timeout, health: health}, nil
+}
+
+// Start makes the scrapes pull reports from client through the monitor set
+// up by opts.
+func (p *puller) Start(client pb.EosClient, opts monitorOptions) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	opts.MaxReports, opts.Duration, opts.IdleTimeout = 1, 0, 0
+	opts.Health, opts.Quiet = nil, true
+	p.client, p.opts = client, opts
+}
+
+// handler pulls a report before serving the metrics with h.
+func (p *puller) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), scrapeTimeout(r, p.timeout))
+		defer cancel()
+		if err := p.pull(ctx); err != nil {
+			http.Error(w, fmt.Sprintf("Error pulling a report from the MGM: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// scrapeTimeout returns the time left to answer the scrape r, fallback if
+// Prometheus didn't tell its timeout.
+func scrapeTimeout(r *http.Request, fallback time.Duration) time.Duration {
+	// Leave some of the scrape timeout to serve the metrics.
+	if s, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64); err == nil && s > 0 {
+		return time.Duration(s * 0.9 * float64(time.Second))
+	}
+	return fallback
+}
+
+func (p *puller) pull(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client == nil {
+		return errors.New("not connected yet")
+	}
+	if !p.last.IsZero() && time.Since(p.last) < p.minInterval {
+		return p.err
+	}
+	start := time.Now()
+	p.err = runMonitor(ctx, p.client, p.opts)
+	if p.err == nil && ctx.Err() != nil {
+		// runMonitor takes the end of ctx for an interruption.
+		p.err = fmt.Errorf("no report received: %w", ctx.Err())
+	}
+	p.last = time.Now()
+	pullDuration.Observe(time.Since(start).Seconds())
+	if p.health != nil {
+		p.health.Connected(p.err == nil)
+		if p.err == nil {
+			p.health.Received()
+		}
+	}
+	return p.err
+}
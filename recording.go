@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// A recording is a sequence of frames, each holding one report together with
+// the MGM it was received from. The native ".pb" format is a stream of varint
+// length-delimited protobuf messages laid out as
+//
+//	message Frame {
+//	  string target = 1; // MGM host:port
+//	  eos.rpc.TrafficShapingRateResponse report = 2;
+//	}
+//
+// ".jsonl" stores one {"target": ..., "report": ...} object per line and
+// ".parquet" one flattened row per entity and estimator. The pb and jsonl
+// formats may carry an additional ".gz" suffix to be gzip compressed.
+
+const (
+	formatPB      = "pb"
+	formatJSONL   = "jsonl"
+	formatParquet = "parquet"
+)
+
+type frame struct {
+	Target string
+	Report *pb.TrafficShapingRateResponse
+}
+
+type recordingWriter interface {
+	Write(f *frame) error
+	Close() error
+}
+
+type recordingReader interface {
+	// Read returns io.EOF once all frames have been consumed.
+	Read() (*frame, error)
+	Close() error
+}
+
+// recordingFormat derives the format and compression of a recording from its
+// file name, e.g. "capture.jsonl.gz" is gzip compressed jsonl.
+func recordingFormat(path string) (string, bool, error) {
+	name := filepath.Base(path)
+	compressed := strings.HasSuffix(name, ".gz")
+	name = strings.TrimSuffix(name, ".gz")
+
+	switch format := strings.TrimPrefix(filepath.Ext(name), "."); format {
+	case formatPB, formatJSONL:
+		return format, compressed, nil
+	case formatParquet:
+		if compressed {
+			return "", false, fmt.Errorf("%s: parquet recordings are compressed internally, drop the .gz suffix", path)
+		}
+		return format, false, nil
+	default:
+		return "", false, fmt.Errorf("%s: unknown recording format (expected .pb, .jsonl or .parquet)", path)
+	}
+}
+
+func createRecording(path string) (recordingWriter, error) {
+	format, compressed, err := recordingFormat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if format == formatParquet {
+		return newParquetWriter(f), nil
+	}
+
+	s := &fileStream{file: f}
+	var w io.Writer = f
+	if compressed {
+		s.gz = gzip.NewWriter(f)
+		w = s.gz
+	}
+	s.buf = bufio.NewWriter(w)
+
+	if format == formatJSONL {
+		return &jsonlWriter{fileStream: s}, nil
+	}
+	return &pbWriter{fileStream: s}, nil
+}
+
+func openRecording(path string) (recordingReader, error) {
+	format, _, err := recordingFormat(path)
+	if err != nil {
+		return nil, err
+	}
+	if format == formatParquet {
+		return nil, fmt.Errorf("%s: parquet is an export-only format", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sniff the gzip magic rather than trusting the file name, so renamed
+	// files still open.
+	r := bufio.NewReader(f)
+	if magic, _ := r.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		r = bufio.NewReader(gz)
+	}
+
+	if format == formatJSONL {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 1<<20), 256<<20)
+		return &jsonlReader{file: f, scanner: scanner}, nil
+	}
+	return &pbReader{file: f, r: r}, nil
+}
+
+// --- Writers ---
+
+// fileStream layers the optional gzip and buffering on top of a file and
+// flushes them in the right order on close.
+type fileStream struct {
+	file *os.File
+	gz   *gzip.Writer
+	buf  *bufio.Writer
+}
+
+func (s *fileStream) Close() error {
+	err := s.buf.Flush()
+	if s.gz != nil {
+		err = errors.Join(err, s.gz.Close())
+	}
+	return errors.Join(err, s.file.Close())
+}
+
+type pbWriter struct {
+	*fileStream
+}
+
+func (w *pbWriter) Write(f *frame) error {
+	report, err := proto.Marshal(f.Report)
+	if err != nil {
+		return err
+	}
+
+	var msg []byte
+	msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+	msg = protowire.AppendString(msg, f.Target)
+	msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+	msg = protowire.AppendBytes(msg, report)
+
+	if _, err := w.buf.Write(binary.AppendUvarint(nil, uint64(len(msg)))); err != nil {
+		return err
+	}
+	_, err = w.buf.Write(msg)
+	return err
+}
+
+type jsonlFrame struct {
+	Target string          `json:"target"`
+	Report json.RawMessage `json:"report"`
+}
+
+type jsonlWriter struct {
+	*fileStream
+}
+
+func (w *jsonlWriter) Write(f *frame) error {
+	report, err := protojson.Marshal(f.Report)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(jsonlFrame{Target: f.Target, Report: report})
+	if err != nil {
+		return err
+	}
+	_, err = w.buf.Write(append(line, '\n'))
+	return err
+}
+
+// --- Readers ---
+
+// maxFrameSize bounds the frames of .pb recordings read, well above the 4 MiB
+// gRPC receives by default, so a corrupt size doesn't allocate gigabytes.
+const maxFrameSize = 64 << 20
+
+type pbReader struct {
+	file *os.File
+	r    *bufio.Reader
+}
+
+func (r *pbReader) Read() (*frame, error) {
+	size, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds %d, not a recording or corrupt", size, maxFrameSize)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r.r, msg); err != nil {
+		return nil, fmt.Errorf("truncated frame: %w", err)
+	}
+
+	f := &frame{Report: &pb.TrafficShapingRateResponse{}}
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			f.Target, n = protowire.ConsumeString(msg)
+		case num == 2 && typ == protowire.BytesType:
+			var report []byte
+			report, n = protowire.ConsumeBytes(msg)
+			if n >= 0 {
+				if err := proto.Unmarshal(report, f.Report); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, msg)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+	}
+	return f, nil
+}
+
+func (r *pbReader) Close() error {
+	return r.file.Close()
+}
+
+type jsonlReader struct {
+	file    *os.File
+	scanner *bufio.Scanner
+}
+
+func (r *jsonlReader) Read() (*frame, error) {
+	for r.scanner.Scan() {
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var jf jsonlFrame
+		if err := json.Unmarshal(line, &jf); err != nil {
+			return nil, err
+		}
+		f := &frame{Target: jf.Target, Report: &pb.TrafficShapingRateResponse{}}
+		if err := protojson.Unmarshal(jf.Report, f.Report); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (r *jsonlReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// parquetRow is the flattened layout of a parquet recording: one row per
+// entity and estimator of every report. Thread loop stats are not carried
+// over, which is why parquet is only supported as an output format.
+type parquetRow struct {
+	Target             string  `parquet:"target,dict"`
+	TimestampMs        int64   `parquet:"timestamp_ms"`
+	EntityType         string  `parquet:"entity_type,dict"`
+	ID                 string  `parquet:"id,dict"`
+	Estimator          string  `parquet:"estimator,dict"`
+	BytesReadPerSec    float64 `parquet:"bytes_read_per_sec"`
+	BytesWrittenPerSec float64 `parquet:"bytes_written_per_sec"`
+}
+
+type parquetWriter struct {
+	file *os.File
+	w    *parquet.GenericWriter[parquetRow]
+	rows []parquetRow
+}
+
+func newParquetWriter(f *os.File) *parquetWriter {
+	return &parquetWriter{
+		file: f,
+		w:    parquet.NewGenericWriter[parquetRow](f, parquet.Compression(&parquet.Zstd)),
+	}
+}
+
+func (w *parquetWriter) Write(f *frame) error {
+	w.rows = w.rows[:0]
+	for _, e := range reportEntities(f.Report) {
+		for _, s := range e.Stats {
+			w.rows = append(w.rows, parquetRow{
+				Target:             f.Target,
+				TimestampMs:        f.Report.TimestampMs,
+				EntityType:         e.Type,
+				ID:                 e.ID,
+				Estimator:          s.Window.String(),
+				BytesReadPerSec:    s.BytesReadPerSec,
+				BytesWrittenPerSec: s.BytesWrittenPerSec,
+			})
+		}
+	}
+	_, err := w.w.Write(w.rows)
+	return err
+}
+
+func (w *parquetWriter) Close() error {
+	return errors.Join(w.w.Close(), w.file.Close())
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+func TestRecordingFormat(t *testing.T) {
+	tests := []struct {
+		path       string
+		format     string
+		compressed bool
+		wantErr    bool
+	}{
+		{path: "capture.pb", format: formatPB},
+		{path: "/tmp/capture.pb.gz", format: formatPB, compressed: true},
+		{path: "capture.jsonl", format: formatJSONL},
+		{path: "capture.jsonl.gz", format: formatJSONL, compressed: true},
+		{path: "capture.parquet", format: formatParquet},
+		{path: "capture.parquet.gz", wantErr: true},
+		{path: "capture.csv", wantErr: true},
+		{path: "capture", wantErr: true},
+	}
+	for _, tt := range tests {
+		format, compressed, err := recordingFormat(tt.path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("recordingFormat(%q) error = %v, want error %v", tt.path, err, tt.wantErr)
+			continue
+		}
+		if format != tt.format || compressed != tt.compressed {
+			t.Errorf("recordingFormat(%q) = %q, %v, want %q, %v", tt.path, format, compressed, tt.format, tt.compressed)
+		}
+	}
+}
+
+func TestRecordingRoundTrip(t *testing.T) {
+	frames := []*frame{
+		{Target: "mgm-a:50051", Report: &pb.TrafficShapingRateResponse{
+			TimestampMs: 1700000000000,
+			AppStats: []*pb.AppRateEntry{{AppName: "rucio-download", Stats: []*pb.RateStats{
+				{Window: pb.TrafficShapingRateRequest_SMA_5_SECONDS, BytesReadPerSec: 1.5e8, BytesWrittenPerSec: 42},
+			}}},
+			UserStats: []*pb.UserRateEntry{{Uid: 1234, Stats: []*pb.RateStats{
+				{Window: pb.TrafficShapingRateRequest_SMA_1_MINUTES, BytesWrittenPerSec: 2e9},
+			}}},
+		}},
+		{Target: "mgm-b:50051", Report: &pb.TrafficShapingRateResponse{
+			TimestampMs: 1700000001000,
+			GroupStats:  []*pb.GroupRateEntry{{Gid: 99, Stats: []*pb.RateStats{{Window: pb.TrafficShapingRateRequest_EMA_1_SECONDS}}}},
+		}},
+		{Target: "mgm-a:50051", Report: &pb.TrafficShapingRateResponse{TimestampMs: 1700000002000}},
+	}
+	for _, name := range []string{"capture.pb", "capture.pb.gz", "capture.jsonl", "capture.jsonl.gz"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			w, err := createRecording(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range frames {
+				if err := w.Write(f); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := openRecording(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			for i, want := range frames {
+				got, err := r.Read()
+				if err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+				if got.Target != want.Target || !proto.Equal(got.Report, want.Report) {
+					t.Errorf("frame %d = %v %v, want %v %v", i, got.Target, got.Report, want.Target, want.Report)
+				}
+			}
+			if _, err := r.Read(); !errors.Is(err, io.EOF) {
+				t.Errorf("Read after the last frame = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestRecordingFrameTooLarge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pb")
+	if err := os.WriteFile(path, binary.AppendUvarint(nil, 1<<40), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := openRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Read(); err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("Read of a frame of 1 TiB = %v, want an error", err)
+	}
+}
+
+func TestConvertRecordingSameFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "capture.pb")
+	w, err := createRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(&frame{Target: "mgm:50051", Report: &pb.TrafficShapingRateResponse{TimestampMs: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, out := range []string{path, filepath.Join(dir, ".", "capture.pb")} {
+		if _, err := convertRecording(path, out); err == nil {
+			t.Errorf("converting %s to %s succeeded", path, out)
+		}
+	}
+	if after, err := os.ReadFile(path); err != nil || !bytes.Equal(after, before) {
+		t.Errorf("input changed by the refused conversions: %v", err)
+	}
+	if n, err := convertRecording(path, filepath.Join(dir, "capture.jsonl")); err != nil || n != 1 {
+		t.Errorf("convert to jsonl = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// relabelRule is a Prometheus-style relabeling rule applied to the
+// per-entity rate series before they are exported, so sites can tune their
+// cardinality, e.g.
+//
+//	prometheus:
+//	  relabel:
+//	    - source_labels: [estimator]   # keep a single estimator...
+//	      regex: SMA_1_MINUTES
+//	      action: keep
+//	    - action: labeldrop            # ...and drop its label
+//	      regex: estimator
+//	    - source_labels: [entity_type] # rename entity_type values
+//	      regex: user
+//	      target_label: entity_type
+//	      replacement: uid
+//	    - source_labels: [id]          # sample a tenth of the uids
+//	      modulus: 10
+//	      target_label: __tmp_hash
+//	      action: hashmod
+//	    - source_labels: [entity_type, __tmp_hash]
+//	      regex: 'uid;[1-9]'
+//	      action: drop
+//
+// The series start with the labels entity_type, id and estimator, plus
+// __name__ to tell the read and write series apart; labels starting with __
+// are removed afterwards. Series that end up with the same labels are
+// summed.
+type relabelRule struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    *string  `yaml:"separator"` // default ;
+	Regex        string   `yaml:"regex"`     // default (.*), anchored
+	Modulus      uint64   `yaml:"modulus"`   // for hashmod
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  *string  `yaml:"replacement"` // default $1
+	Action       string   `yaml:"action"`      // replace (default), keep, drop, hashmod, labeldrop or labelkeep
+
+	re *regexp.Regexp
+}
+
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// compileRelabelRules validates rules and fills in their defaults.
+func compileRelabelRules(rules []relabelRule) ([]relabelRule, error) {
+	out := make([]relabelRule, len(rules))
+	for i, r := range rules {
+		if r.Separator == nil {
+			r.Separator = new(string)
+			*r.Separator = ";"
+		}
+		if r.Replacement == nil {
+			r.Replacement = new(string)
+			*r.Replacement = "$1"
+		}
+		if r.Regex == "" {
+			r.Regex = "(.*)"
+		}
+		if r.Action == "" {
+			r.Action = "replace"
+		}
+		re, err := regexp.Compile("^(?:" + r.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel[%d]: invalid regex: %w", i, err)
+		}
+		r.re = re
+
+		if r.TargetLabel != "" && !strings.Contains(r.TargetLabel, "$") && !labelName.MatchString(r.TargetLabel) {
+			return nil, fmt.Errorf("relabel[%d]: invalid target_label %q", i, r.TargetLabel)
+		}
+
+		switch r.Action {
+		case "replace":
+			if r.TargetLabel == "" {
+				return nil, fmt.Errorf("relabel[%d]: replace needs target_label", i)
+			}
+		case "hashmod":
+			if r.TargetLabel == "" || r.Modulus == 0 {
+				return nil, fmt.Errorf("relabel[%d]: hashmod needs target_label and modulus", i)
+			}
+		case "keep", "drop", "labeldrop", "labelkeep":
+		default:
+			return nil, fmt.Errorf("relabel[%d]: unknown action %q", i, r.Action)
+		}
+		out[i] = r
+	}
+	return out, nil
+}
+
+// relabel applies rules to labels in place, returning false if the series
+// is dropped.
+func relabel(rules []relabelRule, labels map[string]string) bool {
+	for _, r := range rules {
+		values := make([]string, len(r.SourceLabels))
+		for i, name := range r.SourceLabels {
+			values[i] = labels[name]
+		}
+		value := strings.Join(values, *r.Separator)
+
+		switch r.Action {
+		case "keep":
+			if !r.re.MatchString(value) {
+				return false
+			}
+		case "drop":
+			if r.re.MatchString(value) {
+				return false
+			}
+		case "replace":
+			m := r.re.FindStringSubmatchIndex(value)
+			if m == nil {
+				continue
+			}
+			target := string(r.re.ExpandString(nil, r.TargetLabel, value, m))
+			v := string(r.re.ExpandString(nil, *r.Replacement, value, m))
+			if !labelName.MatchString(target) || target == "__name__" {
+				continue
+			}
+			if v == "" {
+				delete(labels, target)
+			} else {
+				labels[target] = v
+			}
+		case "hashmod":
+			sum := md5.Sum([]byte(value))
+			labels[r.TargetLabel] = fmt.Sprint(binary.BigEndian.Uint64(sum[8:]) % r.Modulus)
+		case "labeldrop", "labelkeep":
+			for name := range labels {
+				if name != "__name__" && r.re.MatchString(name) == (r.Action == "labeldrop") {
+					delete(labels, name)
+				}
+			}
+		}
+	}
+	return true
+}
+
+// relabeledRates exports the per-entity rate series through the relabeling
+// rules, in place of the readBytes and writeBytes gauges. As the rules
+// decide the label names, it is an unchecked collector.
+type relabeledRates struct {
+	rules []relabelRule
+
+	mu     sync.Mutex
+	series map[string]*relabeledSeries // by name and labels
+}
+
+type relabeledSeries struct {
+	name           string
+	labels, values []string
+	value          float64
+}
+
+var rateHelp = map[string]string{
+	"eos_io_read_bytes_per_second":  "Current read throughput in bytes/sec",
+	"eos_io_write_bytes_per_second": "Current write throughput in bytes/sec",
+}
+
+func newRelabeledRates(rules []relabelRule) (*relabeledRates, error) {
+	rules, err := compileRelabelRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	return &relabeledRates{rules: rules, series: make(map[string]*relabeledSeries)}, nil
+}
+
+// Set replaces the exported series with the rates of rows by entity type.
+func (c *relabeledRates) Set(rows map[string][]entityRow) {
+	series := make(map[string]*relabeledSeries)
+	for eType, list := range rows {
+		for _, row := range list {
+			for _, s := range row.Stats {
+				c.add(series, "eos_io_read_bytes_per_second", eType, row.ID, s.Window.String(), s.BytesReadPerSec)
+				c.add(series, "eos_io_write_bytes_per_second", eType, row.ID, s.Window.String(), s.BytesWrittenPerSec)
+			}
+		}
+	}
+	c.mu.Lock()
+	c.series = series
+	c.mu.Unlock()
+}
+
+func (c *relabeledRates) add(series map[string]*relabeledSeries, name, eType, id, estimator string, v float64) {
+	labels := map[string]string{"__name__": name, "entity_type": eType, "id": id, "estimator": estimator}
+	if !relabel(c.rules, labels) {
+		return
+	}
+	names := make([]string, 0, len(labels))
+	for l := range labels {
+		if !strings.HasPrefix(l, "__") {
+			names = append(names, l)
+		}
+	}
+	sort.Strings(names)
+	values := make([]string, len(names))
+	var key strings.Builder
+	key.WriteString(name)
+	for i, l := range names {
+		values[i] = labels[l]
+		fmt.Fprintf(&key, "\xff%s\xff%s", l, values[i])
+	}
+
+	if s, ok := series[key.String()]; ok {
+		s.value += v
+		return
+	}
+	series[key.String()] = &relabeledSeries{name: name, labels: names, values: values, value: v}
+}
+
+func (c *relabeledRates) Describe(chan<- *prometheus.Desc) {}
+
+func (c *relabeledRates) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.series {
+		desc := prometheus.NewDesc(s.name, rateHelp[s.name], s.labels, nil)
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, s.value, s.values...)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+var (
+	relaySubscribers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "eos_relay_subscribers",
+			Help: "Number of clients subscribed to the relayed TrafficShapingRate stream",
+		},
+	)
+	relayDisconnects = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "eos_relay_slow_subscribers_total",
+			Help: "Relay subscribers disconnected because they did not keep up with the reports",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(relaySubscribers, relayDisconnects)
+}
+
+// relayServer serves the TrafficShapingRate gRPC API itself, relaying the
+// single stream of the monitor to any number of subscribers, so consumers
+// don't each open a stream against the MGM.
+//
+// Subscribers get what they ask for out of the upstream reports: the
+// entity types of IncludeTypes, the rates of Estimators and the TopN
+// entries by SortByEstimator. They can't get estimators the monitor doesn't
+// request, nor more entries than its own top N. A subscriber that falls
+// more than buffer reports behind is disconnected with RESOURCE_EXHAUSTED
+// rather than holding up the others, as skipping reports silently would
+// break consumers integrating the rates.
+type relayServer struct {
+	pb.UnimplementedEosServer
+
+	estimators []pb.TrafficShapingRateRequest_Estimators // requested upstream
+	buffer     int
+	server     *grpc.Server
+
+	mu     sync.Mutex
+	subs   map[*relaySubscriber]struct{}
+	latest *pb.TrafficShapingRateResponse
+}
+
+type relaySubscriber struct {
+	reports chan *pb.TrafficShapingRateResponse
+	dropped chan struct{} // closed when the subscriber fell behind
+}
+
+// newRelayServer listens on addr and starts serving.
+func newRelayServer(addr string, estimators []pb.TrafficShapingRateRequest_Estimators, buffer int) (*relayServer, error) {
+	if buffer < 1 {
+		return nil, errors.New("relay buffer must be positive")
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &relayServer{
+		estimators: estimators,
+		buffer:     buffer,
+		server:     grpc.NewServer(),
+		subs:       make(map[*relaySubscriber]struct{}),
+	}
+	pb.RegisterEosServer(s.server, s)
+	go func() {
+		if err := s.server.Serve(lis); err != nil {
+			log.Printf("Relay: %v", err)
+		}
+	}()
+	return s, nil
+}
+
+// Send relays report to the subscribers.
+func (s *relayServer) Send(report *pb.TrafficShapingRateResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latest = report
+	for sub := range s.subs {
+		select {
+		case sub.reports <- report:
+		default:
+			close(sub.dropped)
+			delete(s.subs, sub)
+			relayDisconnects.Inc()
+		}
+	}
+	relaySubscribers.Set(float64(len(s.subs)))
+	return nil
+}
+
+// Close ends the subscriptions and stops the server.
+func (s *relayServer) Close() error {
+	done := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		s.server.Stop()
+	}
+	return nil
+}
+
+func (s *relayServer) subscribe() (*relaySubscriber, *pb.TrafficShapingRateResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub := &relaySubscriber{
+		reports: make(chan *pb.TrafficShapingRateResponse, s.buffer),
+		dropped: make(chan struct{}),
+	}
+	s.subs[sub] = struct{}{}
+	relaySubscribers.Set(float64(len(s.subs)))
+	return sub, s.latest
+}
+
+func (s *relayServer) unsubscribe(sub *relaySubscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subs, sub)
+	relaySubscribers.Set(float64(len(s.subs)))
+}
+
+func (s *relayServer) TrafficShapingRate(req *pb.TrafficShapingRateRequest, stream pb.Eos_TrafficShapingRateServer) error {
+	wanted := slices.Clone(req.Estimators)
+	if req.SortByEstimator != nil {
+		wanted = append(wanted, *req.SortByEstimator)
+	}
+	for _, e := range wanted {
+		if !slices.Contains(s.estimators, e) {
+			return status.Errorf(codes.InvalidArgument, "estimator %s is not relayed (available: %v)", e, s.estimators)
+		}
+	}
+
+	sub, latest := s.subscribe()
+	defer s.unsubscribe(sub)
+	if latest != nil {
+		if err := stream.Send(relayFilter(latest, req)); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-sub.dropped:
+			return status.Error(codes.ResourceExhausted, fmt.Sprintf("fell more than %d reports behind", s.buffer))
+		case report := <-sub.reports:
+			if err := stream.Send(relayFilter(report, req)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// relayFilter returns the part of report that req asks for, sharing the
+// rate stats with report.
+func relayFilter(report *pb.TrafficShapingRateResponse, req *pb.TrafficShapingRateRequest) *pb.TrafficShapingRateResponse {
+	include := func(t pb.TrafficShapingRateRequest_EntityType) bool {
+		return len(req.IncludeTypes) == 0 || slices.Contains(req.IncludeTypes, t)
+	}
+	stats := func(in []*pb.RateStats) []*pb.RateStats {
+		if len(req.Estimators) == 0 {
+			return in
+		}
+		out := make([]*pb.RateStats, 0, len(req.Estimators))
+		for _, st := range in {
+			if slices.Contains(req.Estimators, st.Window) {
+				out = append(out, st)
+			}
+		}
+		return out
+	}
+
+	out := &pb.TrafficShapingRateResponse{
+		TimestampMs:                     report.TimestampMs,
+		FstLimitsUpdateThreadLoopStats:  report.FstLimitsUpdateThreadLoopStats,
+		EstimatorsUpdateThreadLoopStats: report.EstimatorsUpdateThreadLoopStats,
+	}
+	if include(pb.TrafficShapingRateRequest_ENTITY_APP) {
+		top := relayTop(report.AppStats, func(e *pb.AppRateEntry) []*pb.RateStats { return e.Stats }, req)
+		for _, e := range top {
+			out.AppStats = append(out.AppStats, &pb.AppRateEntry{AppName: e.AppName, Stats: stats(e.Stats)})
+		}
+	}
+	if include(pb.TrafficShapingRateRequest_ENTITY_UID) {
+		top := relayTop(report.UserStats, func(e *pb.UserRateEntry) []*pb.RateStats { return e.Stats }, req)
+		for _, e := range top {
+			out.UserStats = append(out.UserStats, &pb.UserRateEntry{Uid: e.Uid, Stats: stats(e.Stats)})
+		}
+	}
+	if include(pb.TrafficShapingRateRequest_ENTITY_GID) {
+		top := relayTop(report.GroupStats, func(e *pb.GroupRateEntry) []*pb.RateStats { return e.Stats }, req)
+		for _, e := range top {
+			out.GroupStats = append(out.GroupStats, &pb.GroupRateEntry{Gid: e.Gid, Stats: stats(e.Stats)})
+		}
+	}
+	return out
+}
+
+// relayTop returns the entries sorted by their total rate on
+// req.SortByEstimator, keeping the upstream order (by the monitor's own sort
+// estimator) if unset, and cut to req.TopN.
+func relayTop[E any](entries []E, stats func(E) []*pb.RateStats, req *pb.TrafficShapingRateRequest) []E {
+	if req.SortByEstimator != nil {
+		total := func(e E) float64 {
+			for _, st := range stats(e) {
+				if st.Window == *req.SortByEstimator {
+					return st.BytesReadPerSec + st.BytesWrittenPerSec
+				}
+			}
+			return 0
+		}
+		entries = slices.Clone(entries)
+		sort.SliceStable(entries, func(i, j int) bool { return total(entries[i]) > total(entries[j]) })
+	}
+	if req.TopN != nil && int(*req.TopN) < len(entries) {
+		entries = entries[:*req.TopN]
+	}
+	return entries
+}
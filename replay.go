@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+func replayCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "replay [flags] <recording>...",
+		Short: "Serve recordings as an MGM",
+		Long: "Serves the reports of recordings over the TrafficShapingRate gRPC API at\n" +
+			"the pace they were recorded, so an incident can be watched again with the\n" +
+			"console, dashboard and exporters of the monitor pointed at it. The replay\n" +
+			"starts when the first client connects.",
+		Args: cobra.MinimumNArgs(1),
+	}
+	listen := cmd.Flags().String("listen", ":50051", "Address to serve the TrafficShapingRate API on")
+	speed := cmd.Flags().Float64("speed", 1, "Replay speed, e.g. 10 for ten times faster than recorded")
+	maxGap := cmd.Flags().Duration("gap", 10*time.Second, "Wait at most this long between two reports, shortening longer gaps")
+	target := cmd.Flags().String("target", "", "Only replay the reports of this target of multi-target recordings")
+	loop := cmd.Flags().Bool("loop", false, "Start over after the last recording")
+	cmd.Run = func(cmd *cobra.Command, paths []string) {
+		if *speed <= 0 {
+			log.Fatalf("Invalid --speed %g (expected a positive factor)", *speed)
+		}
+		lis, err := net.Listen("tcp", *listen)
+		if err != nil {
+			log.Fatalf("Error listening: %v", err)
+		}
+		m := newMockMGM()
+		server := grpc.NewServer()
+		pb.RegisterEosServer(server, m)
+		go server.Serve(lis)
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		log.Printf("Replaying %d recordings on %s, waiting for a client", len(paths), lis.Addr())
+		select {
+		case <-m.subscribed:
+		case <-ctx.Done():
+			server.Stop()
+			return
+		}
+
+		r := &replayer{mgm: m, speed: *speed, maxGap: *maxGap, target: *target}
+		for {
+			for _, path := range paths {
+				if err := r.replay(ctx, path); err != nil {
+					server.Stop()
+					if errors.Is(err, context.Canceled) {
+						return
+					}
+					log.Fatalf("Error replaying recording: %v", err)
+				}
+			}
+			if !*loop {
+				break
+			}
+		}
+		log.Printf("Replayed %d reports", r.reports)
+		m.end()
+		server.GracefulStop()
+	}
+	return cmd
+}
+
+// replayer publishes the reports of recordings, waiting between two as
+// long as between their timestamps.
+type replayer struct {
+	mgm    *mockMGM
+	speed  float64
+	maxGap time.Duration
+	target string
+
+	last    int64 // timestamp of the last report published, in ms
+	reports int
+}
+
+func (r *replayer) replay(ctx context.Context, path string) error {
+	rec, err := openRecording(path)
+	if err != nil {
+		return err
+	}
+	defer rec.Close()
+	for {
+		f, err := rec.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if r.target != "" && f.Target != r.target {
+			continue
+		}
+		if r.reports > 0 {
+			// Reports going back in time, e.g. when looping, are
+			// published right away.
+			gap := time.Duration(f.Report.TimestampMs-r.last) * time.Millisecond
+			wait := time.Duration(float64(min(gap, r.maxGap)) / r.speed)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		r.mgm.publish(f.Report)
+		r.last = f.Report.TimestampMs
+		r.reports++
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// trafficReport summarises the local store over a period, for operations
+// meetings: the top entities of every type by mean and peak throughput, and
+// the hours of sustained load.
+type trafficReport struct {
+	Start, End time.Time
+	Sustained  float64 // mean rate from which an hour counts as sustained load
+
+	Read, Written float64 // bytes, of the entity type the hours are of
+	HourType      string
+	Sections      []reportSection
+	Hours         []reportHour // of sustained load
+}
+
+type reportSection struct {
+	Type   string
+	ByMean []*reportEntity
+	ByPeak []*reportEntity
+}
+
+type reportEntity struct {
+	ID             string
+	Read, Written  float64 // bytes
+	Peak           float64 // highest read + write rate sampled
+	PeakAt         time.Time
+	SustainedHours int
+	bytesByHour    map[time.Time]float64
+	seconds        float64 // of the period
+}
+
+func (e *reportEntity) MeanRead() float64  { return e.Read / e.seconds }
+func (e *reportEntity) MeanWrite() float64 { return e.Written / e.seconds }
+func (e *reportEntity) MeanRate() float64  { return (e.Read + e.Written) / e.seconds }
+
+type reportHour struct {
+	Start   time.Time
+	Rate    float64 // mean read + write rate
+	Top     string  // ID of the entity with the most traffic in the hour
+	TopRate float64
+}
+
+func reportCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "report [flags]",
+		Short: "Write a report of the top offenders of a day from the local store",
+		Long: "Aggregates the local store (--store-dir of the monitor) over a day, or the\n" +
+			"--days ending with it, into a Markdown or HTML report of the top apps,\n" +
+			"users and groups by mean and peak throughput and of the hours of\n" +
+			"sustained load, written to a file or mailed with an email notifier of the\n" +
+			"alert rules file. Meant to be run daily or weekly from cron or a systemd\n" +
+			"timer.",
+		Args: cobra.NoArgs,
+	}
+	dir := cmd.Flags().String("store", "", "Directory of the local store (-store-dir of the monitor)")
+	day := cmd.Flags().String("day", "yesterday", "Day reported: today, yesterday or YYYY-MM-DD")
+	days := cmd.Flags().Int("days", 1, "Number of days reported, ending with --day, e.g. 7 for a weekly report")
+	top := cmd.Flags().Int("top", 10, "Number of entities listed per type")
+	sustained := cmd.Flags().String("sustained", "1GB/s", "Mean rate from which an hour counts as sustained load")
+	format := cmd.Flags().String("format", "markdown", "Report format (markdown or html)")
+	output := cmd.Flags().StringP("output", "o", "", "Write the report to this file instead of stdout")
+	rules := cmd.Flags().String("alert-rules", "", "Alert rules file declaring the --email notifier")
+	email := cmd.Flags().String("email", "", "Mail the report with this email notifier of --alert-rules")
+	cmd.Run = func(cmd *cobra.Command, _ []string) {
+		if *dir == "" {
+			log.Fatal("--store is required")
+		}
+		if *days < 1 || *top < 1 {
+			log.Fatal("--days and --top must be positive")
+		}
+		if *format != "markdown" && *format != "html" {
+			log.Fatalf("Invalid --format %q (expected markdown or html)", *format)
+		}
+		threshold, err := parseByteRate(*sustained)
+		if err != nil {
+			log.Fatalf("Invalid --sustained: %v", err)
+		}
+		var notifier *emailNotifier
+		if *email != "" {
+			if notifier, err = loadEmailNotifier(*rules, *email); err != nil {
+				log.Fatalf("Error loading email notifier: %v", err)
+			}
+			defer notifier.stop()
+		}
+		last, err := parseQueryDay(*day, time.Now())
+		if err != nil {
+			log.Fatalf("Invalid --day: %v", err)
+		}
+
+		r, err := buildTrafficReport(*dir, last.AddDate(0, 0, 1-*days), last.AddDate(0, 0, 1), *top, threshold)
+		if err != nil {
+			log.Fatalf("Error reading store: %v", err)
+		}
+		var buf bytes.Buffer
+		contentType := "text/markdown"
+		if *format == "html" {
+			contentType = "text/html"
+			err = reportHTML.Execute(&buf, r)
+		} else {
+			err = reportMarkdown.Execute(&buf, r)
+		}
+		if err != nil {
+			log.Fatalf("Error rendering report: %v", err)
+		}
+
+		switch {
+		case *output != "":
+			if err := os.WriteFile(*output, buf.Bytes(), 0o644); err != nil {
+				log.Fatalf("Error writing report: %v", err)
+			}
+		case notifier == nil:
+			os.Stdout.Write(buf.Bytes())
+		}
+		if notifier != nil {
+			msg := notifier.compose("[eos] Traffic report "+r.Period(), contentType, buf.String())
+			if err := notifier.deliver(msg); err != nil {
+				log.Fatalf("Error mailing report: %v", err)
+			}
+		}
+	}
+	return cmd
+}
+
+// loadEmailNotifier returns the email notifier name declared in the alert
+// rules file at path.
+func loadEmailNotifier(path, name string) (*emailNotifier, error) {
+	var doc alertRulesDoc
+	if err := loadYAML(path, &doc); err != nil {
+		return nil, err
+	}
+	n := doc.Email[name]
+	if n == nil {
+		return nil, fmt.Errorf("%s: no email notifier %q", path, name)
+	}
+	if err := n.init(name); err != nil {
+		return nil, fmt.Errorf("email %s: %w", name, err)
+	}
+	return n, nil
+}
+
+// buildTrafficReport aggregates the samples of the store in dir in
+// [start, end).
+func buildTrafficReport(dir string, start, end time.Time, top int, sustained float64) (*trafficReport, error) {
+	seconds := end.Sub(start).Seconds()
+	entities := make(map[entityKey]*reportEntity)
+	err := scanStore(dir, start, end, func(s storeSample) {
+		e := entities[s.entity]
+		if e == nil {
+			e = &reportEntity{ID: s.entity.ID, bytesByHour: make(map[time.Time]float64), seconds: seconds}
+			entities[s.entity] = e
+		}
+		e.Read += s.read * float64(s.span)
+		e.Written += s.write * float64(s.span)
+		if rate := s.read + s.write; rate > e.Peak {
+			e.Peak, e.PeakAt = rate, s.ts
+		}
+		e.bytesByHour[s.ts.Truncate(time.Hour)] += (s.read + s.write) * float64(s.span)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r := &trafficReport{Start: start, End: end, Sustained: sustained}
+	byType := make(map[string][]*reportEntity)
+	for key, e := range entities {
+		for _, b := range e.bytesByHour {
+			if b/3600 >= sustained {
+				e.SustainedHours++
+			}
+		}
+		byType[key.Type] = append(byType[key.Type], e)
+	}
+	for _, eType := range []string{"app", "user", "group"} {
+		list := byType[eType]
+		if len(list) == 0 {
+			continue
+		}
+		byMean := topReportEntities(list, top, func(e *reportEntity) float64 { return e.Read + e.Written })
+		byPeak := topReportEntities(list, top, func(e *reportEntity) float64 { return e.Peak })
+		r.Sections = append(r.Sections, reportSection{Type: eType, ByMean: byMean, ByPeak: byPeak})
+	}
+
+	// Every entity type covers all the traffic; the hours are those of the
+	// users unless the store has none.
+	for _, eType := range []string{"user", "group", "app"} {
+		if len(byType[eType]) > 0 {
+			r.HourType = eType
+			break
+		}
+	}
+	hours := make(map[time.Time]*reportHour)
+	for _, e := range byType[r.HourType] {
+		r.Read += e.Read
+		r.Written += e.Written
+		for h, b := range e.bytesByHour {
+			hour := hours[h]
+			if hour == nil {
+				hour = &reportHour{Start: h}
+				hours[h] = hour
+			}
+			hour.Rate += b / 3600
+			if b/3600 > hour.TopRate || (b/3600 == hour.TopRate && e.ID < hour.Top) {
+				hour.Top, hour.TopRate = e.ID, b/3600
+			}
+		}
+	}
+	for _, hour := range hours {
+		if hour.Rate >= sustained {
+			r.Hours = append(r.Hours, *hour)
+		}
+	}
+	sort.Slice(r.Hours, func(i, j int) bool { return r.Hours[i].Start.Before(r.Hours[j].Start) })
+	return r, nil
+}
+
+// topReportEntities returns the top entities of list by value, in
+// decreasing order.
+func topReportEntities(list []*reportEntity, top int, value func(*reportEntity) float64) []*reportEntity {
+	sorted := append([]*reportEntity(nil), list...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if vi, vj := value(sorted[i]), value(sorted[j]); vi != vj {
+			return vi > vj
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	if len(sorted) > top {
+		sorted = sorted[:top]
+	}
+	return sorted
+}
+
+// Period returns the days covered, e.g. "2024-05-01" or
+// "2024-04-25 - 2024-05-01".
+func (r *trafficReport) Period() string {
+	first, last := r.Start.Format(storeDayLayout), r.End.AddDate(0, 0, -1).Format(storeDayLayout)
+	if first == last {
+		return first
+	}
+	return first + " - " + last
+}
+
+func (r *trafficReport) MeanRead() float64  { return r.Read / r.End.Sub(r.Start).Seconds() }
+func (r *trafficReport) MeanWrite() float64 { return r.Written / r.End.Sub(r.Start).Seconds() }
+
+var reportFuncs = map[string]any{
+	"bytes": humanizeBytes,
+	"rate":  func(v float64) string { return humanizeBytes(v) + "/s" },
+	"inc":   func(i int) int { return i + 1 },
+	"title": func(eType string) string { return strings.ToUpper(eType[:1]) + eType[1:] + "s" },
+	"time":  func(t time.Time) string { return t.Format("2006-01-02 15:04") },
+	"cell":  func(s string) string { return strings.ReplaceAll(s, "|", `\|`) },
+}
+
+var reportMarkdown = template.Must(template.New("report").Funcs(reportFuncs).Parse(`# EOS traffic report, {{.Period}}
+
+{{bytes .Read}} read and {{bytes .Written}} written, {{rate .MeanRead}} and {{rate .MeanWrite}} on average.
+{{range .Sections}}
+## {{title .Type}} by mean throughput
+
+| # | ID | Read | Written | Mean read | Mean write | Hours above {{rate $.Sustained}} |
+|--:|----|-----:|--------:|----------:|-----------:|-----:|
+{{range $i, $e := .ByMean}}| {{inc $i}} | {{cell $e.ID}} | {{bytes $e.Read}} | {{bytes $e.Written}} | {{rate $e.MeanRead}} | {{rate $e.MeanWrite}} | {{$e.SustainedHours}} |
+{{end}}
+## {{title .Type}} by peak throughput
+
+| # | ID | Peak | At | Mean |
+|--:|----|-----:|----|-----:|
+{{range $i, $e := .ByPeak}}| {{inc $i}} | {{cell $e.ID}} | {{rate $e.Peak}} | {{time $e.PeakAt}} | {{rate $e.MeanRate}} |
+{{end}}{{end}}
+## Hours of sustained load
+
+{{if .Hours}}Hours with a mean throughput of at least {{rate .Sustained}}, with the {{.HourType}} moving the most data:
+
+| Hour | Mean | Top {{.HourType}} | Its mean |
+|------|-----:|----|-----:|
+{{range .Hours}}| {{time .Start}} | {{rate .Rate}} | {{cell .Top}} | {{rate .TopRate}} |
+{{end}}{{else}}No hour with a mean throughput of at least {{rate .Sustained}}.
+{{end}}`))
+
+var reportHTML = htmltemplate.Must(htmltemplate.New("report").Funcs(reportFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>EOS traffic report, {{.Period}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; }
+td.n { text-align: right; }
+</style>
+</head>
+<body>
+<h1>EOS traffic report, {{.Period}}</h1>
+<p>{{bytes .Read}} read and {{bytes .Written}} written, {{rate .MeanRead}} and {{rate .MeanWrite}} on average.</p>
+{{range .Sections}}
+<h2>{{title .Type}} by mean throughput</h2>
+<table>
+<tr><th>#</th><th>ID</th><th>Read</th><th>Written</th><th>Mean read</th><th>Mean write</th><th>Hours above {{rate $.Sustained}}</th></tr>
+{{range $i, $e := .ByMean}}<tr><td class="n">{{inc $i}}</td><td>{{$e.ID}}</td><td class="n">{{bytes $e.Read}}</td><td class="n">{{bytes $e.Written}}</td><td class="n">{{rate $e.MeanRead}}</td><td class="n">{{rate $e.MeanWrite}}</td><td class="n">{{$e.SustainedHours}}</td></tr>
+{{end}}</table>
+<h2>{{title .Type}} by peak throughput</h2>
+<table>
+<tr><th>#</th><th>ID</th><th>Peak</th><th>At</th><th>Mean</th></tr>
+{{range $i, $e := .ByPeak}}<tr><td class="n">{{inc $i}}</td><td>{{$e.ID}}</td><td class="n">{{rate $e.Peak}}</td><td>{{time $e.PeakAt}}</td><td class="n">{{rate $e.MeanRate}}</td></tr>
+{{end}}</table>
+{{end}}
+<h2>Hours of sustained load</h2>
+{{if .Hours}}<p>Hours with a mean throughput of at least {{rate .Sustained}}, with the {{.HourType}} moving the most data:</p>
+<table>
+<tr><th>Hour</th><th>Mean</th><th>Top {{.HourType}}</th><th>Its mean</th></tr>
+{{range .Hours}}<tr><td>{{time .Start}}</td><td class="n">{{rate .Rate}}</td><td>{{.Top}}</td><td class="n">{{rate .TopRate}}</td></tr>
+{{end}}</table>
+{{else}}<p>No hour with a mean throughput of at least {{rate .Sustained}}.</p>
+{{end}}</body>
+</html>
+`))
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+var rollingBytes = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "eos_io_rolling_bytes_per_second",
+		Help: "Maximum, mean or 95th percentile of the rates of an estimator over the rolling window",
+	},
+	[]string{"entity_type", "id", "estimator", "direction", "stat"},
+)
+
+func init() {
+	prometheus.MustRegister(rollingBytes)
+}
+
+// rollingAggregator keeps the rates of one estimator over the last window of
+// reports in memory and computes the maximum, mean and 95th percentile of
+// every entity, which are smoother signals than the instantaneous rates. An
+// entity missing from a report counts as 0 in it, so one that shows up once
+// doesn't get a high mean.
+//
+// The aggregates are exported with every report and served on
+// /api/v1/rolling.
+type rollingAggregator struct {
+	window    time.Duration
+	estimator string
+
+	mu      sync.Mutex
+	reports []rollingReport // oldest first
+	stats   []rollingStats  // of the entities in the window
+}
+
+type rollingReport struct {
+	ts    time.Time
+	rates map[entityKey][2]float64 // read, write
+}
+
+// rollingStats are the aggregates of one entity.
+type rollingStats struct {
+	Type  string        `json:"type"`
+	ID    string        `json:"id"`
+	Read  rollingValues `json:"read"`
+	Write rollingValues `json:"write"`
+	Total rollingValues `json:"total"`
+}
+
+type rollingValues struct {
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+	P95  float64 `json:"p95"`
+}
+
+func (v rollingValues) get(stat string) float64 {
+	switch stat {
+	case "max":
+		return v.Max
+	case "mean":
+		return v.Mean
+	}
+	return v.P95
+}
+
+func newRollingAggregator(window time.Duration, estimator string) (*rollingAggregator, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("rolling window must be positive, got %s", window)
+	}
+	if _, err := parseEstimator(estimator); err != nil {
+		return nil, err
+	}
+	return &rollingAggregator{window: window, estimator: estimator}, nil
+}
+
+func (a *rollingAggregator) register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/rolling", a.serve)
+}
+
+// Update adds report to the window, drops the reports that fell out of it
+// and exports the aggregates.
+func (a *rollingAggregator) Update(report *pb.TrafficShapingRateResponse) {
+	ts := time.UnixMilli(report.TimestampMs)
+	r := rollingReport{ts: ts, rates: make(map[entityKey][2]float64)}
+	for _, e := range reportEntities(report) {
+		for _, s := range e.Stats {
+			if s.Window.String() == a.estimator {
+				r.rates[entityKey{e.Type, e.ID}] = [2]float64{s.BytesReadPerSec, s.BytesWrittenPerSec}
+			}
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reports = append(a.reports, r)
+	old := 0
+	for old < len(a.reports) && !a.reports[old].ts.After(ts.Add(-a.window)) {
+		old++
+	}
+	a.reports = append(a.reports[:0], a.reports[old:]...)
+	a.stats = rollingAggregate(a.reports)
+
+	rollingBytes.Reset()
+	for _, s := range a.stats {
+		for _, stat := range []string{"max", "mean", "p95"} {
+			rollingBytes.WithLabelValues(s.Type, s.ID, a.estimator, "read", stat).Set(s.Read.get(stat))
+			rollingBytes.WithLabelValues(s.Type, s.ID, a.estimator, "write", stat).Set(s.Write.get(stat))
+		}
+	}
+}
+
+// rollingAggregate computes the aggregates of every entity of reports.
+func rollingAggregate(reports []rollingReport) []rollingStats {
+	samples := make(map[entityKey][][2]float64)
+	for _, r := range reports {
+		for k, rate := range r.rates {
+			samples[k] = append(samples[k], rate)
+		}
+	}
+
+	out := make([]rollingStats, 0, len(samples))
+	read := make([]float64, len(reports))
+	write := make([]float64, len(reports))
+	total := make([]float64, len(reports))
+	for k, rates := range samples {
+		clear(read)
+		clear(write)
+		clear(total)
+		for i, rate := range rates {
+			read[i], write[i], total[i] = rate[0], rate[1], rate[0]+rate[1]
+		}
+		out = append(out, rollingStats{
+			Type:  k.Type,
+			ID:    k.ID,
+			Read:  aggregateValues(read),
+			Write: aggregateValues(write),
+			Total: aggregateValues(total),
+		})
+	}
+	return out
+}
+
+// aggregateValues sorts values and returns their aggregates, the percentile
+// by nearest rank.
+func aggregateValues(values []float64) rollingValues {
+	sort.Float64s(values)
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	rank := int(math.Ceil(0.95*float64(len(values)))) - 1
+	return rollingValues{
+		Max:  values[len(values)-1],
+		Mean: sum / float64(len(values)),
+		P95:  values[max(rank, 0)],
+	}
+}
+
+// rollingResponse is the response of /api/v1/rolling.
+type rollingResponse struct {
+	Timestamp int64          `json:"timestamp"` // of the latest report, in milliseconds
+	Window    string         `json:"window"`
+	Reports   int            `json:"reports"`
+	Estimator string         `json:"estimator"`
+	Entities  []rollingStats `json:"entities"`
+}
+
+// serve answers /api/v1/rolling with the aggregates of the n (default 10)
+// entities with the highest stat (max, mean or p95, the default) on
+// direction (read, write or total, the default), optionally of one ?type=.
+func (a *rollingAggregator) serve(w http.ResponseWriter, r *http.Request) {
+	if !readOnly(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	eType, ok := entityTypeParam(w, r)
+	if !ok {
+		return
+	}
+	stat := q.Get("stat")
+	switch stat {
+	case "":
+		stat = "p95"
+	case "max", "mean", "p95":
+	default:
+		http.Error(w, fmt.Sprintf("stat must be max, mean or p95, got %q", stat), http.StatusBadRequest)
+		return
+	}
+	direction := q.Get("direction")
+	switch direction {
+	case "":
+		direction = "total"
+	case "read", "write", "total":
+	default:
+		http.Error(w, fmt.Sprintf("direction must be read, write or total, got %q", direction), http.StatusBadRequest)
+		return
+	}
+	n := 10
+	if v := q.Get("n"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 1 {
+			http.Error(w, fmt.Sprintf("n must be a positive integer, got %q", v), http.StatusBadRequest)
+			return
+		}
+		n = i
+	}
+
+	a.mu.Lock()
+	if len(a.reports) == 0 {
+		a.mu.Unlock()
+		http.Error(w, "no report received yet", http.StatusServiceUnavailable)
+		return
+	}
+	resp := rollingResponse{
+		Timestamp: a.reports[len(a.reports)-1].ts.UnixMilli(),
+		Window:    a.window.String(),
+		Reports:   len(a.reports),
+		Estimator: a.estimator,
+		Entities:  []rollingStats{},
+	}
+	for _, s := range a.stats {
+		if eType == "" || s.Type == eType {
+			resp.Entities = append(resp.Entities, s)
+		}
+	}
+	a.mu.Unlock()
+
+	value := func(s rollingStats) float64 {
+		switch direction {
+		case "read":
+			return s.Read.get(stat)
+		case "write":
+			return s.Write.get(stat)
+		}
+		return s.Total.get(stat)
+	}
+	sort.Slice(resp.Entities, func(i, j int) bool {
+		if a, b := value(resp.Entities[i]), value(resp.Entities[j]); a != b {
+			return a > b
+		}
+		return resp.Entities[i].ID < resp.Entities[j].ID
+	})
+	if len(resp.Entities) > n {
+		resp.Entities = resp.Entities[:n]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ansiReverse is the style of the console rows matching the search.
+const ansiReverse = "\033[7m"
+
+// consoleSearch is the search and filter typed on the console, mirroring
+// htop: the search highlights the matching apps and users and groups, by id
+// or name, while typing, and the filter shows only the matching rows until
+// cleared. Matches are fuzzy: the characters of
+// the query have to appear in order, in any case, not necessarily together.
+type consoleSearch struct {
+	query  string // highlighted, "" for none
+	filter string // shown only, "" for all
+	prompt byte   // '/' or 'f' while typing, 0 otherwise
+	input  string // typed so far
+}
+
+// start starts typing the search, '/', or the filter, 'f', the filter
+// starting from the search or the filter in effect.
+func (s *consoleSearch) start(prompt byte) {
+	s.prompt, s.input = prompt, ""
+	switch {
+	case prompt == '/':
+		s.query = ""
+	case s.query != "":
+		s.input = s.query
+	default:
+		s.input = s.filter
+	}
+}
+
+// clear clears the search and the filter and returns whether there were
+// any.
+func (s *consoleSearch) clear() bool {
+	changed := s.query != "" || s.filter != ""
+	s.query, s.filter = "", ""
+	return changed
+}
+
+// edit handles the keys of in, typed together or pasted, while typing the
+// search or the filter.
+func (s *consoleSearch) edit(in []byte) {
+	if len(in) > 1 && in[0] == 0x1b {
+		return // an escape sequence, e.g. of the arrow keys
+	}
+	for len(in) > 0 {
+		r, n := utf8.DecodeRune(in)
+		in = in[n:]
+		switch {
+		case r == '\r' || r == '\n':
+			if s.prompt == 'f' {
+				s.filter, s.query = s.input, ""
+			}
+			s.prompt = 0
+			return
+		case r == 0x1b:
+			if s.prompt == '/' {
+				s.query = ""
+			}
+			s.prompt = 0
+			return
+		case r == 0x7f || r == '\b':
+			_, size := utf8.DecodeLastRuneInString(s.input)
+			s.input = s.input[:len(s.input)-size]
+		case unicode.IsPrint(r):
+			s.input += string(r)
+		}
+	}
+	if s.prompt == '/' {
+		s.query = s.input
+	}
+}
+
+// highlight returns whether row matches the search.
+func (s consoleSearch) highlight(row entityRow) bool {
+	return s.query != "" && s.matches(s.query, row)
+}
+
+// apply returns the rows passing the filter, keeping the totals.
+func (s consoleSearch) apply(rows []entityRow) []entityRow {
+	if s.filter == "" {
+		return rows
+	}
+	var out []entityRow
+	for _, row := range rows {
+		if totalRow(row.ID) || s.matches(s.filter, row) {
+			out = append(out, row)
+		}
+	}
+	return out
+}
+
+func (s consoleSearch) matches(query string, row entityRow) bool {
+	return fuzzyMatch(query, row.ID) || (row.Name != "" && fuzzyMatch(query, row.Name))
+}
+
+// print prints the prompt being typed or the filter in effect, if any.
+func (s consoleSearch) print(out io.Writer) {
+	switch {
+	case s.prompt == '/':
+		fmt.Fprintf(out, "Search: %s_   (Enter to keep, Esc to cancel)\n\n", s.input)
+	case s.prompt == 'f':
+		fmt.Fprintf(out, "Filter: %s_   (Enter to apply, Esc to cancel)\n\n", s.input)
+	case s.filter != "":
+		fmt.Fprintf(out, "Filter: %s   (c to clear)\n\n", s.filter)
+	}
+}
+
+// fuzzyMatch returns whether the characters of pattern appear in s in the
+// same order, ignoring case.
+func fuzzyMatch(pattern, s string) bool {
+	s = strings.ToLower(s)
+	for _, r := range strings.ToLower(pattern) {
+		i := strings.IndexRune(s, r)
+		if i < 0 {
+			return false
+		}
+		s = s[i+utf8.RuneLen(r):]
+	}
+	return true
+}
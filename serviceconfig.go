@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// retryConfig is the retry policy of the gRPC calls to the MGM. gRPC retries
+// a call transparently as long as no response was received, so for the
+// stream it covers opening it against an MGM that is restarting or behind a
+// flapping path, not reconnecting once reports flowed.
+type retryConfig struct {
+	MaxAttempts       int           `yaml:"max_attempts"`
+	InitialBackoff    time.Duration `yaml:"initial_backoff"`
+	MaxBackoff        time.Duration `yaml:"max_backoff"`
+	BackoffMultiplier float64       `yaml:"backoff_multiplier"`
+}
+
+// serviceConfigJSON returns the gRPC service config of the connection to
+// the MGM: -grpc-service-config, inline JSON or the file it names, or else
+// the retry policy of the -grpc-retry-* flags. It returns "" for neither.
+func serviceConfigJSON(cfg grpcConfig) (string, error) {
+	if cfg.ServiceConfig != "" {
+		if cfg.Retry.MaxAttempts > 1 {
+			return "", errors.New("-grpc-retry-max-attempts can't be combined with -grpc-service-config, set the retry policy there")
+		}
+		js := []byte(cfg.ServiceConfig)
+		if !strings.HasPrefix(strings.TrimSpace(cfg.ServiceConfig), "{") {
+			var err error
+			if js, err = os.ReadFile(cfg.ServiceConfig); err != nil {
+				return "", err
+			}
+		}
+		if !json.Valid(js) {
+			return "", errors.New("service config is not valid JSON")
+		}
+		return string(js), nil
+	}
+	if cfg.Retry.MaxAttempts <= 1 {
+		return "", nil
+	}
+
+	r := cfg.Retry
+	if r.InitialBackoff <= 0 || r.MaxBackoff < r.InitialBackoff || r.BackoffMultiplier < 1 {
+		return "", fmt.Errorf("invalid retry backoff: initial %s, max %s, multiplier %g", r.InitialBackoff, r.MaxBackoff, r.BackoffMultiplier)
+	}
+	type retryPolicy struct {
+		MaxAttempts          int      `json:"maxAttempts"`
+		InitialBackoff       string   `json:"initialBackoff"`
+		MaxBackoff           string   `json:"maxBackoff"`
+		BackoffMultiplier    float64  `json:"backoffMultiplier"`
+		RetryableStatusCodes []string `json:"retryableStatusCodes"`
+	}
+	type name struct {
+		Service string `json:"service"`
+	}
+	type methodConfig struct {
+		Name        []name      `json:"name"`
+		RetryPolicy retryPolicy `json:"retryPolicy"`
+	}
+	js, err := json.Marshal(map[string][]methodConfig{
+		"methodConfig": {{
+			Name: []name{{Service: pb.Eos_ServiceDesc.ServiceName}},
+			RetryPolicy: retryPolicy{
+				MaxAttempts:          r.MaxAttempts,
+				InitialBackoff:       protoDuration(r.InitialBackoff),
+				MaxBackoff:           protoDuration(r.MaxBackoff),
+				BackoffMultiplier:    r.BackoffMultiplier,
+				RetryableStatusCodes: []string{"UNAVAILABLE"},
+			},
+		}},
+	})
+	return string(js), err
+}
+
+// protoDuration formats d as a google.protobuf.Duration in JSON, e.g. "1.5s".
+func protoDuration(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// Shaping effectiveness: for every entity with a limit, count the reports in
+// which its rate on one estimator reached a share of the limit (it is being
+// throttled) and how far it went, to tell whether the limits actually bite.
+
+var (
+	limitAtLimitRatio = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_monitor_limits_file_time_at_limit_ratio",
+			Help: "Fraction of the reports since startup in which the entity was at its limit of the -limits file",
+		},
+		[]string{"entity_type", "id", "direction"},
+	)
+	limitPeakUtilization = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_monitor_limits_file_peak_utilization_ratio",
+			Help: "Highest throughput divided by the limit of the -limits file since startup",
+		},
+		[]string{"entity_type", "id", "direction"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(limitAtLimitRatio, limitPeakUtilization)
+}
+
+type shapingKey struct {
+	entity    entityKey
+	direction string
+}
+
+// shapingStats accumulates the utilization of one limit.
+type shapingStats struct {
+	limit   float64
+	current float64 // utilization in the last report
+	reports int     // reports in which the entity appeared
+	atLimit int     // reports with utilization >= the at-limit ratio
+	sum     float64 // utilization summed over the at-limit reports
+	peak    float64
+}
+
+func (s *shapingStats) atLimitRatio() float64 {
+	if s.reports == 0 {
+		return 0
+	}
+	return float64(s.atLimit) / float64(s.reports)
+}
+
+// meanAtLimit is the average utilization while at the limit, i.e. how hard
+// the entity pushes against it.
+func (s *shapingStats) meanAtLimit() float64 {
+	if s.atLimit == 0 {
+		return 0
+	}
+	return s.sum / float64(s.atLimit)
+}
+
+type shapingTracker struct {
+	estimator string
+	ratio     float64 // utilization from which an entity counts as at its limit
+	stats     map[shapingKey]*shapingStats
+}
+
+func newShapingTracker(estimator string, ratio float64) *shapingTracker {
+	return &shapingTracker{estimator: estimator, ratio: ratio, stats: make(map[shapingKey]*shapingStats)}
+}
+
+// Add accounts the entities of report that have a limit.
+func (t *shapingTracker) Add(report *pb.TrafficShapingRateResponse, limits map[entityKey]limit) {
+	for _, e := range reportEntities(report) {
+		key := entityKey{e.Type, e.ID}
+		l, ok := limits[key]
+		if !ok {
+			continue
+		}
+		for _, s := range e.Stats {
+			if s.Window.String() != t.estimator {
+				continue
+			}
+			t.add(shapingKey{key, "read"}, float64(l.Read), s.BytesReadPerSec)
+			t.add(shapingKey{key, "write"}, float64(l.Write), s.BytesWrittenPerSec)
+		}
+	}
+}
+
+func (t *shapingTracker) add(key shapingKey, limit, rate float64) {
+	if limit <= 0 {
+		return
+	}
+	st := t.stats[key]
+	if st == nil {
+		st = &shapingStats{}
+		t.stats[key] = st
+	}
+	u := rate / limit
+	st.limit, st.current = limit, u
+	st.reports++
+	if u >= t.ratio {
+		st.atLimit++
+		st.sum += u
+	}
+	st.peak = max(st.peak, u)
+}
+
+// export publishes the accumulated statistics.
+func (t *shapingTracker) export() {
+	for k, st := range t.stats {
+		limitAtLimitRatio.WithLabelValues(k.entity.Type, k.entity.ID, k.direction).Set(st.atLimitRatio())
+		limitPeakUtilization.WithLabelValues(k.entity.Type, k.entity.ID, k.direction).Set(st.peak)
+	}
+}
+
+// sorted returns the tracked limits, the most throttled first.
+func (t *shapingTracker) sorted() []shapingKey {
+	keys := make([]shapingKey, 0, len(t.stats))
+	for k := range t.stats {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := t.stats[keys[i]], t.stats[keys[j]]
+		if a.atLimitRatio() != b.atLimitRatio() {
+			return a.atLimitRatio() > b.atLimitRatio()
+		}
+		if keys[i].entity != keys[j].entity {
+			return keys[i].entity.Type+"/"+keys[i].entity.ID < keys[j].entity.Type+"/"+keys[j].entity.ID
+		}
+		return keys[i].direction < keys[j].direction
+	})
+	return keys
+}
+
+// print writes the shaping table; current adds the utilization of the last
+// report, for the live view.
+func (t *shapingTracker) print(out io.Writer, current bool) {
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	if current {
+		fmt.Fprintln(w, "Type\tID\tDirection\tLimit\tUtilization\tAt Limit\tMean At Limit\tPeak")
+	} else {
+		fmt.Fprintln(w, "Type\tID\tDirection\tLimit\tAt Limit\tMean At Limit\tPeak")
+	}
+	for _, k := range t.sorted() {
+		st := t.stats[k]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t", k.entity.Type, k.entity.ID, k.direction, humanizeBytes(st.limit)+"/s")
+		if current {
+			fmt.Fprintf(w, "%.0f%%\t", 100*st.current)
+		}
+		fmt.Fprintf(w, "%.1f%%\t%.0f%%\t%.0f%%\n", 100*st.atLimitRatio(), 100*st.meanAtLimit(), 100*st.peak)
+	}
+	w.Flush()
+}
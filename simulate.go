@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+func runSimulate(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	limitsPath := fs.String("limits", "", "Limits file to apply (required)")
+	estimator := fs.String("estimator", "SMA_1_SECONDS", "Estimator taken as the demand of every entity")
+	maxGap := fs.Duration("gap", 10*time.Second, "Report intervals longer than this are skipped instead of simulated")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s simulate -limits <file> <recording>...\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Replays recordings applying the given limits client-side: traffic above a")
+		fmt.Fprintln(fs.Output(), "limit is queued and served later, and the throughput and queueing of every")
+		fmt.Fprintln(fs.Output(), "limited entity is compared with what was recorded. The recorded rates are")
+		fmt.Fprintln(fs.Output(), "taken as demand, so they are already shaped by the limits in force then.")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() == 0 || *limitsPath == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	limits, err := readLimits(*limitsPath)
+	if err != nil {
+		log.Fatalf("Error loading limits: %v", err)
+	}
+	if _, err := parseEstimator(*estimator); err != nil {
+		log.Fatalf("Invalid -estimator: %v", err)
+	}
+
+	for _, path := range fs.Args() {
+		targets, err := simulateRecording(path, limits, *estimator, *maxGap)
+		if err != nil {
+			log.Fatalf("Error simulating recording: %v", err)
+		}
+		printSimulation(path, targets)
+	}
+}
+
+// simQueue is the fluid queue of one limited entity and direction: demand
+// above the limit accumulates in backlog and is served once the entity is
+// below its limit again.
+type simQueue struct {
+	limit   float64
+	backlog float64 // bytes
+
+	duration     time.Duration // simulated time
+	throttled    time.Duration // time with a backlog
+	observed     float64       // bytes
+	served       float64       // bytes
+	peakObserved float64       // bytes/sec
+	peakServed   float64       // bytes/sec
+	peakBacklog  float64       // bytes
+}
+
+// step advances the queue by dt with the given demand in bytes/sec.
+func (q *simQueue) step(dt time.Duration, demand float64) {
+	sec := dt.Seconds()
+	q.backlog += demand * sec
+	served := min(q.backlog, q.limit*sec)
+	q.backlog -= served
+
+	q.duration += dt
+	q.observed += demand * sec
+	q.served += served
+	q.peakObserved = max(q.peakObserved, demand)
+	q.peakServed = max(q.peakServed, served/sec)
+	if q.backlog > 0 {
+		q.throttled += dt
+	}
+	q.peakBacklog = max(q.peakBacklog, q.backlog)
+}
+
+// simTarget holds the queues of the reports of one target.
+type simTarget struct {
+	last   time.Time
+	queues map[shapingKey]*simQueue
+}
+
+func simulateRecording(path string, limits map[entityKey]limit, estimator string, maxGap time.Duration) (map[string]*simTarget, error) {
+	r, err := openRecording(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	targets := make(map[string]*simTarget)
+	for {
+		f, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return targets, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		t := targets[f.Target]
+		if t == nil {
+			t = &simTarget{queues: make(map[shapingKey]*simQueue)}
+			for k, l := range limits {
+				if l.Read > 0 {
+					t.queues[shapingKey{k, "read"}] = &simQueue{limit: float64(l.Read)}
+				}
+				if l.Write > 0 {
+					t.queues[shapingKey{k, "write"}] = &simQueue{limit: float64(l.Write)}
+				}
+			}
+			targets[f.Target] = t
+		}
+
+		// The rates of a report apply to the interval since the previous one.
+		ts := time.UnixMilli(f.Report.TimestampMs)
+		dt := ts.Sub(t.last)
+		t.last = ts
+		if dt <= 0 || dt > maxGap {
+			continue
+		}
+
+		demand := make(map[shapingKey]float64)
+		for _, e := range reportEntities(f.Report) {
+			for _, s := range e.Stats {
+				if s.Window.String() == estimator {
+					demand[shapingKey{entityKey{e.Type, e.ID}, "read"}] = s.BytesReadPerSec
+					demand[shapingKey{entityKey{e.Type, e.ID}, "write"}] = s.BytesWrittenPerSec
+				}
+			}
+		}
+		// Entities missing from the report have no demand, which lets their
+		// backlog drain.
+		for k, q := range t.queues {
+			q.step(dt, demand[k])
+		}
+	}
+}
+
+func printSimulation(path string, targets map[string]*simTarget) {
+	fmt.Printf("=== %s ===\n\n", path)
+	if len(targets) == 0 {
+		fmt.Printf("No reports.\n\n")
+		return
+	}
+
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		t := targets[name]
+		fmt.Printf("Target:   %s\n\n", name)
+
+		keys := make([]shapingKey, 0, len(t.queues))
+		for k, q := range t.queues {
+			if q.observed > 0 {
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			fmt.Printf("No traffic from limited entities.\n\n")
+			continue
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			a, b := t.queues[keys[i]], t.queues[keys[j]]
+			if a.throttled != b.throttled {
+				return a.throttled > b.throttled
+			}
+			if keys[i].entity != keys[j].entity {
+				return keys[i].entity.Type+"/"+keys[i].entity.ID < keys[j].entity.Type+"/"+keys[j].entity.ID
+			}
+			return keys[i].direction < keys[j].direction
+		})
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "Type\tID\tDirection\tLimit\tMean/s\tSimulated Mean/s\tPeak/s\tSimulated Peak/s\tThrottled\tMax Queue\tMax Delay\tQueued At End")
+		for _, k := range keys {
+			q := t.queues[k]
+			sec := q.duration.Seconds()
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%.1f%%\t%s\t%s\t%s\n",
+				k.entity.Type,
+				k.entity.ID,
+				k.direction,
+				humanizeBytes(q.limit)+"/s",
+				humanizeBytes(q.observed/sec),
+				humanizeBytes(q.served/sec),
+				humanizeBytes(q.peakObserved),
+				humanizeBytes(q.peakServed),
+				100*q.throttled.Seconds()/sec,
+				humanizeBytes(q.peakBacklog),
+				time.Duration(q.peakBacklog/q.limit*float64(time.Second)).Round(time.Second),
+				humanizeBytes(q.backlog),
+			)
+		}
+		w.Flush()
+		fmt.Println()
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// sink receives every report to forward it to another monitoring system.
+// Send must not block for long; errors are logged and the monitor carries on.
+type sink interface {
+	Send(report *pb.TrafficShapingRateResponse) error
+	Close() error
+}
+
+var (
+	sinkSends = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "eos_sink_sends_total",
+			Help: "Reports handed to a sink, by result (ok, error, timeout, skipped)",
+		},
+		[]string{"sink", "result"},
+	)
+	sinkSendSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "eos_sink_send_duration_seconds",
+			Help:    "Time taken by a sink to accept a report",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"sink"},
+	)
+	sinkCircuitOpen = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_sink_circuit_open",
+			Help: "1 while a sink is skipped after failing repeatedly",
+		},
+		[]string{"sink"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sinkSends, sinkSendSeconds, sinkCircuitOpen)
+}
+
+// breakerSink wraps a sink so a failing or hung one can't hold up the
+// stream loop. A Send taking longer than timeout counts as failed and is
+// left to finish in the background, the reports meanwhile being skipped.
+// After failures consecutive failures the sink is skipped for cooldown,
+// then given one report to try again.
+type breakerSink struct {
+	name     string
+	sink     sink
+	timeout  time.Duration
+	failures int
+	cooldown time.Duration
+
+	failed    int
+	openUntil time.Time
+	inflight  chan struct{} // closed when the last Send returns
+}
+
+func newBreakerSink(name string, s sink, timeout time.Duration, failures int, cooldown time.Duration) (*breakerSink, error) {
+	if timeout <= 0 || failures < 1 || cooldown <= 0 {
+		return nil, errors.New("sink timeout, failures and cooldown must be positive")
+	}
+	sinkCircuitOpen.WithLabelValues(name).Set(0)
+	return &breakerSink{name: name, sink: s, timeout: timeout, failures: failures, cooldown: cooldown}, nil
+}
+
+func (b *breakerSink) busy() bool {
+	if b.inflight == nil {
+		return false
+	}
+	select {
+	case <-b.inflight:
+		return false
+	default:
+		return true
+	}
+}
+
+func (b *breakerSink) Send(report *pb.TrafficShapingRateResponse) error {
+	if time.Now().Before(b.openUntil) || b.busy() {
+		sinkSends.WithLabelValues(b.name, "skipped").Inc()
+		return nil
+	}
+
+	done := make(chan struct{})
+	result := make(chan error, 1)
+	b.inflight = done
+	go func() {
+		defer close(done)
+		start := time.Now()
+		var span trace.Span
+		if ctx := reportSpans.Context(report); ctx != nil {
+			_, span = tracer.Start(ctx, "sink", trace.WithAttributes(attribute.String("sink", b.name)))
+		}
+		err := b.sink.Send(report)
+		sinkSendSeconds.WithLabelValues(b.name).Observe(time.Since(start).Seconds())
+		if span != nil {
+			if err != nil {
+				span.SetStatus(codes.Error, err.Error())
+			}
+			span.End()
+		}
+		result <- err
+	}()
+
+	timer := time.NewTimer(b.timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case err = <-result:
+		if err != nil {
+			sinkSends.WithLabelValues(b.name, "error").Inc()
+		}
+	case <-timer.C:
+		sinkSends.WithLabelValues(b.name, "timeout").Inc()
+		err = fmt.Errorf("timed out after %s", b.timeout)
+	}
+	if err == nil {
+		sinkSends.WithLabelValues(b.name, "ok").Inc()
+		if b.failed >= b.failures {
+			log.Printf("Sink %s recovered", b.name)
+			sinkCircuitOpen.WithLabelValues(b.name).Set(0)
+		}
+		b.failed = 0
+		return nil
+	}
+
+	b.failed++
+	if b.failed >= b.failures {
+		b.openUntil = time.Now().Add(b.cooldown)
+		sinkCircuitOpen.WithLabelValues(b.name).Set(1)
+		if b.failed == b.failures {
+			log.Printf("Sink %s failed %d times in a row, skipping it for %s", b.name, b.failed, b.cooldown)
+		}
+	}
+	return fmt.Errorf("%s: %w", b.name, err)
+}
+
+// Close waits up to timeout for a pending Send before closing the sink.
+func (b *breakerSink) Close() error {
+	if b.inflight != nil {
+		select {
+		case <-b.inflight:
+		case <-time.After(b.timeout):
+			return fmt.Errorf("%s: send still pending after %s", b.name, b.timeout)
+		}
+	}
+	return b.sink.Close()
+}
+
+var (
+	sinkQueueLength = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_sink_queue_length",
+			Help: "Reports waiting in the queue of a sink",
+		},
+		[]string{"sink"},
+	)
+	sinkDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "eos_sink_dropped_total",
+			Help: "Oldest reports dropped from the full queue of a sink",
+		},
+		[]string{"sink"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sinkQueueLength, sinkDropped)
+}
+
+// pacedSink is implemented by the sinks whose Send blocks on purpose to
+// slow the monitor down when they fall behind. They get no queue, which
+// would turn that back-pressure into dropped reports.
+type pacedSink interface {
+	paced()
+}
+
+// queuedSink hands the reports to a sink from its own goroutine through a
+// bounded queue, so a slow sink doesn't back up the gRPC stream. When the
+// queue is full, the oldest report is dropped with the drop-oldest
+// overflow policy, or Send waits for room with block.
+type queuedSink struct {
+	name  string
+	sink  sink
+	block bool
+	queue chan *pb.TrafficShapingRateResponse
+	done  chan struct{}
+}
+
+func newQueuedSink(name string, s sink, size int, overflow string) (*queuedSink, error) {
+	if size < 1 {
+		return nil, errors.New("sink queue size must be positive")
+	}
+	q := &queuedSink{
+		name:  name,
+		sink:  s,
+		queue: make(chan *pb.TrafficShapingRateResponse, size),
+		done:  make(chan struct{}),
+	}
+	switch overflow {
+	case "drop-oldest":
+	case "block":
+		q.block = true
+	default:
+		return nil, fmt.Errorf("unknown sink overflow policy %q (expected drop-oldest or block)", overflow)
+	}
+	sinkQueueLength.WithLabelValues(name).Set(0)
+	go q.run()
+	return q, nil
+}
+
+func (q *queuedSink) run() {
+	defer close(q.done)
+	for report := range q.queue {
+		sinkQueueLength.WithLabelValues(q.name).Set(float64(len(q.queue)))
+		if err := q.sink.Send(report); err != nil {
+			log.Printf("Sink error: %v", err)
+		}
+	}
+}
+
+// Send queues report. Errors of the sink are logged by its goroutine.
+func (q *queuedSink) Send(report *pb.TrafficShapingRateResponse) error {
+	for !q.block {
+		select {
+		case q.queue <- report:
+			sinkQueueLength.WithLabelValues(q.name).Set(float64(len(q.queue)))
+			return nil
+		default:
+		}
+		select {
+		case <-q.queue:
+			sinkDropped.WithLabelValues(q.name).Inc()
+		default:
+		}
+	}
+	q.queue <- report
+	sinkQueueLength.WithLabelValues(q.name).Set(float64(len(q.queue)))
+	return nil
+}
+
+// Close sends the queued reports and closes the sink.
+func (q *queuedSink) Close() error {
+	close(q.queue)
+	<-q.done
+	return q.sink.Close()
+}
+
+// queuedWriter writes to w from its own goroutine through a bounded queue, so
+// a slow terminal, e.g. over a high-latency SSH session, or a stalled pipe
+// doesn't back up the gRPC stream. Every Write is queued whole, frames and
+// reports alike, so dropping the oldest with the drop-oldest overflow policy
+// never tears one; Write waits for room with block. Its queue is exported
+// like those of the sinks.
+type queuedWriter struct {
+	name  string
+	w     io.Writer
+	block bool
+	queue chan []byte
+	done  chan struct{}
+}
+
+func newQueuedWriter(name string, w io.Writer, size int, overflow string) (*queuedWriter, error) {
+	if size < 1 {
+		return nil, errors.New("output queue size must be positive")
+	}
+	q := &queuedWriter{
+		name:  name,
+		w:     w,
+		queue: make(chan []byte, size),
+		done:  make(chan struct{}),
+	}
+	switch overflow {
+	case "drop-oldest":
+	case "block":
+		q.block = true
+	default:
+		return nil, fmt.Errorf("unknown sink overflow policy %q (expected drop-oldest or block)", overflow)
+	}
+	sinkQueueLength.WithLabelValues(name).Set(0)
+	go q.run()
+	return q, nil
+}
+
+func (q *queuedWriter) run() {
+	defer close(q.done)
+	for p := range q.queue {
+		sinkQueueLength.WithLabelValues(q.name).Set(float64(len(q.queue)))
+		if _, err := q.w.Write(p); err != nil {
+			log.Printf("Error writing %s output: %v", q.name, err)
+		}
+	}
+}
+
+// Write queues a copy of p. Errors of the writer are logged by its
+// goroutine.
+func (q *queuedWriter) Write(p []byte) (int, error) {
+	b := bytes.Clone(p)
+	for !q.block {
+		select {
+		case q.queue <- b:
+			sinkQueueLength.WithLabelValues(q.name).Set(float64(len(q.queue)))
+			return len(p), nil
+		default:
+		}
+		select {
+		case <-q.queue:
+			sinkDropped.WithLabelValues(q.name).Inc()
+		default:
+		}
+	}
+	q.queue <- b
+	sinkQueueLength.WithLabelValues(q.name).Set(float64(len(q.queue)))
+	return len(p), nil
+}
+
+// Close writes the queued output.
+func (q *queuedWriter) Close() error {
+	close(q.queue)
+	<-q.done
+	return nil
+}
+
+// every calls fn every interval from its own goroutine until stop is
+// called, stop returning once fn has returned.
+func every(interval time.Duration, fn func()) (stop func()) {
+	t := time.NewTicker(interval)
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-t.C:
+				fn()
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		t.Stop()
+		close(quit)
+		<-done
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Slack notifiers are declared next to the rules and used as actions by
+// name. They post either through an incoming webhook or, with a bot token,
+// through chat.postMessage:
+//
+//	slack:
+//	  ops:
+//	    webhook_url: https://hooks.slack.com/services/...   # or:
+//	    token_file: /etc/eos-monitor/slack-token           # xoxb- bot token
+//	    channel: "#eos-ops"           # default channel (required with token_file)
+//	    min_interval: 5m              # per rule and entity (default 5m)
+//	    max_per_minute: 20            # per channel (default 20)
+//	rules:
+//	  - name: heavy-writer
+//	    ...
+//	    channel: "#eos-heavy-writers" # optional, overrides the notifier's channel
+//	    actions: [ops]
+//
+// Incoming webhooks post to the channel they were created for, so routing
+// rules to other channels needs a bot token.
+//
+// A rule firing for the same entity again within min_interval is not posted
+// (nor is its resolution); the next message says how many were suppressed.
+
+const slackPostMessageURL = "https://slack.com/api/chat.postMessage"
+
+type slackNotifier struct {
+	WebhookURL   string        `yaml:"webhook_url"`
+	TokenFile    string        `yaml:"token_file"`
+	Channel      string        `yaml:"channel"`
+	MinInterval  time.Duration `yaml:"min_interval"`
+	MaxPerMinute int           `yaml:"max_per_minute"`
+
+	name   string
+	token  string
+	client *http.Client
+	queue  chan slackMessage
+
+	mu         sync.Mutex
+	last       map[alertKey]time.Time // last firing message per rule and entity
+	open       map[alertKey]bool      // posted as firing, not yet as resolved
+	suppressed map[alertKey]int
+	sent       map[string][]time.Time // recent messages per channel
+}
+
+type slackMessage struct {
+	Channel string `json:"channel,omitempty"`
+	Text    string `json:"text"`
+}
+
+// init validates the notifier and starts its queue.
+func (n *slackNotifier) init(name string) error {
+	switch {
+	case (n.WebhookURL == "") == (n.TokenFile == ""):
+		return errors.New("exactly one of webhook_url and token_file is required")
+	case n.WebhookURL != "":
+		u, err := url.Parse(n.WebhookURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("webhook_url must be an https:// URL, got %q", n.WebhookURL)
+		}
+	default:
+		b, err := os.ReadFile(n.TokenFile)
+		if err != nil {
+			return err
+		}
+		n.token = strings.TrimSpace(string(b))
+		if n.Channel == "" {
+			return errors.New("channel is required with token_file")
+		}
+	}
+	if n.MinInterval < 0 || n.MaxPerMinute < 0 {
+		return errors.New("min_interval and max_per_minute must not be negative")
+	}
+	if n.MinInterval == 0 {
+		n.MinInterval = 5 * time.Minute
+	}
+	if n.MaxPerMinute == 0 {
+		n.MaxPerMinute = 20
+	}
+
+	n.name = name
+	n.client = &http.Client{Timeout: 10 * time.Second}
+	n.last = make(map[alertKey]time.Time)
+	n.open = make(map[alertKey]bool)
+	n.suppressed = make(map[alertKey]int)
+	n.sent = make(map[string][]time.Time)
+	n.queue = make(chan slackMessage, webhookQueueSize)
+	go func() {
+		for msg := range n.queue {
+			if err := n.post(msg); err != nil {
+				log.Printf("Slack %s: %v", n.name, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// notify is the alert action of the notifier.
+func (n *slackNotifier) notify(ev alertEvent) {
+	channel := n.Channel
+	if ev.Rule.Channel != "" {
+		channel = ev.Rule.Channel
+	}
+	key := alertKey{ev.Rule.Name, ev.Entity}
+	now := time.Now()
+
+	n.mu.Lock()
+	if !n.allow(key, channel, ev.Firing, now) {
+		if ev.Firing {
+			n.suppressed[key]++
+		}
+		n.mu.Unlock()
+		return
+	}
+	suppressed := n.suppressed[key]
+	delete(n.suppressed, key)
+	n.mu.Unlock()
+
+	icon := ":white_check_mark:"
+	if ev.Firing {
+		icon = ":rotating_light:"
+	}
+	text := icon + " " + ev.String()
+	if suppressed > 0 {
+		text += fmt.Sprintf(" (%d earlier notifications suppressed)", suppressed)
+	}
+
+	select {
+	case n.queue <- slackMessage{Channel: channel, Text: text}:
+	default:
+		log.Printf("Slack %s: queue full, dropping %s", n.name, ev)
+	}
+}
+
+// allow applies the rate limits, recording the message if it may be sent.
+// min_interval and max_per_minute only hold back firing messages; a
+// resolution is posted if and only if the firing was, so the channel never
+// shows an alert as firing after it resolved. Resolutions still count
+// towards max_per_minute.
+func (n *slackNotifier) allow(key alertKey, channel string, firing bool, now time.Time) bool {
+	if firing {
+		if last, ok := n.last[key]; ok && now.Sub(last) < n.MinInterval {
+			return false
+		}
+	} else if !n.open[key] {
+		return false
+	}
+
+	recent := n.sent[channel][:0]
+	for _, t := range n.sent[channel] {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	n.sent[channel] = recent
+	if firing && len(recent) >= n.MaxPerMinute {
+		return false
+	}
+	n.sent[channel] = append(recent, now)
+	if firing {
+		n.last[key] = now
+		n.open[key] = true
+	} else {
+		delete(n.open, key)
+	}
+	return true
+}
+
+func (n *slackNotifier) post(msg slackMessage) error {
+	endpoint := n.WebhookURL
+	if n.token != "" {
+		endpoint = slackPostMessageURL
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if n.token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.token)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("posting to %s: %s: %s", msg.Channel, resp.Status, bytes.TrimSpace(b))
+	}
+	if n.token != "" {
+		// The Web API answers 200 with {"ok": false, "error": ...} on failure.
+		var r struct {
+			OK    bool   `json:"ok"`
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(b, &r); err != nil {
+			return fmt.Errorf("posting to %s: %w", msg.Channel, err)
+		}
+		if !r.OK {
+			return fmt.Errorf("posting to %s: %s", msg.Channel, r.Error)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// SLOs are read from a YAML file passed with -slos:
+//
+//	slos:
+//	  - name: analysis-read
+//	    type: group          # app, user or group
+//	    id: "2000"           # omit to track every entity of the type
+//	    estimator: SMA_1_MINUTES
+//	    direction: read      # read, write or total
+//	    target: 200MB/s      # rate to sustain while active
+//	    active: 1MB/s        # rate above which the entity counts as active (default 1MB/s)
+//	    objective: 0.99      # fraction of active reports that must reach target
+//	    window: 1h           # compliance is computed over this rolling window (default 1h)
+//
+// Every report in which a matching entity is active counts as good if it
+// reaches the target and bad otherwise; idle or absent entities don't count.
+
+var (
+	sloCompliance = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_slo_compliance_ratio",
+			Help: "Fraction of active reports in the SLO window in which the entity reached the target rate",
+		},
+		[]string{"slo", "entity_type", "id"},
+	)
+	sloBurnRate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_slo_error_budget_burn_rate",
+			Help: "Rate at which the error budget is consumed in the SLO window; 1 uses it up exactly",
+		},
+		[]string{"slo", "entity_type", "id"},
+	)
+	sloBudgetRemaining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_slo_error_budget_remaining_ratio",
+			Help: "Fraction of the error budget left in the SLO window (negative once exhausted)",
+		},
+		[]string{"slo", "entity_type", "id"},
+	)
+	sloActiveReports = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_slo_active_reports",
+			Help: "Reports in the SLO window in which the entity was active",
+		},
+		[]string{"slo", "entity_type", "id"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sloCompliance, sloBurnRate, sloBudgetRemaining, sloActiveReports)
+}
+
+// sloBuckets is the number of buckets the window of an SLO is divided in;
+// reports older than the window are dropped a bucket at a time.
+const sloBuckets = 60
+
+type slo struct {
+	Name      string        `yaml:"name"`
+	Type      string        `yaml:"type"`
+	ID        string        `yaml:"id"`
+	Estimator string        `yaml:"estimator"`
+	Direction string        `yaml:"direction"`
+	Target    byteRate      `yaml:"target"`
+	Active    byteRate      `yaml:"active"`
+	Objective float64       `yaml:"objective"`
+	Window    time.Duration `yaml:"window"`
+}
+
+type slosDoc struct {
+	SLOs []*slo `yaml:"slos"`
+}
+
+func loadSLOs(path string) ([]*slo, error) {
+	var doc slosDoc
+	if err := loadYAML(path, &doc); err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	names := make(map[string]bool)
+	for i, s := range doc.SLOs {
+		if err := s.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: slos[%d]: %w", path, i, err))
+		}
+		if names[s.Name] {
+			errs = append(errs, fmt.Errorf("%s: slos[%d]: duplicate SLO name %q", path, i, s.Name))
+		}
+		names[s.Name] = true
+	}
+	return doc.SLOs, errors.Join(errs...)
+}
+
+func (s *slo) validate() error {
+	if s.Name == "" {
+		return errors.New("name is required")
+	}
+	if !validEntityType(s.Type) {
+		return fmt.Errorf("type must be app, user or group, got %q", s.Type)
+	}
+	if _, err := parseEstimator(s.Estimator); err != nil {
+		return err
+	}
+	switch s.Direction {
+	case "read", "write", "total":
+	default:
+		return fmt.Errorf("direction must be read, write or total, got %q", s.Direction)
+	}
+	if s.Target <= 0 {
+		return errors.New("target is required")
+	}
+	if s.Active < 0 {
+		return errors.New("active must not be negative")
+	}
+	if s.Active == 0 {
+		s.Active = 1 << 20
+	}
+	if s.Objective <= 0 || s.Objective >= 1 {
+		return fmt.Errorf("objective must be between 0 and 1 (exclusive), got %g", s.Objective)
+	}
+	if s.Window == 0 {
+		s.Window = time.Hour
+	}
+	if s.Window < time.Minute {
+		return fmt.Errorf("window must be at least 1m, got %s", s.Window)
+	}
+	return nil
+}
+
+func (s *slo) matches(e entity) bool {
+	return e.Type == s.Type && (s.ID == "" || e.ID == s.ID)
+}
+
+// value returns the rate of e the SLO looks at, and false if the report has
+// no sample of the SLO's estimator for it.
+func (s *slo) value(e entity) (float64, bool) {
+	for _, st := range e.Stats {
+		if st.Window.String() != s.Estimator {
+			continue
+		}
+		switch s.Direction {
+		case "read":
+			return st.BytesReadPerSec, true
+		case "write":
+			return st.BytesWrittenPerSec, true
+		default:
+			return st.BytesReadPerSec + st.BytesWrittenPerSec, true
+		}
+	}
+	return 0, false
+}
+
+type sloKey struct {
+	slo    string
+	entity entityKey
+}
+
+// sloBucket counts the active reports of one slice of the window.
+type sloBucket struct {
+	start     int64 // index of the slice since the epoch
+	good, bad int
+}
+
+// sloState holds the buckets of one entity, indexed by start modulo
+// sloBuckets.
+type sloState struct {
+	buckets [sloBuckets]sloBucket
+}
+
+// add counts a report in the bucket of slice i.
+func (st *sloState) add(i int64, good bool) {
+	b := &st.buckets[i%sloBuckets]
+	if b.start != i {
+		*b = sloBucket{start: i}
+	}
+	if good {
+		b.good++
+	} else {
+		b.bad++
+	}
+}
+
+// counts returns the reports counted in the window ending with slice i.
+func (st *sloState) counts(i int64) (good, bad int) {
+	for _, b := range st.buckets {
+		if b.start > i-sloBuckets && b.start <= i {
+			good += b.good
+			bad += b.bad
+		}
+	}
+	return good, bad
+}
+
+// sloTracker updates the SLO compliance of the matching entities with every
+// report.
+type sloTracker struct {
+	slos   []*slo
+	states map[sloKey]*sloState
+}
+
+func newSLOTracker(slos []*slo) *sloTracker {
+	return &sloTracker{slos: slos, states: make(map[sloKey]*sloState)}
+}
+
+// Update counts report towards the SLOs and exports their compliance.
+func (t *sloTracker) Update(report *pb.TrafficShapingRateResponse) {
+	ts := time.UnixMilli(report.TimestampMs)
+	entities := reportEntities(report)
+
+	for _, s := range t.slos {
+		slice := ts.UnixNano() / int64(s.Window/sloBuckets)
+		for _, e := range entities {
+			if !s.matches(e) {
+				continue
+			}
+			v, ok := s.value(e)
+			if !ok || v < float64(s.Active) {
+				continue
+			}
+			key := sloKey{s.Name, entityKey{e.Type, e.ID}}
+			st := t.states[key]
+			if st == nil {
+				st = &sloState{}
+				t.states[key] = st
+			}
+			st.add(slice, v >= float64(s.Target))
+		}
+
+		for k, st := range t.states {
+			if k.slo != s.Name {
+				continue
+			}
+			good, bad := st.counts(slice)
+			if good+bad == 0 {
+				// Not active for a whole window: forget the entity.
+				delete(t.states, k)
+				sloCompliance.DeleteLabelValues(k.slo, k.entity.Type, k.entity.ID)
+				sloBurnRate.DeleteLabelValues(k.slo, k.entity.Type, k.entity.ID)
+				sloBudgetRemaining.DeleteLabelValues(k.slo, k.entity.Type, k.entity.ID)
+				sloActiveReports.DeleteLabelValues(k.slo, k.entity.Type, k.entity.ID)
+				continue
+			}
+			errorRate := float64(bad) / float64(good+bad)
+			burn := errorRate / (1 - s.Objective)
+			sloCompliance.WithLabelValues(k.slo, k.entity.Type, k.entity.ID).Set(1 - errorRate)
+			sloBurnRate.WithLabelValues(k.slo, k.entity.Type, k.entity.ID).Set(burn)
+			sloBudgetRemaining.WithLabelValues(k.slo, k.entity.Type, k.entity.ID).Set(1 - burn)
+			sloActiveReports.WithLabelValues(k.slo, k.entity.Type, k.entity.ID).Set(float64(good + bad))
+		}
+	}
+}
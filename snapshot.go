@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// snapshotter dumps the latest report, as received from the MGM with all
+// its entities and estimators, to a timestamped file of dir on SIGUSR1, for
+// a forensic record of an incident while the monitor keeps running:
+//
+//	kill -USR1 $(pidof eos_traffic_shaping_monitor)
+//
+// A snapshot is a one frame jsonl recording, so it can be inspected,
+// converted and replayed like any other.
+//
+// Every interval, if set, the top consumers as shown on the console are
+// also written to a top-<time>.json or .csv file, keeping the last keep of
+// them, as a lightweight history for sites without a TSDB.
+type snapshotter struct {
+	dir      string
+	target   string
+	interval time.Duration
+	format   string // of the periodic snapshots, json or csv
+	keep     int
+
+	mu     sync.Mutex
+	latest *pb.TrafficShapingRateResponse
+	ts     time.Time // of the rows
+	rows   map[string][]entityRow
+}
+
+func newSnapshotter(dir, target string, interval time.Duration, format string, keep int) (*snapshotter, error) {
+	if format != "json" && format != "csv" {
+		return nil, fmt.Errorf("unsupported snapshot format %q (expected json or csv)", format)
+	}
+	if interval < 0 || keep < 1 {
+		return nil, errors.New("the snapshot interval must not be negative and at least one snapshot must be kept")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &snapshotter{dir: dir, target: target, interval: interval, format: format, keep: keep}, nil
+}
+
+// Update makes report the one dumped by the next snapshot.
+func (s *snapshotter) Update(report *pb.TrafficShapingRateResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latest = report
+}
+
+// UpdateTop makes rows, the rows shown for the report of ts, the ones
+// written by the next periodic snapshot.
+func (s *snapshotter) UpdateTop(ts time.Time, rows map[string][]entityRow) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ts, s.rows = ts, rows
+}
+
+// Run takes a snapshot on every SIGUSR1, and the periodic ones, until ctx
+// is done.
+func (s *snapshotter) Run(ctx context.Context) {
+	c := make(chan os.Signal, 1)
+	notifySnapshot(c)
+	var tick <-chan time.Time
+	if s.interval > 0 {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c:
+			path, err := s.Dump()
+			if err != nil {
+				log.Printf("Error taking snapshot: %v", err)
+				continue
+			}
+			log.Printf("Snapshot of the latest report written to %s", path)
+		case <-tick:
+			if err := s.DumpTop(); err != nil {
+				log.Printf("Error taking periodic snapshot: %v", err)
+			}
+		}
+	}
+}
+
+// Dump writes the latest report to a new file of the snapshot directory,
+// which only ever appears complete, and returns its path.
+func (s *snapshotter) Dump() (string, error) {
+	s.mu.Lock()
+	report := s.latest
+	s.mu.Unlock()
+	if report == nil {
+		return "", errors.New("no report received yet")
+	}
+
+	js, err := protojson.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+	line, err := json.Marshal(jsonlFrame{Target: s.target, Report: js})
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("snapshot-%s.jsonl", time.Now().UTC().Format(snapshotTime)))
+	return path, s.write(path, append(line, '\n'))
+}
+
+// snapshotTime is the layout of the time in the snapshot file names, which
+// sort by time.
+const snapshotTime = "20060102T150405.000Z"
+
+// snapshotRow is a row of the periodic snapshots, one per entity and
+// estimator.
+type snapshotRow struct {
+	Timestamp  string  `json:"timestamp"` // RFC3339 with milliseconds
+	MGM        string  `json:"mgm"`
+	EntityType string  `json:"entity_type"`
+	ID         string  `json:"id"`
+	Name       string  `json:"name,omitempty"`
+	Estimator  string  `json:"estimator"`
+	Read       float64 `json:"read_bytes_per_second"`
+	Write      float64 `json:"write_bytes_per_second"`
+}
+
+// DumpTop writes the rows of the latest report to a new periodic snapshot,
+// then removes the periodic snapshots beyond the last keep.
+func (s *snapshotter) DumpTop() error {
+	s.mu.Lock()
+	ts, rows := s.ts, s.rows
+	s.mu.Unlock()
+	if rows == nil {
+		return errors.New("no report received yet")
+	}
+
+	b, err := encodeSnapshotRows(snapshotRows(ts, s.target, rows), s.format)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("top-%s.%s", time.Now().UTC().Format(snapshotTime), s.format))
+	if err := s.write(path, b); err != nil {
+		return err
+	}
+
+	old, err := filepath.Glob(filepath.Join(s.dir, "top-*."+s.format))
+	if err != nil {
+		return err
+	}
+	slices.Sort(old)
+	for len(old) > s.keep {
+		if err := os.Remove(old[0]); err != nil {
+			return err
+		}
+		old = old[1:]
+	}
+	return nil
+}
+
+// snapshotRows flattens rows, shown for the report of ts from target, to a
+// snapshot row per entity and estimator.
+func snapshotRows(ts time.Time, target string, rows map[string][]entityRow) []snapshotRow {
+	var out []snapshotRow
+	for _, eType := range []string{"app", "user", "group"} {
+		for _, row := range rows[eType] {
+			for _, st := range row.Stats {
+				out = append(out, snapshotRow{
+					Timestamp:  ts.UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+					MGM:        target,
+					EntityType: eType,
+					ID:         row.ID,
+					Name:       row.Name,
+					Estimator:  st.Window.String(),
+					Read:       st.BytesReadPerSec,
+					Write:      st.BytesWrittenPerSec,
+				})
+			}
+		}
+	}
+	return out
+}
+
+// encodeSnapshotRows encodes rows as a JSON array or CSV with a header.
+func encodeSnapshotRows(rows []snapshotRow, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case "json":
+		b, err := json.Marshal(rows)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(append(b, '\n'))
+	case "csv":
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"timestamp", "mgm", "entity_type", "id", "name", "estimator", "read_bytes_per_second", "write_bytes_per_second"})
+		for _, r := range rows {
+			w.Write([]string{r.Timestamp, r.MGM, r.EntityType, r.ID, r.Name, r.Estimator,
+				strconv.FormatFloat(r.Read, 'f', -1, 64), strconv.FormatFloat(r.Write, 'f', -1, 64)})
+		}
+		w.Flush()
+	default:
+		return nil, fmt.Errorf("unsupported format %q (expected json or csv)", format)
+	}
+	return buf.Bytes(), nil
+}
+
+// write creates path with b, under a temporary name until complete.
+func (s *snapshotter) write(path string, b []byte) error {
+	tmp, err := os.CreateTemp(s.dir, ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifySnapshot does nothing, there being no SIGUSR1 to request snapshots.
+func notifySnapshot(chan<- os.Signal) {}
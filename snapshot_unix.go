@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+
+	"golang.org/x/sys/unix"
+)
+
+// notifySnapshot relays the snapshot requests, SIGUSR1, to c.
+func notifySnapshot(c chan<- os.Signal) {
+	signal.Notify(c, unix.SIGUSR1)
+}
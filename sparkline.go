@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// sparkBlocks are the levels of the sparklines, lowest first.
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// maxSparkWidth is the most columns a sparkline takes.
+const maxSparkWidth = 60
+
+// throughputHistory keeps the cluster read and write rates of the reports of
+// the last window, drawn as sparklines at the top of the console. The rate
+// of a direction is the sum over the entity type with the most traffic on
+// estimator, the types being different views of the same traffic.
+type throughputHistory struct {
+	window    time.Duration
+	estimator string
+	samples   []throughputSample // oldest first
+}
+
+type throughputSample struct {
+	ts          time.Time
+	read, write float64
+}
+
+func newThroughputHistory(window time.Duration, estimator string) (*throughputHistory, error) {
+	if _, err := parseEstimator(estimator); err != nil {
+		return nil, err
+	}
+	return &throughputHistory{window: window, estimator: estimator}, nil
+}
+
+// Update adds the rates of report and returns a copy of the history.
+func (h *throughputHistory) Update(report *pb.TrafficShapingRateResponse) []throughputSample {
+	sums := make(map[string][2]float64)
+	for _, e := range reportEntities(report) {
+		for _, s := range e.Stats {
+			if s.Window.String() == h.estimator {
+				sum := sums[e.Type]
+				sums[e.Type] = [2]float64{sum[0] + s.BytesReadPerSec, sum[1] + s.BytesWrittenPerSec}
+			}
+		}
+	}
+	sample := throughputSample{ts: time.UnixMilli(report.TimestampMs)}
+	for _, sum := range sums {
+		sample.read = max(sample.read, sum[0])
+		sample.write = max(sample.write, sum[1])
+	}
+
+	i := 0
+	for i < len(h.samples) && sample.ts.Sub(h.samples[i].ts) > h.window {
+		i++
+	}
+	h.samples = append(h.samples[i:], sample)
+	return append([]throughputSample(nil), h.samples...)
+}
+
+// printSparklines prints the read and write sparklines of samples, fitting
+// width if positive, with the latest and highest rates.
+func printSparklines(out io.Writer, samples []throughputSample, width int) {
+	if len(samples) == 0 {
+		return
+	}
+	columns := maxSparkWidth
+	if width > 0 {
+		columns = min(columns, width-45) // room for the label and the rates
+	}
+	if columns < 10 {
+		return
+	}
+	last := samples[len(samples)-1]
+	read := make([]float64, len(samples))
+	write := make([]float64, len(samples))
+	for i, s := range samples {
+		read[i], write[i] = s.read, s.write
+	}
+	readLine, readMax := sparkline(read, columns)
+	writeLine, writeMax := sparkline(write, columns)
+	fmt.Fprintf(out, "Read  %s %s/s (max %s/s)\n", readLine, humanizeBytes(last.read), humanizeBytes(readMax))
+	fmt.Fprintf(out, "Write %s %s/s (max %s/s)\n", writeLine, humanizeBytes(last.write), humanizeBytes(writeMax))
+	fmt.Fprintln(out)
+}
+
+// sparkline draws values in at most columns blocks, averaging consecutive
+// values into each, scaled to the highest one, which it also returns.
+func sparkline(values []float64, columns int) (string, float64) {
+	n := min(len(values), columns)
+	avg := make([]float64, n)
+	var highest float64
+	for i := range avg {
+		chunk := values[i*len(values)/n : (i+1)*len(values)/n]
+		for _, v := range chunk {
+			avg[i] += v
+			highest = max(highest, v)
+		}
+		avg[i] /= float64(len(chunk))
+	}
+
+	var b strings.Builder
+	for _, v := range avg {
+		level := 0
+		if highest > 0 {
+			level = min(int(v/highest*float64(len(sparkBlocks))), len(sparkBlocks)-1)
+		}
+		b.WriteRune(sparkBlocks[level])
+	}
+	return b.String(), highest
+}
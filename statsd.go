@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// statsdSink emits the rates as StatsD gauges over UDP or a Unix datagram
+// socket, packing as many as fit in a datagram. With the dogstatsd flavor
+// the entity, estimator and MGM are tags:
+//
+//	eos.io.read_bytes_per_second:1.2e+08|g|#entity_type:app,id:rucio,estimator:SMA_5_SECONDS,mgm:mgm
+//
+// Plain StatsD has no tags, so they become path nodes instead:
+//
+//	eos.io.app.rucio.SMA_5_SECONDS.read_bytes_per_second:1.2e+08|g
+//
+// Datagrams are fire and forget; a missing agent loses the gauges rather
+// than stalling the monitor.
+type statsdSink struct {
+	conn    net.Conn
+	dog     bool
+	prefix  string
+	tags    string // constant tags, "" or starting with ","
+	mgm     string
+	maxSize int
+}
+
+// newStatsDSink connects to address, udp://host:port or unix:///path (a
+// host:port is taken as UDP).
+func newStatsDSink(address, flavor, prefix string, tags []string, mgm string) (*statsdSink, error) {
+	if flavor != "statsd" && flavor != "dogstatsd" {
+		return nil, fmt.Errorf("unsupported StatsD flavor %q (expected statsd or dogstatsd)", flavor)
+	}
+	if len(tags) > 0 && flavor != "dogstatsd" {
+		return nil, fmt.Errorf("tags need the dogstatsd flavor")
+	}
+	network, addr, maxSize := "udp", address, 1432
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "udp":
+			addr = u.Host
+		case "unix", "unixgram":
+			// Unix sockets don't fragment; 8KB is what the Datadog agent
+			// accepts by default.
+			network, addr, maxSize = "unixgram", u.Path, 8192
+		default:
+			return nil, fmt.Errorf("StatsD address must be udp://host:port or unix:///path, got %q", address)
+		}
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &statsdSink{conn: conn, dog: flavor == "dogstatsd", prefix: prefix, mgm: mgm, maxSize: maxSize}
+	for _, t := range tags {
+		s.tags += "," + t
+	}
+	return s, nil
+}
+
+var (
+	statsdNodeEscaper = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+	statsdTagEscaper  = strings.NewReplacer("|", "_", "#", "_", ",", "_", "\n", "_")
+)
+
+func (s *statsdSink) Send(report *pb.TrafficShapingRateResponse) error {
+	var packet, line bytes.Buffer
+	var sent, failed int
+	var lastErr error
+	flush := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := s.conn.Write(packet.Bytes()); err != nil {
+			failed++
+			lastErr = err
+		}
+		sent++
+		packet.Reset()
+	}
+	gauge := func(e entity, estimator, name string, v float64) {
+		line.Reset()
+		line.WriteString(s.prefix)
+		if !s.dog {
+			fmt.Fprintf(&line, "io.%s.%s.%s.", statsdNodeEscaper.Replace(e.Type), statsdNodeEscaper.Replace(e.ID), estimator)
+		} else {
+			line.WriteString("io.")
+		}
+		line.WriteString(name)
+		line.WriteByte(':')
+		line.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+		line.WriteString("|g")
+		if s.dog {
+			fmt.Fprintf(&line, "|#entity_type:%s,id:%s,estimator:%s,mgm:%s%s",
+				e.Type, statsdTagEscaper.Replace(e.ID), estimator, s.mgm, s.tags)
+		}
+		if packet.Len() > 0 && packet.Len()+1+line.Len() > s.maxSize {
+			flush()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.Write(line.Bytes())
+	}
+
+	for _, e := range reportEntities(report) {
+		for _, st := range e.Stats {
+			est := st.Window.String()
+			gauge(e, est, "read_bytes_per_second", st.BytesReadPerSec)
+			gauge(e, est, "write_bytes_per_second", st.BytesWrittenPerSec)
+		}
+	}
+	flush()
+	if failed > 0 {
+		return fmt.Errorf("StatsD: %d of %d datagrams failed: %w", failed, sent, lastErr)
+	}
+	return nil
+}
+
+func (s *statsdSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// The local store keeps the history of the per-entity rates of one estimator
+// in a directory, one append-only file per UTC day:
+//
+//	2024-05-01.tsv      samples taken every store interval
+//	2024-04-20.10m.tsv  the same, averaged over 10 minutes
+//
+// Each line is a sample of one entity:
+//
+//	<timestamp ms>\t<seconds covered>\t<entity type>\t<id>\t<read B/s>\t<write B/s>
+//
+// Once a day is older than the downsampling age its file is rewritten at
+// 10 minute resolution, and once it is older than the retention it is
+// removed. The query subcommand answers questions such as "top writers
+// yesterday between 14:00 and 15:00" from these files.
+
+const (
+	storeRawSuffix   = ".tsv"
+	storeDownSuffix  = ".10m.tsv"
+	storeDownsampled = 10 * time.Minute
+	storeDayLayout   = "2006-01-02"
+)
+
+// storeSink appends the rates of every store interval to the day file.
+type storeSink struct {
+	dir             string
+	estimator       string
+	interval        time.Duration
+	retention       time.Duration
+	downsampleAfter time.Duration
+	maxGap          time.Duration
+
+	last time.Time // of the last stored report
+	day  string
+	file *os.File
+	w    *bufio.Writer
+}
+
+// newStoreSink stores the rates of estimator in dir every interval. The
+// span of a sample is the time since the previous one, or the interval when
+// it exceeds the interval by more than maxGap, as after a reconnection.
+func newStoreSink(dir, estimator string, interval, retention, downsampleAfter, maxGap time.Duration) (*storeSink, error) {
+	if _, err := parseEstimator(estimator); err != nil {
+		return nil, err
+	}
+	if retention <= 0 || downsampleAfter <= 0 || maxGap <= 0 {
+		return nil, errors.New("store retention, downsampling age and maximum gap must be positive")
+	}
+	if interval < time.Second {
+		return nil, fmt.Errorf("store interval must be at least 1s, got %s", interval)
+	}
+	if interval > storeDownsampled {
+		return nil, fmt.Errorf("store interval must be at most %s, got %s", storeDownsampled, interval)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &storeSink{dir: dir, estimator: estimator, interval: interval, retention: retention, downsampleAfter: downsampleAfter, maxGap: maxGap}
+	if err := s.maintain(time.Now()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *storeSink) Send(report *pb.TrafficShapingRateResponse) error {
+	ts := time.UnixMilli(report.TimestampMs)
+	gap := ts.Sub(s.last)
+	if gap < s.interval {
+		return nil
+	}
+	if s.last.IsZero() || gap > s.interval+s.maxGap {
+		gap = s.interval
+	}
+	s.last = ts
+
+	if day := ts.UTC().Format(storeDayLayout); day != s.day {
+		if err := s.closeDay(); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(filepath.Join(s.dir, day+storeRawSuffix), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return fmt.Errorf("store: %w", err)
+		}
+		s.day, s.file, s.w = day, f, bufio.NewWriter(f)
+		if err := s.maintain(ts); err != nil {
+			log.Printf("Store: %v", err)
+		}
+	}
+
+	span := max(1, int(gap.Round(time.Second)/time.Second))
+	for _, e := range reportEntities(report) {
+		for _, st := range e.Stats {
+			if st.Window.String() != s.estimator {
+				continue
+			}
+			writeStoreSample(s.w, storeSample{
+				ts: ts, span: span, entity: entityKey{e.Type, e.ID},
+				read: st.BytesReadPerSec, write: st.BytesWrittenPerSec,
+			})
+		}
+	}
+	if err := s.w.Flush(); err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	return nil
+}
+
+func (s *storeSink) closeDay() error {
+	if s.file == nil {
+		return nil
+	}
+	err := errors.Join(s.w.Flush(), s.file.Close())
+	s.day, s.file, s.w = "", nil, nil
+	return err
+}
+
+func (s *storeSink) Close() error {
+	return s.closeDay()
+}
+
+// maintain applies the retention and downsampling to the day files as of now.
+func (s *storeSink) maintain(now time.Time) error {
+	files, err := storeFiles(s.dir)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, f := range files {
+		end := f.day.Add(24 * time.Hour)
+		switch {
+		case now.Sub(end) > s.retention:
+			errs = append(errs, os.Remove(f.path))
+		case !f.downsampled && now.Sub(end) > s.downsampleAfter:
+			errs = append(errs, downsampleStoreFile(f.path, f.day))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type storeSample struct {
+	ts          time.Time
+	span        int // seconds
+	entity      entityKey
+	read, write float64
+}
+
+func writeStoreSample(w io.Writer, s storeSample) {
+	fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\n", s.ts.UnixMilli(), s.span, s.entity.Type, s.entity.ID,
+		strconv.FormatFloat(s.read, 'g', -1, 64), strconv.FormatFloat(s.write, 'g', -1, 64))
+}
+
+func parseStoreSample(line string) (storeSample, error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) != 6 {
+		return storeSample{}, fmt.Errorf("expected 6 fields, got %d", len(fields))
+	}
+	ms, err1 := strconv.ParseInt(fields[0], 10, 64)
+	span, err2 := strconv.Atoi(fields[1])
+	read, err3 := strconv.ParseFloat(fields[4], 64)
+	write, err4 := strconv.ParseFloat(fields[5], 64)
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return storeSample{}, err
+	}
+	return storeSample{
+		ts:     time.UnixMilli(ms),
+		span:   span,
+		entity: entityKey{fields[2], fields[3]},
+		read:   read,
+		write:  write,
+	}, nil
+}
+
+// readStoreFile calls fn with every sample of a day file. A truncated last
+// line, as left by a crash, is skipped.
+func readStoreFile(path string, fn func(storeSample)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		s, err := parseStoreSample(scanner.Text())
+		if err != nil {
+			log.Printf("%s:%d: skipping sample: %v", path, n, err)
+			continue
+		}
+		fn(s)
+	}
+	return scanner.Err()
+}
+
+type storeFile struct {
+	path        string
+	day         time.Time
+	downsampled bool
+}
+
+// storeFiles lists the day files in dir, oldest first.
+func storeFiles(dir string) ([]storeFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []storeFile
+	for _, e := range entries {
+		name := e.Name()
+		downsampled := strings.HasSuffix(name, storeDownSuffix)
+		day, err := time.Parse(storeDayLayout, strings.TrimSuffix(strings.TrimSuffix(name, storeDownSuffix), storeRawSuffix))
+		if e.IsDir() || !strings.HasSuffix(name, storeRawSuffix) || err != nil {
+			continue
+		}
+		files = append(files, storeFile{path: filepath.Join(dir, name), day: day, downsampled: downsampled})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].day.Before(files[j].day) })
+	return files, nil
+}
+
+// downsampleStoreFile replaces a raw day file by one with the time-weighted
+// mean rate of every entity in each 10 minute slot.
+func downsampleStoreFile(path string, day time.Time) error {
+	type slot struct {
+		start  int64 // unix seconds
+		entity entityKey
+	}
+	type sums struct {
+		span        int
+		read, write float64
+	}
+	slots := make(map[slot]*sums)
+	err := readStoreFile(path, func(s storeSample) {
+		k := slot{s.ts.Unix() / int64(storeDownsampled/time.Second) * int64(storeDownsampled/time.Second), s.entity}
+		v := slots[k]
+		if v == nil {
+			v = &sums{}
+			slots[k] = v
+		}
+		v.span += s.span
+		v.read += s.read * float64(s.span)
+		v.write += s.write * float64(s.span)
+	})
+	if err != nil {
+		return err
+	}
+
+	keys := make([]slot, 0, len(slots))
+	for k := range slots {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].start != keys[j].start {
+			return keys[i].start < keys[j].start
+		}
+		if keys[i].entity.Type != keys[j].entity.Type {
+			return keys[i].entity.Type < keys[j].entity.Type
+		}
+		return keys[i].entity.ID < keys[j].entity.ID
+	})
+
+	out := filepath.Join(filepath.Dir(path), day.Format(storeDayLayout)+storeDownSuffix)
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".downsample-*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, k := range keys {
+		v := slots[k]
+		if v.span <= 0 {
+			continue // only samples without a span, which cover nothing
+		}
+		// The slot covers at most 10 minutes; a longer summed span means
+		// samples were taken more often than the span they claim.
+		span := min(v.span, int(storeDownsampled/time.Second))
+		writeStoreSample(w, storeSample{
+			ts: time.Unix(k.start, 0), span: span, entity: k.entity,
+			read: v.read / float64(v.span), write: v.write / float64(v.span),
+		})
+	}
+	if err := errors.Join(w.Flush(), tmp.Close()); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), out); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Remove(path)
+}
+
+// --- query subcommand ---
+
+func runQuery(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	dir := fs.String("store", "", "Directory of the local store (-store-dir of the monitor)")
+	day := fs.String("day", "today", "Day of time-of-day bounds: today, yesterday or YYYY-MM-DD")
+	from := fs.String("from", "00:00", "Start of the range (RFC3339, or 15:04[:05] on -day)")
+	to := fs.String("to", "", "End of the range (same formats as -from; default: end of -day)")
+	eType := fs.String("type", "user", "Entity type (app, user or group)")
+	id := fs.String("id", "", "Show the samples of this entity instead of the top entities")
+	direction := fs.String("direction", "total", "Rate to rank by (read, write or total)")
+	top := fs.Int("top", 10, "Number of entities to list")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s query -store DIR [flags]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Lists the entities of a type with the most traffic in a time range of the")
+		fmt.Fprintln(fs.Output(), "local store, or with -id the samples of one entity, e.g. the top writers")
+		fmt.Fprintln(fs.Output(), "yesterday between 14:00 and 15:00:")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintf(fs.Output(), "  %s query -store DIR -day yesterday -from 14:00 -to 15:00 -direction write\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if *dir == "" || fs.NArg() != 0 || !validEntityType(*eType) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	switch *direction {
+	case "read", "write", "total":
+	default:
+		log.Fatalf("Invalid -direction %q (expected read, write or total)", *direction)
+	}
+
+	ref, err := parseQueryDay(*day, time.Now())
+	if err != nil {
+		log.Fatalf("Invalid -day: %v", err)
+	}
+	start, err := parseSliceBound(*from, ref)
+	if err != nil {
+		log.Fatalf("Invalid -from: %v", err)
+	}
+	end := ref.AddDate(0, 0, 1)
+	if *to != "" {
+		if end, err = parseSliceBound(*to, ref); err != nil {
+			log.Fatalf("Invalid -to: %v", err)
+		}
+	}
+	if !end.After(start) {
+		log.Fatal("-to must be after -from")
+	}
+
+	if *id != "" {
+		err = queryEntity(os.Stdout, *dir, entityKey{*eType, *id}, start, end)
+	} else {
+		err = queryTop(os.Stdout, *dir, *eType, *direction, *top, start, end)
+	}
+	if err != nil {
+		log.Fatalf("Error querying store: %v", err)
+	}
+}
+
+// parseQueryDay returns the local midnight of the day spec.
+func parseQueryDay(spec string, now time.Time) (time.Time, error) {
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	switch spec {
+	case "today":
+		return today, nil
+	case "yesterday":
+		return today.AddDate(0, 0, -1), nil
+	}
+	return time.ParseInLocation(storeDayLayout, spec, now.Location())
+}
+
+// scanStore calls fn with every stored sample in [start, end).
+func scanStore(dir string, start, end time.Time, fn func(storeSample)) error {
+	files, err := storeFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !f.day.Before(end) || !f.day.Add(24*time.Hour).After(start) {
+			continue
+		}
+		err := readStoreFile(f.path, func(s storeSample) {
+			if !s.ts.Before(start) && s.ts.Before(end) {
+				fn(s)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entityTraffic accumulates the samples of one entity in the query range.
+type entityTraffic struct {
+	id                    string
+	readBytes, writeBytes float64
+	peakRead, peakWrite   float64
+}
+
+func (t *entityTraffic) bytes(direction string) float64 {
+	switch direction {
+	case "read":
+		return t.readBytes
+	case "write":
+		return t.writeBytes
+	}
+	return t.readBytes + t.writeBytes
+}
+
+func queryTop(out io.Writer, dir, eType, direction string, top int, start, end time.Time) error {
+	traffic := make(map[string]*entityTraffic)
+	err := scanStore(dir, start, end, func(s storeSample) {
+		if s.entity.Type != eType {
+			return
+		}
+		t := traffic[s.entity.ID]
+		if t == nil {
+			t = &entityTraffic{id: s.entity.ID}
+			traffic[s.entity.ID] = t
+		}
+		t.readBytes += s.read * float64(s.span)
+		t.writeBytes += s.write * float64(s.span)
+		t.peakRead = max(t.peakRead, s.read)
+		t.peakWrite = max(t.peakWrite, s.write)
+	})
+	if err != nil {
+		return err
+	}
+
+	list := make([]*entityTraffic, 0, len(traffic))
+	for _, t := range traffic {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if bi, bj := list[i].bytes(direction), list[j].bytes(direction); bi != bj {
+			return bi > bj
+		}
+		return list[i].id < list[j].id
+	})
+	if len(list) > top {
+		list = list[:top]
+	}
+
+	seconds := end.Sub(start).Seconds()
+	fmt.Fprintf(out, "Top %s by %s traffic, %s - %s\n\n", eType, direction, start.Format(time.RFC3339), end.Format(time.RFC3339))
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "ID\tRead\tWrite\tMean Read/s\tMean Write/s\tPeak Read/s\tPeak Write/s")
+	for _, t := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t.id,
+			humanizeBytes(t.readBytes), humanizeBytes(t.writeBytes),
+			humanizeBytes(t.readBytes/seconds), humanizeBytes(t.writeBytes/seconds),
+			humanizeBytes(t.peakRead), humanizeBytes(t.peakWrite))
+	}
+	return w.Flush()
+}
+
+func queryEntity(out io.Writer, dir string, key entityKey, start, end time.Time) error {
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "Time\tSpan\tRead/s\tWrite/s")
+	n := 0
+	err := scanStore(dir, start, end, func(s storeSample) {
+		if s.entity != key {
+			return
+		}
+		n++
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.ts.Format(time.RFC3339), time.Duration(s.span)*time.Second,
+			humanizeBytes(s.read), humanizeBytes(s.write))
+	})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		fmt.Fprintf(out, "No samples of %s %s between %s and %s.\n", key.Type, key.ID, start.Format(time.RFC3339), end.Format(time.RFC3339))
+		return nil
+	}
+	return w.Flush()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+func TestStoreSampleRoundTrip(t *testing.T) {
+	want := storeSample{
+		ts:     time.UnixMilli(1714567890123),
+		span:   60,
+		entity: entityKey{"app", "rucio-download"},
+		read:   1.5e8,
+		write:  0.25,
+	}
+	var buf bytes.Buffer
+	writeStoreSample(&buf, want)
+	got, err := parseStoreSample(strings.TrimSuffix(buf.String(), "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.ts.Equal(want.ts) || got.span != want.span || got.entity != want.entity || got.read != want.read || got.write != want.write {
+		t.Errorf("round trip of %+v gave %+v", want, got)
+	}
+
+	for _, line := range []string{
+		"",
+		"1714567890123\t60\tapp\trucio",
+		"1714567890123\t60\tapp\trucio\t1\t2\t3",
+		"x\t60\tapp\trucio\t1\t2",
+		"1714567890123\t1.5\tapp\trucio\t1\t2",
+		"1714567890123\t60\tapp\trucio\tfast\t2",
+	} {
+		if _, err := parseStoreSample(line); err == nil {
+			t.Errorf("parseStoreSample(%q) succeeded", line)
+		}
+	}
+}
+
+func TestDownsampleStoreFile(t *testing.T) {
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return day.Add(d) }
+	user1, user2, app := entityKey{"user", "1"}, entityKey{"user", "2"}, entityKey{"app", "x"}
+	samples := []storeSample{
+		// Time-weighted: (100*60 + 400*30) / 90 = 200.
+		{ts: at(0), span: 60, entity: user1, read: 100},
+		{ts: at(time.Minute), span: 30, entity: user1, read: 400, write: 90},
+		{ts: at(5 * time.Minute), span: 60, entity: app, write: 50},
+		// Next slot.
+		{ts: at(10 * time.Minute), span: 60, entity: user1, read: 10},
+		// Spans longer than the slot are capped, the mean still weighted.
+		{ts: at(20 * time.Minute), span: 600, entity: user2, read: 1},
+		{ts: at(25 * time.Minute), span: 600, entity: user2, read: 3},
+		// Samples without a span cover nothing.
+		{ts: at(30 * time.Minute), span: 0, entity: user2, read: 5},
+	}
+	want := []storeSample{
+		{ts: at(0), span: 60, entity: app, write: 50},
+		{ts: at(0), span: 90, entity: user1, read: 200, write: 30},
+		{ts: at(10 * time.Minute), span: 60, entity: user1, read: 10},
+		{ts: at(20 * time.Minute), span: 600, entity: user2, read: 2},
+	}
+
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "2024-05-01"+storeRawSuffix)
+	var buf bytes.Buffer
+	for _, s := range samples {
+		writeStoreSample(&buf, s)
+	}
+	if err := os.WriteFile(raw, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := downsampleStoreFile(raw, day); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(raw); !os.IsNotExist(err) {
+		t.Errorf("raw file not removed: %v", err)
+	}
+
+	var got []storeSample
+	if err := readStoreFile(filepath.Join(dir, "2024-05-01"+storeDownSuffix), func(s storeSample) { got = append(got, s) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d samples, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if !g.ts.Equal(w.ts) || g.span != w.span || g.entity != w.entity || g.read != w.read || g.write != w.write {
+			t.Errorf("sample %d = %+v, want %+v", i, g, w)
+		}
+	}
+}
+
+func TestStoreSinkSpan(t *testing.T) {
+	for _, interval := range []time.Duration{0, 500 * time.Millisecond, 11 * time.Minute} {
+		if _, err := newStoreSink(t.TempDir(), "SMA_1_MINUTES", interval, 24*time.Hour, time.Hour, 10*time.Second); err == nil {
+			t.Errorf("interval %s accepted", interval)
+		}
+	}
+
+	dir := t.TempDir()
+	s, err := newStoreSink(dir, "SMA_1_MINUTES", 2*time.Second, 24*time.Hour, time.Hour, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().UTC().Truncate(24 * time.Hour).Add(time.Hour)
+	// The first sample covers one interval, the next ones the time since the
+	// previous sample unless it exceeds the interval by more than maxGap.
+	offsets := []time.Duration{0, time.Second, 3 * time.Second, 60 * time.Second, 62500 * time.Millisecond}
+	for _, d := range offsets {
+		err := s.Send(&pb.TrafficShapingRateResponse{
+			TimestampMs: start.Add(d).UnixMilli(),
+			UserStats: []*pb.UserRateEntry{{Uid: 1, Stats: []*pb.RateStats{
+				{Window: pb.TrafficShapingRateRequest_SMA_1_MINUTES, BytesReadPerSec: 100},
+				{Window: pb.TrafficShapingRateRequest_SMA_5_SECONDS, BytesReadPerSec: 1},
+			}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var spans []int
+	err = readStoreFile(filepath.Join(dir, start.Format(storeDayLayout)+storeRawSuffix), func(s storeSample) {
+		spans = append(spans, s.span)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{2, 3, 2, 3}; !slices.Equal(spans, want) {
+		t.Errorf("spans = %v, want %v", spans, want)
+	}
+}
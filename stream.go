@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// reportStream re-broadcasts every report on /stream, in the JSON of
+// /api/v1/snapshot, to any number of clients, so browsers and scripts can
+// follow the single MGM stream without opening their own. Clients get
+// Server-Sent Events, or WebSocket text messages if they ask for an upgrade;
+// ?type=app|user|group restricts the reports to one entity type.
+//
+// Reports are only encoded for the variants that have clients.
+type reportStream struct {
+	hubs map[string]*eventHub // by entity type, "" for the whole report
+
+	mu     sync.Mutex
+	report *pb.TrafficShapingRateResponse
+}
+
+func newReportStream() *reportStream {
+	s := &reportStream{hubs: make(map[string]*eventHub)}
+	for _, eType := range []string{"", "app", "user", "group"} {
+		s.hubs[eType] = newEventHub()
+	}
+	return s
+}
+
+func (s *reportStream) register(mux *http.ServeMux) {
+	mux.HandleFunc("/stream", s.serve)
+}
+
+// Update sends report to the connected clients.
+func (s *reportStream) Update(report *pb.TrafficShapingRateResponse) {
+	s.mu.Lock()
+	s.report = report
+	s.mu.Unlock()
+	for eType, hub := range s.hubs {
+		if hub.Clients() == 0 {
+			hub.Publish(nil)
+			continue
+		}
+		b, err := protojson.Marshal(filterReport(report, eType))
+		if err != nil {
+			log.Printf("Stream: %v", err)
+			continue
+		}
+		hub.Publish(b)
+	}
+}
+
+func (s *reportStream) serve(w http.ResponseWriter, r *http.Request) {
+	eType := r.URL.Query().Get("type")
+	if eType != "" && !validEntityType(eType) {
+		http.Error(w, fmt.Sprintf("type must be app, user or group, got %q", eType), http.StatusBadRequest)
+		return
+	}
+	hub := s.hubs[eType]
+
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		hub.serveEvents(w, r, func() []byte { return s.latest(eType) })
+		return
+	}
+	// The stream is as public as /metrics, so any origin may connect;
+	// websocket.Server, unlike websocket.Handler, doesn't check it.
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		c, latest := hub.subscribe()
+		defer hub.unsubscribe(c)
+		if latest == nil {
+			latest = s.latest(eType)
+		}
+
+		closed := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, ws)
+			close(closed)
+		}()
+		if latest != nil {
+			if err := websocket.Message.Send(ws, string(latest)); err != nil {
+				return
+			}
+		}
+		for {
+			select {
+			case <-closed:
+				return
+			case msg := <-c:
+				if err := websocket.Message.Send(ws, string(msg)); err != nil {
+					return
+				}
+			}
+		}
+	}}.ServeHTTP(w, r)
+}
+
+// latest encodes the last report for a client that connects before the
+// variant it asked for has been encoded.
+func (s *reportStream) latest(eType string) []byte {
+	s.mu.Lock()
+	report := s.report
+	s.mu.Unlock()
+	if report == nil {
+		return nil
+	}
+	b, err := protojson.Marshal(filterReport(report, eType))
+	if err != nil {
+		log.Printf("Stream: %v", err)
+		return nil
+	}
+	return b
+}
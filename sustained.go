@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+var (
+	sustainedViolation = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_io_sustained_violation",
+			Help: "1 while an entity is in sustained violation of the -sustained-rate threshold",
+		},
+		[]string{"entity_type", "id", "direction"},
+	)
+	sustainedViolations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "eos_io_sustained_violations_total",
+			Help: "Sustained violations of the -sustained-rate threshold that started",
+		},
+		[]string{"entity_type", "direction"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sustainedViolation, sustainedViolations)
+}
+
+// sustainedDetector flags the entities whose rate stays at or above a
+// threshold, with hysteresis so transient spikes and dips don't flap: a
+// violation starts after enter consecutive reports at or above the
+// threshold and only clears after leave consecutive reports below it. An
+// entity missing from a report counts as below.
+type sustainedDetector struct {
+	threshold float64
+	estimator string
+	direction string // read, write or total
+	enter     int
+	leave     int
+
+	states map[entityKey]*sustainedState
+}
+
+type sustainedState struct {
+	above, below int // consecutive reports
+	violating    bool
+}
+
+func newSustainedDetector(threshold float64, estimator, direction string, enter, leave int) (*sustainedDetector, error) {
+	if _, err := parseEstimator(estimator); err != nil {
+		return nil, err
+	}
+	switch direction {
+	case "read", "write", "total":
+	default:
+		return nil, errors.New("the direction must be read, write or total")
+	}
+	if threshold <= 0 || enter < 1 || leave < 1 {
+		return nil, errors.New("the threshold and the report counts must be positive")
+	}
+	return &sustainedDetector{
+		threshold: threshold,
+		estimator: estimator,
+		direction: direction,
+		enter:     enter,
+		leave:     leave,
+		states:    make(map[entityKey]*sustainedState),
+	}, nil
+}
+
+// Update advances the state of every entity with report and exports the
+// violations.
+func (d *sustainedDetector) Update(report *pb.TrafficShapingRateResponse) {
+	above := make(map[entityKey]float64)
+	for _, e := range reportEntities(report) {
+		s, ok := sampleOf(e.Stats, d.estimator)
+		if !ok {
+			continue
+		}
+		rate := s.read + s.write
+		switch d.direction {
+		case "read":
+			rate = s.read
+		case "write":
+			rate = s.write
+		}
+		if rate >= d.threshold {
+			above[entityKey{e.Type, e.ID}] = rate
+		}
+	}
+
+	for key, rate := range above {
+		st := d.states[key]
+		if st == nil {
+			st = &sustainedState{}
+			d.states[key] = st
+		}
+		st.above++
+		st.below = 0
+		if !st.violating && st.above >= d.enter {
+			st.violating = true
+			sustainedViolation.WithLabelValues(key.Type, key.ID, d.direction).Set(1)
+			sustainedViolations.WithLabelValues(key.Type, d.direction).Inc()
+			log.Printf("Sustained violation: %s %s %s rate %s/s for %d reports", key.Type, key.ID, d.direction, humanizeBytes(rate), st.above)
+		}
+	}
+	for key, st := range d.states {
+		if _, ok := above[key]; ok {
+			continue
+		}
+		st.above = 0
+		st.below++
+		if !st.violating {
+			delete(d.states, key)
+		} else if st.below >= d.leave {
+			delete(d.states, key)
+			sustainedViolation.DeleteLabelValues(key.Type, key.ID, d.direction)
+			log.Printf("Sustained violation cleared: %s %s %s rate below %s/s for %d reports", key.Type, key.ID, d.direction, humanizeBytes(d.threshold), st.below)
+		}
+	}
+}
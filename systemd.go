@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// systemdNotifier implements the sd_notify protocol for units of
+// Type=notify: the service is reported ready once the first report arrives,
+// its status shows the latest totals in systemctl status, and with
+// WatchdogSec= every report pets the watchdog, so systemd restarts a
+// monitor whose stream silently stalled.
+type systemdNotifier struct {
+	conn     net.Conn
+	watchdog time.Duration // 0 if not enabled
+
+	ready   bool
+	lastPet time.Time
+}
+
+// newSystemdNotifier connects to $NOTIFY_SOCKET, returning nil if the
+// monitor doesn't run under systemd with Type=notify.
+func newSystemdNotifier() (*systemdNotifier, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:] // abstract socket
+	}
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		return nil, err
+	}
+	n := &systemdNotifier{conn: conn}
+	usec, _ := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	pid := os.Getenv("WATCHDOG_PID")
+	if usec > 0 && (pid == "" || pid == strconv.Itoa(os.Getpid())) {
+		n.watchdog = time.Duration(usec) * time.Microsecond
+	}
+	return n, nil
+}
+
+// Report notifies systemd of a report, whose summary becomes the status.
+// The watchdog is petted at most every half of its timeout.
+func (n *systemdNotifier) Report(status string) {
+	var msg []byte
+	if !n.ready {
+		msg = append(msg, "READY=1\n"...)
+		n.ready = true
+	}
+	if n.watchdog > 0 && time.Since(n.lastPet) >= n.watchdog/2 {
+		msg = append(msg, "WATCHDOG=1\n"...)
+		n.lastPet = time.Now()
+	}
+	msg = append(msg, "STATUS="+status...)
+	n.conn.Write(msg)
+}
+
+// Stopping tells systemd the monitor is shutting down.
+func (n *systemdNotifier) Stopping() {
+	n.conn.Write([]byte("STOPPING=1"))
+	n.conn.Close()
+}
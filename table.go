@@ -0,0 +1,300 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// columnHeaders are the headers of the columns the console tables can show
+// after the id of the entities.
+var columnHeaders = map[string]string{
+	"name":      "Name",
+	"estimator": "Estimator",
+	"read":      "Read/s",
+	"write":     "Write/s",
+	"total":     "Total/s",
+	"ratio":     "Read%",
+	"trend":     "Trend",
+}
+
+func parseColumns(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, errors.New("at least one column is needed")
+	}
+	for _, name := range names {
+		if _, ok := columnHeaders[name]; !ok {
+			return nil, fmt.Errorf("unknown column %q (expected name, estimator, read, write, total, ratio or trend)", name)
+		}
+	}
+	return names, nil
+}
+
+// tableView holds how the console tables of a report are drawn.
+type tableView struct {
+	width   int                  // of the terminal, 0 for no limit
+	colors  *colorScheme         // nil for no colors
+	columns []string             // shown after the id, see columnHeaders
+	pivot   bool                 // one line per entity, estimators as columns
+	sortBy  string               // estimator of the trend when pivoted
+	trends  bool                 // whether to show the Trend column
+	prev    map[trendKey]float64 // rates of the previous report
+	search  consoleSearch        // whose matches are highlighted
+}
+
+// entityTable returns the console table of the rows of eType, with a line
+// per entity and estimator or, pivoted, per entity with a column per
+// estimator and rate. It also returns the style of every line and the
+// column shortened to fit the terminal: the names if shown, else the ids.
+func (v tableView) entityTable(idHeader, eType string, rows []entityRow, showNames bool) ([][]string, []string, int) {
+	var columns []string
+	for _, c := range v.columns {
+		if (c == "name" && !showNames) || (c == "trend" && !v.trends) || (c == "estimator" && v.pivot) {
+			continue
+		}
+		columns = append(columns, c)
+	}
+	flex := slices.Index(columns, "name") + 1
+
+	if !v.pivot {
+		header := []string{idHeader}
+		for _, c := range columns {
+			header = append(header, columnHeaders[c])
+		}
+		lines := 0
+		for _, row := range rows {
+			lines += len(row.Stats)
+		}
+		table, styles := newTable(header, lines)
+		for _, row := range rows {
+			for _, s := range row.Stats {
+				line := table.next()
+				line[0] = row.ID
+				for i, c := range columns {
+					line[i+1] = v.cell(c, eType, row, s)
+				}
+				styles = append(styles, v.style(row, s))
+			}
+		}
+		return table.rows, styles, flex
+	}
+
+	var estimators []string
+	for _, row := range rows {
+		for _, s := range row.Stats {
+			if !slices.Contains(estimators, s.Window.String()) {
+				estimators = append(estimators, s.Window.String())
+			}
+		}
+	}
+	header := []string{idHeader}
+	for _, c := range columns {
+		if c == "name" || c == "trend" {
+			header = append(header, columnHeaders[c])
+			continue
+		}
+		for _, e := range estimators {
+			header = append(header, columnHeaders[c]+" "+shortEstimator(e))
+		}
+	}
+	table, styles := newTable(header, len(rows))
+	byEstimator := make(map[string]*pb.RateStats, len(estimators))
+	for _, row := range rows {
+		clear(byEstimator)
+		for _, s := range row.Stats {
+			byEstimator[s.Window.String()] = s
+		}
+		line := table.next()
+		line[0] = row.ID
+		i := 1
+		for _, c := range columns {
+			if c == "name" || c == "trend" {
+				line[i] = v.cell(c, eType, row, byEstimator[v.sortBy])
+				i++
+				continue
+			}
+			for _, e := range estimators {
+				line[i] = v.cell(c, eType, row, byEstimator[e])
+				i++
+			}
+		}
+		style := ""
+		if s := byEstimator[v.sortBy]; s != nil {
+			style = v.style(row, s)
+		}
+		styles = append(styles, style)
+	}
+	return table.rows, styles, flex
+}
+
+// cellTable is a table of lines of as many cells as its header, all taken
+// from one array rather than allocated line by line.
+type cellTable struct {
+	rows  [][]string
+	cells []string
+	width int
+}
+
+// newTable returns a table with header and room for lines more lines, and
+// the slice of the styles of its lines, the header's included.
+func newTable(header []string, lines int) (*cellTable, []string) {
+	t := &cellTable{
+		rows:  make([][]string, 1, lines+1),
+		cells: make([]string, lines*len(header)),
+		width: len(header),
+	}
+	t.rows[0] = header
+	styles := make([]string, 1, lines+1)
+	return t, styles
+}
+
+// next appends a line to the table and returns its cells.
+func (t *cellTable) next() []string {
+	var line []string
+	if len(t.cells) >= t.width {
+		line, t.cells = t.cells[:t.width:t.width], t.cells[t.width:]
+	} else {
+		line = make([]string, t.width)
+	}
+	t.rows = append(t.rows, line)
+	return line
+}
+
+// style returns the ANSI style of the line of row for the rates s: bold
+// for the totals, by rate for the others, reversed if matching the search.
+func (v tableView) style(row entityRow, s *pb.RateStats) string {
+	if v.colors != nil && totalRow(row.ID) {
+		return ansiBold
+	}
+	if v.search.highlight(row) {
+		return ansiReverse + v.colors.style(s)
+	}
+	return v.colors.style(s)
+}
+
+// cell formats column c of row for the rates s, nil if the row has none
+// for the estimator.
+func (v tableView) cell(c, eType string, row entityRow, s *pb.RateStats) string {
+	if c == "name" {
+		return row.Name
+	}
+	if s == nil {
+		return "-"
+	}
+	switch c {
+	case "estimator":
+		return s.Window.String()
+	case "read":
+		return humanizeBytes(s.BytesReadPerSec)
+	case "write":
+		return humanizeBytes(s.BytesWrittenPerSec)
+	case "total":
+		return humanizeBytes(s.BytesReadPerSec + s.BytesWrittenPerSec)
+	case "ratio":
+		return readPercent(s)
+	case "trend":
+		return trendCell(v.prev, trendKey{eType, row.ID, s.Window.String()}, s.BytesReadPerSec+s.BytesWrittenPerSec)
+	}
+	return ""
+}
+
+// readPercent formats the share of the rates s that is read, - if idle.
+func readPercent(s *pb.RateStats) string {
+	total := s.BytesReadPerSec + s.BytesWrittenPerSec
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", 100*s.BytesReadPerSec/total)
+}
+
+// shortEstimator abbreviates an estimator name for the pivoted headers,
+// e.g. SMA_5_SECONDS to SMA 5s.
+func shortEstimator(name string) string {
+	parts := strings.Split(name, "_")
+	if len(parts) != 3 || parts[2] == "" {
+		return name
+	}
+	return parts[0] + " " + parts[1] + strings.ToLower(parts[2][:1])
+}
+
+// tablePadding is the space between the columns of the console tables.
+const tablePadding = 3
+
+// minFlexWidth is the width below which writeTable doesn't shorten cells.
+const minFlexWidth = 8
+
+// writeTable writes rows of cells, the header first, in aligned columns,
+// each row in its ANSI style if styles has one for it. If width is
+// positive and the table is wider, the cells of column flex, such as long
+// app names, are ellipsized to fit rather than letting the terminal wrap
+// the lines.
+func writeTable(out io.Writer, rows [][]string, styles []string, width, flex int) {
+	if len(rows) == 0 {
+		return
+	}
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+	total := (len(widths) - 1) * tablePadding
+	for _, w := range widths {
+		total += w
+	}
+	if over := total - width; width > 0 && over > 0 {
+		fit := max(widths[flex]-over, minFlexWidth)
+		for _, row := range rows {
+			row[flex] = ellipsize(row[flex], fit)
+		}
+		widths[flex] = min(widths[flex], fit)
+	}
+
+	var b []byte
+	for r, row := range rows {
+		start := len(b)
+		style := ""
+		if r < len(styles) {
+			style = styles[r]
+		}
+		b = append(b, style...)
+		for i, cell := range row {
+			b = append(b, cell...)
+			if i < len(row)-1 {
+				b = appendSpaces(b, widths[i]-utf8.RuneCountInString(cell)+tablePadding)
+			}
+		}
+		for len(b) > start+len(style) && b[len(b)-1] == ' ' {
+			b = b[:len(b)-1]
+		}
+		if style != "" {
+			b = append(b, ansiReset...)
+		}
+		b = append(b, '\n')
+	}
+	out.Write(b)
+}
+
+const spaces = "                                        "
+
+func appendSpaces(b []byte, n int) []byte {
+	for n > len(spaces) {
+		b = append(b, spaces...)
+		n -= len(spaces)
+	}
+	return append(b, spaces[:n]...)
+}
+
+// ellipsize shortens s to n runes, ending with … if anything was cut.
+func ellipsize(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	r := []rune(s)
+	return string(r[:n-1]) + "…"
+}
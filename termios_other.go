@@ -0,0 +1,11 @@
+//go:build aix || linux || solaris
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// The ioctls getting and setting the terminal attributes.
+const (
+	ioctlGetTermios = unix.TCGETS
+	ioctlSetTermios = unix.TCSETS
+)
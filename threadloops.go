@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+var (
+	threadLoopSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "eos_io_thread_loop_duration_seconds",
+			Help:    "Mean duration of the MGM thread loops, observed once per report",
+			Buckets: prometheus.ExponentialBuckets(100e-6, 2, 16), // 100µs to 3.3s
+		},
+		[]string{"loop_name"}, // fst_limits, estimators
+	)
+	threadLoopMaxSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_io_thread_loop_max_seconds",
+			Help: "Longest duration of the MGM thread loops reported over the thread loop window",
+		},
+		[]string{"loop_name"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(threadLoopSeconds, threadLoopMaxSeconds)
+}
+
+// threadLoopStats accumulates the stats of the MGM thread loops across
+// reports. Every report only carries the mean, min and max of its own
+// period, so the means are observed into a histogram for percentiles over
+// any range, and the maxima are kept for window so a spike stays visible
+// for longer than a scrape interval.
+type threadLoopStats struct {
+	window time.Duration
+	maxes  map[string][]loopMax // by loop, oldest first
+}
+
+type loopMax struct {
+	at  time.Time
+	max time.Duration
+}
+
+func newThreadLoopStats(window time.Duration) (*threadLoopStats, error) {
+	if window <= 0 {
+		return nil, errors.New("thread loop window must be positive")
+	}
+	return &threadLoopStats{window: window, maxes: make(map[string][]loopMax)}, nil
+}
+
+// Update records the stats of loop reported at ts, nil if the MGM omits
+// them, in which case the loop's metrics are removed.
+func (t *threadLoopStats) Update(loop string, stats *pb.ThreadLoopStats, ts time.Time) {
+	if stats == nil {
+		threadLoopSeconds.DeleteLabelValues(loop)
+		threadLoopMaxSeconds.DeleteLabelValues(loop)
+		delete(t.maxes, loop)
+		return
+	}
+	threadLoopSeconds.WithLabelValues(loop).Observe((time.Duration(stats.MeanElapsedTimeMicroSec) * time.Microsecond).Seconds())
+
+	maxes := append(t.maxes[loop], loopMax{at: ts, max: time.Duration(stats.MaxElapsedTimeMicroSec) * time.Microsecond})
+	i := 0
+	for i < len(maxes)-1 && ts.Sub(maxes[i].at) > t.window {
+		i++
+	}
+	maxes = maxes[i:]
+	t.maxes[loop] = maxes
+
+	var longest time.Duration
+	for _, m := range maxes {
+		longest = max(longest, m.max)
+	}
+	threadLoopMaxSeconds.WithLabelValues(loop).Set(longest.Seconds())
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// The totals of every report summarize the cluster IO in a handful of
+// series, so a single panel can show the overall rates and how concentrated
+// they are without summing thousands of per-entity series. They only cover
+// the entities the MGM reports, the top N of each type.
+
+var (
+	totalReadBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_io_total_read_bytes_per_second",
+			Help: "Read throughput summed over the reported entities of a type",
+		},
+		[]string{"entity_type", "estimator"},
+	)
+	totalWriteBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_io_total_write_bytes_per_second",
+			Help: "Write throughput summed over the reported entities of a type",
+		},
+		[]string{"entity_type", "estimator"},
+	)
+	totalReadRatio = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_io_total_read_ratio",
+			Help: "Share of the throughput summed over the reported entities of a type that is read",
+		},
+		[]string{"entity_type", "estimator"},
+	)
+	reportedEntities = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_io_entities",
+			Help: "Number of entities of a type in the last report",
+		},
+		[]string{"entity_type"},
+	)
+	topEntityShare = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "eos_io_top_entity_share_ratio",
+			Help: "Share of the total throughput of a type taken by its busiest entity",
+		},
+		[]string{"entity_type", "estimator", "direction"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(totalReadBytes, totalWriteBytes, totalReadRatio, reportedEntities, topEntityShare)
+}
+
+// exportTotals exports the totals of report per entity type and estimator.
+func exportTotals(report *pb.TrafficShapingRateResponse) {
+	type totals struct {
+		read, write       float64
+		topRead, topWrite float64
+	}
+	sums := make(map[[2]string]*totals) // by entity type, estimator
+	counts := map[string]int{"app": 0, "user": 0, "group": 0}
+	for _, e := range reportEntities(report) {
+		counts[e.Type]++
+		for _, s := range e.Stats {
+			k := [2]string{e.Type, s.Window.String()}
+			t := sums[k]
+			if t == nil {
+				t = &totals{}
+				sums[k] = t
+			}
+			t.read += s.BytesReadPerSec
+			t.write += s.BytesWrittenPerSec
+			t.topRead = max(t.topRead, s.BytesReadPerSec)
+			t.topWrite = max(t.topWrite, s.BytesWrittenPerSec)
+		}
+	}
+
+	totalReadBytes.Reset()
+	totalWriteBytes.Reset()
+	totalReadRatio.Reset()
+	topEntityShare.Reset()
+	for eType, n := range counts {
+		reportedEntities.WithLabelValues(eType).Set(float64(n))
+	}
+	share := func(top, total float64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return top / total
+	}
+	for k, t := range sums {
+		totalReadBytes.WithLabelValues(k[0], k[1]).Set(t.read)
+		totalWriteBytes.WithLabelValues(k[0], k[1]).Set(t.write)
+		if t.read+t.write > 0 {
+			totalReadRatio.WithLabelValues(k[0], k[1]).Set(t.read / (t.read + t.write))
+		}
+		topEntityShare.WithLabelValues(k[0], k[1], "read").Set(share(t.topRead, t.read))
+		topEntityShare.WithLabelValues(k[0], k[1], "write").Set(share(t.topWrite, t.write))
+	}
+}
+
+// totalID and reportedID are the ids of the rows of the console tables
+// summing the entities shown and all the entities of the report.
+const (
+	totalID    = "TOTAL"
+	reportedID = "REPORTED"
+)
+
+// withTotals returns the rows of every entity type followed by their
+// totalRows.
+func withTotals(report *pb.TrafficShapingRateResponse, rows map[string][]entityRow, topN int) map[string][]entityRow {
+	reported := make(map[string][][]*pb.RateStats)
+	for _, e := range reportEntities(report) {
+		reported[e.Type] = append(reported[e.Type], e.Stats)
+	}
+	shown := make(map[string][]entityRow, len(rows))
+	for eType, list := range rows {
+		shown[eType] = append(slices.Clip(list), totalRows(list, reported[eType], topN)...)
+	}
+	return shown
+}
+
+// totalRows returns the row summing rows, the entities of a type shown,
+// followed by the row summing the stats of all the entities of that type in
+// the report if they add up to something else, e.g. when some are filtered
+// out. The MGM only reports the top N entities of each type, so when the
+// report has topN of them the last row says its sum may be short.
+func totalRows(rows []entityRow, reported [][]*pb.RateStats, topN int) []entityRow {
+	if len(rows) == 0 {
+		return nil
+	}
+	total := entityRow{ID: totalID}
+	for _, row := range rows {
+		total.Stats = addRateStats(total.Stats, row.Stats)
+	}
+	all := entityRow{ID: reportedID}
+	for _, stats := range reported {
+		all.Stats = addRateStats(all.Stats, stats)
+	}
+	totals := []entityRow{total}
+	if !sameRates(total.Stats, all.Stats) {
+		totals = append(totals, all)
+	}
+	if len(reported) == topN {
+		last := &totals[len(totals)-1]
+		last.ID = fmt.Sprintf("%s (top %d)", last.ID, topN)
+	}
+	return totals
+}
+
+// sameRates reports whether a and b have the same rates for the same
+// estimators, but for rounding.
+func sameRates(a, b []*pb.RateStats) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	near := func(x, y float64) bool {
+		return math.Abs(x-y) <= 1e-9*max(math.Abs(x), math.Abs(y))
+	}
+	for _, s := range a {
+		i := slices.IndexFunc(b, func(t *pb.RateStats) bool { return t.Window == s.Window })
+		if i < 0 || !near(s.BytesReadPerSec, b[i].BytesReadPerSec) || !near(s.BytesWrittenPerSec, b[i].BytesWrittenPerSec) {
+			return false
+		}
+	}
+	return true
+}
+
+// totalRow reports whether id is that of a row made by totalRows.
+func totalRow(id string) bool {
+	id, _, _ = strings.Cut(id, " (top ")
+	return id == totalID || id == reportedID
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+// tracer records the spans of the stream lifecycle: dial, stream.open, one
+// report span per report, from its emission by the MGM to the end of its
+// processing, and a sink span per sink write. It does nothing unless
+// -tracing-endpoint is set.
+var tracer = otel.Tracer("eos_traffic_shaping_monitor")
+
+// newTracerProvider makes tracer export its spans to an OpenTelemetry
+// collector, sampling ratio of the report spans.
+func newTracerProvider(ctx context.Context, endpoint, protocol string, ratio float64, cluster, mgmHost string) (*sdktrace.TracerProvider, error) {
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("sample ratio %g is not between 0 and 1", ratio)
+	}
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch protocol {
+	case "grpc":
+		exporter, err = otlptracegrpc.New(ctx, otlptracegrpc.WithEndpointURL(endpoint))
+	case "http":
+		if u, perr := url.Parse(endpoint); perr == nil && strings.TrimSuffix(u.Path, "/") == "" {
+			u.Path = "/v1/traces"
+			endpoint = u.String()
+		}
+		exporter, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q (expected grpc or http)", protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithResource(otlpResource(cluster, mgmHost)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithBatcher(exporter),
+	)
+	otel.SetTracerProvider(provider)
+	return provider, nil
+}
+
+// reportSpans remembers the spans of the latest reports, so the sinks,
+// which get the bare report and may write it from their own goroutine once
+// the monitor moved on, can record their write under the span of the
+// report.
+var reportSpans = &spanIndex{spans: map[*pb.TrafficShapingRateResponse]trace.SpanContext{}}
+
+// spanIndex holds at most len(order) spans.
+type spanIndex struct {
+	mu    sync.Mutex
+	spans map[*pb.TrafficShapingRateResponse]trace.SpanContext
+	order [64]*pb.TrafficShapingRateResponse
+	next  int
+}
+
+// Add records the span of report, if sampled.
+func (i *spanIndex) Add(report *pb.TrafficShapingRateResponse, span trace.SpanContext) {
+	if !span.IsSampled() {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.spans, i.order[i.next])
+	i.order[i.next] = report
+	i.next = (i.next + 1) % len(i.order)
+	i.spans[report] = span
+}
+
+// Context returns a context holding the span of report, nil if it isn't
+// known (not sampled, or too old).
+func (i *spanIndex) Context(report *pb.TrafficShapingRateResponse) context.Context {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	span, ok := i.spans[report]
+	if !ok {
+		return nil
+	}
+	return trace.ContextWithSpanContext(context.Background(), span)
+}
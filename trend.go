@@ -0,0 +1,55 @@
+package main
+
+import "math"
+
+// trendKey identifies a line of the console tables.
+type trendKey struct {
+	eType, id, estimator string
+}
+
+// steadyRatio is the relative change of rate below which an entity is shown
+// as steady.
+const steadyRatio = 0.01
+
+// rateTrends keeps the total rates of the rows of the previous report, so
+// the console can show who is ramping up and who is steady.
+type rateTrends struct {
+	prev map[trendKey]float64
+}
+
+// Update stores the rates of rows by entity type and returns those of the
+// previous report, nil for the first one.
+func (t *rateTrends) Update(rows map[string][]entityRow) map[trendKey]float64 {
+	cur := make(map[trendKey]float64)
+	for eType, list := range rows {
+		for _, row := range list {
+			for _, s := range row.Stats {
+				cur[trendKey{eType, row.ID, s.Window.String()}] = s.BytesReadPerSec + s.BytesWrittenPerSec
+			}
+		}
+	}
+	prev := t.prev
+	t.prev = cur
+	return prev
+}
+
+// trendCell formats the change from the previous rate of a line, e.g.
+// "▲ +12.00 MB", empty if steady or for the first report and "new" if it
+// wasn't in the previous report.
+func trendCell(prev map[trendKey]float64, k trendKey, rate float64) string {
+	if prev == nil {
+		return ""
+	}
+	before, ok := prev[k]
+	if !ok {
+		return "new"
+	}
+	delta := rate - before
+	if math.Abs(delta) <= steadyRatio*max(rate, before) {
+		return ""
+	}
+	if delta > 0 {
+		return "▲ +" + humanizeBytes(delta)
+	}
+	return "▼ -" + humanizeBytes(-delta)
+}
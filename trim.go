@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+func runTrim(args []string) {
+	fs := flag.NewFlagSet("trim", flag.ExitOnError)
+	from := fs.String("from", "", "Start of the slice (RFC3339, or 15:04[:05] on the day of the first report)")
+	to := fs.String("to", "", "End of the slice, inclusive (same formats as -from)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s trim [-from T] [-to T] <input> <output>\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Copies the reports of a recording that fall within [from, to] into a new")
+		fmt.Fprintln(fs.Output(), "recording, converting the format if the extensions differ.")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() != 2 || (*from == "" && *to == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	n, err := trimRecording(fs.Arg(0), fs.Arg(1), *from, *to)
+	if err != nil {
+		log.Fatalf("Error trimming recording: %v", err)
+	}
+	log.Printf("Wrote %d reports to %s", n, fs.Arg(1))
+}
+
+func trimRecording(inPath, outPath, fromSpec, toSpec string) (int, error) {
+	in, err := openRecording(inPath)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := createRecording(outPath)
+	if err != nil {
+		return 0, err
+	}
+
+	var from, to time.Time
+	n := 0
+	for i := 0; ; i++ {
+		f, err := in.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			out.Close()
+			return n, fmt.Errorf("%s: report %d: %w", inPath, i+1, err)
+		}
+
+		ts := time.UnixMilli(f.Report.TimestampMs)
+		if i == 0 {
+			// Time-of-day bounds are resolved against the first report.
+			if from, err = parseSliceBound(fromSpec, ts); err != nil {
+				out.Close()
+				return 0, fmt.Errorf("invalid -from: %w", err)
+			}
+			if to, err = parseSliceBound(toSpec, ts); err != nil {
+				out.Close()
+				return 0, fmt.Errorf("invalid -to: %w", err)
+			}
+		}
+
+		if (!from.IsZero() && ts.Before(from)) || (!to.IsZero() && ts.After(to)) {
+			continue
+		}
+		if err := out.Write(f); err != nil {
+			out.Close()
+			return n, fmt.Errorf("%s: %w", outPath, err)
+		}
+		n++
+	}
+	return n, out.Close()
+}
+
+// parseSliceBound parses an RFC3339 timestamp or a time of day on the date of
+// ref. An empty spec returns the zero time, meaning unbounded.
+func parseSliceBound(spec string, ref time.Time) (time.Time, error) {
+	if spec == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, spec); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{time.TimeOnly, "15:04"} {
+		if t, err := time.ParseInLocation(layout, spec, ref.Location()); err == nil {
+			y, m, d := ref.Date()
+			return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, ref.Location()), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is neither RFC3339 nor a time of day", spec)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// parseByteRate parses rates such as "500", "1.5MB/s" or "2 GiB" into bytes
+// per second. Units are powers of 1024, matching the default -units.
+func parseByteRate(s string) (float64, error) {
+	v := strings.TrimSpace(s)
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "/s"), "ps")
+
+	i := strings.IndexFunc(v, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	num, unit := v, ""
+	if i >= 0 {
+		num, unit = v[:i], strings.TrimSpace(v[i:])
+	}
+
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+
+	switch strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(unit), "IB"), "B") {
+	case "":
+	case "K":
+		f *= 1 << 10
+	case "M":
+		f *= 1 << 20
+	case "G":
+		f *= 1 << 30
+	case "T":
+		f *= 1 << 40
+	default:
+		return 0, fmt.Errorf("invalid rate %q: unknown unit %q", s, unit)
+	}
+	return f, nil
+}
+
+// formatByteRate is the inverse of parseByteRate, using the largest unit
+// that represents v exactly so that it round-trips through config files.
+func formatByteRate(v float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for i < len(units)-1 && v != 0 && math.Mod(v, 1024) == 0 {
+		v /= 1024
+		i++
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64) + units[i] + "/s"
+}
+
+// unitFormat is how humanizeBytes formats amounts: in bytes or, with a
+// scale of 8, bits, using the largest unit below the value or, if fixed is
+// set, always the unit at that index.
+type unitFormat struct {
+	scale float64
+	base  float64
+	units []string
+	fixed int // index in units, -1 to pick the unit by value
+}
+
+// unitFormats are the display units -units accepts besides a single unit.
+// bytes are the powers of 1024 named like SI units, as always printed.
+var unitFormats = map[string]unitFormat{
+	"bytes": {scale: 1, base: 1024, units: []string{"B", "KB", "MB", "GB", "TB"}, fixed: -1},
+	"iec":   {scale: 1, base: 1024, units: []string{"B", "KiB", "MiB", "GiB", "TiB"}, fixed: -1},
+	"si":    {scale: 1, base: 1000, units: []string{"B", "KB", "MB", "GB", "TB"}, fixed: -1},
+	"bits":  {scale: 8, base: 1000, units: []string{"b", "Kb", "Mb", "Gb", "Tb"}, fixed: -1},
+}
+
+var displayUnits = unitFormats["bytes"]
+
+// parseUnits parses -units: bytes, iec, si, bits, or a single unit such as
+// GB (SI), GiB (IEC) or Gb (bits) that every amount is printed in.
+func parseUnits(spec string) (unitFormat, error) {
+	if f, ok := unitFormats[spec]; ok {
+		return f, nil
+	}
+	for _, name := range []string{"iec", "si", "bits"} {
+		f := unitFormats[name]
+		if i := slices.Index(f.units, spec); i >= 0 {
+			f.fixed = i
+			return f, nil
+		}
+	}
+	return unitFormat{}, fmt.Errorf("unknown units %q (expected bytes, iec, si, bits or a unit such as GB, GiB or Gb)", spec)
+}
+
+func (f unitFormat) format(v float64) string {
+	v *= f.scale
+	i := 0
+	if f.fixed >= 0 {
+		i = f.fixed
+		v /= math.Pow(f.base, float64(i))
+	} else {
+		for v >= f.base && i < len(f.units)-1 {
+			v /= f.base
+			i++
+		}
+	}
+	b := make([]byte, 0, 24)
+	b = strconv.AppendFloat(b, v, 'f', 2, 64)
+	b = append(b, ' ')
+	b = append(b, f.units[i]...)
+	return string(b)
+}
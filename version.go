@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The version, commit and build date are set when building releases:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%FT%TZ)"
+//
+// Otherwise they are taken from the module and VCS information Go embeds
+// in the binary, if any.
+var (
+	version string
+	commit  string
+	date    string
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"go_version"`
+}
+
+func currentBuildInfo() buildInfo {
+	b := buildInfo{Version: version, Commit: commit, Date: date, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if b.Version == "" {
+			b.Version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && b.Date == "":
+				b.Date = s.Value
+			}
+		}
+	}
+	for _, v := range []*string{&b.Version, &b.Commit, &b.Date} {
+		if *v == "" || *v == "(devel)" {
+			*v = "unknown"
+		}
+	}
+	return b
+}
+
+func init() {
+	b := currentBuildInfo()
+	buildInfoGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "eos_monitor_build_info",
+		Help: "Always 1, labelled with the version, commit and build date of the monitor",
+		ConstLabels: prometheus.Labels{
+			"version":    b.Version,
+			"commit":     b.Commit,
+			"date":       b.Date,
+			"go_version": b.GoVersion,
+		},
+	})
+	buildInfoGauge.Set(1)
+	prometheus.MustRegister(buildInfoGauge)
+}
+
+func runVersion(args []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the build information as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s version [-json]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Prints the version, commit and build date of the monitor.")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	b := currentBuildInfo()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(b); err != nil {
+			log.Fatalf("Error encoding build information: %v", err)
+		}
+		return
+	}
+	fmt.Printf("eos_traffic_shaping_monitor %s\ncommit: %s\nbuilt: %s\ngo: %s\n", b.Version, b.Commit, b.Date, b.GoVersion)
+}
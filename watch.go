@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	pb "eos_traffic_shaping_monitor/eos-grpc-proto/build"
+)
+
+func watchCommand(args []string) *cobra.Command {
+	var uid, gid uint32
+	var app string
+	cmd := monitorCommand(args, &cobra.Command{
+		Use:   "watch (--uid UID | --gid GID | --app APP)",
+		Short: "Follow a single entity full screen",
+		Long: "Follows one user, group or app full screen: its rates in large digits, their\n" +
+			"history over --sparkline-window and its rates on every estimator, for\n" +
+			"chasing a misbehaving entity interactively. The large rates and the history\n" +
+			"are on the --sort-by estimator. As with top, the endpoints, exporters and\n" +
+			"sinks of the config file are left out. The entity has to be in the --top-n\n" +
+			"of the MGM to be seen.",
+	}, func(cfg *config) {
+		clientConfig(cfg)
+		cfg.Console.Mode = "clear"
+	})
+	cmd.Flags().Uint32Var(&uid, "uid", 0, "Follow this user")
+	cmd.Flags().Uint32Var(&gid, "gid", 0, "Follow this group")
+	cmd.Flags().StringVar(&app, "app", "", "Follow this app")
+	cmd.MarkFlagsOneRequired("uid", "gid", "app")
+	cmd.MarkFlagsMutuallyExclusive("uid", "gid", "app")
+	run := cmd.Run
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		spec := "app:" + app
+		switch {
+		case cmd.Flags().Changed("uid"):
+			spec = "user:" + strconv.FormatUint(uint64(uid), 10)
+		case cmd.Flags().Changed("gid"):
+			spec = "group:" + strconv.FormatUint(uint64(gid), 10)
+		}
+		if err := cmd.Flags().Set("watch", spec); err != nil {
+			log.Fatal(err)
+		}
+		run(cmd, args)
+	}
+	return cmd
+}
+
+// entityWatch follows one entity for the watch view, which replaces the
+// tables of the console.
+type entityWatch struct {
+	entity    entityKey
+	name      string // resolved, "" if unknown
+	estimator string // of the large rates and the history
+	window    time.Duration
+
+	samples []throughputSample // oldest first, 0 when missing from a report
+}
+
+// watchFrame is what the watch view draws of a report.
+type watchFrame struct {
+	entity    entityKey
+	name      string
+	estimator string
+	ts        time.Time
+	stats     []*pb.RateStats // nil if the entity isn't in the report
+	samples   []throughputSample
+}
+
+// newEntityWatch follows the entity of spec, type:id, resolving its name
+// with names if set.
+func newEntityWatch(spec, estimator string, window time.Duration, names *nameResolver) (*entityWatch, error) {
+	if _, err := parseEstimator(estimator); err != nil {
+		return nil, err
+	}
+	eType, id, ok := strings.Cut(spec, ":")
+	if !ok || !validEntityType(eType) || id == "" {
+		return nil, fmt.Errorf("%q is not type:id with type app, user or group", spec)
+	}
+	w := &entityWatch{entity: entityKey{eType, id}, estimator: estimator, window: window}
+	if names != nil && eType != "app" {
+		n, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s id %q is not numeric", eType, id)
+		}
+		if eType == "user" {
+			w.name = names.user(uint32(n))
+		} else {
+			w.name = names.group(uint32(n))
+		}
+	}
+	return w, nil
+}
+
+// Update adds report to the history and returns the frame to draw.
+func (w *entityWatch) Update(report *pb.TrafficShapingRateResponse) watchFrame {
+	f := watchFrame{entity: w.entity, name: w.name, estimator: w.estimator, ts: time.UnixMilli(report.TimestampMs)}
+	for _, e := range reportEntities(report) {
+		if e.Type == w.entity.Type && e.ID == w.entity.ID {
+			f.stats = e.Stats
+			break
+		}
+	}
+	sample := throughputSample{ts: f.ts}
+	if s, ok := sampleOf(f.stats, w.estimator); ok {
+		sample.read, sample.write = s.read, s.write
+	}
+	i := 0
+	for i < len(w.samples) && sample.ts.Sub(w.samples[i].ts) > w.window {
+		i++
+	}
+	w.samples = append(w.samples[i:], sample)
+	f.samples = append([]throughputSample(nil), w.samples...)
+	return f
+}
+
+func (f watchFrame) print(out io.Writer, width int) {
+	title := f.entity.Type + " " + f.entity.ID
+	if f.name != "" {
+		title += " (" + f.name + ")"
+	}
+	fmt.Fprint(out, "\033[H\033[2J")
+	fmt.Fprintf(out, "EOS IO Monitor | Watching %s | Last Update: %s\n\n", title, f.ts.Format(time.RFC3339))
+	if f.stats == nil {
+		fmt.Fprintf(out, "Not in this report: idle, or below the top N of the MGM.\n\n")
+	}
+
+	var last throughputSample
+	if len(f.samples) > 0 {
+		last = f.samples[len(f.samples)-1]
+	}
+	fmt.Fprintf(out, "Read (%s)\n", f.estimator)
+	printBigRate(out, last.read)
+	fmt.Fprintf(out, "Write (%s)\n", f.estimator)
+	printBigRate(out, last.write)
+	if len(f.samples) > 1 {
+		printSparklines(out, f.samples, width)
+	}
+
+	if len(f.stats) == 0 {
+		return
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "Estimator\tRead\tWrite\tTotal")
+	for _, s := range f.stats {
+		fmt.Fprintf(w, "%s\t%s/s\t%s/s\t%s/s\n", s.Window, humanizeBytes(s.BytesReadPerSec),
+			humanizeBytes(s.BytesWrittenPerSec), humanizeBytes(s.BytesReadPerSec+s.BytesWrittenPerSec))
+	}
+	w.Flush()
+}
+
+// bigDigits are the glyphs of printBigRate, three rows each.
+var bigDigits = map[rune][3]string{
+	'0': {"█▀█", "█ █", "▀▀▀"},
+	'1': {" ▀█", "  █", "  ▀"},
+	'2': {"▀▀█", "█▀▀", "▀▀▀"},
+	'3': {"▀▀█", " ▀█", "▀▀▀"},
+	'4': {"█ █", "▀▀█", "  ▀"},
+	'5': {"█▀▀", "▀▀█", "▀▀▀"},
+	'6': {"█▀▀", "█▀█", "▀▀▀"},
+	'7': {"▀▀█", "  █", "  ▀"},
+	'8': {"█▀█", "█▀█", "▀▀▀"},
+	'9': {"█▀█", "▀▀█", "▀▀▀"},
+	'.': {" ", " ", "▀"},
+}
+
+// printBigRate prints rate with the number in three rows high digits,
+// followed by its unit.
+func printBigRate(out io.Writer, rate float64) {
+	number, unit, _ := strings.Cut(humanizeBytes(rate), " ")
+	var rows [3]strings.Builder
+	for _, r := range number {
+		glyph, ok := bigDigits[r]
+		if !ok {
+			glyph = [3]string{string(r), " ", " "}
+		}
+		for i := range rows {
+			rows[i].WriteString(glyph[i] + " ")
+		}
+	}
+	fmt.Fprintf(out, "  %s\n  %s %s/s\n  %s\n\n", rows[0].String(), rows[1].String(), unit, rows[2].String())
+}
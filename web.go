@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// webHandler mounts mux under the route prefix and adds CORS headers, so the
+// HTTP endpoints work behind ingress controllers and reverse proxies that
+// publish them under a sub-path of a shared host.
+func webHandler(mux http.Handler, prefix string, corsOrigins []string) http.Handler {
+	h := mux
+	if prefix != "" {
+		h = http.StripPrefix(prefix, mux)
+	}
+	if len(corsOrigins) > 0 {
+		h = corsHandler(h, corsOrigins)
+	}
+	return h
+}
+
+// routePrefix returns the path under which the endpoints are served: the
+// explicit prefix if given, otherwise the path of the external URL. The
+// result is "" or starts with "/" and has no trailing slash.
+func routePrefix(externalURL, prefix string) (string, error) {
+	if prefix == "" && externalURL != "" {
+		u, err := url.Parse(externalURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", fmt.Errorf("external URL must be an http:// or https:// URL, got %q", externalURL)
+		}
+		prefix = u.Path
+	}
+	prefix = strings.TrimRight(prefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return prefix, nil
+}
+
+// corsHandler answers preflight requests and sets the CORS headers for
+// requests from the allowed origins ("*" allows any).
+func corsHandler(h http.Handler, origins []string) http.Handler {
+	anyOrigin := slices.Contains(origins, "*")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || (!anyOrigin && !slices.Contains(origins, origin)) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if anyOrigin {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "If-None-Match, If-Modified-Since")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
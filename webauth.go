@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// webConfigFile protects the HTTP endpoints with TLS, client certificates
+// and basic auth, in the format of the web config file of the Prometheus
+// exporters (github.com/prometheus/exporter-toolkit), so the same file
+// works for this monitor and the node exporter alike:
+//
+//	tls_server_config:
+//	  cert_file: /etc/eos-monitor/tls.crt
+//	  key_file: /etc/eos-monitor/tls.key
+//	  client_auth_type: RequireAndVerifyClientCert   # default NoClientCert
+//	  client_ca_file: /etc/eos-monitor/ca.crt
+//	  min_version: TLS12                             # or TLS13, the default TLS12
+//	basic_auth_users:
+//	  prometheus: $2y$10$...                         # bcrypt hash, e.g. from htpasswd -nBC 10 ""
+//
+// The certificate is read again when its files change, so it can be
+// renewed without restarting the monitor.
+type webConfigFile struct {
+	TLS   *tlsServerConfig  `yaml:"tls_server_config"`
+	Users map[string]string `yaml:"basic_auth_users"`
+
+	authCache sync.Map // sha256 of "user:password" seen valid -> struct{}
+}
+
+type tlsServerConfig struct {
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	ClientAuth string `yaml:"client_auth_type"`
+	ClientCA   string `yaml:"client_ca_file"`
+	MinVersion string `yaml:"min_version"`
+}
+
+var tlsClientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"":      tls.VersionTLS12,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+func loadWebConfigFile(path string) (*webConfigFile, error) {
+	c := &webConfigFile{}
+	if err := loadYAML(path, c); err != nil {
+		return nil, err
+	}
+	for user, hash := range c.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s: basic_auth_users.%s: not a bcrypt hash: %w", path, user, err)
+		}
+	}
+	if c.TLS != nil {
+		if _, err := c.tlsConfig(); err != nil {
+			return nil, fmt.Errorf("%s: tls_server_config: %w", path, err)
+		}
+	}
+	return c, nil
+}
+
+// tlsConfig returns the TLS config of the server, nil for plain HTTP.
+func (c *webConfigFile) tlsConfig() (*tls.Config, error) {
+	if c.TLS == nil {
+		return nil, nil
+	}
+	if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+		return nil, errors.New("cert_file and key_file are required")
+	}
+	clientAuth, ok := tlsClientAuthTypes[c.TLS.ClientAuth]
+	if !ok {
+		return nil, fmt.Errorf("unknown client_auth_type %q", c.TLS.ClientAuth)
+	}
+	minVersion, ok := tlsVersions[c.TLS.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown min_version %q (expected TLS12 or TLS13)", c.TLS.MinVersion)
+	}
+	certs := &certReloader{certFile: c.TLS.CertFile, keyFile: c.TLS.KeyFile}
+	if _, err := certs.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		ClientAuth:     clientAuth,
+		MinVersion:     minVersion,
+	}
+	if c.TLS.ClientCA != "" {
+		pem, err := os.ReadFile(c.TLS.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", c.TLS.ClientCA)
+		}
+	} else if clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("client_auth_type %s needs client_ca_file", c.TLS.ClientAuth)
+	}
+	return cfg, nil
+}
+
+// handler requires basic auth from the users of the file, if any. Valid
+// credentials are remembered, as checking a bcrypt hash takes long enough
+// to slow down every scrape.
+func (c *webConfigFile) handler(h http.Handler) http.Handler {
+	if len(c.Users) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if ok && c.authorized(user, password) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="eos_traffic_shaping_monitor"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func (c *webConfigFile) authorized(user, password string) bool {
+	key := sha256.Sum256([]byte(user + ":" + password))
+	if _, ok := c.authCache.Load(key); ok {
+		return true
+	}
+	hash, ok := c.Users[user]
+	if !ok {
+		// Compare anyway, so unknown users take as long as wrong passwords.
+		hash = "$2a$10$B1ITerWQIyp2dJ7Dl80r4uVARpA3/xtdL.DBx4gOT/foNh6RfqHaK"
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil || !ok {
+		return false
+	}
+	c.authCache.Store(key, struct{}{})
+	return true
+}
+
+// certReloader loads the server certificate again when its files change.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // latest of the two files when loaded
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var modTime time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			if c.cert != nil {
+				return c.cert, nil
+			}
+			return nil, err
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	if c.cert != nil && modTime.Equal(c.modTime) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			// Keep serving the old one while the files are being replaced.
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	c.cert, c.modTime = &cert, modTime
+	return c.cert, nil
+}
+
+// serveWeb serves h on addr, over TLS and behind basic auth as set by web,
+// which may be nil for plain HTTP.
+func serveWeb(addr string, h http.Handler, web *webConfigFile) error {
+	if web == nil {
+		return http.ListenAndServe(addr, h)
+	}
+	tlsConfig, err := web.tlsConfig()
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Addr: addr, Handler: web.handler(h), TLSConfig: tlsConfig}
+	if tlsConfig == nil {
+		return server.ListenAndServe()
+	}
+	return server.ListenAndServeTLS("", "")
+}
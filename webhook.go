@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+)
+
+// Webhooks are declared next to the rules and used as actions by name:
+//
+//	webhooks:
+//	  mattermost:
+//	    url: https://mattermost.example.org/hooks/xyz
+//	    body: '{"text": {{json .Summary}}}'   # text/template, default: the JSON payload
+//	    headers: {X-Token: secret}
+//	    timeout: 10s                          # per attempt (default 10s)
+//	    retries: 3                            # on network errors, 429 and 5xx (default 3)
+//	rules:
+//	  - name: heavy-writer
+//	    ...
+//	    actions: [log, mattermost]
+//
+// Events are posted in order from a background queue so a slow endpoint
+// never delays the processing of reports.
+
+const webhookQueueSize = 100
+
+type webhook struct {
+	URL     string            `yaml:"url"`
+	Body    string            `yaml:"body"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout time.Duration     `yaml:"timeout"`
+	Retries *int              `yaml:"retries"`
+
+	name   string
+	tmpl   *template.Template
+	client *http.Client
+	queue  chan alertEvent
+}
+
+// webhookPayload is the default body of webhook requests and the data
+// available to body templates.
+type webhookPayload struct {
+	Rule       string    `json:"rule"`
+	State      string    `json:"state"` // firing or resolved
+	EntityType string    `json:"entity_type"`
+	ID         string    `json:"id"`
+	Estimator  string    `json:"estimator"`
+	Direction  string    `json:"direction"`
+	Value      float64   `json:"value"` // bytes/sec
+	Condition  string    `json:"condition"`
+	Reports    int       `json:"reports"`
+	Timestamp  time.Time `json:"timestamp"`
+	Summary    string    `json:"summary"`
+}
+
+func newWebhookPayload(ev alertEvent) webhookPayload {
+	state := "resolved"
+	if ev.Firing {
+		state = "firing"
+	}
+	return webhookPayload{
+		Rule:       ev.Rule.Name,
+		State:      state,
+		EntityType: ev.Entity.Type,
+		ID:         ev.Entity.ID,
+		Estimator:  ev.Rule.Estimator,
+		Direction:  ev.Rule.Direction,
+		Value:      ev.Value,
+		Condition:  ev.Rule.condition(),
+		Reports:    ev.Reports,
+		Timestamp:  ev.Timestamp,
+		Summary:    ev.String(),
+	}
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"humanize": func(v float64) string { return humanizeBytes(v) + "/s" },
+}
+
+// init validates the webhook and starts its queue.
+func (w *webhook) init(name string) error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http:// or https:// URL, got %q", w.URL)
+	}
+	if w.Body != "" {
+		if w.tmpl, err = template.New(name).Funcs(webhookFuncs).Parse(w.Body); err != nil {
+			return fmt.Errorf("body: %w", err)
+		}
+	}
+	if w.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative, got %s", w.Timeout)
+	}
+	if w.Timeout == 0 {
+		w.Timeout = 10 * time.Second
+	}
+	if w.Retries == nil {
+		w.Retries = new(int)
+		*w.Retries = 3
+	}
+	if *w.Retries < 0 {
+		return fmt.Errorf("retries must not be negative, got %d", *w.Retries)
+	}
+
+	w.name = name
+	w.client = &http.Client{Timeout: w.Timeout}
+	w.queue = make(chan alertEvent, webhookQueueSize)
+	go func() {
+		for ev := range w.queue {
+			if err := w.post(ev); err != nil {
+				log.Printf("Webhook %s: %v", w.name, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// notify is the alert action of the webhook.
+func (w *webhook) notify(ev alertEvent) {
+	select {
+	case w.queue <- ev:
+	default:
+		log.Printf("Webhook %s: queue full, dropping %s", w.name, ev)
+	}
+}
+
+func (w *webhook) post(ev alertEvent) error {
+	payload := newWebhookPayload(ev)
+	var body bytes.Buffer
+	if w.tmpl != nil {
+		if err := w.tmpl.Execute(&body, payload); err != nil {
+			return fmt.Errorf("rendering body: %w", err)
+		}
+	} else if err := json.NewEncoder(&body).Encode(payload); err != nil {
+		return err
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := w.send(body.Bytes())
+		var perm permanentError
+		if err == nil || errors.As(err, &perm) || attempt == *w.Retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// permanentError is a failure that retrying won't fix.
+type permanentError struct{ error }
+
+func (w *webhook) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("POST %s: %s: %s", redactURL(w.URL), resp.Status, bytes.TrimSpace(msg))
+	default:
+		return permanentError{fmt.Errorf("POST %s: %s: %s", redactURL(w.URL), resp.Status, bytes.TrimSpace(msg))}
+	}
+}